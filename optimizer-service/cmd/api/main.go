@@ -2,14 +2,19 @@
 package main
 
 import (
+	"log"
 	"optimizer-service/cmd/config"
 	"optimizer-service/cmd/internal/app/handler"
 	"optimizer-service/cmd/internal/app/interceptor"
 	"optimizer-service/cmd/internal/app/repositories"
 	"optimizer-service/cmd/internal/app/service"
+	"optimizer-service/cmd/internal/auth"
+	"optimizer-service/cmd/internal/outbox"
 	"optimizer-service/cmd/internal/types"
 	"optimizer-service/cmd/internal/utils"
 	"os"
+	"runtime"
+	"strconv"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -20,28 +25,67 @@ import (
 )
 
 func main() {
+	// Refuse to start without a key to verify tokens with
+	jwtConfig, err := config.LoadJWTConfig()
+	if err != nil {
+		log.Fatalf("Invalid JWT configuration: %v", err)
+	}
+
 	// Init database
 	app := config.NewConfig()
 	db := app.InitDB()
 	storage := app.InitStorage()
+	pipeline := app.InitPipeline()
+	fileEvents := app.InitFileEvents(db)
 
 	// Setup Repositories
 	fileRepo := repositories.NewFileRepository(db)
-	authRepo := repositories.NewAuthRepository(db)
+	userClient, err := config.UserServiceClient()
+	if err != nil {
+		log.Fatalf("Invalid user service configuration: %v", err)
+	}
+	authRepo := repositories.NewAuthRepository(db, userClient)
+	userRepo := repositories.NewUserRepository(userClient)
+	notificationRepo := repositories.NewNotificationRepository(db)
+	webhookRepo := repositories.NewWebhookRepository(db)
+	outboxRepo := repositories.NewOutboxRepository(db)
 
 	// Setup Services
+	notificationService := service.NewNotificationService(notificationRepo)
+	webhookService := service.NewWebhookService(webhookRepo)
+	webhookService.AllowPrivate = config.WebhooksAllowPrivate()
+	dispatcher := app.InitWebhooks(webhookRepo)
+	dispatcher.Start()
+
+	// Relay the file events of the outbox to webhooks and emails
+	sinks := []outbox.Sink{dispatcher}
+	if notifier := app.InitNotifier(userRepo, notificationService); notifier != nil {
+		sinks = append(sinks, notifier)
+	}
+	app.InitOutbox(db, outboxRepo, sinks...).Start()
+
 	fileService := service.NewFileService(fileRepo, storage)
-	authService := service.NewAuthService(authRepo)
+	fileService.Pipeline = pipeline
+	fileService.Limits = config.ValidationLimits()
+	fileService.Budget = config.JobBudget()
+	fileService.Progress = fileEvents
+	fileService.StartWorkers(optimizerWorkers())
+	authService := service.NewAuthService(authRepo, jwtConfig)
+	authService.CacheTTL = config.IntrospectionCacheTTL()
 	//Setup AuthService
 
 	//Setup Interceptors
 	authInterceptor := interceptor.AuthenticationMiddleware(authService)
+	streamInterceptor := interceptor.StreamAuthenticationMiddleware(authService)
 	// Init App Container
 	container := &types.AppContainer{
-		DB:          db,
-		Utils:       utils.NewUtils(db),
-		FileService: fileService,
-		AuthService: authService,
+		DB:                  db,
+		Utils:               utils.NewUtils(db),
+		FileService:         fileService,
+		AuthService:         authService,
+		NotificationService: notificationService,
+		WebhookService:      webhookService,
+		FileEvents:          fileEvents,
 	}
 
 	// Start a new handle
@@ -49,6 +93,13 @@ func main() {
 
 	//Set up echo
 	e := echo.New()
+	// The client address is passed on to the user service to count failed
+	// logins, so it is only taken from X-Forwarded-For behind a trusted proxy
+	ipExtractor, err := config.IPExtractor()
+	if err != nil {
+		log.Fatalf("Invalid proxy configuration: %v", err)
+	}
+	e.IPExtractor = ipExtractor
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 
@@ -64,9 +115,42 @@ func main() {
 
 	authGroup := e.Group("/protected")
 
+	// Personal access tokens can only use the routes their scopes allow,
+	// the account settings require a login session
+	filesRead := interceptor.RequireScope(auth.ScopeFilesRead)
+	filesWrite := interceptor.RequireScope(auth.ScopeFilesWrite)
+	session := interceptor.RequireSession()
+
+	// Unverified users cannot upload, unless the verification policy of the user service allows them
+	upload := []echo.MiddlewareFunc{filesWrite, interceptor.RequireVerifiedEmail()}
+
 	authGroup.Use(authInterceptor)
-	authGroup.POST("/upload", h.PostUploadFile, authInterceptor)
+	authGroup.POST("/upload", h.PostUploadFile, upload...)
+	authGroup.GET("/files/:id", h.GetFile, filesRead)
+	authGroup.DELETE("/files/:id", h.DeleteFile, filesWrite)
+	authGroup.GET("/files/:id/download", h.DownloadFile, filesRead)
+	authGroup.POST("/files/:id/stream-ticket", h.CreateStreamTicket, filesRead)
+	authGroup.GET("/notifications", h.GetNotificationPreference, session)
+	authGroup.PUT("/notifications", h.UpdateNotificationPreference, session)
+	authGroup.POST("/webhooks", h.CreateWebhook, session)
+	authGroup.GET("/webhooks", h.GetWebhooks, session)
+	authGroup.DELETE("/webhooks/:id", h.DeleteWebhook, session)
+	authGroup.GET("/webhooks/:id/deliveries", h.GetWebhookDeliveries, session)
+	authGroup.POST("/webhooks/:id/deliveries/:deliveryId/redeliver", h.RedeliverWebhookDelivery, session)
+
+	// Event streams also take a stream ticket from the query, browsers cannot set their headers
+	e.GET("/protected/files/:id/events", h.GetFileEvents, streamInterceptor, filesRead)
+	e.GET("/protected/files/:id/ws", h.GetFileEventsWebSocket, streamInterceptor, filesRead)
 
 	optimizerServicePort := os.Getenv("PORT")
 	e.Logger.Fatal(e.Start(":" + optimizerServicePort))
 }
+
+// optimizerWorkers returns the number of optimizer workers to start
+// It reads OPTIMIZER_WORKERS and defaults to the number of CPUs
+func optimizerWorkers() int {
+	if n, err := strconv.Atoi(os.Getenv("OPTIMIZER_WORKERS")); err == nil && n > 0 {
+		return n
+	}
+	return runtime.NumCPU()
+}
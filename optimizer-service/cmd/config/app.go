@@ -4,6 +4,7 @@ package config
 import (
 	"log"
 	"optimizer-service/cmd/internal/models"
+	"optimizer-service/cmd/internal/optimizer"
 	"optimizer-service/cmd/internal/storage"
 	"os"
 	"time"
@@ -13,8 +14,9 @@ import (
 )
 
 type Config struct {
-	DB      *gorm.DB
-	Storage storage.Storage
+	DB       *gorm.DB
+	Storage  storage.Storage
+	Pipeline *optimizer.Pipeline
 }
 
 func NewConfig() *Config {
@@ -32,7 +34,7 @@ func (app *Config) InitDB() *gorm.DB {
 			counts++
 		} else {
 			log.Printf("Connected to database")
-			err = db.AutoMigrate(&models.File{}, &models.OptimizationSettings{})
+			err = db.AutoMigrate(&models.File{}, &models.FileEncoding{}, &models.OptimizationSettings{}, &models.NotificationPreference{}, &models.Webhook{}, &models.WebhookDelivery{}, &models.OutboxEvent{}, &models.OutboxConsumption{}, &models.StreamTicket{})
 			if err != nil {
 				log.Println("Error migrating the schema")
 				return nil
@@ -55,6 +57,14 @@ func (app *Config) InitStorage() storage.Storage {
 	return app.Storage
 }
 
+// InitPipeline sets up the optimizers for the supported file types
+func (app *Config) InitPipeline() *optimizer.Pipeline {
+	app.Pipeline = optimizer.NewPipeline(
+		optimizer.NewGIFOptimizer(gifOptions()),
+	)
+	return app.Pipeline
+}
+
 func connectToPostgress() (*gorm.DB, error) {
 	DATABASE_URL := os.Getenv("DATABASE_URL")
 	log.Printf("DATABASE_URL %v\n", DATABASE_URL)
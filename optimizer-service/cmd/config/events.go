@@ -0,0 +1,18 @@
+package config
+
+import (
+	"context"
+	"optimizer-service/cmd/internal/app/interfaces"
+	"optimizer-service/cmd/internal/events"
+	"os"
+
+	"gorm.io/gorm"
+)
+
+// InitFileEvents sets up the broker streaming file events to clients
+// Events go through Postgres so every replica can stream every file
+func (app *Config) InitFileEvents(db *gorm.DB) interfaces.IFileEventBroker {
+	broker := events.NewPostgresBroker(db, os.Getenv("DATABASE_URL"))
+	broker.Listen(context.Background())
+	return broker
+}
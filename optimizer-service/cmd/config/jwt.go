@@ -0,0 +1,52 @@
+package config
+
+import (
+	"optimizer-service/cmd/internal/app/service"
+	"optimizer-service/cmd/internal/auth"
+	"os"
+	"strings"
+	"time"
+)
+
+// Defaults for the optional token settings
+const (
+	defaultJWTIssuer   = "user-service"
+	defaultJWTAudience = "optimate"
+)
+
+// LoadJWTConfig reads the configuration used to verify the tokens of the user service
+// The keys are fetched from the JWKS of the user service, at JWKS_URL or
+// under USER_SERVICE_URL, and cached for JWKS_CACHE_SECONDS
+// It returns the configuration and an error if it is incomplete
+func LoadJWTConfig() (*auth.Config, error) {
+	url := envString("JWKS_URL", strings.TrimSuffix(UserServiceURL(), "/")+"/.well-known/jwks.json")
+
+	jwks := auth.NewJWKS(url)
+	if seconds := envInt("JWKS_CACHE_SECONDS", 0); seconds > 0 {
+		jwks.TTL = time.Duration(seconds) * time.Second
+	}
+
+	config := &auth.Config{
+		Keys:     jwks,
+		Issuer:   envString("JWT_ISSUER", defaultJWTIssuer),
+		Audience: envString("JWT_AUDIENCE", defaultJWTAudience),
+	}
+	if err := config.Check(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// envString returns the value of an environment variable or the fallback when unset
+func envString(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// IntrospectionCacheTTL returns how long the introspection of a token is cached
+// It reads INTROSPECTION_CACHE_SECONDS, zero introspects every request
+func IntrospectionCacheTTL() time.Duration {
+	return time.Duration(envInt("INTROSPECTION_CACHE_SECONDS", int(service.DefaultIntrospectionCacheTTL/time.Second))) * time.Second
+}
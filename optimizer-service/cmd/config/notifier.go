@@ -0,0 +1,35 @@
+package config
+
+import (
+	"log"
+	"optimizer-service/cmd/internal/app/interfaces"
+	"optimizer-service/cmd/internal/notifier"
+	"os"
+)
+
+// defaultMailFrom is the sender of the emails when MAIL_FROM is not set
+const defaultMailFrom = "OptiMate <no-reply@optimate.local>"
+
+// InitNotifier sets up the emails sent when a file is optimized
+// It returns nil, disabling the emails, when SMTP_HOST is not set
+func (app *Config) InitNotifier(users interfaces.IUserRepository, preferences interfaces.INotificationService) *notifier.Notifier {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		log.Println("SMTP_HOST is not set, email notifications are disabled")
+		return nil
+	}
+
+	sender := notifier.NewSMTPSender(
+		host,
+		envInt("SMTP_PORT", 587),
+		os.Getenv("SMTP_USERNAME"),
+		os.Getenv("SMTP_PASSWORD"),
+	)
+
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = defaultMailFrom
+	}
+
+	return notifier.NewNotifier(sender, users, preferences, from, os.Getenv("FILE_URL"))
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"log"
+	"optimizer-service/cmd/internal/optimizer"
+	"os"
+	"strconv"
+	"time"
+)
+
+// gifOptions reads the GIF optimizer options from the environment
+// Unset variables keep the defaults
+func gifOptions() optimizer.GIFOptions {
+	opts := optimizer.DefaultGIFOptions()
+	opts.MaxFrames = envInt("GIF_MAX_FRAMES", opts.MaxFrames)
+	opts.MaxFramePixels = envInt("GIF_MAX_FRAME_PIXELS", opts.MaxFramePixels)
+	opts.MaxTotalPixels = envInt("GIF_MAX_TOTAL_PIXELS", opts.MaxTotalPixels)
+	opts.MaxColors = envInt("GIF_MAX_COLORS", opts.MaxColors)
+	// A tolerance out of range would wrap around, 256 would turn lossless
+	tolerance := envInt("GIF_LOSSY_TOLERANCE", int(opts.Tolerance))
+	if tolerance < 0 || tolerance > 255 {
+		log.Printf("GIF_LOSSY_TOLERANCE must be between 0 and 255, got %d", tolerance)
+	}
+	if tolerance < 0 {
+		tolerance = 0
+	}
+	if tolerance > 255 {
+		tolerance = 255
+	}
+	opts.Tolerance = uint8(tolerance)
+
+	if os.Getenv("GIF_TO_WEBP") == "true" {
+		encoder, err := optimizer.NewGif2WebP(envInt("WEBP_QUALITY", 75), os.Getenv("WEBP_LOSSY") == "true")
+		if err != nil {
+			log.Printf("GIF to WebP conversion disabled, gif2webp not available %v", err)
+		} else {
+			opts.WebP = encoder
+		}
+	}
+
+	return opts
+}
+
+// envInt reads an integer from the environment
+// It returns the fallback when the variable is unset or invalid
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// ValidationLimits reads the upload validation limits from the environment
+// Unset variables keep the defaults
+func ValidationLimits() optimizer.Limits {
+	limits := optimizer.DefaultLimits()
+	limits.MaxWidth = envInt("IMAGE_MAX_WIDTH", limits.MaxWidth)
+	limits.MaxHeight = envInt("IMAGE_MAX_HEIGHT", limits.MaxHeight)
+	limits.MaxPixels = envInt("IMAGE_MAX_PIXELS", limits.MaxPixels)
+	limits.MaxFrames = envInt("IMAGE_MAX_FRAMES", limits.MaxFrames)
+	return limits
+}
+
+// JobBudget reads the budget of a single optimization job from the environment
+// Unset variables keep the defaults
+func JobBudget() optimizer.Budget {
+	budget := optimizer.DefaultBudget()
+	budget.Timeout = time.Duration(envInt("JOB_TIMEOUT_SECONDS", int(budget.Timeout/time.Second))) * time.Second
+	budget.MaxBytes = int64(envInt("JOB_MAX_BYTES", int(budget.MaxBytes)))
+	budget.MaxMemory = int64(envInt("JOB_MAX_MEMORY_BYTES", int(budget.MaxMemory)))
+	budget.MaxAbandoned = envInt("JOB_MAX_ABANDONED", budget.MaxAbandoned)
+	return budget
+}
@@ -0,0 +1,24 @@
+package config
+
+import (
+	"optimizer-service/cmd/internal/app/interfaces"
+	"optimizer-service/cmd/internal/outbox"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// InitOutbox sets up the relay of the outbox to the given sinks
+// Events are also published to Postgres NOTIFY when OUTBOX_NOTIFY_CHANNEL is set
+// Unset variables keep the defaults
+func (app *Config) InitOutbox(db *gorm.DB, repo interfaces.IOutboxRepository, sinks ...outbox.Sink) *outbox.Relay {
+	if channel := os.Getenv("OUTBOX_NOTIFY_CHANNEL"); channel != "" {
+		sinks = append(sinks, outbox.NewBrokerSink(outbox.NewNotifyPublisher(db), channel))
+	}
+
+	r := outbox.NewRelay(repo, sinks...)
+	r.MaxAttempts = envInt("OUTBOX_MAX_ATTEMPTS", r.MaxAttempts)
+	r.Backoff = time.Duration(envInt("OUTBOX_BACKOFF_SECONDS", int(r.Backoff/time.Second))) * time.Second
+	return r
+}
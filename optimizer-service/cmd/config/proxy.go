@@ -0,0 +1,37 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// IPExtractor returns how the address of a client is found, it is passed on
+// to the user service so failed logins are counted per client
+// X-Forwarded-For is only believed from TRUSTED_PROXIES, a comma separated
+// list of address ranges like 10.0.0.0/8. Without it, the address requests
+// come from is used, any client could otherwise pick its address
+// It returns an error if a range cannot be parsed
+func IPExtractor() (echo.IPExtractor, error) {
+	value := os.Getenv("TRUSTED_PROXIES")
+	if value == "" {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, cidr := range strings.Split(value, ",") {
+		_, ipRange, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
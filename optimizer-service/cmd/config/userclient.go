@@ -0,0 +1,66 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"optimizer-service/cmd/internal/userclient"
+	"os"
+	"strings"
+	"time"
+)
+
+// UserServiceURL returns the base URL of the user service
+// It reads USER_SERVICE_URL and defaults to the docker compose service
+func UserServiceURL() string {
+	if url := os.Getenv("USER_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://user-service:8080"
+}
+
+// Defaults for the credentials of this service
+const defaultServiceClientID = "optimizer-service"
+
+// ServiceClientCredentials returns the credentials this service requests service tokens with
+// The secret is read from SERVICE_CLIENT_SECRET or from the file at
+// SERVICE_CLIENT_SECRET_FILE, so it can be rotated by replacing the file
+// It returns the client ID, the secret and an error if the file cannot be read
+func ServiceClientCredentials() (string, string, error) {
+	clientID := envString("SERVICE_CLIENT_ID", defaultServiceClientID)
+
+	secret := os.Getenv("SERVICE_CLIENT_SECRET")
+	path := os.Getenv("SERVICE_CLIENT_SECRET_FILE")
+	switch {
+	case secret != "" && path != "":
+		return "", "", fmt.Errorf("only one of SERVICE_CLIENT_SECRET and SERVICE_CLIENT_SECRET_FILE can be set")
+	case path != "":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", fmt.Errorf("reading SERVICE_CLIENT_SECRET_FILE: %w", err)
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+	return clientID, secret, nil
+}
+
+// UserServiceClient creates the client of the user service
+// Timeouts, retries and the circuit breaker are read from the environment,
+// unset variables keep the defaults
+// It returns the client and an error if the credentials of this service cannot be read
+func UserServiceClient() (*userclient.Client, error) {
+	clientID, secret, err := ServiceClientCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		log.Println("SERVICE_CLIENT_SECRET is not set, calls to the internal routes of the user service will fail")
+	}
+
+	client := userclient.NewClient(UserServiceURL(), clientID, secret)
+	client.HTTP.Timeout = time.Duration(envInt("USER_SERVICE_TIMEOUT_MS", int(client.HTTP.Timeout/time.Millisecond))) * time.Millisecond
+	client.Retries = envInt("USER_SERVICE_RETRIES", client.Retries)
+	client.Backoff = time.Duration(envInt("USER_SERVICE_BACKOFF_MS", int(client.Backoff/time.Millisecond))) * time.Millisecond
+	client.Breaker.Threshold = envInt("USER_SERVICE_BREAKER_THRESHOLD", client.Breaker.Threshold)
+	client.Breaker.Cooldown = time.Duration(envInt("USER_SERVICE_BREAKER_COOLDOWN_SECONDS", int(client.Breaker.Cooldown/time.Second))) * time.Second
+	return client, nil
+}
@@ -0,0 +1,29 @@
+package config
+
+import (
+	"optimizer-service/cmd/internal/app/interfaces"
+	"optimizer-service/cmd/internal/webhook"
+	"os"
+	"time"
+)
+
+// WebhooksAllowPrivate reports whether webhooks may post to loopback and
+// private addresses, which only makes sense in development
+func WebhooksAllowPrivate() bool {
+	return os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"
+}
+
+// InitWebhooks sets up the dispatcher posting file events to webhooks
+// Unset variables keep the defaults
+func (app *Config) InitWebhooks(repo interfaces.IWebhookRepository) *webhook.Dispatcher {
+	d := webhook.NewDispatcher(repo)
+	d.MaxAttempts = envInt("WEBHOOK_MAX_ATTEMPTS", d.MaxAttempts)
+	d.Backoff = time.Duration(envInt("WEBHOOK_BACKOFF_SECONDS", int(d.Backoff/time.Second))) * time.Second
+	timeout := time.Duration(envInt("WEBHOOK_TIMEOUT_SECONDS", int(d.Client.Timeout/time.Second))) * time.Second
+	d.Client = webhook.NewClient(timeout, WebhooksAllowPrivate())
+	// A claimed delivery must outlast its attempt, or another replica posts it too
+	if d.Lease < 2*timeout {
+		d.Lease = 2 * timeout
+	}
+	return d
+}
@@ -2,12 +2,21 @@
 package handler
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"mime"
 	"net/http"
+	"optimizer-service/cmd/internal/app/service"
+	"optimizer-service/cmd/internal/models"
 	"optimizer-service/cmd/internal/types"
+	"optimizer-service/cmd/internal/userclient"
+	"path/filepath"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
 )
 
 // Handler struct to hold the db instance
@@ -43,7 +52,11 @@ func (h *Handler) HomePage(c echo.Context) error {
 // @Failure 400 {object} utils.JSONResponse "Error uploading file"
 // @Router /upload [post]
 func (h *Handler) PostUploadFile(c echo.Context) error {
-	userId := uuid.New().String()
+	// Get the user id from the middleware
+	userId, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
 
 	// Get the submitted file
 	file, err := c.FormFile("file")
@@ -79,9 +92,9 @@ func (h *Handler) PostUploadFile(c echo.Context) error {
 // @Produce json
 // @Success 200 {object} utils.JSONResponse "Login successful"
 // @Failure 400 {object} utils.JSONResponse "Invalid request payload"
-// @Failure 401 {object} utils.JSONResponse "Invalid password"
-// @Failure 404 {object} utils.JSONResponse "User not found"
-// @Failure 500 {object} utils.JSONResponse "Failed to create token"
+// @Failure 401 {object} utils.JSONResponse "Invalid credentials"
+// @Failure 429 {object} utils.JSONResponse "Too many failed login attempts, try again later"
+// @Failure 503 {object} utils.JSONResponse "User service unavailable"
 // @Router /login [post]
 func (h *Handler) LoginUser(c echo.Context) error {
 	u := new(types.LoginInput)
@@ -92,11 +105,535 @@ func (h *Handler) LoginUser(c echo.Context) error {
 	email := u.Email
 	password := u.Password
 
-	// Call the auth service to login the user
-	authResult, err := h.Container.AuthService.Login(email, password)
-	if err != nil {
+	// Call the auth service to login the user, failed logins are counted per client address
+	authResult, err := h.Container.AuthService.Login(email, password, c.RealIP())
+	if errors.Is(err, userclient.ErrInvalidCredentials) {
 		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, err.Error())
 	}
+	if errors.Is(err, userclient.ErrLoginLocked) {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusTooManyRequests, err.Error())
+	}
+	if err != nil {
+		log.Printf("Failed to login with the user service: %v", err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusServiceUnavailable, "User service unavailable")
+	}
 
 	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Login successful", authResult)
 }
+
+// GetFile godoc
+// @Summary Get a file
+// @Description Get the details of a file, including the metadata extracted from images
+// @Produce json
+// @Param id path string true "File ID"
+// @Success 200 {object} utils.JSONResponse "File retrieved successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 404 {object} utils.JSONResponse "File not found"
+// @Security Bearer
+// @Router /files/{id} [get]
+func (h *Handler) GetFile(c echo.Context) error {
+	// Get the user id from the middleware
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	file, err := h.Container.FileService.GetFile(c.Param("id"))
+	if err != nil || file.UserID != userID {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusNotFound, "File not found")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "File retrieved successfully", file)
+}
+
+// DownloadFile godoc
+// @Summary Download a file
+// @Description Download the optimized file, precompressed when the client accepts it
+// @Produce octet-stream
+// @Param id path string true "File ID"
+// @Param Accept-Encoding header string false "Accepted encodings, e.g. br, zstd, gzip"
+// @Success 200 {file} file "The file content"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 404 {object} utils.JSONResponse "File not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to read file"
+// @Security Bearer
+// @Router /files/{id}/download [get]
+func (h *Handler) DownloadFile(c echo.Context) error {
+	// Get the user id from the middleware
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	file, err := h.Container.FileService.GetFile(c.Param("id"))
+	if err != nil || file.UserID != userID {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusNotFound, "File not found")
+	}
+
+	content, encoding, err := h.Container.FileService.OpenDownload(file, c.Request().Header.Get(echo.HeaderAcceptEncoding))
+	if err != nil {
+		log.Printf("Error opening file %s for download %v", file.ID, err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to read file")
+	}
+	defer content.Close()
+
+	name := file.OriginalName
+	if file.OptimizedName != nil {
+		name = *file.OptimizedName
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = echo.MIMEOctetStream
+	}
+
+	// The representation depends on Accept-Encoding, caches must key on it
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+	if encoding != "" {
+		c.Response().Header().Set(echo.HeaderContentEncoding, encoding)
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name))
+
+	return c.Stream(http.StatusOK, contentType, content)
+}
+
+// DeleteFile godoc
+// @Summary Delete a file
+// @Description Delete a file with its optimized version
+// @Produce json
+// @Param id path string true "File ID"
+// @Success 200 {object} utils.JSONResponse "File deleted successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 404 {object} utils.JSONResponse "File not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to delete file"
+// @Security Bearer
+// @Router /files/{id} [delete]
+func (h *Handler) DeleteFile(c echo.Context) error {
+	// Get the user id from the middleware
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	file, err := h.Container.FileService.GetFile(c.Param("id"))
+	if err != nil || file.UserID != userID {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusNotFound, "File not found")
+	}
+
+	if err := h.Container.FileService.DeleteFile(file); err != nil {
+		log.Printf("Error deleting file %s %v", file.ID, err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to delete file")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "File deleted successfully", nil)
+}
+
+// CreateStreamTicket godoc
+// @Summary Issue a stream ticket
+// @Description Issue a ticket to open the event stream of a file from a browser, which cannot set the Authorization header.
+// @Description The ticket is sent in the ticket query parameter, it can be used once and expires after expires_in seconds.
+// @Produce json
+// @Param id path string true "File ID"
+// @Success 201 {object} utils.JSONResponse "Stream ticket issued successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 404 {object} utils.JSONResponse "File not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to issue stream ticket"
+// @Security Bearer
+// @Router /files/{id}/stream-ticket [post]
+func (h *Handler) CreateStreamTicket(c echo.Context) error {
+	// Get the user id from the middleware
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	file, err := h.Container.FileService.GetFile(c.Param("id"))
+	if err != nil || file.UserID != userID {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusNotFound, "File not found")
+	}
+
+	ticket, ttl, err := h.Container.AuthService.IssueStreamTicket(userID, file.ID)
+	if err != nil {
+		log.Printf("Error issuing stream ticket %v", err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to issue stream ticket")
+	}
+
+	response := map[string]interface{}{
+		"ticket":     ticket,
+		"expires_in": int(ttl.Seconds()),
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusCreated, "Stream ticket issued successfully", response)
+}
+
+// GetFileEvents godoc
+// @Summary Stream file events
+// @Description Stream the status transitions and progress of a file as server-sent events.
+// @Description Every event is a JSON object with the status and the progress percentage,
+// @Description the stream starts with the current status and ends once the file is completed or failed.
+// @Description Browsers can send a stream ticket of the file in the ticket query parameter instead of the bearer token.
+// @Produce text/event-stream
+// @Param id path string true "File ID"
+// @Param ticket query string false "Stream ticket, when the Authorization header cannot be set"
+// @Success 200 {object} models.FileEvent "The events"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 404 {object} utils.JSONResponse "File not found"
+// @Security Bearer
+// @Router /files/{id}/events [get]
+func (h *Handler) GetFileEvents(c echo.Context) error {
+	file, events, unsubscribe, err := h.subscribeFile(c)
+	if file == nil {
+		return err
+	}
+	defer unsubscribe()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	// Tell proxies such as nginx not to buffer the stream
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	send := func(event models.FileEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event.Status, data); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	}
+	ping := func() error {
+		if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	}
+
+	streamFileEvents(c.Request().Context().Done(), file, events, send, ping)
+	return nil
+}
+
+// GetFileEventsWebSocket godoc
+// @Summary Stream file events over a WebSocket
+// @Description Stream the status transitions and progress of a file as JSON messages over a WebSocket.
+// @Description The stream starts with the current status and the server closes it once the file is completed or failed.
+// @Description Browsers can send a stream ticket of the file in the ticket query parameter instead of the bearer token.
+// @Param id path string true "File ID"
+// @Param ticket query string false "Stream ticket, when the Authorization header cannot be set"
+// @Success 101 {object} models.FileEvent "The events"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 404 {object} utils.JSONResponse "File not found"
+// @Security Bearer
+// @Router /files/{id}/ws [get]
+func (h *Handler) GetFileEventsWebSocket(c echo.Context) error {
+	file, events, unsubscribe, err := h.subscribeFile(c)
+	if file == nil {
+		return err
+	}
+	defer unsubscribe()
+
+	server := websocket.Server{
+		// Requests are authenticated with bearer tokens, not cookies,
+		// so cross-origin requests are not a risk
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			// Clients do not send anything, reading only tells us they left
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				var discard string
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+			}()
+
+			send := func(event models.FileEvent) error {
+				return websocket.JSON.Send(ws, event)
+			}
+			streamFileEvents(done, file, events, send, nil)
+		},
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// subscribeFile subscribes to the events of the file of the request
+// It returns a nil file once it has written an error response
+func (h *Handler) subscribeFile(c echo.Context) (*models.File, <-chan models.FileEvent, func(), error) {
+	// Get the user id from the middleware
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return nil, nil, nil, h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	file, err := h.Container.FileService.GetFile(c.Param("id"))
+	if err != nil || file.UserID != userID {
+		return nil, nil, nil, h.Container.Utils.WriteErrorResponse(c, http.StatusNotFound, "File not found")
+	}
+
+	// Read the file again once subscribed, so no transition falls in between
+	events, unsubscribe := h.Container.FileEvents.Subscribe(file.ID)
+	if current, err := h.Container.FileService.GetFile(file.ID); err == nil {
+		file = current
+	}
+
+	return file, events, unsubscribe, nil
+}
+
+// fileEventPing is how often a stream without events is kept alive
+const fileEventPing = 15 * time.Second
+
+// streamFileEvents sends the current status of a file, then its events,
+// until the file is completed or failed or done is closed
+// ping, when set, is called when nothing was sent for a while
+func streamFileEvents(done <-chan struct{}, file *models.File, events <-chan models.FileEvent, send func(models.FileEvent) error, ping func() error) {
+	current := models.NewFileEvent(file, 0)
+	if current.Final() {
+		current.Progress = 100
+	}
+	if err := send(current); err != nil || current.Final() {
+		return
+	}
+
+	ticker := time.NewTicker(fileEventPing)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case event := <-events:
+			if err := send(event); err != nil || event.Final() {
+				return
+			}
+		case <-ticker.C:
+			if ping != nil && ping() != nil {
+				return
+			}
+		}
+	}
+}
+
+// GetNotificationPreference godoc
+// @Summary Get the notification preference
+// @Description Get whether the user receives an email when a file is optimized
+// @Produce json
+// @Success 200 {object} utils.JSONResponse "Notification preference retrieved successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to fetch notification preference"
+// @Security Bearer
+// @Router /notifications [get]
+func (h *Handler) GetNotificationPreference(c echo.Context) error {
+	// Get the user id from the middleware
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	preference, err := h.Container.NotificationService.GetPreference(userID)
+	if err != nil {
+		log.Printf("Error fetching notification preference of user %s %v", userID, err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to fetch notification preference")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Notification preference retrieved successfully", preference)
+}
+
+// UpdateNotificationPreference godoc
+// @Summary Update the notification preference
+// @Description Opt in or out of the email sent when a file is optimized
+// @Accept json
+// @Produce json
+// @Param email_opt_out body bool true "Whether to stop the emails"
+// @Success 200 {object} utils.JSONResponse "Notification preference updated successfully"
+// @Failure 400 {object} utils.JSONResponse "Invalid request payload"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to update notification preference"
+// @Security Bearer
+// @Router /notifications [put]
+func (h *Handler) UpdateNotificationPreference(c echo.Context) error {
+	// Get the user id from the middleware
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	input := new(types.NotificationPreferenceInput)
+	if err := c.Bind(input); err != nil || input.EmailOptOut == nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Invalid request payload")
+	}
+
+	preference, err := h.Container.NotificationService.UpdatePreference(userID, *input.EmailOptOut)
+	if err != nil {
+		log.Printf("Error updating notification preference of user %s %v", userID, err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to update notification preference")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Notification preference updated successfully", preference)
+}
+
+// CreateWebhook godoc
+// @Summary Create a webhook
+// @Description Subscribe a URL to file events, leave events empty for all of them.
+// @Description The secret deliveries are signed with is only shown in this response.
+// @Accept json
+// @Produce json
+// @Param webhook body types.WebhookInput true "The URL and the events, file.uploaded, file.optimized, file.failed or file.deleted"
+// @Success 201 {object} utils.JSONResponse "Webhook created successfully"
+// @Failure 400 {object} utils.JSONResponse "Invalid request payload"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to create webhook"
+// @Security Bearer
+// @Router /webhooks [post]
+func (h *Handler) CreateWebhook(c echo.Context) error {
+	// Get the user id from the middleware
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	input := new(types.WebhookInput)
+	if err := c.Bind(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Invalid request payload")
+	}
+
+	webhook, err := h.Container.WebhookService.CreateWebhook(userID, input.URL, input.Events)
+	if errors.Is(err, service.ErrInvalidWebhookURL) || errors.Is(err, service.ErrForbiddenWebhookURL) || errors.Is(err, service.ErrUnknownWebhookEvent) {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		log.Printf("Error creating webhook %v", err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to create webhook")
+	}
+
+	response := map[string]interface{}{
+		"webhook": webhook,
+		"secret":  webhook.Secret,
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusCreated, "Webhook created successfully", response)
+}
+
+// GetWebhooks godoc
+// @Summary List webhooks
+// @Description List the webhooks of the user
+// @Produce json
+// @Success 200 {object} utils.JSONResponse "Webhooks retrieved successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to fetch webhooks"
+// @Security Bearer
+// @Router /webhooks [get]
+func (h *Handler) GetWebhooks(c echo.Context) error {
+	// Get the user id from the middleware
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	webhooks, err := h.Container.WebhookService.GetWebhooks(userID)
+	if err != nil {
+		log.Printf("Error fetching webhooks of user %s %v", userID, err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to fetch webhooks")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Webhooks retrieved successfully", webhooks)
+}
+
+// DeleteWebhook godoc
+// @Summary Delete a webhook
+// @Description Delete a webhook and its delivery log
+// @Produce json
+// @Param id path string true "Webhook ID"
+// @Success 200 {object} utils.JSONResponse "Webhook deleted successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 404 {object} utils.JSONResponse "Webhook not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to delete webhook"
+// @Security Bearer
+// @Router /webhooks/{id} [delete]
+func (h *Handler) DeleteWebhook(c echo.Context) error {
+	// Get the user id from the middleware
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	err := h.Container.WebhookService.DeleteWebhook(userID, c.Param("id"))
+	if errors.Is(err, service.ErrWebhookNotFound) {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		log.Printf("Error deleting webhook %s %v", c.Param("id"), err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to delete webhook")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Webhook deleted successfully", nil)
+}
+
+// GetWebhookDeliveries godoc
+// @Summary List webhook deliveries
+// @Description List the delivery log of a webhook, newest first
+// @Produce json
+// @Param id path string true "Webhook ID"
+// @Success 200 {object} utils.JSONResponse "Deliveries retrieved successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 404 {object} utils.JSONResponse "Webhook not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to fetch deliveries"
+// @Security Bearer
+// @Router /webhooks/{id}/deliveries [get]
+func (h *Handler) GetWebhookDeliveries(c echo.Context) error {
+	// Get the user id from the middleware
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	deliveries, err := h.Container.WebhookService.GetDeliveries(userID, c.Param("id"))
+	if errors.Is(err, service.ErrWebhookNotFound) {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		log.Printf("Error fetching deliveries of webhook %s %v", c.Param("id"), err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to fetch deliveries")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Deliveries retrieved successfully", deliveries)
+}
+
+// RedeliverWebhookDelivery godoc
+// @Summary Redeliver a webhook delivery
+// @Description Post a delivery again, e.g. a dead one once the receiver is fixed
+// @Produce json
+// @Param id path string true "Webhook ID"
+// @Param deliveryId path string true "Delivery ID"
+// @Success 202 {object} utils.JSONResponse "Delivery scheduled"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 404 {object} utils.JSONResponse "Delivery not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to schedule delivery"
+// @Security Bearer
+// @Router /webhooks/{id}/deliveries/{deliveryId}/redeliver [post]
+func (h *Handler) RedeliverWebhookDelivery(c echo.Context) error {
+	// Get the user id from the middleware
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	delivery, err := h.Container.WebhookService.Redeliver(userID, c.Param("id"), c.Param("deliveryId"))
+	if errors.Is(err, service.ErrWebhookNotFound) || errors.Is(err, service.ErrDeliveryNotFound) {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		log.Printf("Error scheduling delivery %s %v", c.Param("deliveryId"), err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to schedule delivery")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusAccepted, "Delivery scheduled", delivery)
+}
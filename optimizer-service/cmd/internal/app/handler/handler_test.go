@@ -3,27 +3,55 @@ package handler
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"optimizer-service/cmd/internal/app/interceptor"
 	"optimizer-service/cmd/internal/app/repositories"
 	"optimizer-service/cmd/internal/app/service"
+	"optimizer-service/cmd/internal/auth"
+	"optimizer-service/cmd/internal/events"
 	"optimizer-service/cmd/internal/models"
 	"optimizer-service/cmd/internal/storage"
 	"optimizer-service/cmd/internal/types"
+	"optimizer-service/cmd/internal/userclient"
 	"optimizer-service/cmd/internal/utils"
 	"optimizer-service/cmd/lib/mocks"
+	"strings"
 	"testing"
 
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/websocket"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
+// testJWTConfig verifies tokens against a user service that is not running
+var testJWTConfig = &auth.Config{
+	Keys:     auth.NewJWKS("http://user-service.test/.well-known/jwks.json"),
+	Issuer:   "user-service",
+	Audience: "optimate",
+}
+
+// testResolver resolves hosts to fixed addresses, the tests do not use DNS
+type testResolver map[string]string
+
+func (r testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ip, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+}
+
 func setUpTest() (*echo.Echo, *types.AppContainer) {
 	// Set up the test
 	e := echo.New()
@@ -31,7 +59,7 @@ func setUpTest() (*echo.Echo, *types.AppContainer) {
 	db, _ := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
 
 	//migrate models
-	err := db.AutoMigrate(&models.File{}, &models.OptimizationSettings{})
+	err := db.AutoMigrate(&models.File{}, &models.FileEncoding{}, &models.OptimizationSettings{}, &models.NotificationPreference{}, &models.Webhook{}, &models.WebhookDelivery{}, &models.OutboxEvent{}, &models.OutboxConsumption{}, &models.StreamTicket{})
 	if err != nil {
 		fmt.Println("Error migrating the schema")
 		return nil, nil
@@ -41,13 +69,19 @@ func setUpTest() (*echo.Echo, *types.AppContainer) {
 	fileService := service.NewFileService(fileRepo, &storage.LocalStorage{
 		BasePath: "uploads",
 	})
-	authRepo := repositories.NewAuthRepository(db)
-	authService := service.NewAuthService(authRepo)
+	authRepo := repositories.NewAuthRepository(db, userclient.NewClient("http://user-service.test", "optimizer-service", ""))
+	authService := service.NewAuthService(authRepo, testJWTConfig)
+	notificationService := service.NewNotificationService(repositories.NewNotificationRepository(db))
+	webhookService := service.NewWebhookService(repositories.NewWebhookRepository(db))
+	webhookService.Resolver = testResolver{"example.com": "93.184.216.34", "internal.example.com": "10.0.0.5"}
 	container := &types.AppContainer{
-		Utils:       utils.NewUtils(db),
-		DB:          db,
-		FileService: fileService,
-		AuthService: authService,
+		Utils:               utils.NewUtils(db),
+		DB:                  db,
+		FileService:         fileService,
+		AuthService:         authService,
+		NotificationService: notificationService,
+		WebhookService:      webhookService,
+		FileEvents:          events.NewHub(),
 	}
 
 	return e, container
@@ -112,6 +146,7 @@ func TestPostUploadFileWithSuccess(t *testing.T) {
 
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set("userID", expectedFile.UserID)
 
 	// Add authentication middleware
 	authMiddleware := func(next echo.HandlerFunc) echo.HandlerFunc {
@@ -186,6 +221,7 @@ func TestPostUploadFileWithFailure(t *testing.T) {
 	rec := httptest.NewRecorder()
 
 	c := e.NewContext(req, rec)
+	c.Set("userID", expectedFile.UserID)
 
 	// assert that the file was uploaded successfully
 	if assert.NoError(t, handler.PostUploadFile(c)) {
@@ -197,13 +233,400 @@ func TestPostUploadFileWithFailure(t *testing.T) {
 	mockFileService.AssertExpectations(t)
 }
 
+func TestDownloadFileNegotiatesEncoding(t *testing.T) {
+	e, container := setUpTest()
+
+	basePath := t.TempDir()
+	fileService := service.NewFileService(repositories.NewFileRepository(container.DB), storage.NewLocalStorage(basePath))
+	container.FileService = fileService
+
+	userID := uuid.New().String()
+	content := strings.Repeat("body { color: red; }\n", 200)
+	uploaded, err := fileService.UploadFile(userID, strings.NewReader(content), "style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fileService.OptimizeFile(uploaded.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(container)
+
+	tests := []struct {
+		acceptEncoding   string
+		expectedEncoding string
+	}{
+		{"gzip, deflate, br", "br"},
+		{"gzip;q=1.0, br;q=0.5", "gzip"},
+		{"zstd", "zstd"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/protected/files/"+uploaded.ID+"/download", nil)
+		req.Header.Set(echo.HeaderAcceptEncoding, tt.acceptEncoding)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(uploaded.ID)
+		c.Set("userID", userID)
+
+		if assert.NoError(t, h.DownloadFile(c)) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, tt.expectedEncoding, rec.Header().Get(echo.HeaderContentEncoding))
+			assert.Equal(t, echo.HeaderAcceptEncoding, rec.Header().Get(echo.HeaderVary))
+			if tt.expectedEncoding == "" {
+				assert.Equal(t, content, rec.Body.String())
+			}
+		}
+	}
+}
+
+func TestDownloadFileOfAnotherUser(t *testing.T) {
+	e, container := setUpTest()
+
+	fileService := service.NewFileService(repositories.NewFileRepository(container.DB), storage.NewLocalStorage(t.TempDir()))
+	container.FileService = fileService
+
+	uploaded, err := fileService.UploadFile(uuid.New().String(), strings.NewReader("hello"), "hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/protected/files/"+uploaded.ID+"/download", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(uploaded.ID)
+	c.Set("userID", uuid.New().String())
+
+	h := NewHandler(container)
+	if assert.NoError(t, h.DownloadFile(c)) {
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	}
+}
+
 func TestLoginWithValidData(t *testing.T) {
 
 	mockAuthRepo := new(mocks.MockAuthRepository)
-	authService := service.NewAuthService(mockAuthRepo)
+	authService := service.NewAuthService(mockAuthRepo, testJWTConfig)
 
-	mockAuthRepo.On("LoginWithREST", mock.Anything, mock.Anything).Return(&types.ResponsePayload{}, nil)
-	_, err := authService.Login("admin@admin.com", "password")
+	mockAuthRepo.On("LoginWithREST", "admin@admin.com", "password", "192.0.2.1").Return(&models.LoginResult{}, nil)
+	_, err := authService.Login("admin@admin.com", "password", "192.0.2.1")
 	assert.NoError(t, err)
 	mockAuthRepo.AssertExpectations(t)
 }
+
+func TestNotificationPreference(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	userID := uuid.New().String()
+
+	get := func() string {
+		req := httptest.NewRequest(http.MethodGet, "/protected/notifications", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("userID", userID)
+
+		assert.NoError(t, h.GetNotificationPreference(c))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+
+	// Users get emails until they opt out
+	assert.Contains(t, get(), `"email_opt_out":false`)
+
+	req := httptest.NewRequest(http.MethodPut, "/protected/notifications", strings.NewReader(`{"email_opt_out": true}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("userID", userID)
+
+	if assert.NoError(t, h.UpdateNotificationPreference(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+	assert.Contains(t, get(), `"email_opt_out":true`)
+
+	// The preference is required
+	req = httptest.NewRequest(http.MethodPut, "/protected/notifications", strings.NewReader(`{}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.Set("userID", userID)
+
+	if assert.NoError(t, h.UpdateNotificationPreference(c)) {
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestCreateWebhook(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	userID := uuid.New().String()
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"url": "https://example.com/hook", "events": ["file.optimized", "file.failed"]}`, http.StatusCreated},
+		{`{"url": "https://example.com/hook"}`, http.StatusCreated},
+		{`{"url": "ftp://example.com/hook"}`, http.StatusBadRequest},
+		{`{"url": "/hook"}`, http.StatusBadRequest},
+		{`{"url": "https://example.com/hook", "events": ["file.renamed"]}`, http.StatusBadRequest},
+		// Webhooks cannot reach this service or its neighbours
+		{`{"url": "http://127.0.0.1/hook"}`, http.StatusBadRequest},
+		{`{"url": "http://[::1]:8080/hook"}`, http.StatusBadRequest},
+		{`{"url": "http://169.254.169.254/latest/meta-data"}`, http.StatusBadRequest},
+		{`{"url": "https://internal.example.com/hook"}`, http.StatusBadRequest},
+		{`{"url": "http://user-service:8020/internal/users"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/protected/webhooks", strings.NewReader(tt.body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("userID", userID)
+
+		if assert.NoError(t, h.CreateWebhook(c)) {
+			assert.Equal(t, tt.status, rec.Code, tt.body)
+			if tt.status == http.StatusCreated {
+				// The secret is only shown once
+				assert.Contains(t, rec.Body.String(), `"secret":"whsec_`)
+			}
+		}
+	}
+
+	webhooks, err := container.WebhookService.GetWebhooks(userID)
+	assert.NoError(t, err)
+	if assert.Len(t, webhooks, 2) {
+		assert.Equal(t, "file.optimized,file.failed", webhooks[0].Events)
+	}
+
+	// Listing does not leak the secrets
+	req := httptest.NewRequest(http.MethodGet, "/protected/webhooks", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("userID", userID)
+	if assert.NoError(t, h.GetWebhooks(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotContains(t, rec.Body.String(), "whsec_")
+	}
+}
+
+func TestRedeliverDeadDelivery(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	userID := uuid.New().String()
+
+	webhook, err := container.WebhookService.CreateWebhook(userID, "https://example.com/hook", nil)
+	assert.NoError(t, err)
+
+	delivery := &models.WebhookDelivery{
+		ID:        uuid.New().String(),
+		WebhookID: webhook.ID,
+		Event:     models.EventFileOptimized,
+		Payload:   "{}",
+		Status:    models.DeliveryDead,
+		Attempts:  8,
+	}
+	assert.NoError(t, container.DB.Create(delivery).Error)
+
+	redeliver := func(userID, deliveryID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id", "deliveryId")
+		c.SetParamValues(webhook.ID, deliveryID)
+		c.Set("userID", userID)
+		assert.NoError(t, h.RedeliverWebhookDelivery(c))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusNotFound, redeliver(uuid.New().String(), delivery.ID).Code)
+	assert.Equal(t, http.StatusNotFound, redeliver(userID, uuid.New().String()).Code)
+	assert.Equal(t, http.StatusAccepted, redeliver(userID, delivery.ID).Code)
+
+	deliveries, err := container.WebhookService.GetDeliveries(userID, webhook.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, deliveries, 1) {
+		assert.Equal(t, models.DeliveryPending, deliveries[0].Status)
+		assert.Equal(t, 0, deliveries[0].Attempts)
+		assert.NotNil(t, deliveries[0].NextAttemptAt)
+	}
+}
+
+// setUpStream serves the event streams of a processing file of a user
+// The returned function publishes a progress update of the file
+func setUpStream(t *testing.T) (*httptest.Server, *models.File, func(models.FileStatus, int)) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+
+	file := &models.File{
+		ID:           uuid.New().String(),
+		UserID:       uuid.New().String(),
+		OriginalName: "file.png",
+		OriginalPath: "/file.png",
+		Type:         ".png",
+		Status:       models.StatusProcessing,
+	}
+	assert.NoError(t, container.DB.Create(file).Error)
+
+	// Stands in for the authentication middleware
+	authenticated := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("userID", c.Request().Header.Get("X-Test-User"))
+			return next(c)
+		}
+	}
+	e.GET("/protected/files/:id/events", h.GetFileEvents, authenticated)
+	e.GET("/protected/files/:id/ws", h.GetFileEventsWebSocket, authenticated)
+
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	publish := func(status models.FileStatus, progress int) {
+		event := models.NewFileEvent(file, progress)
+		event.Status = status
+		container.FileEvents.Publish(event)
+	}
+	return server, file, publish
+}
+
+func TestGetFileEventsStreamsUntilCompleted(t *testing.T) {
+	server, file, publish := setUpStream(t)
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/protected/files/"+file.ID+"/events", nil)
+	req.Header.Set("X-Test-User", file.UserID)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get(echo.HeaderContentType))
+
+	// The headers are only sent once subscribed
+	publish(models.StatusProcessing, 40)
+	publish(models.StatusCompleleted, 100)
+
+	// The stream ends with the final status
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	var received []models.FileEvent
+	for _, line := range strings.Split(string(body), "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var event models.FileEvent
+			assert.NoError(t, json.Unmarshal([]byte(data), &event))
+			received = append(received, event)
+		}
+	}
+
+	if assert.Len(t, received, 3) {
+		assert.Equal(t, models.StatusProcessing, received[0].Status)
+		assert.Equal(t, 40, received[1].Progress)
+		assert.Equal(t, models.StatusCompleleted, received[2].Status)
+	}
+	assert.Contains(t, string(body), "event: completed\n")
+}
+
+func TestGetFileEventsOfAnotherUser(t *testing.T) {
+	server, file, _ := setUpStream(t)
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/protected/files/"+file.ID+"/events", nil)
+	req.Header.Set("X-Test-User", uuid.New().String())
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestGetFileEventsWebSocket(t *testing.T) {
+	server, file, publish := setUpStream(t)
+
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(server.URL, "http")+"/protected/files/"+file.ID+"/ws", server.URL)
+	assert.NoError(t, err)
+	config.Header.Set("X-Test-User", file.UserID)
+	ws, err := websocket.DialConfig(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+
+	var event models.FileEvent
+	assert.NoError(t, websocket.JSON.Receive(ws, &event))
+	assert.Equal(t, models.StatusProcessing, event.Status)
+
+	publish(models.StatusProcessing, 70)
+	assert.NoError(t, websocket.JSON.Receive(ws, &event))
+	assert.Equal(t, 70, event.Progress)
+
+	reason := "corrupt image"
+	file.FailureReason = &reason
+	publish(models.StatusFailed, 100)
+	assert.NoError(t, websocket.JSON.Receive(ws, &event))
+	assert.Equal(t, models.StatusFailed, event.Status)
+	assert.Equal(t, "corrupt image", *event.FailureReason)
+
+	// The server closes the socket after the final status
+	assert.Equal(t, io.EOF, websocket.JSON.Receive(ws, &event))
+}
+
+func TestStreamTicketOpensEventStreamOnce(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+
+	file := &models.File{
+		ID:           uuid.New().String(),
+		UserID:       uuid.New().String(),
+		OriginalName: "file.png",
+		OriginalPath: "/file.png",
+		Type:         ".png",
+		Status:       models.StatusCompleleted,
+	}
+	assert.NoError(t, container.DB.Create(file).Error)
+
+	issue := func(userID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/protected/files/"+file.ID+"/stream-ticket", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(file.ID)
+		c.Set("userID", userID)
+		assert.NoError(t, h.CreateStreamTicket(c))
+		return rec
+	}
+
+	// Users only get tickets for their own files
+	assert.Equal(t, http.StatusNotFound, issue(uuid.New().String()).Code)
+
+	rec := issue(file.UserID)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var response struct {
+		Data struct {
+			Ticket    string `json:"ticket"`
+			ExpiresIn int    `json:"expires_in"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.NotEmpty(t, response.Data.Ticket)
+	assert.Equal(t, 30, response.Data.ExpiresIn)
+
+	e.GET("/protected/files/:id/events", h.GetFileEvents, interceptor.StreamAuthenticationMiddleware(container.AuthService), interceptor.RequireScope(auth.ScopeFilesRead))
+	stream := func(fileID, ticket string) int {
+		req := httptest.NewRequest(http.MethodGet, "/protected/files/"+fileID+"/events?ticket="+ticket, nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// A ticket only opens the stream of its file, and only once
+	assert.Equal(t, http.StatusForbidden, stream(uuid.New().String(), response.Data.Ticket))
+	assert.Equal(t, http.StatusForbidden, stream(file.ID, response.Data.Ticket))
+
+	response.Data.Ticket = ""
+	assert.NoError(t, json.Unmarshal(issue(file.UserID).Body.Bytes(), &response))
+	assert.Equal(t, http.StatusOK, stream(file.ID, response.Data.Ticket))
+	assert.Equal(t, http.StatusForbidden, stream(file.ID, response.Data.Ticket))
+}
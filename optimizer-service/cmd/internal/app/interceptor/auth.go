@@ -5,9 +5,9 @@ import (
 	"log"
 	"net/http"
 	"optimizer-service/cmd/internal/app/interfaces"
+	"optimizer-service/cmd/internal/auth"
 	"strings"
 
-	"github.com/golang-jwt/jwt"
 	"github.com/labstack/echo/v4"
 )
 
@@ -32,25 +32,96 @@ func AuthenticationMiddleware(authService interfaces.IAuthService) echo.Middlewa
 				return echo.NewHTTPError(http.StatusUnauthorized, "Bearer token not found")
 			}
 
-			// Check if token is valid using the auth service
-			token, err := authService.ValidateToken(tokenString)
+			if err := authenticate(c, authService, tokenString); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+// StreamAuthenticationMiddleware is the AuthenticationMiddleware for event streams
+// Browsers cannot set headers on EventSource and WebSocket requests, so they
+// send a stream ticket of the file in the ticket query parameter instead.
+// Bearer tokens are never read from the query, where they would end up in logs
+func StreamAuthenticationMiddleware(authService interfaces.IAuthService) echo.MiddlewareFunc {
+	headerAuthentication := AuthenticationMiddleware(authService)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		withHeader := headerAuthentication(next)
+		return func(c echo.Context) error {
+			ticket := c.QueryParam("ticket")
+			if ticket == "" || c.Request().Header.Get("Authorization") != "" {
+				return withHeader(c)
+			}
 
-			if err != nil || !token.Valid {
-				log.Printf("Failed to validate token: %v\n", err)
-				return echo.NewHTTPError(http.StatusForbidden, "Invalid token")
+			identity, err := authService.RedeemStreamTicket(ticket, c.Param("id"))
+			if err != nil {
+				log.Printf("Failed to redeem stream ticket: %v\n", err)
+				return echo.NewHTTPError(http.StatusForbidden, "Invalid stream ticket")
 			}
 
-			// Check the claims for userID
-			claims, ok := token.Claims.(jwt.MapClaims)
-			if !ok {
-				return echo.NewHTTPError(http.StatusInternalServerError, "Token claims are not accessible")
+			c.Set("userID", identity.UserID)
+			c.Set("identity", identity)
+			return next(c)
+		}
+	}
+}
+
+// authenticate validates a token and sets the userID of the request
+// It returns the HTTP error to respond with if the token is not valid
+func authenticate(c echo.Context, authService interfaces.IAuthService, tokenString string) error {
+	// Check if token is valid using the auth service
+	identity, err := authService.ValidateToken(tokenString)
+	if err != nil {
+		log.Printf("Failed to validate token: %v\n", err)
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid token")
+	}
+
+	c.Set("userID", identity.UserID)
+	c.Set("identity", identity)
+	return nil
+}
+
+// RequireScope is a middleware that checks the token of the request grants a scope
+// It runs after the authentication, the tokens of a login session grant every scope
+func RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identity, ok := c.Get("identity").(*auth.Identity)
+			if !ok || !identity.HasScope(scope) {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="insufficient_scope", scope="`+scope+`"`)
+				return echo.NewHTTPError(http.StatusForbidden, "Insufficient scope")
 			}
-			userID, ok := claims["user_id"].(string)
-			if !ok {
-				return echo.NewHTTPError(http.StatusInternalServerError, "Token claims are not accessible")
+			return next(c)
+		}
+	}
+}
+
+// RequireVerifiedEmail is a middleware that stops the users the user service
+// restricts until they verify their email address
+// Its verification policy decides who they are, so both services always agree
+// It runs after the authentication
+func RequireVerifiedEmail() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identity, ok := c.Get("identity").(*auth.Identity)
+			if !ok || identity.VerificationRequired {
+				return echo.NewHTTPError(http.StatusForbidden, "Email address is not verified")
 			}
+			return next(c)
+		}
+	}
+}
 
-			c.Set("userID", userID)
+// RequireSession is a middleware that only lets through the tokens of a login session
+// It runs after the authentication, personal access tokens are refused
+func RequireSession() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identity, ok := c.Get("identity").(*auth.Identity)
+			if !ok || !identity.Session {
+				return echo.NewHTTPError(http.StatusForbidden, "This route requires a login session")
+			}
 			return next(c)
 		}
 	}
@@ -0,0 +1,116 @@
+package interceptor
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"optimizer-service/cmd/internal/auth"
+	"optimizer-service/cmd/lib/mocks"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRequireScope(t *testing.T) {
+	authService := new(mocks.MockAuthService)
+	authService.On("ValidateToken", "session").Return(&auth.Identity{UserID: "user-id", Session: true}, nil)
+	authService.On("ValidateToken", "pat_read").Return(&auth.Identity{UserID: "user-id", Scopes: []string{auth.ScopeFilesRead}}, nil)
+	authService.On("ValidateToken", "invalid").Return(nil, errors.New("Invalid token"))
+
+	e := echo.New()
+	ok := func(c echo.Context) error { return c.String(http.StatusOK, c.Get("userID").(string)) }
+	group := e.Group("/protected", AuthenticationMiddleware(authService))
+	group.GET("/files", ok, RequireScope(auth.ScopeFilesRead))
+	group.POST("/upload", ok, RequireScope(auth.ScopeFilesWrite))
+	group.GET("/webhooks", ok, RequireSession())
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{http.MethodGet, "/protected/files", "session", http.StatusOK},
+		{http.MethodPost, "/protected/upload", "session", http.StatusOK},
+		{http.MethodGet, "/protected/webhooks", "session", http.StatusOK},
+		{http.MethodGet, "/protected/files", "pat_read", http.StatusOK},
+		{http.MethodPost, "/protected/upload", "pat_read", http.StatusForbidden},
+		{http.MethodGet, "/protected/webhooks", "pat_read", http.StatusForbidden},
+		{http.MethodGet, "/protected/files", "invalid", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		assert.Equal(t, tt.status, rec.Code, tt.method+" "+tt.path+" with "+tt.token)
+		if tt.status == http.StatusOK {
+			assert.Equal(t, "user-id", rec.Body.String())
+		}
+	}
+
+	// Clients are told which scope they lack
+	req := httptest.NewRequest(http.MethodPost, "/protected/upload", nil)
+	req.Header.Set("Authorization", "Bearer pat_read")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, `Bearer error="insufficient_scope", scope="files:write"`, rec.Header().Get(echo.HeaderWWWAuthenticate))
+}
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	authService := new(mocks.MockAuthService)
+	authService.On("ValidateToken", "verified").Return(&auth.Identity{UserID: "user-id", Session: true, EmailVerified: true}, nil)
+	authService.On("ValidateToken", "unverified").Return(&auth.Identity{UserID: "user-id", Session: true, VerificationRequired: true}, nil)
+	// The verification policy of the user service does not restrict every unverified user
+	authService.On("ValidateToken", "unrestricted").Return(&auth.Identity{UserID: "user-id", Session: true}, nil)
+
+	e := echo.New()
+	ok := func(c echo.Context) error { return c.String(http.StatusOK, c.Get("userID").(string)) }
+	e.POST("/protected/upload", ok, AuthenticationMiddleware(authService), RequireVerifiedEmail())
+
+	for token, status := range map[string]int{"verified": http.StatusOK, "unverified": http.StatusForbidden, "unrestricted": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodPost, "/protected/upload", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, status, rec.Code, token)
+	}
+}
+
+func TestStreamAuthenticationMiddleware(t *testing.T) {
+	authService := new(mocks.MockAuthService)
+	authService.On("ValidateToken", "session").Return(&auth.Identity{UserID: "user-id", Session: true}, nil)
+	authService.On("RedeemStreamTicket", "ticket", "file-id").Return(&auth.Identity{UserID: "user-id", Scopes: []string{auth.ScopeFilesRead}}, nil)
+	authService.On("RedeemStreamTicket", mock.Anything, mock.Anything).Return(nil, errors.New("Stream ticket is not valid"))
+
+	e := echo.New()
+	ok := func(c echo.Context) error { return c.String(http.StatusOK, c.Get("userID").(string)) }
+	e.GET("/protected/files/:id/events", ok, StreamAuthenticationMiddleware(authService))
+
+	tests := []struct {
+		query  string
+		header string
+		status int
+	}{
+		{"?ticket=ticket", "", http.StatusOK},
+		{"", "Bearer session", http.StatusOK},
+		{"?ticket=other", "", http.StatusForbidden},
+		// Bearer tokens are not read from the query, where they would be logged
+		{"?access_token=session", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/protected/files/file-id/events"+tt.query, nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, tt.status, rec.Code, tt.query+tt.header)
+	}
+	authService.AssertNotCalled(t, "ValidateToken", "ticket")
+}
@@ -2,32 +2,103 @@ package interfaces
 
 import (
 	"io"
+	"optimizer-service/cmd/internal/auth"
 	"optimizer-service/cmd/internal/models"
-
-	"github.com/golang-jwt/jwt"
+	"time"
 )
 
 // IAuthRepository is an interface for the auth repository
 // It defines the methods that the auth repository should implement
 type IAuthRepository interface {
-	LoginWithREST(email, password string) (interface{}, error)
-	ValidateToken(token string) (interface{}, error)
+	LoginWithREST(email, password, clientIP string) (*models.LoginResult, error)
+	Introspect(token string) (*models.TokenIntrospection, error)
+	CreateStreamTicket(ticket *models.StreamTicket) error
+	RedeemStreamTicket(id string, now time.Time) (*models.StreamTicket, error)
+	DeleteExpiredStreamTickets(now time.Time) error
 }
 
 // IAuthService is an interface for the auth service
 // It defines the methods that the auth service should implement
 type IAuthService interface {
-	Login(email string, password string) (interface{}, error)
-	ValidateToken(token string) (*jwt.Token, error)
+	Login(email, password, clientIP string) (*models.LoginResult, error)
+	ValidateToken(token string) (*auth.Identity, error)
+	IssueStreamTicket(userID, fileID string) (string, time.Duration, error)
+	RedeemStreamTicket(ticket, fileID string) (*auth.Identity, error)
 }
 
 // IFileService is an interface for the file service
 // It defines the methods that the file service should implement
 type IFileService interface {
 	UploadFile(userID string, fileData io.Reader, fileName string) (*models.File, error)
+	GetFile(id string) (*models.File, error)
+	OptimizeFile(id string) (*models.File, error)
+	OpenDownload(file *models.File, acceptEncoding string) (io.ReadCloser, string, error)
+	DeleteFile(file *models.File) error
 }
 
 // IFileRepository is an interface for the file repository
 type IFileRepository interface {
 	CreateFile(file *models.File) error
+	GetFile(id string) (*models.File, error)
+	UpdateFile(file *models.File) error
+	DeleteFile(file *models.File) error
+	GetOptimizationSettings(fileType string) (*models.OptimizationSettings, error)
+}
+
+// IUserRepository is an interface for the user repository
+// It looks users up in the user service
+type IUserRepository interface {
+	GetUser(userID string) (*models.User, error)
+}
+
+// INotificationRepository is an interface for the notification repository
+type INotificationRepository interface {
+	GetPreference(userID string) (*models.NotificationPreference, error)
+	SavePreference(preference *models.NotificationPreference) error
+}
+
+// INotificationService is an interface for the notification service
+// It defines the methods that the notification service should implement
+type INotificationService interface {
+	GetPreference(userID string) (*models.NotificationPreference, error)
+	UpdatePreference(userID string, emailOptOut bool) (*models.NotificationPreference, error)
+}
+
+// IWebhookRepository is an interface for the webhook repository
+type IWebhookRepository interface {
+	CreateWebhook(webhook *models.Webhook) error
+	GetWebhook(id string) (*models.Webhook, error)
+	GetWebhooks(userID string) ([]models.Webhook, error)
+	DeleteWebhook(id string) error
+	CreateDelivery(delivery *models.WebhookDelivery) error
+	GetDelivery(id string) (*models.WebhookDelivery, error)
+	GetDeliveries(webhookID string) ([]models.WebhookDelivery, error)
+	ClaimDueDeliveries(now time.Time, lease time.Duration, limit int) ([]models.WebhookDelivery, error)
+	UpdateDelivery(delivery *models.WebhookDelivery) error
+}
+
+// IWebhookService is an interface for the webhook service
+// It defines the methods that the webhook service should implement
+type IWebhookService interface {
+	CreateWebhook(userID, url string, events []string) (*models.Webhook, error)
+	GetWebhooks(userID string) ([]models.Webhook, error)
+	GetWebhook(userID, id string) (*models.Webhook, error)
+	DeleteWebhook(userID, id string) error
+	GetDeliveries(userID, webhookID string) ([]models.WebhookDelivery, error)
+	Redeliver(userID, webhookID, deliveryID string) (*models.WebhookDelivery, error)
+}
+
+// IOutboxRepository is an interface for the outbox repository
+type IOutboxRepository interface {
+	ClaimEvents(now time.Time, lease time.Duration, limit int) ([]models.OutboxEvent, error)
+	GetConsumptions(eventID string) (map[string]*models.OutboxConsumption, error)
+	SaveConsumption(consumption *models.OutboxConsumption) error
+	MarkPublished(eventID string, at time.Time) error
+	Reschedule(eventID string, until time.Time) error
+}
+
+// IFileEventBroker is an interface for the broker of file status and progress updates
+type IFileEventBroker interface {
+	Publish(event models.FileEvent)
+	Subscribe(fileID string) (<-chan models.FileEvent, func())
 }
@@ -2,132 +2,65 @@
 package repositories
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
-	"log"
-	"net/http"
-	"optimizer-service/cmd/internal/types"
+	"optimizer-service/cmd/internal/models"
+	"optimizer-service/cmd/internal/userclient"
+	"time"
 
 	"gorm.io/gorm"
 )
 
 // AuthRepository is a struct that defines the auth repository
+// It authenticates users with the user service
 type AuthRepository struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	Client *userclient.Client
 }
 
 // NewAuthRepository creates a new instance of AuthRepository
-func NewAuthRepository(db *gorm.DB) *AuthRepository {
-	return &AuthRepository{DB: db}
+// It takes the client of the user service as input
+func NewAuthRepository(db *gorm.DB, client *userclient.Client) *AuthRepository {
+	return &AuthRepository{DB: db, Client: client}
 }
 
-// @note: We Can establish any kind of communication we want here,
-// with the user service or any other service
-
-// Should return user type or error
-func (r *AuthRepository) LoginWithREST(email, password string) (interface{}, error) {
-	userServiceUrl := "http://user-service:8080/login"
-
-	loginPayload := types.LoginInput{
-		Email:    email,
-		Password: password,
-	}
-
-	// Converting the payload to bytes, by marshalling it
-	payloadBytes, err := json.Marshal(loginPayload)
-
-	if err != nil {
-		log.Println(err)
-		return "", err
-	}
-
-	// Setting up the request
-	req, err := http.NewRequest(http.MethodPost, userServiceUrl, bytes.NewBuffer(payloadBytes))
-
-	if err != nil {
-		log.Println(err)
-		return "", err
-	}
-
-	// Setting the headers
-	req.Header.Set("Content-Type", "application/json")
-
-	//Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Println(err)
-		return "", err
-	}
-
-	// Close the response body
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", errors.New("Invalid credentials")
-	}
-
-	var responsePayload types.ResponsePayload
-
-	// read the response body and unmarshal it
-	err = json.NewDecoder(resp.Body).Decode(&responsePayload)
-	if err != nil {
-		log.Println(err)
-		return "", err
-	}
-
-	return responsePayload.Data, nil
+// LoginWithREST logs a user in with the user service, for a client at clientIP
+// It returns the tokens of the user and an error
+func (r *AuthRepository) LoginWithREST(email, password, clientIP string) (*models.LoginResult, error) {
+	return r.Client.Login(email, password, clientIP)
 }
 
-// Would validate the token and return a interface and error
-// @note: We Can establish any kind of communication we want here,
-func (r *AuthRepository) ValidateToken(token string) (interface{}, error) {
-	validateUrl := "http://user-service:8080/validate"
-
-	//get the token from the arg
-	var requestPayload map[string]string
-	requestPayload = make(map[string]string)
-	requestPayload["token"] = token
+// Introspect asks the user service whether a token is still active
+// It returns the introspection and an error if the user service could not answer
+func (r *AuthRepository) Introspect(token string) (*models.TokenIntrospection, error) {
+	return r.Client.Introspect(token)
+}
 
-	// Converting the payload to bytes, by marshalling it
-	payloadBytes, err := json.Marshal(requestPayload)
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
+// CreateStreamTicket stores a stream ticket
+// It returns an error if the ticket could not be stored
+func (r *AuthRepository) CreateStreamTicket(ticket *models.StreamTicket) error {
+	return r.DB.Create(ticket).Error
+}
 
-	//CReate Post request
-	req, err := http.NewRequest(http.MethodPost, validateUrl, bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		log.Println(err)
+// RedeemStreamTicket deletes a stream ticket that has not expired
+// The delete is conditional, so of two requests redeeming the same ticket only one gets it
+// It returns the ticket, or gorm.ErrRecordNotFound if it does not exist, expired or was redeemed
+func (r *AuthRepository) RedeemStreamTicket(id string, now time.Time) (*models.StreamTicket, error) {
+	var ticket models.StreamTicket
+	if err := r.DB.Where("id = ? AND expires_at > ?", id, now).First(&ticket).Error; err != nil {
 		return nil, err
 	}
 
-	//Set the header
-	req.Header.Set("Content-Type", "application/json")
-
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Println(err)
-		return nil, err
+	result := r.DB.Where("id = ?", id).Delete(&models.StreamTicket{})
+	if result.Error != nil {
+		return nil, result.Error
 	}
-
-	//close the response body
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("Invalid token")
+	if result.RowsAffected != 1 {
+		return nil, gorm.ErrRecordNotFound
 	}
+	return &ticket, nil
+}
 
-	var responsePayload types.ResponsePayload
-
-	err = json.NewDecoder(resp.Body).Decode(&responsePayload)
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
-	return responsePayload.Data, nil
+// DeleteExpiredStreamTickets deletes the tickets that were never redeemed
+// It returns an error if they could not be deleted
+func (r *AuthRepository) DeleteExpiredStreamTickets(now time.Time) error {
+	return r.DB.Where("expires_at <= ?", now).Delete(&models.StreamTicket{}).Error
 }
@@ -3,6 +3,7 @@ package repositories
 
 import (
 	"optimizer-service/cmd/internal/models"
+	"strings"
 
 	"gorm.io/gorm"
 )
@@ -22,9 +23,14 @@ func NewFileRepository(db *gorm.DB) *FileRepository {
 
 // CreateFile creates a new file
 // It takes a file as input
-// GetFile retrieves a file by its ID
+// The file.uploaded event is written to the outbox in the same transaction
 func (r *FileRepository) CreateFile(file *models.File) error {
-	return r.DB.Create(file).Error
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(file).Error; err != nil {
+			return err
+		}
+		return writeOutboxEvent(tx, file, models.EventFileUploaded)
+	})
 }
 
 // GetFile retrieves a file by its ID
@@ -32,6 +38,47 @@ func (r *FileRepository) CreateFile(file *models.File) error {
 // It returns a file and an error
 func (r *FileRepository) GetFile(id string) (*models.File, error) {
 	var file models.File
-	result := r.DB.First(&file, id)
-	return &file, result.Error
+	if err := r.DB.Preload("Encodings").First(&file, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// UpdateFile saves the changes made to a file
+// New encodings attached to the file are created as well
+// The event of the file status is written to the outbox in the same transaction
+// It returns an error if the operation fails
+func (r *FileRepository) UpdateFile(file *models.File) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(file).Error; err != nil {
+			return err
+		}
+		return writeOutboxEvent(tx, file, models.EventForStatus(file.Status))
+	})
+}
+
+// GetOptimizationSettings retrieves the optimization settings for a file type
+// It takes a file extension as input
+// It returns the settings and an error
+func (r *FileRepository) GetOptimizationSettings(fileType string) (*models.OptimizationSettings, error) {
+	var settings models.OptimizationSettings
+	if err := r.DB.Where("file_type = ?", strings.ToLower(fileType)).First(&settings).Error; err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// DeleteFile deletes a file and its encodings
+// The file.deleted event is written to the outbox in the same transaction
+// It returns an error if the operation fails
+func (r *FileRepository) DeleteFile(file *models.File) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("file_id = ?", file.ID).Delete(&models.FileEncoding{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(file).Error; err != nil {
+			return err
+		}
+		return writeOutboxEvent(tx, file, models.EventFileDeleted)
+	})
 }
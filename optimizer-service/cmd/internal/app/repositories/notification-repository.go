@@ -0,0 +1,41 @@
+// Package repositories
+package repositories
+
+import (
+	"errors"
+	"optimizer-service/cmd/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// NotificationRepository is a struct for the notification repository
+// It implements the INotificationRepository interface
+type NotificationRepository struct {
+	DB *gorm.DB
+}
+
+// NewNotificationRepository creates a new notification repository
+// It returns a pointer to the notification repository
+func NewNotificationRepository(db *gorm.DB) *NotificationRepository {
+	return &NotificationRepository{DB: db}
+}
+
+// GetPreference retrieves the notification preference of a user
+// It returns nil and no error when the user has not set one
+func (r *NotificationRepository) GetPreference(userID string) (*models.NotificationPreference, error) {
+	var preference models.NotificationPreference
+	err := r.DB.First(&preference, "user_id = ?", userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &preference, nil
+}
+
+// SavePreference creates or updates the notification preference of a user
+// It returns an error if the operation fails
+func (r *NotificationRepository) SavePreference(preference *models.NotificationPreference) error {
+	return r.DB.Save(preference).Error
+}
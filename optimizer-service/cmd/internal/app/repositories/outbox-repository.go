@@ -0,0 +1,112 @@
+// Package repositories
+package repositories
+
+import (
+	"encoding/json"
+	"optimizer-service/cmd/internal/models"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OutboxRepository is a struct for the outbox repository
+// It implements the IOutboxRepository interface
+type OutboxRepository struct {
+	DB *gorm.DB
+}
+
+// NewOutboxRepository creates a new outbox repository
+// It returns a pointer to the outbox repository
+func NewOutboxRepository(db *gorm.DB) *OutboxRepository {
+	return &OutboxRepository{DB: db}
+}
+
+// writeOutboxEvent writes an event about a file to the outbox
+// It takes the transaction the file is changed in as input
+func writeOutboxEvent(tx *gorm.DB, file *models.File, eventType models.EventType) error {
+	payload, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	return tx.Create(&models.OutboxEvent{
+		ID:      uuid.New().String(),
+		FileID:  file.ID,
+		UserID:  file.UserID,
+		Type:    eventType,
+		Payload: string(payload),
+	}).Error
+}
+
+// ClaimEvents locks unpublished events for a relay, oldest first
+// An event is only claimed by one relay until the lease runs out,
+// so relays on several replicas do not process the same event at once
+// It takes the current time, the lease and the maximum number of events as input
+func (r *OutboxRepository) ClaimEvents(now time.Time, lease time.Duration, limit int) ([]models.OutboxEvent, error) {
+	var candidates []models.OutboxEvent
+	err := r.DB.
+		Where("published_at IS NULL AND (locked_until IS NULL OR locked_until <= ?)", now).
+		Order("created_at, id").
+		Limit(limit).
+		Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	until := now.Add(lease)
+	claimed := make([]models.OutboxEvent, 0, len(candidates))
+	for _, event := range candidates {
+		// Only one relay can move the lock from what it read
+		result := r.DB.Model(&models.OutboxEvent{}).
+			Where("id = ? AND published_at IS NULL AND (locked_until IS NULL OR locked_until <= ?)", event.ID, now).
+			Update("locked_until", until)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			event.LockedUntil = &until
+			claimed = append(claimed, event)
+		}
+	}
+
+	return claimed, nil
+}
+
+// GetConsumptions retrieves what the sinks did with an event
+// It returns the consumptions by sink name and an error
+func (r *OutboxRepository) GetConsumptions(eventID string) (map[string]*models.OutboxConsumption, error) {
+	var consumptions []models.OutboxConsumption
+	if err := r.DB.Where("event_id = ?", eventID).Find(&consumptions).Error; err != nil {
+		return nil, err
+	}
+
+	bySink := make(map[string]*models.OutboxConsumption, len(consumptions))
+	for i := range consumptions {
+		bySink[consumptions[i].Sink] = &consumptions[i]
+	}
+	return bySink, nil
+}
+
+// SaveConsumption creates or updates what a sink did with an event
+// It returns an error if the operation fails
+func (r *OutboxRepository) SaveConsumption(consumption *models.OutboxConsumption) error {
+	return r.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(consumption).Error
+}
+
+// MarkPublished records that every sink is done with an event
+// It returns an error if the operation fails
+func (r *OutboxRepository) MarkPublished(eventID string, at time.Time) error {
+	return r.DB.Model(&models.OutboxEvent{}).
+		Where("id = ?", eventID).
+		Updates(map[string]interface{}{"published_at": at, "locked_until": nil}).Error
+}
+
+// Reschedule releases an event until it is due again
+// It returns an error if the operation fails
+func (r *OutboxRepository) Reschedule(eventID string, until time.Time) error {
+	return r.DB.Model(&models.OutboxEvent{}).
+		Where("id = ?", eventID).
+		Update("locked_until", until).Error
+}
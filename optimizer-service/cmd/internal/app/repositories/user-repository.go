@@ -0,0 +1,26 @@
+// Package repositories
+package repositories
+
+import (
+	"optimizer-service/cmd/internal/models"
+	"optimizer-service/cmd/internal/userclient"
+)
+
+// UserRepository is a struct for the user repository
+// It looks users up in the user service
+// It implements the IUserRepository interface
+type UserRepository struct {
+	Client *userclient.Client
+}
+
+// NewUserRepository creates a new user repository
+// It takes the client of the user service as input
+func NewUserRepository(client *userclient.Client) *UserRepository {
+	return &UserRepository{Client: client}
+}
+
+// GetUser retrieves the contact details of a user from the user service
+// It returns the user and an error
+func (r *UserRepository) GetUser(userID string) (*models.User, error) {
+	return r.Client.GetUser(userID)
+}
@@ -0,0 +1,127 @@
+// Package repositories
+package repositories
+
+import (
+	"optimizer-service/cmd/internal/models"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// WebhookRepository is a struct for the webhook repository
+// It implements the IWebhookRepository interface
+type WebhookRepository struct {
+	DB *gorm.DB
+}
+
+// NewWebhookRepository creates a new webhook repository
+// It returns a pointer to the webhook repository
+func NewWebhookRepository(db *gorm.DB) *WebhookRepository {
+	return &WebhookRepository{DB: db}
+}
+
+// CreateWebhook creates a new webhook
+// It returns an error if the operation fails
+func (r *WebhookRepository) CreateWebhook(webhook *models.Webhook) error {
+	return r.DB.Create(webhook).Error
+}
+
+// GetWebhook retrieves a webhook by its ID
+// It returns the webhook and an error
+func (r *WebhookRepository) GetWebhook(id string) (*models.Webhook, error) {
+	var webhook models.Webhook
+	if err := r.DB.First(&webhook, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// GetWebhooks retrieves the webhooks of a user
+// It returns the webhooks and an error
+func (r *WebhookRepository) GetWebhooks(userID string) ([]models.Webhook, error) {
+	var webhooks []models.Webhook
+	if err := r.DB.Where("user_id = ?", userID).Order("created_at").Find(&webhooks).Error; err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes a webhook and its delivery log
+// It returns an error if the operation fails
+func (r *WebhookRepository) DeleteWebhook(id string) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", id).Delete(&models.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.Webhook{}, "id = ?", id).Error
+	})
+}
+
+// CreateDelivery creates a new delivery
+// A delivery that already exists is left as it is
+// It returns an error if the operation fails
+func (r *WebhookRepository) CreateDelivery(delivery *models.WebhookDelivery) error {
+	return r.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(delivery).Error
+}
+
+// GetDelivery retrieves a delivery by its ID
+// It returns the delivery and an error
+func (r *WebhookRepository) GetDelivery(id string) (*models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	if err := r.DB.First(&delivery, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// GetDeliveries retrieves the delivery log of a webhook, newest first
+// It returns the deliveries and an error
+func (r *WebhookRepository) GetDeliveries(webhookID string) ([]models.WebhookDelivery, error) {
+	var deliveries []models.WebhookDelivery
+	if err := r.DB.Where("webhook_id = ?", webhookID).Order("created_at desc").Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// ClaimDueDeliveries claims pending deliveries whose next attempt is due
+// A claimed delivery's next attempt is moved to the end of the lease, so
+// dispatchers on several replicas do not post the same delivery, and one
+// that stops before recording the outcome is retried once the lease runs out
+// It takes the current time, the lease and the maximum number of deliveries as input
+func (r *WebhookRepository) ClaimDueDeliveries(now time.Time, lease time.Duration, limit int) ([]models.WebhookDelivery, error) {
+	var candidates []models.WebhookDelivery
+	err := r.DB.
+		Where("status = ? AND next_attempt_at <= ?", models.DeliveryPending, now).
+		Order("next_attempt_at").
+		Limit(limit).
+		Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	until := now.Add(lease)
+	claimed := make([]models.WebhookDelivery, 0, len(candidates))
+	for _, delivery := range candidates {
+		// Only one dispatcher can move the next attempt from what it read
+		result := r.DB.Model(&models.WebhookDelivery{}).
+			Where("id = ? AND status = ? AND next_attempt_at <= ?", delivery.ID, models.DeliveryPending, now).
+			Update("next_attempt_at", until)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			delivery.NextAttemptAt = &until
+			claimed = append(claimed, delivery)
+		}
+	}
+
+	return claimed, nil
+}
+
+// UpdateDelivery saves the changes made to a delivery
+// It returns an error if the operation fails
+func (r *WebhookRepository) UpdateDelivery(delivery *models.WebhookDelivery) error {
+	return r.DB.Save(delivery).Error
+}
@@ -2,58 +2,240 @@
 package service
 
 import (
-	"fmt"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"optimizer-service/cmd/internal/app/interfaces"
+	"optimizer-service/cmd/internal/auth"
+	"optimizer-service/cmd/internal/models"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang-jwt/jwt"
-	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
 )
 
+// Defaults for the introspection cache
+const (
+	DefaultIntrospectionCacheTTL = 30 * time.Second
+	DefaultIntrospectionCacheMax = 10000
+)
+
+// DefaultStreamTicketTTL is how long a stream ticket can be redeemed
+const DefaultStreamTicketTTL = 30 * time.Second
+
+// Personal access tokens are told apart by their prefix and their introspected type
+const (
+	personalAccessTokenPrefix = "pat_"
+	personalAccessTokenType   = "personal_access_token"
+)
+
+// ErrTokenInactive is returned when the user service no longer accepts a token
+var ErrTokenInactive = errors.New("Token is not active")
+
+// ErrInvalidStreamTicket is returned for a stream ticket that expired, was used or is for another file
+var ErrInvalidStreamTicket = errors.New("Stream ticket is not valid")
+
+// cachedIntrospection is an introspection and when it stops being used
+type cachedIntrospection struct {
+	introspection *models.TokenIntrospection
+	expiresAt     time.Time
+}
+
 // AuthService is a service for the auth repository
 // It defines the methods that the auth service should implement
 type AuthService struct {
 	Repo interfaces.IAuthRepository
+	JWT  *auth.Config
+
+	// CacheTTL is how long an introspection is reused, zero disables the cache
+	CacheTTL time.Duration
+	// CacheMax bounds the number of cached introspections
+	CacheMax int
+	// StreamTicketTTL is how long a stream ticket can be redeemed
+	StreamTicketTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedIntrospection
+	now   func() time.Time
 }
 
 // NewAuthService creates a new auth service
+// It verifies the tokens with the JWT configuration of the user service
 // It returns a new auth service
-func NewAuthService(r interfaces.IAuthRepository) *AuthService {
+func NewAuthService(r interfaces.IAuthRepository, jwtConfig *auth.Config) *AuthService {
 	return &AuthService{
-		Repo: r,
+		Repo:            r,
+		JWT:             jwtConfig,
+		CacheTTL:        DefaultIntrospectionCacheTTL,
+		CacheMax:        DefaultIntrospectionCacheMax,
+		StreamTicketTTL: DefaultStreamTicketTTL,
+		cache:           make(map[string]cachedIntrospection),
+		now:             time.Now,
 	}
 }
 
-// Login logs in a user
-// It returns the token if the login is successful
-func (a *AuthService) Login(email, password string) (interface{}, error) {
-	return a.Repo.LoginWithREST(email, password)
+// Login logs in a user for a client at clientIP
+// It returns the tokens if the login is successful
+func (a *AuthService) Login(email, password, clientIP string) (*models.LoginResult, error) {
+	return a.Repo.LoginWithREST(email, password, clientIP)
 }
 
-// ValidateToken validates the JWT token
-// It returns the token if it is valid
-func (a *AuthService) ValidateToken(token string) (*jwt.Token, error) {
-	fmt.Printf("Validating token: %s\n", token)
+// ValidateToken validates the token of a request
+// The signature and claims of JWT tokens are checked locally, then the user
+// service is asked whether the token is still active, so revoked tokens are
+// rejected. Personal access tokens are opaque and only introspected
+// A missing configuration or an unreachable user service rejects every token
+// It returns who the token was issued to and an error if it is not valid
+func (a *AuthService) ValidateToken(token string) (*auth.Identity, error) {
+	if strings.HasPrefix(token, personalAccessTokenPrefix) {
+		return a.validatePersonalAccessToken(token)
+	}
+
+	parsed, err := a.JWT.Parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, _ := parsed.Claims.(jwt.MapClaims)
+	userID, _ := claims["user_id"].(string)
+	if userID == "" {
+		return nil, auth.ErrInvalidClaims
+	}
 
-	validatedToken, err := validatesJWTToken(token)
+	introspection, err := a.introspect(token)
 	if err != nil {
 		return nil, err
 	}
+	if !introspection.Active || introspection.Sub != userID || introspection.TokenType == personalAccessTokenType {
+		return nil, ErrTokenInactive
+	}
+	return &auth.Identity{
+		UserID:               userID,
+		Session:              true,
+		EmailVerified:        introspection.EmailVerified,
+		VerificationRequired: introspection.VerificationRequired,
+	}, nil
+}
 
-	return validatedToken, nil
+// validatePersonalAccessToken validates a personal access token with the user service
+// It returns who the token was issued to, with its scopes, and an error if it is not valid
+func (a *AuthService) validatePersonalAccessToken(token string) (*auth.Identity, error) {
+	introspection, err := a.introspect(token)
+	if err != nil {
+		return nil, err
+	}
+	if !introspection.Active || introspection.Sub == "" || introspection.TokenType != personalAccessTokenType {
+		return nil, ErrTokenInactive
+	}
+	return &auth.Identity{
+		UserID:               introspection.Sub,
+		Scopes:               strings.Fields(introspection.Scope),
+		EmailVerified:        introspection.EmailVerified,
+		VerificationRequired: introspection.VerificationRequired,
+	}, nil
 }
 
-// validatesJWTToken validates the JWT token
-// It returns the token if it is valid
-func validatesJWTToken(tokenString string) (*jwt.Token, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Ensure the token method conform to "SigningMethodHMAC"
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, echo.NewHTTPError(401, "Invalid token")
-		}
-		return []byte("secret"), nil
+// IssueStreamTicket issues a ticket to open the event stream of a file once
+// Only the hash of the ticket is stored
+// It returns the ticket, how long it can be redeemed and an error
+func (a *AuthService) IssueStreamTicket(userID, fileID string) (string, time.Duration, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", 0, err
+	}
+	ticket := hex.EncodeToString(secret)
+
+	now := a.now()
+	// Tickets that were never redeemed are dropped as new ones are issued
+	if err := a.Repo.DeleteExpiredStreamTickets(now); err != nil {
+		return "", 0, err
+	}
+
+	err := a.Repo.CreateStreamTicket(&models.StreamTicket{
+		ID:        hashToken(ticket),
+		UserID:    userID,
+		FileID:    fileID,
+		ExpiresAt: now.Add(a.StreamTicketTTL),
 	})
+	if err != nil {
+		return "", 0, err
+	}
+	return ticket, a.StreamTicketTTL, nil
+}
+
+// RedeemStreamTicket redeems a stream ticket for the event stream of a file
+// A ticket can only be redeemed once, before it expires
+// It returns who the ticket was issued to, allowed to read files only,
+// and ErrInvalidStreamTicket if it cannot be redeemed for the file
+func (a *AuthService) RedeemStreamTicket(ticket, fileID string) (*auth.Identity, error) {
+	redeemed, err := a.Repo.RedeemStreamTicket(hashToken(ticket), a.now())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidStreamTicket
+	}
+	if err != nil {
+		return nil, err
+	}
+	if redeemed.FileID != fileID {
+		return nil, ErrInvalidStreamTicket
+	}
+	return &auth.Identity{UserID: redeemed.UserID, Scopes: []string{auth.ScopeFilesRead}}, nil
+}
+
+// hashToken returns the SHA-256 hash of a token, as hex
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// introspect returns the introspection of a token
+// Results are cached for CacheTTL, but never past the expiry of the token
+// It returns the introspection and an error if the user service could not answer
+func (a *AuthService) introspect(token string) (*models.TokenIntrospection, error) {
+	if a.CacheTTL <= 0 {
+		return a.Repo.Introspect(token)
+	}
+
+	key := hashToken(token)
+	now := a.now()
+
+	a.mu.Lock()
+	cached, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.introspection, nil
+	}
+
+	introspection, err := a.Repo.Introspect(token)
 	if err != nil {
 		return nil, err
 	}
-	return token, nil
+
+	expiresAt := now.Add(a.CacheTTL)
+	if introspection.Exp > 0 && time.Unix(introspection.Exp, 0).Before(expiresAt) {
+		expiresAt = time.Unix(introspection.Exp, 0)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.cache) >= a.CacheMax {
+		a.evict(now)
+	}
+	a.cache[key] = cachedIntrospection{introspection: introspection, expiresAt: expiresAt}
+	return introspection, nil
+}
+
+// evict drops the expired introspections, or all of them if none expired
+// The lock must be held
+func (a *AuthService) evict(now time.Time) {
+	for key, cached := range a.cache {
+		if !now.Before(cached.expiresAt) {
+			delete(a.cache, key)
+		}
+	}
+	if len(a.cache) >= a.CacheMax {
+		a.cache = make(map[string]cachedIntrospection)
+	}
 }
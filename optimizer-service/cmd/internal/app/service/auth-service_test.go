@@ -0,0 +1,250 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"optimizer-service/cmd/internal/app/repositories"
+	"optimizer-service/cmd/internal/auth"
+	"optimizer-service/cmd/internal/models"
+	"optimizer-service/cmd/internal/userclient"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+// staticKey is a KeySource with a single key
+type staticKey struct {
+	key *auth.Key
+}
+
+func (s staticKey) Key(kid string) (*auth.Key, error) {
+	if kid != s.key.ID {
+		return nil, auth.ErrUnknownKey
+	}
+	return s.key, nil
+}
+
+// introspectionServer is a user service answering /introspect
+type introspectionServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	active   map[string]bool
+	verified bool
+	requests int
+}
+
+func newIntrospectionServer(t *testing.T) *introspectionServer {
+	s := &introspectionServer{active: map[string]bool{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if r.URL.Path == "/oauth/token" {
+			if id, secret, _ := r.BasicAuth(); id != "optimizer-service" || secret != "service-secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "service-token", "expires_in": 300})
+			return
+		}
+		if r.URL.Path != "/introspect" || r.Header.Get("Authorization") != "Bearer service-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.requests++
+
+		introspection := models.TokenIntrospection{}
+		token := r.FormValue("token")
+		if s.active[token] {
+			introspection = models.TokenIntrospection{Active: true, Sub: "user-id", TokenType: "access_token", Exp: time.Now().Add(time.Hour).Unix()}
+		}
+		introspection.EmailVerified = s.active[token] && s.verified
+		introspection.VerificationRequired = s.active[token] && !s.verified
+		if s.active[token] && strings.HasPrefix(token, "pat_") {
+			introspection.TokenType = "personal_access_token"
+			introspection.Scope = "files:read"
+		}
+		json.NewEncoder(w).Encode(introspection)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *introspectionServer) setActive(token string, active bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active[token] = active
+}
+
+func (s *introspectionServer) setVerified(verified bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verified = verified
+}
+
+func (s *introspectionServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// setUpAuthService returns an auth service introspecting with the server
+// and a function signing valid tokens for it
+func setUpAuthService(t *testing.T, server *introspectionServer) (*AuthService, func() string) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	config := &auth.Config{
+		Keys:     staticKey{key: &auth.Key{ID: "kid", Method: jwt.SigningMethodEdDSA, Public: public}},
+		Issuer:   "user-service",
+		Audience: "optimate",
+	}
+	repo := repositories.NewAuthRepository(nil, userclient.NewClient(server.URL, "optimizer-service", "service-secret"))
+
+	sign := func() string {
+		token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{
+			"user_id": "user-id",
+			"jti":     time.Now().String(),
+			"iss":     "user-service",
+			"aud":     "optimate",
+			"iat":     time.Now().Unix(),
+			"exp":     time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = "kid"
+		signed, err := token.SignedString(private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	return NewAuthService(repo, config), sign
+}
+
+func TestValidateTokenIntrospects(t *testing.T) {
+	server := newIntrospectionServer(t)
+	authService, sign := setUpAuthService(t, server)
+	authService.CacheTTL = 0
+
+	token := sign()
+	server.setActive(token, true)
+	identity, err := authService.ValidateToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user-id", identity.UserID)
+	assert.True(t, identity.Session)
+
+	// A revoked token is rejected although its signature is valid
+	server.setActive(token, false)
+	_, err = authService.ValidateToken(token)
+	assert.ErrorIs(t, err, ErrTokenInactive)
+
+	// Invalid tokens are rejected without asking the user service
+	count := server.requestCount()
+	_, err = authService.ValidateToken("not-a-token")
+	assert.Error(t, err)
+	assert.Equal(t, count, server.requestCount())
+}
+
+func TestValidatePersonalAccessToken(t *testing.T) {
+	server := newIntrospectionServer(t)
+	authService, sign := setUpAuthService(t, server)
+
+	server.setActive("pat_token", true)
+	identity, err := authService.ValidateToken("pat_token")
+	assert.NoError(t, err)
+	assert.Equal(t, "user-id", identity.UserID)
+	assert.False(t, identity.Session)
+	assert.True(t, identity.HasScope(auth.ScopeFilesRead))
+	assert.False(t, identity.HasScope(auth.ScopeFilesWrite))
+
+	_, err = authService.ValidateToken("pat_revoked")
+	assert.ErrorIs(t, err, ErrTokenInactive)
+
+	// A signed token is only a session if the user service says so
+	token := sign()
+	server.setActive(token, true)
+	identity, err = authService.ValidateToken(token)
+	assert.NoError(t, err)
+	assert.True(t, identity.HasScope(auth.ScopePresetsAdmin))
+}
+
+func TestValidateTokenEmailVerified(t *testing.T) {
+	server := newIntrospectionServer(t)
+	authService, sign := setUpAuthService(t, server)
+	authService.CacheTTL = 0
+
+	token := sign()
+	server.setActive(token, true)
+	server.setActive("pat_token", true)
+	for _, tokenString := range []string{token, "pat_token"} {
+		identity, err := authService.ValidateToken(tokenString)
+		assert.NoError(t, err)
+		assert.False(t, identity.EmailVerified)
+		assert.True(t, identity.VerificationRequired)
+	}
+
+	server.setVerified(true)
+	for _, tokenString := range []string{token, "pat_token"} {
+		identity, err := authService.ValidateToken(tokenString)
+		assert.NoError(t, err)
+		assert.True(t, identity.EmailVerified)
+		assert.False(t, identity.VerificationRequired)
+	}
+}
+
+func TestValidateTokenCachesIntrospection(t *testing.T) {
+	server := newIntrospectionServer(t)
+	authService, sign := setUpAuthService(t, server)
+	now := time.Now()
+	authService.now = func() time.Time { return now }
+
+	token := sign()
+	server.setActive(token, true)
+	for i := 0; i < 3; i++ {
+		_, err := authService.ValidateToken(token)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, server.requestCount())
+
+	// A revocation is seen once the cached result expires
+	server.setActive(token, false)
+	now = now.Add(DefaultIntrospectionCacheTTL)
+	_, err := authService.ValidateToken(token)
+	assert.ErrorIs(t, err, ErrTokenInactive)
+	assert.Equal(t, 2, server.requestCount())
+}
+
+func TestIntrospectionCacheIsBounded(t *testing.T) {
+	server := newIntrospectionServer(t)
+	authService, sign := setUpAuthService(t, server)
+	authService.CacheMax = 2
+
+	for i := 0; i < 5; i++ {
+		token := sign()
+		server.setActive(token, true)
+		_, err := authService.ValidateToken(token)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(authService.cache), 2)
+	}
+}
+
+func TestValidateTokenFailsClosed(t *testing.T) {
+	server := newIntrospectionServer(t)
+	authService, sign := setUpAuthService(t, server)
+	token := sign()
+	server.setActive(token, true)
+
+	// The user service rejects our key
+	authService.Repo = repositories.NewAuthRepository(nil, userclient.NewClient(server.URL, "optimizer-service", "wrong-secret"))
+	_, err := authService.ValidateToken(token)
+	assert.Error(t, err)
+
+	// The user service is down
+	server.Close()
+	authService.Repo = repositories.NewAuthRepository(nil, userclient.NewClient(server.URL, "optimizer-service", "service-secret"))
+	_, err = authService.ValidateToken(token)
+	assert.Error(t, err)
+}
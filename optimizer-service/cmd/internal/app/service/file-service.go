@@ -1,29 +1,72 @@
 package service
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"log"
 	"optimizer-service/cmd/internal/app/interfaces"
 	"optimizer-service/cmd/internal/models"
+	"optimizer-service/cmd/internal/optimizer"
 	"optimizer-service/cmd/internal/storage"
 	"path/filepath"
+	"runtime/debug"
+	"strings"
 
 	"github.com/google/uuid"
 )
 
+// jobQueueSize is the number of uploads that can wait for a worker
+const jobQueueSize = 100
+
 // FileService is a struct for the file service
 // It implements the IFileService interface
 type FileService struct {
-	Repo    interfaces.IFileRepository
-	Storage storage.Storage
+	Repo     interfaces.IFileRepository
+	Storage  storage.Storage
+	Pipeline *optimizer.Pipeline
+	Limits   optimizer.Limits
+	Budget   optimizer.Budget
+	Progress interfaces.IFileEventBroker
+	jobs     chan string
 }
 
 // NewFileService creates a new file service
 // It returns a pointer to the file service
 func NewFileService(r interfaces.IFileRepository, storage storage.Storage) *FileService {
 	return &FileService{
-		Repo:    r,
-		Storage: storage,
+		Repo:     r,
+		Storage:  storage,
+		Pipeline: optimizer.NewPipeline(),
+		Limits:   optimizer.DefaultLimits(),
+		Budget:   optimizer.DefaultBudget(),
+		jobs:     make(chan string, jobQueueSize),
+	}
+}
+
+// StartWorkers starts n workers that optimize uploaded files
+// It takes the number of workers as input
+func (s *FileService) StartWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for id := range s.jobs {
+				s.runJob(id)
+			}
+		}()
+	}
+}
+
+// runJob optimizes a queued file
+// A panic is logged instead of taking the worker down with it
+func (s *FileService) runJob(id string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered from panic optimizing file %s: %v\n%s", id, r, debug.Stack())
+		}
+	}()
+
+	if _, err := s.OptimizeFile(id); err != nil {
+		log.Printf("Error optimizing file %s: %v", id, err)
 	}
 }
 
@@ -64,6 +107,7 @@ func (s *FileService) UploadFile(userId string, fileData io.Reader, fileName str
 		ID:           uuid.New().String(),
 		UserID:       userId,
 		OriginalName: uniqueFileName,
+		UploadName:   uploadName(fileName),
 		OriginalPath: targetPath,
 		Type:         filepath.Ext(fileName),
 		Status:       models.StatusUploaded,
@@ -74,6 +118,311 @@ func (s *FileService) UploadFile(userId string, fileData io.Reader, fileName str
 	if err != nil {
 		return nil, err
 	}
+	s.statusChanged(file)
+
+	// Queue the file for optimization, without blocking the upload
+	select {
+	case s.jobs <- file.ID:
+	default:
+		log.Printf("Optimization queue is full, file %s was not queued", file.ID)
+	}
 
 	return file, nil
 }
+
+// uploadName returns the name a file was uploaded with, as it is stored
+// It keeps the base name as valid UTF-8, cut to its column
+func uploadName(fileName string) string {
+	name := []rune(strings.ToValidUTF8(filepath.Base(fileName), "\uFFFD"))
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	return string(name)
+}
+
+// GetFile retrieves a file by its ID
+// It returns a file and an error
+func (s *FileService) GetFile(id string) (*models.File, error) {
+	return s.Repo.GetFile(id)
+}
+
+// OptimizeFile runs the optimizer pipeline for a file
+// It stores the optimized file and, for text-like files,
+// its gzip, brotli and zstd encodings next to it
+// It returns the updated file and an error
+func (s *FileService) OptimizeFile(id string) (*models.File, error) {
+	file, err := s.Repo.GetFile(id)
+	if err != nil {
+		return nil, err
+	}
+
+	file.Status = models.StatusProcessing
+	if err := s.Repo.UpdateFile(file); err != nil {
+		return nil, err
+	}
+	s.statusChanged(file)
+
+	if err := s.optimize(file); err != nil {
+		s.markFailed(file, err)
+		return nil, err
+	}
+
+	file.Status = models.StatusCompleleted
+	file.FailureReason = nil
+	if err := s.Repo.UpdateFile(file); err != nil {
+		// The results may be what could not be saved, so the failure is
+		// recorded on the file as it was before the optimization
+		if stored, getErr := s.Repo.GetFile(id); getErr != nil {
+			log.Printf("Error marking file %s as failed: %v", id, getErr)
+		} else {
+			s.markFailed(stored, err)
+		}
+		return nil, err
+	}
+	s.statusChanged(file)
+
+	return file, nil
+}
+
+// markFailed records why a file could not be optimized
+// The file would otherwise stay processing, so errors are only logged
+func (s *FileService) markFailed(file *models.File, cause error) {
+	reason := failureReason(cause)
+	file.Status = models.StatusFailed
+	file.FailureReason = &reason
+	if err := s.Repo.UpdateFile(file); err != nil {
+		log.Printf("Error marking file %s as failed: %v", file.ID, err)
+		return
+	}
+	s.statusChanged(file)
+}
+
+// failureReason returns why a file could not be optimized, as its owner is told
+// The error itself can hold storage paths and tool output, it is only logged
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, optimizer.ErrFormatMismatch):
+		return "The file content does not match its extension"
+	case errors.Is(err, optimizer.ErrMalformedImage), errors.Is(err, optimizer.ErrMalformedGIF):
+		return "The file is damaged or is not a valid image"
+	case errors.Is(err, optimizer.ErrImageTooLarge), errors.Is(err, optimizer.ErrFrameTooLarge), errors.Is(err, optimizer.ErrTooManyFrames):
+		return "The image is too large to optimize"
+	case errors.Is(err, optimizer.ErrBudgetExceeded):
+		return "The file took too much time or memory to optimize"
+	case errors.Is(err, optimizer.ErrOverloaded):
+		return "The optimizer is busy, upload the file again later"
+	default:
+		return "The file could not be optimized"
+	}
+}
+
+// statusChanged streams the new status of a file to the clients following it
+// Notifications and webhooks are relayed from the outbox the repository writes to
+func (s *FileService) statusChanged(file *models.File) {
+	progress := 0
+	if file.Status == models.StatusCompleleted || file.Status == models.StatusFailed {
+		progress = 100
+	}
+	s.report(file, progress)
+}
+
+// report streams the progress of a file to the clients following it
+// Progress is a percentage
+func (s *FileService) report(file *models.File, progress int) {
+	if s.Progress == nil {
+		return
+	}
+	s.Progress.Publish(models.NewFileEvent(file, progress))
+}
+
+// DeleteFile deletes a file, its optimized version and its encodings
+// Missing objects in the storage do not stop the deletion
+// It returns an error if the file record could not be deleted
+func (s *FileService) DeleteFile(file *models.File) error {
+	paths := []string{file.OriginalPath}
+	if file.OptimizedPath != nil {
+		paths = append(paths, *file.OptimizedPath)
+	}
+	for _, e := range file.Encodings {
+		paths = append(paths, e.Path)
+	}
+
+	for _, path := range paths {
+		if err := s.Storage.Delete(path); err != nil {
+			log.Printf("Error deleting %s of file %s: %v", path, file.ID, err)
+		}
+	}
+
+	return s.Repo.DeleteFile(file)
+}
+
+// optimize writes the optimized file and its encodings to the storage
+// It records the results on the file but does not persist it
+func (s *FileService) optimize(file *models.File) error {
+	src, err := s.Storage.Retrieve(file.OriginalPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Read at most one byte over the budget, enough to tell it was exceeded
+	reader := io.Reader(src)
+	if s.Budget.MaxBytes > 0 {
+		reader = io.LimitReader(src, s.Budget.MaxBytes+1)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	if err := s.Budget.CheckSize(int64(len(data))); err != nil {
+		return err
+	}
+	s.report(file, 10)
+
+	// Validate the content from its headers before any optimizer touches it
+	info, err := optimizer.Validate(data, file.Type, s.Limits)
+	if err != nil {
+		return err
+	}
+	if err := s.Budget.CheckMemory(info); err != nil {
+		return err
+	}
+	s.report(file, 20)
+
+	var metadataOpts optimizer.MetadataOptions
+	if info.Format != "" {
+		metadataOpts = s.metadataOptions(file)
+	}
+
+	// Decoding the metadata parses the untrusted upload too, so it runs under
+	// the budget with the optimizer. The job only touches its own variables,
+	// it may outlive a timeout
+	opt := s.Pipeline.For(file.Type)
+	optimized := new(bytes.Buffer)
+	var metadata *models.ImageMetadata
+	err = s.Budget.Run(func() error {
+		input := data
+		if info.Format != "" {
+			processed, extracted, err := optimizer.ProcessMetadata(input, info.Format, metadataOpts)
+			if err != nil {
+				return err
+			}
+			input, metadata = processed, extracted
+		}
+		return opt.Optimize(bytes.NewReader(input), optimized)
+	})
+	if err != nil {
+		var panicErr *optimizer.PanicError
+		if errors.As(err, &panicErr) {
+			log.Printf("Optimizer panicked on file %s: %v\n%s", file.ID, panicErr.Value, panicErr.Stack)
+		}
+		return err
+	}
+
+	// Keep the metadata we extracted on the record
+	if metadata != nil {
+		file.Metadata = *metadata
+	}
+
+	s.report(file, 70)
+
+	// Some optimizers convert the file, e.g. GIF to animated WebP
+	ext := file.Type
+	if converter, ok := opt.(optimizer.Converter); ok {
+		ext = converter.OutputExt(file.Type)
+	}
+
+	optimizedName := strings.TrimSuffix(file.OriginalName, file.Type) + ".optimized" + ext
+	optimizedPath := filepath.Join("/", optimizedName)
+	optimizedSize := int64(optimized.Len())
+	if err := s.Storage.Save(optimizedPath, bytes.NewReader(optimized.Bytes())); err != nil {
+		return err
+	}
+
+	file.OptimizedName = &optimizedName
+	file.OptimizedPath = &optimizedPath
+	file.OptimizedSize = &optimizedSize
+
+	s.report(file, 85)
+
+	if !optimizer.IsCompressible(ext) {
+		return nil
+	}
+
+	for _, enc := range optimizer.Encodings {
+		encoded := new(bytes.Buffer)
+		if err := optimizer.Compress(enc, bytes.NewReader(optimized.Bytes()), encoded); err != nil {
+			return err
+		}
+
+		// An encoding that does not save anything is not worth serving
+		if encoded.Len() >= optimized.Len() {
+			continue
+		}
+
+		encodedPath := optimizedPath + enc.Extension()
+		encodedSize := int64(encoded.Len())
+		if err := s.Storage.Save(encodedPath, encoded); err != nil {
+			return err
+		}
+
+		file.Encodings = append(file.Encodings, models.FileEncoding{
+			ID:       uuid.New().String(),
+			FileID:   file.ID,
+			Encoding: string(enc),
+			Path:     encodedPath,
+			Size:     encodedSize,
+		})
+	}
+
+	return nil
+}
+
+// metadataOptions returns the metadata handling for a file
+// It uses the optimization settings for the file type, or the defaults
+func (s *FileService) metadataOptions(file *models.File) optimizer.MetadataOptions {
+	opts := optimizer.DefaultMetadataOptions()
+
+	settings, err := s.Repo.GetOptimizationSettings(file.Type)
+	if err != nil {
+		return opts
+	}
+
+	if settings.MetadataPolicy != "" {
+		opts.Policy = settings.MetadataPolicy
+	}
+	opts.AutoOrient = settings.AutoOrient
+	return opts
+}
+
+// OpenDownload opens the best representation of a file for download
+// It negotiates the encoding against the Accept-Encoding header
+// It returns the content, the chosen content encoding ("" for identity) and an error
+func (s *FileService) OpenDownload(file *models.File, acceptEncoding string) (io.ReadCloser, string, error) {
+	// Files that are not optimized yet are served as uploaded
+	if file.OptimizedPath == nil {
+		content, err := s.Storage.Retrieve(file.OriginalPath)
+		return content, "", err
+	}
+
+	available := make([]optimizer.Encoding, 0, len(file.Encodings))
+	for _, e := range file.Encodings {
+		available = append(available, optimizer.Encoding(e.Encoding))
+	}
+
+	if enc, ok := optimizer.NegotiateEncoding(acceptEncoding, available); ok {
+		for _, e := range file.Encodings {
+			if e.Encoding != string(enc) {
+				continue
+			}
+			content, err := s.Storage.Retrieve(e.Path)
+			if err == nil {
+				return content, e.Encoding, nil
+			}
+			log.Printf("Error retrieving %s encoding of file %s: %v", e.Encoding, file.ID, err)
+		}
+	}
+
+	content, err := s.Storage.Retrieve(*file.OptimizedPath)
+	return content, "", err
+}
@@ -2,8 +2,14 @@ package service
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"image"
+	"image/jpeg"
+	"io"
 	"io/ioutil"
+	"optimizer-service/cmd/internal/models"
+	"optimizer-service/cmd/internal/optimizer"
 	"optimizer-service/cmd/lib/mocks"
 	"testing"
 
@@ -28,6 +34,8 @@ func TestUploadFile_Success(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, file)
 	assert.Equal(t, "user123", file.UserID)
+	assert.Equal(t, "testfile.txt", file.UploadName)
+	assert.NotEqual(t, "testfile.txt", file.OriginalName)
 	mockStorage.AssertExpectations(t)
 	mockRepo.AssertExpectations(t)
 }
@@ -49,3 +57,202 @@ func TestUploadFile_Failure(t *testing.T) {
 	assert.Equal(t, "failed to save", err.Error())
 	mockStorage.AssertExpectations(t)
 }
+
+// panickingOptimizer simulates an optimizer crashing on a malicious file
+type panickingOptimizer struct{}
+
+func (panickingOptimizer) Supports(ext string) bool {
+	return true
+}
+
+func (panickingOptimizer) Optimize(src io.Reader, dst io.Writer) error {
+	panic("malicious input")
+}
+
+func TestOptimizeFile_PanicMarksFileFailed(t *testing.T) {
+	mockStorage := new(mocks.MockStorage)
+	mockRepo := new(mocks.MockFileRepository)
+	fileService := NewFileService(mockRepo, mockStorage)
+	fileService.Pipeline = optimizer.NewPipeline(panickingOptimizer{})
+
+	file := &models.File{ID: "file-id", OriginalPath: "/file.txt", Type: ".txt", Status: models.StatusUploaded}
+	mockRepo.On("GetFile", "file-id").Return(file, nil)
+	mockRepo.On("UpdateFile", file).Return(nil)
+	mockStorage.On("Retrieve", "/file.txt").Return(ioutil.NopCloser(bytes.NewReader([]byte("file content"))), nil)
+
+	optimized, err := fileService.OptimizeFile("file-id")
+
+	var panicErr *optimizer.PanicError
+	assert.True(t, errors.As(err, &panicErr))
+	assert.Nil(t, optimized)
+	assert.Equal(t, models.StatusFailed, file.Status)
+	// The owner is not shown what the optimizer panicked with
+	assert.Equal(t, "The file could not be optimized", *file.FailureReason)
+	mockStorage.AssertNotCalled(t, "Save", mock.Anything, mock.Anything)
+}
+
+func TestOptimizeFile_RejectsMismatchedFormat(t *testing.T) {
+	mockStorage := new(mocks.MockStorage)
+	mockRepo := new(mocks.MockFileRepository)
+	fileService := NewFileService(mockRepo, mockStorage)
+
+	file := &models.File{ID: "file-id", OriginalPath: "/file.png", Type: ".png", Status: models.StatusUploaded}
+	mockRepo.On("GetFile", "file-id").Return(file, nil)
+	mockRepo.On("UpdateFile", file).Return(nil)
+	mockStorage.On("Retrieve", "/file.png").Return(ioutil.NopCloser(bytes.NewReader([]byte("GIF89a not really a png"))), nil)
+
+	_, err := fileService.OptimizeFile("file-id")
+
+	assert.True(t, errors.Is(err, optimizer.ErrFormatMismatch))
+	assert.Equal(t, models.StatusFailed, file.Status)
+	assert.Equal(t, "The file content does not match its extension", *file.FailureReason)
+}
+
+func TestOptimizeFile_RejectsFilesOverBudget(t *testing.T) {
+	mockStorage := new(mocks.MockStorage)
+	mockRepo := new(mocks.MockFileRepository)
+	fileService := NewFileService(mockRepo, mockStorage)
+	fileService.Budget.MaxBytes = 4
+
+	file := &models.File{ID: "file-id", OriginalPath: "/file.txt", Type: ".txt", Status: models.StatusUploaded}
+	mockRepo.On("GetFile", "file-id").Return(file, nil)
+	mockRepo.On("UpdateFile", file).Return(nil)
+	mockStorage.On("Retrieve", "/file.txt").Return(ioutil.NopCloser(bytes.NewReader([]byte("file content"))), nil)
+
+	_, err := fileService.OptimizeFile("file-id")
+
+	assert.True(t, errors.Is(err, optimizer.ErrBudgetExceeded))
+	assert.Equal(t, models.StatusFailed, file.Status)
+}
+
+func TestOptimizeFile_MarksFileFailedWhenResultsCannotBeSaved(t *testing.T) {
+	mockStorage := new(mocks.MockStorage)
+	mockRepo := new(mocks.MockFileRepository)
+	fileService := NewFileService(mockRepo, mockStorage)
+
+	file := &models.File{ID: "file-id", OriginalName: "notes.txt", OriginalPath: "/notes.txt", Type: ".txt", Status: models.StatusUploaded}
+	saveErr := errors.New("value too long for type character varying(255)")
+	completed := func(f *models.File) bool { return f.Status == models.StatusCompleleted }
+	mockRepo.On("GetFile", "file-id").Return(file, nil)
+	mockRepo.On("UpdateFile", mock.MatchedBy(completed)).Return(saveErr)
+	mockRepo.On("UpdateFile", mock.Anything).Return(nil)
+	mockRepo.On("GetOptimizationSettings", ".txt").Return(nil, errors.New("not found"))
+	mockStorage.On("Retrieve", "/notes.txt").Return(ioutil.NopCloser(bytes.NewReader([]byte("file content"))), nil)
+	mockStorage.On("Save", mock.Anything, mock.Anything).Return(nil)
+
+	_, err := fileService.OptimizeFile("file-id")
+
+	assert.ErrorIs(t, err, saveErr)
+	assert.Equal(t, models.StatusFailed, file.Status)
+	assert.Equal(t, "The file could not be optimized", *file.FailureReason)
+	mockRepo.AssertNumberOfCalls(t, "UpdateFile", 3)
+}
+
+// recordingBroker records the progress it is told about
+type recordingBroker struct {
+	events []models.FileEvent
+}
+
+func (b *recordingBroker) Publish(event models.FileEvent) {
+	b.events = append(b.events, event)
+}
+
+func (b *recordingBroker) Subscribe(fileID string) (<-chan models.FileEvent, func()) {
+	return nil, func() {}
+}
+
+func TestOptimizeFile_ReportsProgress(t *testing.T) {
+	mockStorage := new(mocks.MockStorage)
+	mockRepo := new(mocks.MockFileRepository)
+	broker := &recordingBroker{}
+	fileService := NewFileService(mockRepo, mockStorage)
+	fileService.Progress = broker
+
+	file := &models.File{ID: "file-id", OriginalName: "notes.txt", OriginalPath: "/notes.txt", Type: ".txt", Status: models.StatusUploaded}
+	mockRepo.On("GetFile", "file-id").Return(file, nil)
+	mockRepo.On("UpdateFile", file).Return(nil)
+	mockRepo.On("GetOptimizationSettings", ".txt").Return(nil, errors.New("not found"))
+	mockStorage.On("Retrieve", "/notes.txt").Return(ioutil.NopCloser(bytes.NewReader([]byte("file content"))), nil)
+	mockStorage.On("Save", mock.Anything, mock.Anything).Return(nil)
+
+	_, err := fileService.OptimizeFile("file-id")
+	assert.NoError(t, err)
+
+	var progress []int
+	for _, event := range broker.events {
+		progress = append(progress, event.Progress)
+	}
+	assert.Equal(t, []int{0, 10, 20, 70, 85, 100}, progress)
+	assert.Equal(t, models.StatusProcessing, broker.events[0].Status)
+	assert.Equal(t, models.StatusCompleleted, broker.events[len(broker.events)-1].Status)
+}
+
+// rotatedJPEG encodes a 4x2 JPEG whose EXIF orientation turns it a quarter clockwise
+func rotatedJPEG(t *testing.T) []byte {
+	encoded := new(bytes.Buffer)
+	if err := jpeg.Encode(encoded, image.NewGray(image.Rect(0, 0, 4, 2)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A little-endian TIFF header and an IFD with only the orientation, 6
+	tiff := []byte("II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00\x06\x00\x00\x00\x00\x00\x00\x00")
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(payload)+2))
+
+	out := []byte{0xFF, 0xD8}
+	out = append(out, app1...)
+	out = append(out, payload...)
+	return append(out, encoded.Bytes()[2:]...)
+}
+
+func TestOptimizeFile_AutoOrientsJPEG(t *testing.T) {
+	mockStorage := new(mocks.MockStorage)
+	mockRepo := new(mocks.MockFileRepository)
+	fileService := NewFileService(mockRepo, mockStorage)
+
+	file := &models.File{ID: "file-id", OriginalName: "photo.jpg", OriginalPath: "/photo.jpg", Type: ".jpg", Status: models.StatusUploaded}
+	mockRepo.On("GetFile", "file-id").Return(file, nil)
+	mockRepo.On("UpdateFile", file).Return(nil)
+	mockRepo.On("GetOptimizationSettings", ".jpg").Return(nil, errors.New("not found"))
+	mockStorage.On("Retrieve", "/photo.jpg").Return(ioutil.NopCloser(bytes.NewReader(rotatedJPEG(t))), nil)
+	var saved []byte
+	mockStorage.On("Save", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		saved, _ = io.ReadAll(args.Get(1).(io.Reader))
+	}).Return(nil)
+
+	_, err := fileService.OptimizeFile("file-id")
+	assert.NoError(t, err)
+
+	// The metadata describes the upright image that is stored
+	assert.Equal(t, 6, file.Metadata.Orientation)
+	assert.Equal(t, 2, file.Metadata.Width)
+	assert.Equal(t, 4, file.Metadata.Height)
+	config, err := jpeg.DecodeConfig(bytes.NewReader(saved))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, config.Width)
+	assert.Equal(t, 4, config.Height)
+}
+
+func TestDeleteFile_RemovesStoredObjects(t *testing.T) {
+	mockStorage := new(mocks.MockStorage)
+	mockRepo := new(mocks.MockFileRepository)
+	fileService := NewFileService(mockRepo, mockStorage)
+
+	optimizedPath := "/notes.optimized.txt"
+	file := &models.File{
+		ID:            "file-id",
+		OriginalPath:  "/notes.txt",
+		OptimizedPath: &optimizedPath,
+		Encodings:     []models.FileEncoding{{Path: "/notes.optimized.txt.gz"}},
+	}
+	mockStorage.On("Delete", "/notes.txt").Return(nil)
+	mockStorage.On("Delete", optimizedPath).Return(nil)
+	// A missing object does not stop the deletion
+	mockStorage.On("Delete", "/notes.optimized.txt.gz").Return(errors.New("not found"))
+	mockRepo.On("DeleteFile", file).Return(nil)
+
+	assert.NoError(t, fileService.DeleteFile(file))
+	mockStorage.AssertExpectations(t)
+	mockRepo.AssertExpectations(t)
+}
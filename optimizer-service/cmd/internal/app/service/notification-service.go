@@ -0,0 +1,44 @@
+package service
+
+import (
+	"optimizer-service/cmd/internal/app/interfaces"
+	"optimizer-service/cmd/internal/models"
+)
+
+// NotificationService is a struct for the notification service
+// It implements the INotificationService interface
+type NotificationService struct {
+	Repo interfaces.INotificationRepository
+}
+
+// NewNotificationService creates a new notification service
+// It returns a pointer to the notification service
+func NewNotificationService(r interfaces.INotificationRepository) *NotificationService {
+	return &NotificationService{Repo: r}
+}
+
+// GetPreference retrieves the notification preference of a user
+// Users who never set one get the default, which is to receive emails
+func (s *NotificationService) GetPreference(userID string) (*models.NotificationPreference, error) {
+	preference, err := s.Repo.GetPreference(userID)
+	if err != nil {
+		return nil, err
+	}
+	if preference == nil {
+		preference = &models.NotificationPreference{UserID: userID}
+	}
+	return preference, nil
+}
+
+// UpdatePreference opts a user in or out of emails
+// It returns the saved preference and an error
+func (s *NotificationService) UpdatePreference(userID string, emailOptOut bool) (*models.NotificationPreference, error) {
+	preference := &models.NotificationPreference{
+		UserID:      userID,
+		EmailOptOut: emailOptOut,
+	}
+	if err := s.Repo.SavePreference(preference); err != nil {
+		return nil, err
+	}
+	return preference, nil
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"optimizer-service/cmd/internal/app/interfaces"
+	"optimizer-service/cmd/internal/models"
+	"optimizer-service/cmd/internal/webhook"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrWebhookNotFound     = errors.New("Webhook not found")
+	ErrDeliveryNotFound    = errors.New("Delivery not found")
+	ErrInvalidWebhookURL   = errors.New("Webhook URL must be an absolute http or https URL")
+	ErrForbiddenWebhookURL = errors.New("Webhook URL must resolve to public addresses")
+	ErrUnknownWebhookEvent = errors.New("Unknown webhook event")
+)
+
+// WebhookService is a struct for the webhook service
+// It manages the webhooks of users and their delivery logs
+// It implements the IWebhookService interface
+type WebhookService struct {
+	Repo interfaces.IWebhookRepository
+	// Resolver looks up the addresses of webhook hosts
+	Resolver webhook.Resolver
+	// AllowPrivate lets webhooks post to loopback and private addresses, for development
+	AllowPrivate bool
+}
+
+// NewWebhookService creates a new webhook service
+// It returns a pointer to the webhook service
+func NewWebhookService(r interfaces.IWebhookRepository) *WebhookService {
+	return &WebhookService{Repo: r, Resolver: net.DefaultResolver}
+}
+
+// CreateWebhook subscribes a URL to file events
+// No events means all of them
+// The secret payloads are signed with is generated and returned on the webhook
+func (s *WebhookService) CreateWebhook(userID, rawURL string, events []string) (*models.Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrInvalidWebhookURL
+	}
+	// The dispatcher checks the addresses again when it connects, as the
+	// host may resolve to others by then
+	if !s.AllowPrivate {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := webhook.CheckHost(ctx, s.Resolver, u.Hostname()); err != nil {
+			return nil, ErrForbiddenWebhookURL
+		}
+	}
+
+	for _, e := range events {
+		if !models.IsWebhookEvent(models.EventType(e)) {
+			return nil, ErrUnknownWebhookEvent
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	hook := &models.Webhook{
+		ID:     uuid.New().String(),
+		UserID: userID,
+		URL:    u.String(),
+		Secret: "whsec_" + hex.EncodeToString(secret),
+		Events: strings.Join(events, ","),
+	}
+	if err := s.Repo.CreateWebhook(hook); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// GetWebhooks retrieves the webhooks of a user
+// It returns the webhooks and an error
+func (s *WebhookService) GetWebhooks(userID string) ([]models.Webhook, error) {
+	return s.Repo.GetWebhooks(userID)
+}
+
+// GetWebhook retrieves a webhook of a user
+// It returns ErrWebhookNotFound for webhooks of other users
+func (s *WebhookService) GetWebhook(userID, id string) (*models.Webhook, error) {
+	webhook, err := s.Repo.GetWebhook(id)
+	if err != nil || webhook.UserID != userID {
+		return nil, ErrWebhookNotFound
+	}
+	return webhook, nil
+}
+
+// DeleteWebhook deletes a webhook of a user and its delivery log
+// It returns an error if the operation fails
+func (s *WebhookService) DeleteWebhook(userID, id string) error {
+	if _, err := s.GetWebhook(userID, id); err != nil {
+		return err
+	}
+	return s.Repo.DeleteWebhook(id)
+}
+
+// GetDeliveries retrieves the delivery log of a webhook of a user
+// It returns the deliveries and an error
+func (s *WebhookService) GetDeliveries(userID, webhookID string) ([]models.WebhookDelivery, error) {
+	if _, err := s.GetWebhook(userID, webhookID); err != nil {
+		return nil, err
+	}
+	return s.Repo.GetDeliveries(webhookID)
+}
+
+// Redeliver schedules a delivery to be posted again, with a fresh set of attempts
+// It is how dead deliveries are brought back once the receiver is fixed
+func (s *WebhookService) Redeliver(userID, webhookID, deliveryID string) (*models.WebhookDelivery, error) {
+	if _, err := s.GetWebhook(userID, webhookID); err != nil {
+		return nil, err
+	}
+
+	delivery, err := s.Repo.GetDelivery(deliveryID)
+	if err != nil || delivery.WebhookID != webhookID {
+		return nil, ErrDeliveryNotFound
+	}
+
+	now := time.Now()
+	delivery.Status = models.DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = &now
+	if err := s.Repo.UpdateDelivery(delivery); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
@@ -0,0 +1,35 @@
+package auth
+
+// The scopes of personal access tokens, as issued by the user service
+const (
+	ScopeFilesRead    = "files:read"
+	ScopeFilesWrite   = "files:write"
+	ScopePresetsAdmin = "presets:admin"
+)
+
+// Identity is who a request is made for and what it may do
+// The tokens of a login session can do everything, personal access tokens
+// only what their scopes allow
+type Identity struct {
+	UserID  string
+	Scopes  []string
+	Session bool
+	// EmailVerified is whether the user verified their email address
+	EmailVerified bool
+	// VerificationRequired is whether the user service restricts the user
+	// until they verify their email address
+	VerificationRequired bool
+}
+
+// HasScope reports whether the identity is allowed a scope
+func (i *Identity) HasScope(scope string) bool {
+	if i.Session {
+		return true
+	}
+	for _, granted := range i.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
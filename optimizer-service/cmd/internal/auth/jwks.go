@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/sync/singleflight"
+)
+
+// MinRSAKeyBits is the minimum size of the RSA keys tokens are verified with
+const MinRSAKeyBits = 2048
+
+var ErrUnknownKey = errors.New("Token is signed with an unknown key")
+
+// Key is a public key tokens are verified with
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	Public crypto.PublicKey
+}
+
+// KeySource looks up the key a token was signed with
+type KeySource interface {
+	Key(kid string) (*Key, error)
+}
+
+// JWK is a public key in the JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+}
+
+// JWKS fetches the key set of the user service and caches it
+// The keys are fetched again once the cache expires, and when a token
+// names a key we do not know about, for the keys of a rotation
+type JWKS struct {
+	URL    string
+	Client *http.Client
+	// TTL is how long the keys are cached
+	TTL time.Duration
+	// MinRefreshInterval limits the fetches caused by unknown key IDs
+	MinRefreshInterval time.Duration
+
+	// refreshes makes concurrent lookups share one fetch, it runs without
+	// the lock so the lookups of known keys are not held up by it
+	refreshes   singleflight.Group
+	mu          sync.Mutex
+	keys        map[string]*Key
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+// NewJWKS creates a key set fetched from a URL
+// It returns a pointer to the key set
+func NewJWKS(url string) *JWKS {
+	return &JWKS{
+		URL:                url,
+		Client:             &http.Client{Timeout: 5 * time.Second},
+		TTL:                5 * time.Minute,
+		MinRefreshInterval: 10 * time.Second,
+	}
+}
+
+// Key returns the key with an ID
+// The keys we already have are still used when they cannot be fetched again
+// It returns ErrUnknownKey if the key set has no such key
+func (j *JWKS) Key(kid string) (*Key, error) {
+	j.mu.Lock()
+	key, known := j.keys[kid]
+	expired := time.Since(j.fetchedAt) > j.TTL
+	j.mu.Unlock()
+
+	if expired || !known {
+		j.refreshes.Do("refresh", func() (interface{}, error) {
+			j.refresh()
+			return nil, nil
+		})
+		j.mu.Lock()
+		key, known = j.keys[kid]
+		j.mu.Unlock()
+	}
+
+	if !known {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// refresh fetches the key set, unless it was tried within MinRefreshInterval
+// The keys are swapped in once they are fetched
+func (j *JWKS) refresh() {
+	j.mu.Lock()
+	now := time.Now()
+	if now.Sub(j.attemptedAt) < j.MinRefreshInterval {
+		j.mu.Unlock()
+		return
+	}
+	j.attemptedAt = now
+	j.mu.Unlock()
+
+	keys, err := j.fetch()
+	if err != nil {
+		log.Printf("Error fetching the JWKS from %s: %v", j.URL, err)
+		return
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.fetchedAt = now
+	j.mu.Unlock()
+}
+
+// fetch fetches the key set
+// Keys we cannot use are skipped
+// It returns the keys by ID and an error
+func (j *JWKS) fetch() (map[string]*Key, error) {
+	resp, err := j.Client.Get(j.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*Key, len(set.Keys))
+	for _, jwk := range set.Keys {
+		key, err := ParseJWK(jwk)
+		if err != nil {
+			log.Printf("Skipping JWK %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[key.ID] = key
+	}
+	return keys, nil
+}
+
+// ParseJWK parses an RSA or Ed25519 signing key
+// It returns the key and an error if it cannot verify tokens
+func ParseJWK(jwk JWK) (*Key, error) {
+	if jwk.Kid == "" {
+		return nil, errors.New("key has no kid")
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return nil, errors.New("key is not a signing key")
+	}
+
+	key := &Key{ID: jwk.Kid}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if public.N.BitLen() < MinRSAKeyBits {
+			return nil, errors.New("RSA key is too small")
+		}
+		key.Method = jwt.SigningMethodRS256
+		key.Public = public
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || jwk.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		key.Method = jwt.SigningMethodEdDSA
+		key.Public = ed25519.PublicKey(x)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+
+	if jwk.Alg != "" && jwk.Alg != key.Method.Alg() {
+		return nil, fmt.Errorf("unsupported algorithm %q", jwk.Alg)
+	}
+	return key, nil
+}
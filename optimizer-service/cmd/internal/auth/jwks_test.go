@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// jwksServer serves the public keys of signers
+type jwksServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	signers []*signer
+	status  int
+	fetches int
+}
+
+func newJWKSServer(t *testing.T, signers ...*signer) *jwksServer {
+	s := &jwksServer{signers: signers, status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.fetches++
+
+		if s.status != http.StatusOK {
+			w.WriteHeader(s.status)
+			return
+		}
+		keys := []JWK{}
+		for _, signer := range s.signers {
+			keys = append(keys, signer.jwk())
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) set(status int, signers ...*signer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+	s.signers = signers
+}
+
+func (s *jwksServer) fetchCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+// jwk returns the public key of a signer as the user service publishes it
+func (s *signer) jwk() JWK {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch public := s.public.(type) {
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", Kid: s.kid, Use: "sig", Alg: "RS256", N: encode(public.N.Bytes()), E: encode(big.NewInt(int64(public.E)).Bytes())}
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Kid: s.kid, Use: "sig", Alg: "EdDSA", Crv: "Ed25519", X: encode(public)}
+	default:
+		return JWK{}
+	}
+}
+
+func newTestJWKS(url string) *JWKS {
+	jwks := NewJWKS(url)
+	jwks.MinRefreshInterval = 0
+	return jwks
+}
+
+func TestJWKSCachesKeys(t *testing.T) {
+	ed := newEd25519Signer("ed-key")
+	rs := newRSASigner(t, "rsa-key")
+	server := newJWKSServer(t, ed, rs)
+	config := &Config{Keys: newTestJWKS(server.URL), Issuer: "user-service", Audience: "optimate"}
+
+	for i := 0; i < 3; i++ {
+		_, err := config.Parse(ed.sign(t, nil))
+		assert.NoError(t, err)
+		_, err = config.Parse(rs.sign(t, nil))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, server.fetchCount())
+}
+
+func TestJWKSRefreshesOnUnknownKey(t *testing.T) {
+	old := newEd25519Signer("old-key")
+	server := newJWKSServer(t, old)
+	config := &Config{Keys: newTestJWKS(server.URL), Issuer: "user-service", Audience: "optimate"}
+
+	_, err := config.Parse(old.sign(t, nil))
+	assert.NoError(t, err)
+
+	// The user service rotates to a new key and keeps publishing the old one
+	rotated := newEd25519Signer("new-key")
+	server.set(http.StatusOK, rotated, old)
+
+	_, err = config.Parse(rotated.sign(t, nil))
+	assert.NoError(t, err)
+	_, err = config.Parse(old.sign(t, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, server.fetchCount())
+
+	// Until the old key is dropped and the cache expires
+	server.set(http.StatusOK, rotated)
+	config.Keys.(*JWKS).TTL = 0
+	time.Sleep(time.Millisecond)
+	_, err = config.Parse(old.sign(t, nil))
+	assert.ErrorContains(t, err, ErrUnknownKey.Error())
+}
+
+func TestJWKSLimitsRefreshes(t *testing.T) {
+	s := newEd25519Signer("ed-key")
+	server := newJWKSServer(t, s)
+	jwks := NewJWKS(server.URL)
+	jwks.MinRefreshInterval = time.Hour
+
+	_, err := jwks.Key("ed-key")
+	assert.NoError(t, err)
+
+	// Tokens with made up key IDs do not hammer the user service
+	for i := 0; i < 5; i++ {
+		_, err := jwks.Key("made-up")
+		assert.ErrorIs(t, err, ErrUnknownKey)
+	}
+	assert.Equal(t, 1, server.fetchCount())
+}
+
+func TestJWKSKeepsKeysWhenTheUserServiceIsDown(t *testing.T) {
+	s := newEd25519Signer("ed-key")
+	server := newJWKSServer(t, s)
+	jwks := newTestJWKS(server.URL)
+
+	_, err := jwks.Key("ed-key")
+	assert.NoError(t, err)
+
+	server.set(http.StatusServiceUnavailable, s)
+	jwks.TTL = 0
+	time.Sleep(time.Millisecond)
+
+	key, err := jwks.Key("ed-key")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "EdDSA", key.Method.Alg())
+	}
+	assert.Equal(t, 2, server.fetchCount())
+}
+
+func TestJWKSFetchesWithoutHoldingUpKnownKeys(t *testing.T) {
+	s := newEd25519Signer("ed-key")
+	var fetches int32
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every fetch after the first hangs until it is released
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			close(fetching)
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []JWK{s.jwk()}})
+	}))
+	t.Cleanup(server.Close)
+	jwks := NewJWKS(server.URL)
+	jwks.MinRefreshInterval = time.Hour
+
+	_, err := jwks.Key("ed-key")
+	assert.NoError(t, err)
+	jwks.attemptedAt = time.Time{}
+
+	// Lookups of an unknown key wait for one shared fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := jwks.Key("made-up")
+			assert.ErrorIs(t, err, ErrUnknownKey)
+		}()
+	}
+	<-fetching
+
+	// While the known key is found at once
+	start := time.Now()
+	_, err = jwks.Key("ed-key")
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestJWKSWithoutKeysRejectsTokens(t *testing.T) {
+	s := newEd25519Signer("ed-key")
+	server := newJWKSServer(t)
+	server.set(http.StatusInternalServerError)
+	config := &Config{Keys: newTestJWKS(server.URL), Issuer: "user-service", Audience: "optimate"}
+
+	_, err := config.Parse(s.sign(t, nil))
+	assert.ErrorContains(t, err, ErrUnknownKey.Error())
+}
+
+func TestParseJWKRejectsUnusableKeys(t *testing.T) {
+	rs := newRSASigner(t, "rsa-key").jwk()
+	ed := newEd25519Signer("ed-key").jwk()
+
+	tests := map[string]func(*JWK){
+		"without kid":        func(k *JWK) { k.Kid = "" },
+		"encryption key":     func(k *JWK) { k.Use = "enc" },
+		"other algorithm":    func(k *JWK) { k.Alg = "PS256" },
+		"unknown key type":   func(k *JWK) { k.Kty = "EC" },
+		"small RSA modulus":  func(k *JWK) { k.N = base64.RawURLEncoding.EncodeToString(big.NewInt(3233).Bytes()) },
+		"empty RSA exponent": func(k *JWK) { k.E = "" },
+	}
+	for name, change := range tests {
+		t.Run(name, func(t *testing.T) {
+			jwk := rs
+			change(&jwk)
+			_, err := ParseJWK(jwk)
+			assert.Error(t, err)
+		})
+	}
+
+	ed.Crv = "X25519"
+	_, err := ParseJWK(ed)
+	assert.Error(t, err)
+}
@@ -0,0 +1,86 @@
+// Package auth
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Leeway is the clock skew tolerated between the services
+const Leeway = time.Minute
+
+var (
+	ErrNotConfigured = errors.New("JWT keys are not configured")
+	ErrInvalidClaims = errors.New("Invalid token claims")
+)
+
+// Config is the configuration used to verify the access tokens of the user service
+// The keys come from the user service, we do not share any secret with it
+type Config struct {
+	Keys     KeySource
+	Issuer   string
+	Audience string
+}
+
+// Check checks the configuration is complete
+// It returns an error if tokens cannot be safely verified with it
+func (c *Config) Check() error {
+	if c == nil || c.Keys == nil {
+		return ErrNotConfigured
+	}
+	if c.Issuer == "" || c.Audience == "" {
+		return errors.New("JWT issuer and audience are required")
+	}
+	return nil
+}
+
+// Parse verifies the signature and the claims of an access token
+// The token must name its key in its kid, and the exp, iat, iss and aud
+// claims are all required
+// It returns the token and an error if it is not valid
+func (c *Config) Parse(tokenString string) (*jwt.Token, error) {
+	if err := c.Check(); err != nil {
+		return nil, err
+	}
+
+	// The claims are checked below, with the leeway
+	parser := &jwt.Parser{
+		ValidMethods:         []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()},
+		SkipClaimsValidation: true,
+	}
+	token, err := parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return nil, ErrUnknownKey
+		}
+		key, err := c.Keys.Key(kid)
+		if err != nil {
+			return nil, err
+		}
+		// A key is only used with its own algorithm
+		if key.Method.Alg() != token.Method.Alg() {
+			return nil, ErrUnknownKey
+		}
+		return key.Public, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !c.validClaims(claims, time.Now()) {
+		return nil, ErrInvalidClaims
+	}
+	return token, nil
+}
+
+// validClaims checks the registered claims of a token at a time
+func (c *Config) validClaims(claims jwt.MapClaims, now time.Time) bool {
+	return claims.VerifyExpiresAt(now.Add(-Leeway).Unix(), true) &&
+		claims.VerifyNotBefore(now.Add(Leeway).Unix(), false) &&
+		claims.VerifyIssuedAt(now.Add(Leeway).Unix(), true) &&
+		claims.VerifyIssuer(c.Issuer, true) &&
+		claims.VerifyAudience(c.Audience, true)
+}
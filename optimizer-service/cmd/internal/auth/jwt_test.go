@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+// keySet is a KeySource over fixed keys
+type keySet map[string]*Key
+
+func (s keySet) Key(kid string) (*Key, error) {
+	if key, ok := s[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// signer is a key of the user service
+type signer struct {
+	kid     string
+	method  jwt.SigningMethod
+	private interface{}
+	public  interface{}
+}
+
+func newEd25519Signer(kid string) *signer {
+	public, private, _ := ed25519.GenerateKey(nil)
+	return &signer{kid: kid, method: jwt.SigningMethodEdDSA, private: private, public: public}
+}
+
+func newRSASigner(t *testing.T, kid string) *signer {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signer{kid: kid, method: jwt.SigningMethodRS256, private: private, public: &private.PublicKey}
+}
+
+func (s *signer) key() *Key {
+	return &Key{ID: s.kid, Method: s.method, Public: s.public}
+}
+
+// sign signs the claims of a valid token, with the overrides applied
+// A nil override removes the claim
+func (s *signer) sign(t *testing.T, overrides jwt.MapClaims) string {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"user_id": "user-id",
+		"iss":     "user-service",
+		"aud":     "optimate",
+		"iat":     now.Unix(),
+		"exp":     now.Add(time.Hour).Unix(),
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(claims, k)
+			continue
+		}
+		claims[k] = v
+	}
+
+	token := jwt.NewWithClaims(s.method, claims)
+	token.Header["kid"] = s.kid
+	signed, err := token.SignedString(s.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func testConfig(signers ...*signer) *Config {
+	keys := keySet{}
+	for _, s := range signers {
+		keys[s.kid] = s.key()
+	}
+	return &Config{Keys: keys, Issuer: "user-service", Audience: "optimate"}
+}
+
+func TestParseValidToken(t *testing.T) {
+	ed := newEd25519Signer("ed-key")
+	rs := newRSASigner(t, "rsa-key")
+	config := testConfig(ed, rs)
+
+	for _, s := range []*signer{ed, rs} {
+		token, err := config.Parse(s.sign(t, nil))
+		if assert.NoError(t, err) {
+			assert.True(t, token.Valid)
+			assert.Equal(t, "user-id", token.Claims.(jwt.MapClaims)["user_id"])
+		}
+	}
+}
+
+func TestParseRejectsInvalidClaims(t *testing.T) {
+	s := newEd25519Signer("ed-key")
+	now := time.Now()
+	cases := map[string]jwt.MapClaims{
+		"expired":          {"exp": now.Add(-time.Hour).Unix()},
+		"without exp":      {"exp": nil},
+		"issued later":     {"iat": now.Add(time.Hour).Unix()},
+		"without iat":      {"iat": nil},
+		"other issuer":     {"iss": "someone-else"},
+		"without issuer":   {"iss": nil},
+		"other audience":   {"aud": "another-service"},
+		"without audience": {"aud": nil},
+		"not yet valid":    {"nbf": now.Add(time.Hour).Unix()},
+	}
+
+	for name, overrides := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := testConfig(s).Parse(s.sign(t, overrides))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseToleratesClockSkew(t *testing.T) {
+	s := newEd25519Signer("ed-key")
+	now := time.Now()
+	token := s.sign(t, jwt.MapClaims{
+		"iat": now.Add(30 * time.Second).Unix(),
+		"exp": now.Add(-30 * time.Second).Unix(),
+	})
+
+	_, err := testConfig(s).Parse(token)
+	assert.NoError(t, err)
+}
+
+func TestParseRejectsUnknownKeysAndMethods(t *testing.T) {
+	known := newEd25519Signer("ed-key")
+	config := testConfig(known)
+
+	// A key we do not know about
+	_, err := config.Parse(newEd25519Signer("other-key").sign(t, nil))
+	assert.ErrorContains(t, err, ErrUnknownKey.Error())
+
+	// A known kid with another key
+	_, err = config.Parse(newEd25519Signer("ed-key").sign(t, nil))
+	assert.Error(t, err)
+
+	// A known kid with another algorithm
+	rs := newRSASigner(t, "ed-key")
+	_, err = config.Parse(rs.sign(t, nil))
+	assert.Error(t, err)
+
+	// Shared secrets and unsigned tokens
+	hmac := &signer{kid: "ed-key", method: jwt.SigningMethodHS256, private: []byte("test-secret-that-is-long-enough-to-sign")}
+	_, err = config.Parse(hmac.sign(t, nil))
+	assert.Error(t, err)
+	none := &signer{kid: "ed-key", method: jwt.SigningMethodNone, private: jwt.UnsafeAllowNoneSignatureType}
+	_, err = config.Parse(none.sign(t, nil))
+	assert.Error(t, err)
+
+	// A token without a kid
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{"user_id": "user-id"})
+	signed, err := token.SignedString(known.private)
+	assert.NoError(t, err)
+	_, err = config.Parse(signed)
+	assert.Error(t, err)
+}
+
+func TestParseFailsClosed(t *testing.T) {
+	s := newEd25519Signer("ed-key")
+	token := s.sign(t, nil)
+
+	var missing *Config
+	_, err := missing.Parse(token)
+	assert.ErrorIs(t, err, ErrNotConfigured)
+
+	_, err = (&Config{Issuer: "user-service", Audience: "optimate"}).Parse(token)
+	assert.ErrorIs(t, err, ErrNotConfigured)
+
+	_, err = (&Config{Keys: keySet{"ed-key": s.key()}}).Parse(token)
+	assert.Error(t, err)
+}
@@ -0,0 +1,71 @@
+// Package events streams file status and progress updates to clients
+package events
+
+import (
+	"optimizer-service/cmd/internal/models"
+	"sync"
+)
+
+// subscriberBuffer is the number of events a slow subscriber can lag behind
+const subscriberBuffer = 32
+
+// Hub fans file events out to the subscribers of this process
+// It implements the IFileEventBroker interface
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan models.FileEvent]struct{}
+}
+
+// NewHub creates a new hub
+// It returns a pointer to the hub
+func NewHub() *Hub {
+	return &Hub{subscribers: map[string]map[chan models.FileEvent]struct{}{}}
+}
+
+// Publish sends an event to the subscribers of its file
+// A subscriber that lags behind loses its oldest event, never the newest,
+// so it always ends up with the final status
+func (h *Hub) Publish(event models.FileEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers[event.FileID] {
+		select {
+		case ch <- event:
+			continue
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns the events of a file and a function to unsubscribe
+func (h *Hub) Subscribe(fileID string) (<-chan models.FileEvent, func()) {
+	ch := make(chan models.FileEvent, subscriberBuffer)
+
+	h.mu.Lock()
+	if h.subscribers[fileID] == nil {
+		h.subscribers[fileID] = map[chan models.FileEvent]struct{}{}
+	}
+	h.subscribers[fileID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			delete(h.subscribers[fileID], ch)
+			if len(h.subscribers[fileID]) == 0 {
+				delete(h.subscribers, fileID)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package events
+
+import (
+	"optimizer-service/cmd/internal/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHubDeliversToSubscribersOfTheFile(t *testing.T) {
+	hub := NewHub()
+	first, unsubscribeFirst := hub.Subscribe("file-id")
+	second, unsubscribeSecond := hub.Subscribe("file-id")
+	other, unsubscribeOther := hub.Subscribe("other-file-id")
+	defer unsubscribeSecond()
+	defer unsubscribeOther()
+
+	hub.Publish(models.FileEvent{FileID: "file-id", Status: models.StatusProcessing, Progress: 20})
+
+	assert.Equal(t, 20, (<-first).Progress)
+	assert.Equal(t, 20, (<-second).Progress)
+	assert.Empty(t, other)
+
+	// Unsubscribed channels do not get anything anymore
+	unsubscribeFirst()
+	unsubscribeFirst()
+	hub.Publish(models.FileEvent{FileID: "file-id", Status: models.StatusProcessing, Progress: 30})
+	assert.Empty(t, first)
+	assert.Equal(t, 30, (<-second).Progress)
+}
+
+func TestHubKeepsTheNewestEventsOfLaggingSubscribers(t *testing.T) {
+	hub := NewHub()
+	events, unsubscribe := hub.Subscribe("file-id")
+	defer unsubscribe()
+
+	for i := 0; i < subscriberBuffer*2; i++ {
+		hub.Publish(models.FileEvent{FileID: "file-id", Status: models.StatusProcessing, Progress: i})
+	}
+	hub.Publish(models.FileEvent{FileID: "file-id", Status: models.StatusCompleleted, Progress: 100})
+
+	assert.Len(t, events, subscriberBuffer)
+	var last models.FileEvent
+	for len(events) > 0 {
+		last = <-events
+	}
+	assert.True(t, last.Final())
+}
+
+func TestHubRemovesFilesWithoutSubscribers(t *testing.T) {
+	hub := NewHub()
+	_, unsubscribe := hub.Subscribe("file-id")
+	unsubscribe()
+
+	assert.Empty(t, hub.subscribers)
+}
@@ -0,0 +1,93 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"optimizer-service/cmd/internal/models"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+// notifyChannel is the Postgres channel file events go through
+const notifyChannel = "file_events"
+
+// PostgresBroker fans file events out across replicas with LISTEN/NOTIFY
+// Every replica publishes with NOTIFY and listens on a dedicated connection,
+// handing what it hears to the subscribers of its own hub
+// It implements the IFileEventBroker interface
+type PostgresBroker struct {
+	*Hub
+	DB  *gorm.DB
+	DSN string
+	// RetryInterval is the wait before listening again after losing the connection
+	RetryInterval time.Duration
+}
+
+// NewPostgresBroker creates a new Postgres broker
+// It takes the database to notify on and the URL to listen with as input
+func NewPostgresBroker(db *gorm.DB, dsn string) *PostgresBroker {
+	return &PostgresBroker{
+		Hub:           NewHub(),
+		DB:            db,
+		DSN:           dsn,
+		RetryInterval: 2 * time.Second,
+	}
+}
+
+// Publish notifies every replica, this one included, of an event
+// When the notification fails the event still reaches this replica
+func (b *PostgresBroker) Publish(event models.FileEvent) {
+	payload, err := json.Marshal(event)
+	if err == nil {
+		err = b.DB.Exec("SELECT pg_notify(?, ?)", notifyChannel, string(payload)).Error
+	}
+	if err != nil {
+		log.Printf("Error notifying event of file %s: %v", event.FileID, err)
+		b.Hub.Publish(event)
+	}
+}
+
+// Listen listens for the events of all replicas in the background
+// It reconnects when the connection is lost, events notified in between are missed
+func (b *PostgresBroker) Listen(ctx context.Context) {
+	go func() {
+		for {
+			err := b.listen(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Lost the file events connection, listening again in %v: %v", b.RetryInterval, err)
+			time.Sleep(b.RetryInterval)
+		}
+	}()
+}
+
+// listen hands the notifications of a connection to the hub until it fails
+func (b *PostgresBroker) listen(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, b.DSN)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+notifyChannel); err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var event models.FileEvent
+		if err := json.Unmarshal([]byte(notification.Payload), &event); err != nil {
+			log.Printf("Error decoding file event: %v", err)
+			continue
+		}
+		b.Hub.Publish(event)
+	}
+}
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+)
+
+// FileEncoding is a precompressed variant of an optimized file
+// e.g. the gzip, brotli or zstd encoding of a stylesheet
+type FileEncoding struct {
+	ID        string    `json:"id" gorm:"type:uuid;primary_key"`
+	FileID    string    `json:"file_id" gorm:"type:uuid;not null;index"`
+	Encoding  string    `json:"encoding" gorm:"type:varchar(32);not null"`
+	Path      string    `json:"path" gorm:"type:varchar(255);not null"`
+	Size      int64     `json:"size" gorm:"type:bigint;not null"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// FileEvent is a status or progress update of a file
+// It is streamed to clients, this is not stored
+type FileEvent struct {
+	FileID        string     `json:"file_id"`
+	UserID        string     `json:"user_id"`
+	Status        FileStatus `json:"status"`
+	Progress      int        `json:"progress"`
+	FailureReason *string    `json:"failure_reason,omitempty"`
+	Time          time.Time  `json:"time"`
+}
+
+// NewFileEvent returns the event for the current status of a file
+// Progress is a percentage
+func NewFileEvent(file *File, progress int) FileEvent {
+	return FileEvent{
+		FileID:        file.ID,
+		UserID:        file.UserID,
+		Status:        file.Status,
+		Progress:      progress,
+		FailureReason: file.FailureReason,
+		Time:          time.Now(),
+	}
+}
+
+// Final reports whether the file will not change anymore
+func (e FileEvent) Final() bool {
+	return e.Status == StatusCompleleted || e.Status == StatusFailed
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+)
+
+// MetadataPolicy decides what happens to the metadata of an image
+type MetadataPolicy string
+
+const (
+	// MetadataStrip removes all metadata
+	MetadataStrip MetadataPolicy = "strip"
+	// MetadataKeepCopyright keeps only the copyright and the ICC color profile
+	MetadataKeepCopyright MetadataPolicy = "keep_copyright"
+	// MetadataPreserve keeps all metadata
+	MetadataPreserve MetadataPolicy = "preserve"
+)
+
+// ImageMetadata is the metadata extracted from an uploaded image
+// It is read before the policy is applied, so it reflects the upload, except
+// for the width and height which are those of the image once auto-oriented
+type ImageMetadata struct {
+	Width        int        `json:"width"`
+	Height       int        `json:"height"`
+	Orientation  int        `json:"orientation"`
+	CameraMake   string     `json:"camera_make" gorm:"type:varchar(255)"`
+	CameraModel  string     `json:"camera_model" gorm:"type:varchar(255)"`
+	LensModel    string     `json:"lens_model" gorm:"type:varchar(255)"`
+	TakenAt      *time.Time `json:"taken_at"`
+	Artist       string     `json:"artist" gorm:"type:varchar(255)"`
+	Copyright    string     `json:"copyright" gorm:"type:varchar(255)"`
+	ColorSpace   string     `json:"color_space" gorm:"type:varchar(32)"`
+	ColorProfile string     `json:"color_profile" gorm:"type:varchar(255)"`
+	HasGPS       bool       `json:"has_gps"`
+}
@@ -0,0 +1,14 @@
+package models
+
+// LoginResult holds the tokens the user service issues on login
+// Users with two-factor authentication get an MFA token instead, they complete
+// the login at /login/mfa of the user service
+// It is not stored
+type LoginResult struct {
+	Token        string `json:"token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	MFARequired  bool   `json:"mfa_required,omitempty"`
+	MFAToken     string `json:"mfa_token,omitempty"`
+}
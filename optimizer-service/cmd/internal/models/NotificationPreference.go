@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// NotificationPreference holds how a user wants to hear about their files
+// Users without a preference get emails
+type NotificationPreference struct {
+	UserID      string    `json:"user_id" gorm:"type:uuid;primary_key"`
+	EmailOptOut bool      `json:"email_opt_out" gorm:"not null;default:false"`
+	UpdatedAt   time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
@@ -0,0 +1,61 @@
+package models
+
+import "time"
+
+// EventType is something that happened to a file
+type EventType string
+
+const (
+	EventFileUploaded   EventType = "file.uploaded"
+	EventFileProcessing EventType = "file.processing"
+	EventFileOptimized  EventType = "file.optimized"
+	EventFileFailed     EventType = "file.failed"
+	EventFileDeleted    EventType = "file.deleted"
+	// EventFileUpdated is a change that does not move the file to another status
+	EventFileUpdated EventType = "file.updated"
+)
+
+// EventForStatus returns the event of a file entering a status
+func EventForStatus(status FileStatus) EventType {
+	switch status {
+	case StatusUploaded:
+		return EventFileUploaded
+	case StatusProcessing:
+		return EventFileProcessing
+	case StatusCompleleted:
+		return EventFileOptimized
+	case StatusFailed:
+		return EventFileFailed
+	default:
+		return EventFileUpdated
+	}
+}
+
+// OutboxEvent is a change to a file waiting to be relayed to the sinks
+// It is written in the same transaction as the change itself
+type OutboxEvent struct {
+	ID     string    `json:"id" gorm:"type:uuid;primary_key"`
+	FileID string    `json:"file_id" gorm:"type:uuid;not null;index"`
+	UserID string    `json:"user_id" gorm:"type:uuid;not null"`
+	Type   EventType `json:"type" gorm:"type:varchar(64);not null"`
+	// Payload is the file as it was after the change, as JSON
+	Payload string `json:"payload" gorm:"type:text;not null"`
+	// LockedUntil is when the relay holding the event gives it up,
+	// or when a failed event is retried
+	LockedUntil *time.Time `json:"locked_until" gorm:"index"`
+	// PublishedAt is when every sink was done with the event
+	PublishedAt *time.Time `json:"published_at" gorm:"index"`
+	CreatedAt   time.Time  `json:"created_at" gorm:"autoCreateTime;index"`
+}
+
+// OutboxConsumption records what a sink did with an event
+// The relay skips the sinks that already processed an event,
+// which is how every sink gets every event once
+type OutboxConsumption struct {
+	EventID     string     `json:"event_id" gorm:"type:uuid;primary_key"`
+	Sink        string     `json:"sink" gorm:"type:varchar(64);primary_key"`
+	Attempts    int        `json:"attempts" gorm:"not null;default:0"`
+	LastError   *string    `json:"last_error" gorm:"type:text"`
+	ProcessedAt *time.Time `json:"processed_at"`
+	UpdatedAt   time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+}
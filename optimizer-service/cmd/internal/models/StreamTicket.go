@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// StreamTicket lets a browser open the event stream of a file
+// Browsers cannot set headers on EventSource and WebSocket requests, so they
+// send a ticket in the query instead of their bearer token. Tickets are
+// short-lived and used once, so they are harmless in logs
+type StreamTicket struct {
+	// ID is the SHA-256 hash of the ticket, the ticket itself is not stored
+	ID        string    `json:"-" gorm:"type:varchar(64);primary_key"`
+	UserID    string    `json:"user_id" gorm:"type:uuid;not null"`
+	FileID    string    `json:"file_id" gorm:"type:uuid;not null"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"not null;index"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
@@ -0,0 +1,20 @@
+package models
+
+// TokenIntrospection is the state of a token according to the user service
+// It follows RFC 7662, an inactive token has no other fields set
+// It is not stored
+type TokenIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+	// EmailVerified is whether the user verified their email address, it is not part of RFC 7662
+	EmailVerified bool `json:"email_verified,omitempty"`
+	// VerificationRequired is whether the verification policy of the user service
+	// restricts the user until they verify their email address, it is not part of RFC 7662
+	VerificationRequired bool `json:"verification_required,omitempty"`
+}
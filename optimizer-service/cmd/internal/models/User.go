@@ -0,0 +1,9 @@
+package models
+
+// User holds the contact details of a user
+// Users live in the user service, this is not stored
+type User struct {
+	ID        string  `json:"id"`
+	Email     string  `json:"email"`
+	Firstname *string `json:"firstname"`
+}
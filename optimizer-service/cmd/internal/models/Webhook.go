@@ -0,0 +1,72 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// WebhookEvents lists the events webhooks can subscribe to
+var WebhookEvents = []EventType{EventFileUploaded, EventFileOptimized, EventFileFailed, EventFileDeleted}
+
+// IsWebhookEvent reports whether webhooks can subscribe to an event
+func IsWebhookEvent(event EventType) bool {
+	for _, e := range WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhook is a URL a user wants file events posted to
+// Payloads are signed with the secret so the receiver can verify them
+type Webhook struct {
+	ID     string `json:"id" gorm:"type:uuid;primary_key"`
+	UserID string `json:"user_id" gorm:"type:uuid;not null;index"`
+	URL    string `json:"url" gorm:"type:varchar(2048);not null"`
+	Secret string `json:"-" gorm:"type:varchar(255);not null"`
+	// Events is a comma separated list of events, empty for all of them
+	Events    string    `json:"events" gorm:"type:varchar(255)"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// Subscribes reports whether the webhook wants an event
+func (w *Webhook) Subscribes(event EventType) bool {
+	if w.Events == "" {
+		return true
+	}
+	for _, e := range strings.Split(w.Events, ",") {
+		if EventType(strings.TrimSpace(e)) == event {
+			return true
+		}
+	}
+	return false
+}
+
+// DeliveryStatus is the state of a webhook delivery
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// DeliveryDead is a delivery that ran out of attempts
+	// It stays in the log until it is redelivered
+	DeliveryDead DeliveryStatus = "dead"
+)
+
+// WebhookDelivery is one event posted, or to be posted, to a webhook
+type WebhookDelivery struct {
+	ID            string         `json:"id" gorm:"type:uuid;primary_key"`
+	WebhookID     string         `json:"webhook_id" gorm:"type:uuid;not null;index"`
+	Event         EventType      `json:"event" gorm:"type:varchar(64);not null"`
+	Payload       string         `json:"payload" gorm:"type:text;not null"`
+	Status        DeliveryStatus `json:"status" gorm:"type:varchar(32);not null;index"`
+	Attempts      int            `json:"attempts" gorm:"not null;default:0"`
+	ResponseCode  *int           `json:"response_code"`
+	LastError     *string        `json:"last_error" gorm:"type:text"`
+	NextAttemptAt *time.Time     `json:"next_attempt_at" gorm:"index"`
+	DeliveredAt   *time.Time     `json:"delivered_at"`
+	CreatedAt     time.Time      `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt     time.Time      `json:"updated_at" gorm:"autoUpdateTime"`
+}
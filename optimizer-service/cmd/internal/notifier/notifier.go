@@ -0,0 +1,128 @@
+package notifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"optimizer-service/cmd/internal/app/interfaces"
+	"optimizer-service/cmd/internal/models"
+	"strings"
+)
+
+// Notifier emails users when their files are optimized or fail to be
+// It is the outbox sink for emails, a failed email is retried by the relay
+// with its own backoff, so the relay is never held up waiting
+type Notifier struct {
+	Sender      Sender
+	Users       interfaces.IUserRepository
+	Preferences interfaces.INotificationService
+	From        string
+	// FileURL is the page of the frontend that shows a file, links append the file ID
+	// The download route of this service needs a bearer token a mail client does not send
+	FileURL string
+}
+
+// NewNotifier creates a new notifier
+// It returns a pointer to the notifier
+func NewNotifier(sender Sender, users interfaces.IUserRepository, preferences interfaces.INotificationService, from, fileURL string) *Notifier {
+	return &Notifier{
+		Sender:      sender,
+		Users:       users,
+		Preferences: preferences,
+		From:        from,
+		FileURL:     strings.TrimSuffix(fileURL, "/"),
+	}
+}
+
+// Name identifies the notifier as an outbox sink
+func (n *Notifier) Name() string {
+	return "email"
+}
+
+// Handle emails the owner of a file that was optimized or failed to be
+// It returns an error if the email could not be sent, for the relay to retry
+func (n *Notifier) Handle(event *models.OutboxEvent) error {
+	if event.Type != models.EventFileOptimized && event.Type != models.EventFileFailed {
+		return nil
+	}
+
+	var file models.File
+	if err := json.Unmarshal([]byte(event.Payload), &file); err != nil {
+		return err
+	}
+	return n.Notify(&file)
+}
+
+// Notify emails the owner of a completed or failed file
+// Users who opted out are skipped
+// It returns an error if the email could not be sent
+func (n *Notifier) Notify(file *models.File) error {
+	var template *emailTemplate
+	switch file.Status {
+	case models.StatusCompleleted:
+		template = completedTemplate
+	case models.StatusFailed:
+		template = failedTemplate
+	default:
+		return nil
+	}
+
+	// Without the preference we cannot tell the user has not opted out
+	preference, err := n.Preferences.GetPreference(file.UserID)
+	if err != nil {
+		return err
+	}
+	if preference.EmailOptOut {
+		return nil
+	}
+
+	user, err := n.Users.GetUser(file.UserID)
+	if err != nil {
+		return fmt.Errorf("looking up user: %w", err)
+	}
+
+	msg := &Message{From: n.From, To: user.Email}
+	if err := template.render(msg, n.templateData(file, user)); err != nil {
+		return err
+	}
+
+	return n.Sender.Send(msg)
+}
+
+// templateData builds what the email shows about a file
+func (n *Notifier) templateData(file *models.File, user *models.User) *templateData {
+	data := &templateData{
+		Name:     "there",
+		FileName: file.UploadName,
+		Size:     formatBytes(file.Size),
+	}
+	// Files uploaded before the name was kept only have their stored name
+	if data.FileName == "" {
+		data.FileName = file.OriginalName
+	}
+	if user.Firstname != nil && *user.Firstname != "" {
+		data.Name = *user.Firstname
+	}
+	if file.FailureReason != nil {
+		data.Reason = *file.FailureReason
+	}
+
+	if file.OptimizedSize != nil {
+		saved := file.Size - *file.OptimizedSize
+		if saved < 0 {
+			saved = 0
+		}
+		data.OptimizedSize = formatBytes(*file.OptimizedSize)
+		data.Saved = formatBytes(saved)
+		data.SavedPercent = "0%"
+		if file.Size > 0 {
+			data.SavedPercent = fmt.Sprintf("%.1f%%", float64(saved)*100/float64(file.Size))
+		}
+	}
+
+	if n.FileURL != "" {
+		data.FileURL = n.FileURL + "/" + url.PathEscape(file.ID)
+	}
+
+	return data
+}
@@ -0,0 +1,358 @@
+package notifier
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"optimizer-service/cmd/internal/models"
+	"optimizer-service/cmd/lib/mocks"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// smtpMessage is a message received by the SMTP stand-in
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// smtpStandIn is an in-process SMTP server that records what it receives
+type smtpStandIn struct {
+	listener net.Listener
+	// failures is how many MAIL commands are rejected before accepting any
+	failures int
+
+	mu       sync.Mutex
+	attempts int
+	messages []smtpMessage
+}
+
+// newSMTPStandIn starts an SMTP stand-in on a random local port
+func newSMTPStandIn(t *testing.T, failures int) *smtpStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStandIn{listener: listener, failures: failures}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// sender returns an SMTP sender for the stand-in
+func (s *smtpStandIn) sender() *SMTPSender {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return NewSMTPSender("127.0.0.1", addr.Port, "", "")
+}
+
+// received returns the messages received so far
+func (s *smtpStandIn) received() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMessage(nil), s.messages...)
+}
+
+// attemptCount returns how many messages the sender tried to deliver
+func (s *smtpStandIn) attemptCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts
+}
+
+// serve speaks just enough SMTP for net/smtp
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP stand-in")
+
+	var msg smtpMessage
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch command {
+		case "EHLO", "HELO":
+			text.PrintfLine("250 localhost")
+		case "MAIL":
+			s.mu.Lock()
+			s.attempts++
+			reject := s.attempts <= s.failures
+			s.mu.Unlock()
+			if reject {
+				text.PrintfLine("451 try again later")
+				continue
+			}
+			msg = smtpMessage{from: between(line, "<", ">")}
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, between(line, "<", ">"))
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+// between returns the part of s between the first open and the next close
+func between(s, open, close string) string {
+	start := strings.Index(s, open)
+	end := strings.LastIndex(s, close)
+	if start < 0 || end < start {
+		return ""
+	}
+	return s[start+len(open) : end]
+}
+
+// parseMessage splits a received message into its subject, text and HTML
+func parseMessage(t *testing.T, data string) (string, string, string) {
+	m, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := multipart.NewReader(m.Body, params["boundary"])
+	bodies := map[string]string{}
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(quotedprintable.NewReader(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		bodies[mediaType] = string(body)
+	}
+
+	return subject, bodies["text/plain"], bodies["text/html"]
+}
+
+// completedFile returns a 2 MB file optimized down to 512 KB
+func completedFile() *models.File {
+	optimizedSize := int64(512 * 1024)
+	return &models.File{
+		ID:            "file-id",
+		UserID:        "user-id",
+		OriginalName:  "5f0c2a8e-6d1b-4c3e-9a7f-2b8d4e6f1a3c.png",
+		UploadName:    "holiday.png",
+		Size:          2 * 1024 * 1024,
+		OptimizedSize: &optimizedSize,
+		Status:        models.StatusCompleleted,
+	}
+}
+
+// newTestNotifier returns a notifier for user-id, who has not opted out
+func newTestNotifier(sender Sender) (*Notifier, *mocks.MockUserRepository, *mocks.MockNotificationService) {
+	users := new(mocks.MockUserRepository)
+	preferences := new(mocks.MockNotificationService)
+	firstname := "Jane"
+	users.On("GetUser", "user-id").Return(&models.User{ID: "user-id", Email: "jane@example.com", Firstname: &firstname}, nil)
+	preferences.On("GetPreference", "user-id").Return(&models.NotificationPreference{UserID: "user-id"}, nil)
+
+	n := NewNotifier(sender, users, preferences, "OptiMate <no-reply@optimate.test>", "https://optimate.test/files/")
+	return n, users, preferences
+}
+
+func TestNotifyCompleted(t *testing.T) {
+	server := newSMTPStandIn(t, 0)
+	n, _, _ := newTestNotifier(server.sender())
+
+	assert.NoError(t, n.Notify(completedFile()))
+
+	received := server.received()
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, "no-reply@optimate.test", received[0].from)
+		assert.Equal(t, []string{"jane@example.com"}, received[0].to)
+
+		subject, text, html := parseMessage(t, received[0].data)
+		assert.Equal(t, "Your file holiday.png is optimized", subject)
+		assert.Contains(t, text, "Hi Jane,")
+		assert.Contains(t, text, "You saved:      1.5 MB (75.0%)")
+		assert.Contains(t, text, "https://optimate.test/files/file-id\n")
+		assert.Contains(t, html, `<a href="https://optimate.test/files/file-id">`)
+		assert.Contains(t, html, "1.5 MB (75.0%)")
+	}
+}
+
+func TestNotifyFailed(t *testing.T) {
+	server := newSMTPStandIn(t, 0)
+	n, _, _ := newTestNotifier(server.sender())
+
+	reason := "The file content does not match its extension"
+	file := completedFile()
+	file.Status = models.StatusFailed
+	file.OptimizedSize = nil
+	file.FailureReason = &reason
+
+	assert.NoError(t, n.Notify(file))
+
+	received := server.received()
+	if assert.Len(t, received, 1) {
+		subject, text, html := parseMessage(t, received[0].data)
+		assert.Equal(t, "We could not optimize holiday.png", subject)
+		assert.Contains(t, text, "Reason: "+reason)
+		assert.Contains(t, html, "Reason: "+reason)
+	}
+}
+
+func TestNotifyLeavesRetriesToTheRelay(t *testing.T) {
+	server := newSMTPStandIn(t, 2)
+	n, _, _ := newTestNotifier(server.sender())
+
+	// Every failure is returned at once, the relay retries after its backoff
+	assert.Error(t, n.Notify(completedFile()))
+	assert.Equal(t, 1, server.attemptCount())
+	assert.Error(t, n.Notify(completedFile()))
+	assert.Empty(t, server.received())
+
+	assert.NoError(t, n.Notify(completedFile()))
+	assert.Len(t, server.received(), 1)
+	assert.Equal(t, 3, server.attemptCount())
+}
+
+func TestNotifyReturnsUserLookupErrors(t *testing.T) {
+	server := newSMTPStandIn(t, 0)
+	n, _, preferences := newTestNotifier(server.sender())
+
+	users := new(mocks.MockUserRepository)
+	users.On("GetUser", "user-id").Return(nil, errors.New("connection refused")).Once()
+	users.On("GetUser", "user-id").Return(&models.User{ID: "user-id", Email: "jane@example.com"}, nil)
+	n.Users = users
+
+	assert.Error(t, n.Notify(completedFile()))
+	assert.Empty(t, server.received())
+
+	assert.NoError(t, n.Notify(completedFile()))
+	users.AssertNumberOfCalls(t, "GetUser", 2)
+	preferences.AssertExpectations(t)
+	assert.Len(t, server.received(), 1)
+}
+
+func TestSMTPSenderTimesOut(t *testing.T) {
+	// A server that accepts connections and never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	sender := NewSMTPSender("127.0.0.1", listener.Addr().(*net.TCPAddr).Port, "", "")
+	sender.Timeout = 100 * time.Millisecond
+	n, _, _ := newTestNotifier(sender)
+
+	start := time.Now()
+	assert.Error(t, n.Notify(completedFile()))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestNotifySkipsUsersWhoOptedOut(t *testing.T) {
+	server := newSMTPStandIn(t, 0)
+	n, users, _ := newTestNotifier(server.sender())
+
+	preferences := new(mocks.MockNotificationService)
+	preferences.On("GetPreference", "user-id").Return(&models.NotificationPreference{UserID: "user-id", EmailOptOut: true}, nil)
+	n.Preferences = preferences
+
+	assert.NoError(t, n.Notify(completedFile()))
+	users.AssertNotCalled(t, "GetUser", "user-id")
+	assert.Empty(t, server.received())
+}
+
+func TestNotifySkipsUnfinishedFiles(t *testing.T) {
+	server := newSMTPStandIn(t, 0)
+	n, _, preferences := newTestNotifier(server.sender())
+
+	file := completedFile()
+	file.Status = models.StatusProcessing
+
+	assert.NoError(t, n.Notify(file))
+	preferences.AssertNotCalled(t, "GetPreference", "user-id")
+	assert.Empty(t, server.received())
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:                      "0 B",
+		1023:                   "1023 B",
+		1536:                   "1.5 KB",
+		5 * 1024 * 1024:        "5.0 MB",
+		3 * 1024 * 1024 * 1024: "3.0 GB",
+	}
+	for n, expected := range tests {
+		assert.Equal(t, expected, formatBytes(n), fmt.Sprint(n))
+	}
+}
+
+func TestHandleOutboxEvents(t *testing.T) {
+	server := newSMTPStandIn(t, 0)
+	n, _, _ := newTestNotifier(server.sender())
+
+	payload, err := json.Marshal(completedFile())
+	assert.NoError(t, err)
+
+	// Only finished files are worth an email
+	assert.NoError(t, n.Handle(&models.OutboxEvent{ID: "event-id", Type: models.EventFileUploaded, Payload: string(payload)}))
+	assert.Empty(t, server.received())
+
+	assert.NoError(t, n.Handle(&models.OutboxEvent{ID: "event-id", Type: models.EventFileOptimized, Payload: string(payload)}))
+	assert.Len(t, server.received(), 1)
+}
@@ -0,0 +1,106 @@
+package notifier
+
+import (
+	"crypto/tls"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// DefaultSMTPTimeout bounds the delivery of a message, a server that hangs
+// would otherwise hold up the outbox relay past its lease
+const DefaultSMTPTimeout = 30 * time.Second
+
+// Sender delivers email messages
+type Sender interface {
+	Send(msg *Message) error
+}
+
+// SMTPSender delivers messages to an SMTP server
+// It upgrades to TLS when the server offers STARTTLS
+type SMTPSender struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Timeout  time.Duration
+}
+
+// NewSMTPSender creates a new SMTP sender
+// No authentication is used when the username is empty
+func NewSMTPSender(host string, port int, username, password string) *SMTPSender {
+	return &SMTPSender{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		Timeout:  DefaultSMTPTimeout,
+	}
+}
+
+// Send delivers a message
+// It returns an error if the server does not accept it
+func (s *SMTPSender) Send(msg *Message) error {
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	// The envelope only takes the addresses, without display names
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+
+	// smtp.SendMail has no timeout, the same steps are taken under a deadline
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	conn, err := net.DialTimeout("tcp", addr, s.Timeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(s.Timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
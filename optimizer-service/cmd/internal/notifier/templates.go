@@ -0,0 +1,133 @@
+package notifier
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+)
+
+// templateData is what the email templates can show
+type templateData struct {
+	Name          string
+	FileName      string
+	Size          string
+	OptimizedSize string
+	Saved         string
+	SavedPercent  string
+	FileURL       string
+	Reason        string
+}
+
+const completedSubject = "Your file {{.FileName}} is optimized"
+
+const completedText = `Hi {{.Name}},
+
+Your file {{.FileName}} has been optimized.
+
+Original size:  {{.Size}}
+Optimized size: {{.OptimizedSize}}
+You saved:      {{.Saved}} ({{.SavedPercent}})
+{{if .FileURL}}
+Download it at {{.FileURL}}
+{{end}}
+The OptiMate team
+`
+
+const completedHTML = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; color: #222;">
+<p>Hi {{.Name}},</p>
+<p>Your file <strong>{{.FileName}}</strong> has been optimized.</p>
+<table cellpadding="4">
+<tr><td>Original size</td><td>{{.Size}}</td></tr>
+<tr><td>Optimized size</td><td>{{.OptimizedSize}}</td></tr>
+<tr><td>You saved</td><td><strong>{{.Saved}} ({{.SavedPercent}})</strong></td></tr>
+</table>
+{{if .FileURL}}<p><a href="{{.FileURL}}">Download your file</a></p>{{end}}
+<p>The OptiMate team</p>
+</body>
+</html>
+`
+
+const failedSubject = "We could not optimize {{.FileName}}"
+
+const failedText = `Hi {{.Name}},
+
+We could not optimize your file {{.FileName}}.
+
+Reason: {{.Reason}}
+
+Your original file is untouched.
+
+The OptiMate team
+`
+
+const failedHTML = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; color: #222;">
+<p>Hi {{.Name}},</p>
+<p>We could not optimize your file <strong>{{.FileName}}</strong>.</p>
+<p>Reason: {{.Reason}}</p>
+<p>Your original file is untouched.</p>
+<p>The OptiMate team</p>
+</body>
+</html>
+`
+
+// emailTemplate is the subject and bodies of one kind of email
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+var (
+	completedTemplate = newEmailTemplate("completed", completedSubject, completedText, completedHTML)
+	failedTemplate    = newEmailTemplate("failed", failedSubject, failedText, failedHTML)
+)
+
+// newEmailTemplate parses the templates of an email
+// It panics on invalid templates as they are compiled in
+func newEmailTemplate(name, subject, text, html string) *emailTemplate {
+	return &emailTemplate{
+		subject: texttemplate.Must(texttemplate.New(name + "-subject").Parse(subject)),
+		text:    texttemplate.Must(texttemplate.New(name + "-text").Parse(text)),
+		html:    htmltemplate.Must(htmltemplate.New(name + "-html").Parse(html)),
+	}
+}
+
+// render fills in the message subject and bodies
+func (t *emailTemplate) render(msg *Message, data *templateData) error {
+	subject := new(strings.Builder)
+	if err := t.subject.Execute(subject, data); err != nil {
+		return err
+	}
+	text := new(strings.Builder)
+	if err := t.text.Execute(text, data); err != nil {
+		return err
+	}
+	html := new(strings.Builder)
+	if err := t.html.Execute(html, data); err != nil {
+		return err
+	}
+
+	msg.Subject = subject.String()
+	msg.Text = text.String()
+	msg.HTML = html.String()
+	return nil
+}
+
+// formatBytes formats a size for humans, e.g. 1.5 MB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
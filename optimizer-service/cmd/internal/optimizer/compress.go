@@ -0,0 +1,163 @@
+package optimizer
+
+import (
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encoding is a content coding as used in the Accept-Encoding header
+type Encoding string
+
+const (
+	EncodingGzip   Encoding = "gzip"
+	EncodingBrotli Encoding = "br"
+	EncodingZstd   Encoding = "zstd"
+)
+
+// Encodings lists the precompressed encodings we produce
+// in the order we prefer to serve them
+var Encodings = []Encoding{EncodingBrotli, EncodingZstd, EncodingGzip}
+
+// compressibleTypes are the text-like extensions worth precompressing
+var compressibleTypes = map[string]bool{
+	".txt":  true,
+	".html": true,
+	".htm":  true,
+	".css":  true,
+	".js":   true,
+	".mjs":  true,
+	".json": true,
+	".xml":  true,
+	".svg":  true,
+	".csv":  true,
+	".md":   true,
+	".map":  true,
+	".wasm": true,
+}
+
+// IsCompressible reports whether files with the extension
+// should get precompressed encodings
+func IsCompressible(ext string) bool {
+	return compressibleTypes[strings.ToLower(ext)]
+}
+
+// Extension returns the file suffix used to store the encoding
+func (e Encoding) Extension() string {
+	switch e {
+	case EncodingGzip:
+		return ".gz"
+	case EncodingBrotli:
+		return ".br"
+	case EncodingZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// Compress writes the encoded form of src to dst
+// It returns an error if the encoding is unknown or compression fails
+func Compress(enc Encoding, src io.Reader, dst io.Writer) error {
+	var w io.WriteCloser
+	switch enc {
+	case EncodingGzip:
+		gw, err := gzip.NewWriterLevel(dst, gzip.BestCompression)
+		if err != nil {
+			return err
+		}
+		w = gw
+	case EncodingBrotli:
+		w = brotli.NewWriterLevel(dst, brotli.BestCompression)
+	case EncodingZstd:
+		zw, err := zstd.NewWriter(dst, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+		if err != nil {
+			return err
+		}
+		w = zw
+	default:
+		return &UnsupportedEncodingError{Encoding: enc}
+	}
+
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// UnsupportedEncodingError is returned for encodings we cannot produce
+type UnsupportedEncodingError struct {
+	Encoding Encoding
+}
+
+func (e *UnsupportedEncodingError) Error() string {
+	return "unsupported encoding " + string(e.Encoding)
+}
+
+// NegotiateEncoding picks the encoding to serve for an Accept-Encoding header
+// It only considers the available encodings and returns false when
+// the identity (uncompressed) representation should be served
+func NegotiateEncoding(acceptEncoding string, available []Encoding) (Encoding, bool) {
+	weights := parseAcceptEncoding(acceptEncoding)
+	wildcard, hasWildcard := weights["*"]
+
+	var best Encoding
+	bestWeight := 0.0
+	// Walk our preference order so ties go to the better compression
+	for _, enc := range Encodings {
+		if !containsEncoding(available, enc) {
+			continue
+		}
+		weight, ok := weights[string(enc)]
+		if !ok && hasWildcard {
+			weight, ok = wildcard, true
+		}
+		if !ok || weight <= bestWeight {
+			continue
+		}
+		best, bestWeight = enc, weight
+	}
+
+	return best, bestWeight > 0
+}
+
+// parseAcceptEncoding parses an Accept-Encoding header into coding weights
+func parseAcceptEncoding(header string) map[string]float64 {
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range fields[1:] {
+			key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if !found || strings.ToLower(strings.TrimSpace(key)) != "q" {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				q = 0
+			}
+			weight = q
+		}
+		weights[coding] = weight
+	}
+	return weights
+}
+
+// containsEncoding reports whether enc is in the list
+func containsEncoding(list []Encoding, enc Encoding) bool {
+	for _, e := range list {
+		if e == enc {
+			return true
+		}
+	}
+	return false
+}
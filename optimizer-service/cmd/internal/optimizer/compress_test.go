@@ -0,0 +1,79 @@
+package optimizer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	content := strings.Repeat("<p>Hello, OptiMate</p>\n", 100)
+
+	readers := map[Encoding]func(io.Reader) (io.Reader, error){
+		EncodingGzip: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		EncodingBrotli: func(r io.Reader) (io.Reader, error) {
+			return brotli.NewReader(r), nil
+		},
+		EncodingZstd: func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+	}
+
+	for _, enc := range Encodings {
+		encoded := new(bytes.Buffer)
+		err := Compress(enc, strings.NewReader(content), encoded)
+		assert.NoError(t, err)
+		assert.Less(t, encoded.Len(), len(content))
+
+		r, err := readers[enc](encoded)
+		assert.NoError(t, err)
+		decoded, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(decoded))
+	}
+}
+
+func TestCompressUnsupportedEncoding(t *testing.T) {
+	err := Compress("deflate", strings.NewReader("data"), io.Discard)
+	assert.Error(t, err)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	all := []Encoding{EncodingGzip, EncodingBrotli, EncodingZstd}
+
+	tests := []struct {
+		header    string
+		available []Encoding
+		expected  Encoding
+		ok        bool
+	}{
+		{"gzip, deflate, br, zstd", all, EncodingBrotli, true},
+		{"gzip, deflate", all, EncodingGzip, true},
+		{"br;q=0.2, gzip;q=0.8", all, EncodingGzip, true},
+		{"*", all, EncodingBrotli, true},
+		{"*, br;q=0", all, EncodingZstd, true},
+		{"br", []Encoding{EncodingGzip}, "", false},
+		{"identity", all, "", false},
+		{"", all, "", false},
+	}
+
+	for _, tt := range tests {
+		enc, ok := NegotiateEncoding(tt.header, tt.available)
+		assert.Equal(t, tt.ok, ok, tt.header)
+		assert.Equal(t, tt.expected, enc, tt.header)
+	}
+}
+
+func TestIsCompressible(t *testing.T) {
+	assert.True(t, IsCompressible(".css"))
+	assert.True(t, IsCompressible(".JSON"))
+	assert.False(t, IsCompressible(".jpg"))
+}
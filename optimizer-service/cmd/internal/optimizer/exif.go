@@ -0,0 +1,305 @@
+package optimizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+// EXIF tags we read or write
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagArtist           = 0x013B
+	tagCopyright        = 0x8298
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagLensModel        = 0xA434
+)
+
+// EXIF field types
+const (
+	typeASCII = 2
+	typeShort = 3
+	typeLong  = 4
+)
+
+// typeSizes is the size in bytes of one value of each field type
+var typeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+var errMalformedExif = errors.New("malformed exif")
+
+// exifEntry is a single IFD entry
+type exifEntry struct {
+	typ   uint16
+	count uint32
+	// offset of the value within the TIFF data
+	offset int
+}
+
+// exif is a parsed TIFF structure from an APP1 segment or eXIf chunk
+type exif struct {
+	tiff  []byte
+	order binary.ByteOrder
+	ifd0  map[uint16]exifEntry
+	sub   map[uint16]exifEntry
+}
+
+// parseExif parses the TIFF data of an EXIF block
+// It returns an error if the structure cannot be read
+func parseExif(tiff []byte) (*exif, error) {
+	if len(tiff) < 8 {
+		return nil, errMalformedExif
+	}
+
+	e := &exif{tiff: tiff}
+	switch string(tiff[:2]) {
+	case "II":
+		e.order = binary.LittleEndian
+	case "MM":
+		e.order = binary.BigEndian
+	default:
+		return nil, errMalformedExif
+	}
+
+	ifd0, err := e.readIFD(int(e.order.Uint32(tiff[4:8])))
+	if err != nil {
+		return nil, err
+	}
+	e.ifd0 = ifd0
+
+	// The Exif sub-IFD holds the capture details
+	e.sub = map[uint16]exifEntry{}
+	if pointer, ok := e.uint(ifd0, tagExifIFD); ok {
+		if sub, err := e.readIFD(int(pointer)); err == nil {
+			e.sub = sub
+		}
+	}
+
+	return e, nil
+}
+
+// readIFD reads the entries of the IFD at offset
+func (e *exif) readIFD(offset int) (map[uint16]exifEntry, error) {
+	if offset < 8 || offset+2 > len(e.tiff) {
+		return nil, errMalformedExif
+	}
+
+	count := int(e.order.Uint16(e.tiff[offset:]))
+	if offset+2+count*12 > len(e.tiff) {
+		return nil, errMalformedExif
+	}
+
+	entries := make(map[uint16]exifEntry, count)
+	for i := 0; i < count; i++ {
+		pos := offset + 2 + i*12
+		tag := e.order.Uint16(e.tiff[pos:])
+		typ := e.order.Uint16(e.tiff[pos+2:])
+		n := e.order.Uint32(e.tiff[pos+4:])
+
+		size, ok := typeSizes[typ]
+		if !ok {
+			continue
+		}
+		valueOffset := pos + 8
+		if int64(size)*int64(n) > 4 {
+			valueOffset = int(e.order.Uint32(e.tiff[pos+8:]))
+		}
+		if valueOffset < 0 || int64(valueOffset)+int64(size)*int64(n) > int64(len(e.tiff)) {
+			continue
+		}
+
+		entries[tag] = exifEntry{typ: typ, count: n, offset: valueOffset}
+	}
+
+	return entries, nil
+}
+
+// uint returns the value of a SHORT or LONG tag
+func (e *exif) uint(ifd map[uint16]exifEntry, tag uint16) (uint32, bool) {
+	entry, ok := ifd[tag]
+	if !ok || entry.count == 0 {
+		return 0, false
+	}
+	switch entry.typ {
+	case typeShort:
+		return uint32(e.order.Uint16(e.tiff[entry.offset:])), true
+	case typeLong:
+		return e.order.Uint32(e.tiff[entry.offset:]), true
+	default:
+		return 0, false
+	}
+}
+
+// string returns the value of an ASCII tag
+func (e *exif) string(ifd map[uint16]exifEntry, tag uint16) string {
+	entry, ok := ifd[tag]
+	if !ok || entry.typ != typeASCII {
+		return ""
+	}
+	value := e.tiff[entry.offset : entry.offset+int(entry.count)]
+	return strings.TrimSpace(string(bytes.TrimRight(value, "\x00")))
+}
+
+// orientation returns the EXIF orientation, 1 when it is missing or invalid
+func (e *exif) orientation() int {
+	if o, ok := e.uint(e.ifd0, tagOrientation); ok && o >= 1 && o <= 8 {
+		return int(o)
+	}
+	return 1
+}
+
+// resetOrientation sets the orientation tag to 1 in place
+// It is used once the pixels have been rotated
+func (e *exif) resetOrientation() {
+	entry, ok := e.ifd0[tagOrientation]
+	if !ok || entry.typ != typeShort {
+		return
+	}
+	e.order.PutUint16(e.tiff[entry.offset:], 1)
+}
+
+// takenAt returns the original capture time
+func (e *exif) takenAt() *time.Time {
+	value := e.string(e.sub, tagDateTimeOriginal)
+	if value == "" {
+		return nil
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", value)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// buildExif builds a minimal little-endian TIFF block
+// It holds the orientation, when it is not 1, and the given ASCII tags
+// and is used to keep a few tags while dropping everything else
+func buildExif(orientation int, tags map[uint16]string) []byte {
+	order := binary.LittleEndian
+	// IFD entries must be sorted by tag
+	keys := []uint16{tagArtist, tagCopyright}
+
+	entries := 0
+	if orientation > 1 {
+		entries++
+	}
+	for _, k := range keys {
+		if tags[k] != "" {
+			entries++
+		}
+	}
+	if entries == 0 {
+		return nil
+	}
+
+	// Header, IFD entry count, entries and the next-IFD offset
+	dataOffset := 8 + 2 + entries*12 + 4
+	out := make([]byte, dataOffset)
+	copy(out, "II")
+	order.PutUint16(out[2:], 42)
+	order.PutUint32(out[4:], 8)
+	order.PutUint16(out[8:], uint16(entries))
+
+	pos := 10
+	if orientation > 1 {
+		order.PutUint16(out[pos:], tagOrientation)
+		order.PutUint16(out[pos+2:], typeShort)
+		order.PutUint32(out[pos+4:], 1)
+		order.PutUint16(out[pos+8:], uint16(orientation))
+		pos += 12
+	}
+
+	for _, k := range keys {
+		value := tags[k]
+		if value == "" {
+			continue
+		}
+		data := append([]byte(value), 0)
+
+		order.PutUint16(out[pos:], k)
+		order.PutUint16(out[pos+2:], typeASCII)
+		order.PutUint32(out[pos+4:], uint32(len(data)))
+		if len(data) <= 4 {
+			copy(out[pos+8:], data)
+		} else {
+			order.PutUint32(out[pos+8:], uint32(len(out)))
+			out = append(out, data...)
+			// Values start on a word boundary
+			if len(out)%2 == 1 {
+				out = append(out, 0)
+			}
+		}
+		pos += 12
+	}
+
+	return out
+}
+
+// iccColorSpaces maps the ICC data color space signatures to names
+var iccColorSpaces = map[string]string{
+	"RGB ": "RGB",
+	"CMYK": "CMYK",
+	"GRAY": "Gray",
+	"Lab ": "Lab",
+	"YCbr": "YCbCr",
+}
+
+// parseICC returns the color space and description of an ICC profile
+func parseICC(profile []byte) (string, string) {
+	if len(profile) < 132 {
+		return "", ""
+	}
+
+	colorSpace := iccColorSpaces[string(profile[16:20])]
+
+	// Find the description in the tag table
+	tagCount := int(binary.BigEndian.Uint32(profile[128:132]))
+	for i := 0; i < tagCount && 132+i*12+12 <= len(profile); i++ {
+		pos := 132 + i*12
+		if string(profile[pos:pos+4]) != "desc" {
+			continue
+		}
+		offset := int(binary.BigEndian.Uint32(profile[pos+4:]))
+		size := int(binary.BigEndian.Uint32(profile[pos+8:]))
+		if offset < 0 || size < 12 || offset+size > len(profile) {
+			break
+		}
+		return colorSpace, parseICCText(profile[offset : offset+size])
+	}
+
+	return colorSpace, ""
+}
+
+// parseICCText reads a v2 "desc" or v4 "mluc" text element
+func parseICCText(element []byte) string {
+	switch string(element[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(element[8:12]))
+		if 12+n > len(element) {
+			return ""
+		}
+		return strings.TrimRight(string(element[12:12+n]), "\x00")
+	case "mluc":
+		// Use the first record, encoded as UTF-16BE
+		if len(element) < 28 {
+			return ""
+		}
+		length := int(binary.BigEndian.Uint32(element[20:24]))
+		offset := int(binary.BigEndian.Uint32(element[24:28]))
+		if offset+length > len(element) {
+			return ""
+		}
+		runes := make([]rune, 0, length/2)
+		for i := offset; i+1 < offset+length; i += 2 {
+			runes = append(runes, rune(binary.BigEndian.Uint16(element[i:])))
+		}
+		return strings.TrimRight(string(runes), "\x00")
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,487 @@
+package optimizer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"sort"
+)
+
+var (
+	// ErrMalformedGIF is returned when the GIF block structure cannot be read
+	ErrMalformedGIF = errors.New("malformed gif")
+	// ErrTooManyFrames is returned when an animation exceeds the frame limit
+	ErrTooManyFrames = errors.New("too many frames")
+	// ErrFrameTooLarge is returned when a frame exceeds the pixel limit
+	ErrFrameTooLarge = errors.New("frame too large")
+)
+
+// GIFOptions configures the GIF optimizer
+type GIFOptions struct {
+	// MaxFrames is the maximum number of frames we accept
+	MaxFrames int
+	// MaxFramePixels is the maximum width*height of the canvas
+	MaxFramePixels int
+	// MaxTotalPixels is the maximum pixels decoded across all frames
+	MaxTotalPixels int
+	// MaxColors caps the palette of each frame, between 2 and 256
+	MaxColors int
+	// Tolerance is the per-channel difference under which a pixel counts as
+	// unchanged between frames, 0 keeps the animation lossless
+	Tolerance uint8
+	// WebP converts the result to an animated WebP when set
+	WebP WebPEncoder
+}
+
+// DefaultGIFOptions returns lossless options with limits that keep
+// a worker within a few hundred megabytes
+func DefaultGIFOptions() GIFOptions {
+	return GIFOptions{
+		MaxFrames:      1000,
+		MaxFramePixels: 4096 * 4096,
+		MaxTotalPixels: 1 << 27,
+		MaxColors:      256,
+	}
+}
+
+// GIFOptimizer optimizes animated GIFs
+// It drops duplicate frames, shrinks palettes to the colors in use
+// and re-encodes every frame as the difference to the previous one
+type GIFOptimizer struct {
+	Options GIFOptions
+}
+
+// NewGIFOptimizer creates a new GIF optimizer
+// It returns a pointer to the optimizer
+func NewGIFOptimizer(opts GIFOptions) *GIFOptimizer {
+	return &GIFOptimizer{Options: opts}
+}
+
+// Supports reports whether the optimizer handles the extension
+func (o *GIFOptimizer) Supports(ext string) bool {
+	return ext == ".gif"
+}
+
+// OutputExt returns the extension of the optimized file
+func (o *GIFOptimizer) OutputExt(ext string) string {
+	if o.Options.WebP != nil {
+		return ".webp"
+	}
+	return ext
+}
+
+// Optimize reads a GIF from src and writes the optimized file to dst
+// It returns an error if the GIF is malformed or exceeds the limits
+func (o *GIFOptimizer) Optimize(src io.Reader, dst io.Writer) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	// Check the limits from the block structure before decoding any pixels
+	info, err := ScanGIF(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if err := o.checkLimits(info); err != nil {
+		return err
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	out := new(bytes.Buffer)
+	if err := gif.EncodeAll(out, o.optimize(g)); err != nil {
+		return err
+	}
+
+	// Keep the original when re-encoding did not pay off
+	result := out.Bytes()
+	if len(result) >= len(data) {
+		result = data
+	}
+
+	if o.Options.WebP != nil {
+		return o.Options.WebP.Encode(bytes.NewReader(result), dst)
+	}
+
+	_, err = dst.Write(result)
+	return err
+}
+
+// checkLimits enforces the frame and pixel limits
+func (o *GIFOptimizer) checkLimits(info *GIFInfo) error {
+	canvasPixels := info.Width * info.Height
+	if o.Options.MaxFrames > 0 && info.Frames > o.Options.MaxFrames {
+		return fmt.Errorf("%w: %d frames, the limit is %d", ErrTooManyFrames, info.Frames, o.Options.MaxFrames)
+	}
+	if o.Options.MaxFramePixels > 0 && (canvasPixels > o.Options.MaxFramePixels || info.MaxFramePixels > o.Options.MaxFramePixels) {
+		return fmt.Errorf("%w: %dx%d, the limit is %d pixels", ErrFrameTooLarge, info.Width, info.Height, o.Options.MaxFramePixels)
+	}
+	if o.Options.MaxTotalPixels > 0 && canvasPixels*info.Frames > o.Options.MaxTotalPixels {
+		return fmt.Errorf("%w: %d frames of %dx%d, the limit is %d pixels", ErrFrameTooLarge, info.Frames, info.Width, info.Height, o.Options.MaxTotalPixels)
+	}
+	return nil
+}
+
+// optimize re-encodes the decoded animation
+func (o *GIFOptimizer) optimize(g *gif.GIF) *gif.GIF {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+
+	// Frames can only be diffed against each other when every composed
+	// frame is opaque, otherwise pixels may need to turn transparent again
+	hasTransparency := false
+	c := newComposer(bounds)
+	for i := range g.Image {
+		if !isOpaque(c.next(g.Image[i], disposalAt(g, i))) {
+			hasTransparency = true
+			break
+		}
+	}
+
+	out := &gif.GIF{
+		LoopCount: g.LoopCount,
+		Config:    image.Config{Width: g.Config.Width, Height: g.Config.Height},
+	}
+
+	// displayed is what a viewer sees after the frames we emitted so far
+	displayed := image.NewRGBA(bounds)
+	c = newComposer(bounds)
+	for i := range g.Image {
+		canvas := c.next(g.Image[i], disposalAt(g, i))
+		delay := 0
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+
+		rect := changedRect(canvas, displayed, o.Options.Tolerance)
+		if i > 0 && rect.Empty() {
+			// Duplicate frame, show the previous one for longer
+			out.Delay[len(out.Delay)-1] += delay
+			continue
+		}
+
+		disposal := byte(gif.DisposalNone)
+		if i == 0 || hasTransparency {
+			rect = bounds
+		}
+		if hasTransparency {
+			disposal = gif.DisposalBackground
+		}
+
+		var skip *image.RGBA
+		if i > 0 && !hasTransparency {
+			skip = displayed
+		}
+
+		frame := o.encodeFrame(canvas, skip, rect)
+		out.Image = append(out.Image, frame)
+		out.Delay = append(out.Delay, delay)
+		out.Disposal = append(out.Disposal, disposal)
+
+		// Track the emitted pixels rather than the canvas, so lossy
+		// differences do not add up from frame to frame
+		op := draw.Over
+		if hasTransparency {
+			op = draw.Src
+		}
+		draw.Draw(displayed, rect, frame, rect.Min, op)
+	}
+
+	return out
+}
+
+// encodeFrame builds a paletted frame for rect of the canvas
+// Pixels within tolerance of skip are left transparent so the
+// previous frame shows through
+func (o *GIFOptimizer) encodeFrame(canvas, skip *image.RGBA, rect image.Rectangle) *image.Paletted {
+	counts := make(map[color.RGBA]int)
+	transparent := make([]bool, rect.Dx()*rect.Dy())
+	needsTransparent := false
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			c := canvas.RGBAAt(x, y)
+			if c.A == 0 || (skip != nil && similar(c, skip.RGBAAt(x, y), o.Options.Tolerance)) {
+				transparent[(y-rect.Min.Y)*rect.Dx()+(x-rect.Min.X)] = true
+				needsTransparent = true
+				continue
+			}
+			counts[c]++
+		}
+	}
+
+	maxColors := o.Options.MaxColors
+	if maxColors < 2 || maxColors > 256 {
+		maxColors = 256
+	}
+	if needsTransparent {
+		maxColors--
+	}
+
+	palette, lookup := reducePalette(counts, maxColors)
+	transparentIndex := uint8(len(palette))
+	if needsTransparent {
+		palette = append(palette, color.RGBA{})
+	}
+
+	frame := image.NewPaletted(rect, palette)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			offset := frame.PixOffset(x, y)
+			if transparent[(y-rect.Min.Y)*rect.Dx()+(x-rect.Min.X)] {
+				frame.Pix[offset] = transparentIndex
+				continue
+			}
+			frame.Pix[offset] = lookup[canvas.RGBAAt(x, y)]
+		}
+	}
+
+	return frame
+}
+
+// reducePalette builds a palette of at most maxColors from the used colors
+// The most used colors are kept, the rest map to their nearest kept color
+// It returns the palette and the palette index of every used color
+func reducePalette(counts map[color.RGBA]int, maxColors int) (color.Palette, map[color.RGBA]uint8) {
+	colors := make([]color.RGBA, 0, len(counts))
+	for c := range counts {
+		colors = append(colors, c)
+	}
+	sort.Slice(colors, func(i, j int) bool {
+		if counts[colors[i]] != counts[colors[j]] {
+			return counts[colors[i]] > counts[colors[j]]
+		}
+		return colorKey(colors[i]) < colorKey(colors[j])
+	})
+
+	kept := colors
+	if len(kept) > maxColors {
+		kept = colors[:maxColors]
+	}
+
+	palette := make(color.Palette, 0, len(kept)+1)
+	lookup := make(map[color.RGBA]uint8, len(colors))
+	for i, c := range kept {
+		palette = append(palette, c)
+		lookup[c] = uint8(i)
+	}
+	for _, c := range colors[len(kept):] {
+		lookup[c] = uint8(nearest(kept, c))
+	}
+
+	return palette, lookup
+}
+
+// nearest returns the index of the closest color in the list
+func nearest(list []color.RGBA, c color.RGBA) int {
+	best, bestDistance := 0, -1
+	for i, p := range list {
+		dr, dg, db := int(p.R)-int(c.R), int(p.G)-int(c.G), int(p.B)-int(c.B)
+		distance := dr*dr + dg*dg + db*db
+		if bestDistance < 0 || distance < bestDistance {
+			best, bestDistance = i, distance
+		}
+	}
+	return best
+}
+
+// colorKey packs a color into an integer, used for a stable sort order
+func colorKey(c color.RGBA) uint32 {
+	return uint32(c.R)<<24 | uint32(c.G)<<16 | uint32(c.B)<<8 | uint32(c.A)
+}
+
+// changedRect returns the bounding box of the pixels that differ
+// between the two images by more than the tolerance
+func changedRect(a, b *image.RGBA, tolerance uint8) image.Rectangle {
+	rect := image.Rectangle{}
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if similar(a.RGBAAt(x, y), b.RGBAAt(x, y), tolerance) {
+				continue
+			}
+			rect = rect.Union(image.Rect(x, y, x+1, y+1))
+		}
+	}
+	return rect
+}
+
+// similar reports whether no channel differs by more than the tolerance
+// Transparent pixels are only similar to other transparent pixels
+func similar(a, b color.RGBA, tolerance uint8) bool {
+	if a.A == 0 || b.A == 0 {
+		return a.A == b.A
+	}
+	return absDiff(a.R, b.R) <= tolerance &&
+		absDiff(a.G, b.G) <= tolerance &&
+		absDiff(a.B, b.B) <= tolerance &&
+		absDiff(a.A, b.A) <= tolerance
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// isOpaque reports whether every pixel of the image is opaque
+func isOpaque(img *image.RGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// disposalAt returns the disposal method of frame i
+func disposalAt(g *gif.GIF, i int) byte {
+	if i < len(g.Disposal) {
+		return g.Disposal[i]
+	}
+	return 0
+}
+
+// composer renders the frames of an animation onto a canvas
+// following their disposal methods, like a viewer would
+type composer struct {
+	canvas       *image.RGBA
+	saved        *image.RGBA
+	lastRect     image.Rectangle
+	lastDisposal byte
+}
+
+func newComposer(bounds image.Rectangle) *composer {
+	return &composer{canvas: image.NewRGBA(bounds)}
+}
+
+// next disposes the previous frame, draws the frame and returns the canvas
+// The returned canvas is reused by the following call
+func (c *composer) next(frame *image.Paletted, disposal byte) *image.RGBA {
+	switch c.lastDisposal {
+	case gif.DisposalBackground:
+		draw.Draw(c.canvas, c.lastRect, image.Transparent, image.Point{}, draw.Src)
+	case gif.DisposalPrevious:
+		if c.saved != nil {
+			draw.Draw(c.canvas, c.lastRect, c.saved, c.lastRect.Min, draw.Src)
+		}
+	}
+
+	if disposal == gif.DisposalPrevious {
+		if c.saved == nil {
+			c.saved = image.NewRGBA(c.canvas.Bounds())
+		}
+		copy(c.saved.Pix, c.canvas.Pix)
+	}
+
+	draw.Draw(c.canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	c.lastRect = frame.Bounds().Intersect(c.canvas.Bounds())
+	c.lastDisposal = disposal
+
+	return c.canvas
+}
+
+// GIFInfo describes a GIF as read from its block structure
+type GIFInfo struct {
+	Width          int
+	Height         int
+	Frames         int
+	MaxFramePixels int
+}
+
+// ScanGIF reads the block structure of a GIF without decoding any pixels
+// It returns the canvas size, the frame count and the largest frame
+func ScanGIF(r io.Reader) (*GIFInfo, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedGIF, err)
+	}
+	if string(header[:6]) != "GIF87a" && string(header[:6]) != "GIF89a" {
+		return nil, fmt.Errorf("%w: bad signature", ErrMalformedGIF)
+	}
+
+	info := &GIFInfo{
+		Width:  int(binary.LittleEndian.Uint16(header[6:8])),
+		Height: int(binary.LittleEndian.Uint16(header[8:10])),
+	}
+
+	// Skip the global color table
+	if header[10]&0x80 != 0 {
+		if _, err := br.Discard(3 * (1 << ((header[10] & 0x07) + 1))); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedGIF, err)
+		}
+	}
+
+	for {
+		introducer, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedGIF, err)
+		}
+
+		switch introducer {
+		case 0x21: // Extension
+			if _, err := br.ReadByte(); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrMalformedGIF, err)
+			}
+			if err := skipSubBlocks(br); err != nil {
+				return nil, err
+			}
+		case 0x2C: // Image descriptor
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(br, descriptor); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrMalformedGIF, err)
+			}
+			width := int(binary.LittleEndian.Uint16(descriptor[4:6]))
+			height := int(binary.LittleEndian.Uint16(descriptor[6:8]))
+			if width*height > info.MaxFramePixels {
+				info.MaxFramePixels = width * height
+			}
+			if descriptor[8]&0x80 != 0 {
+				if _, err := br.Discard(3 * (1 << ((descriptor[8] & 0x07) + 1))); err != nil {
+					return nil, fmt.Errorf("%w: %v", ErrMalformedGIF, err)
+				}
+			}
+			// LZW minimum code size
+			if _, err := br.ReadByte(); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrMalformedGIF, err)
+			}
+			if err := skipSubBlocks(br); err != nil {
+				return nil, err
+			}
+			info.Frames++
+		case 0x3B: // Trailer
+			return info, nil
+		default:
+			return nil, fmt.Errorf("%w: unknown block 0x%02x", ErrMalformedGIF, introducer)
+		}
+	}
+}
+
+// skipSubBlocks skips a sequence of data sub-blocks
+func skipSubBlocks(br *bufio.Reader) error {
+	for {
+		size, err := br.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedGIF, err)
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := br.Discard(int(size)); err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedGIF, err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package optimizer
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// animation builds a 64x64 animation with a moving square
+// The third frame duplicates the second one
+func animation() *gif.GIF {
+	bounds := image.Rect(0, 0, 64, 64)
+	red := color.RGBA{R: 0xff, A: 0xff}
+	blue := color.RGBA{B: 0xff, A: 0xff}
+
+	frame := func(square image.Rectangle) *image.Paletted {
+		img := image.NewPaletted(bounds, palette.Plan9)
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				if image.Pt(x, y).In(square) {
+					img.Set(x, y, blue)
+				} else {
+					img.Set(x, y, red)
+				}
+			}
+		}
+		return img
+	}
+
+	return &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rectangle{}),
+			frame(image.Rect(4, 4, 12, 12)),
+			frame(image.Rect(4, 4, 12, 12)),
+			frame(image.Rect(20, 20, 28, 28)),
+		},
+		Delay:    []int{10, 10, 10, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalNone, gif.DisposalNone, gif.DisposalNone},
+		Config:   image.Config{Width: 64, Height: 64},
+	}
+}
+
+// composeAll renders every frame like a viewer would
+func composeAll(g *gif.GIF) []*image.RGBA {
+	c := newComposer(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	frames := make([]*image.RGBA, 0, len(g.Image))
+	for i := range g.Image {
+		canvas := c.next(g.Image[i], disposalAt(g, i))
+		frame := image.NewRGBA(canvas.Bounds())
+		copy(frame.Pix, canvas.Pix)
+		// Repeat the frame for every 10ms so different delays compare equal
+		for d := 0; d < g.Delay[i]; d += 10 {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+func TestGIFOptimizerLossless(t *testing.T) {
+	source := new(bytes.Buffer)
+	assert.NoError(t, gif.EncodeAll(source, animation()))
+
+	out := new(bytes.Buffer)
+	err := NewGIFOptimizer(DefaultGIFOptions()).Optimize(bytes.NewReader(source.Bytes()), out)
+	assert.NoError(t, err)
+	assert.Less(t, out.Len(), source.Len())
+
+	original, err := gif.DecodeAll(bytes.NewReader(source.Bytes()))
+	assert.NoError(t, err)
+	optimized, err := gif.DecodeAll(bytes.NewReader(out.Bytes()))
+	assert.NoError(t, err)
+
+	// The duplicate frame is merged into the previous one
+	assert.Len(t, optimized.Image, 3)
+	assert.Equal(t, []int{10, 20, 10}, optimized.Delay)
+
+	// Later frames only cover the changed pixels
+	assert.Equal(t, image.Rect(4, 4, 12, 12), optimized.Image[1].Bounds())
+
+	// Palettes only hold the colors in use, padded to a power of two
+	assert.LessOrEqual(t, len(optimized.Image[0].Palette), 2)
+
+	assert.Equal(t, composeAll(original), composeAll(optimized))
+}
+
+func TestGIFOptimizerLossyTolerance(t *testing.T) {
+	g := animation()
+	// Repeat the second frame with a slightly different red, within the tolerance
+	nearRed := color.RGBA{R: 0xfa, A: 0xff}
+	g.Image[3] = image.NewPaletted(g.Image[2].Bounds(), color.Palette{nearRed, color.RGBA{B: 0xff, A: 0xff}})
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			if r, _, _, _ := g.Image[2].At(x, y).RGBA(); r == 0xffff {
+				g.Image[3].Set(x, y, nearRed)
+			} else {
+				g.Image[3].Set(x, y, g.Image[2].At(x, y))
+			}
+		}
+	}
+
+	source := new(bytes.Buffer)
+	assert.NoError(t, gif.EncodeAll(source, g))
+
+	opts := DefaultGIFOptions()
+	opts.Tolerance = 8
+
+	out := new(bytes.Buffer)
+	assert.NoError(t, NewGIFOptimizer(opts).Optimize(bytes.NewReader(source.Bytes()), out))
+
+	optimized, err := gif.DecodeAll(bytes.NewReader(out.Bytes()))
+	assert.NoError(t, err)
+	assert.Len(t, optimized.Image, 2)
+	assert.Equal(t, []int{10, 30}, optimized.Delay)
+}
+
+func TestGIFOptimizerTransparentAnimation(t *testing.T) {
+	bounds := image.Rect(0, 0, 32, 32)
+	pal := color.Palette{color.RGBA{}, color.RGBA{G: 0xff, A: 0xff}}
+
+	g := &gif.GIF{Config: image.Config{Width: 32, Height: 32}}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(bounds, pal)
+		for y := i * 8; y < i*8+8; y++ {
+			for x := i * 8; x < i*8+8; x++ {
+				frame.SetColorIndex(x, y, 1)
+			}
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+
+	source := new(bytes.Buffer)
+	assert.NoError(t, gif.EncodeAll(source, g))
+
+	out := new(bytes.Buffer)
+	assert.NoError(t, NewGIFOptimizer(DefaultGIFOptions()).Optimize(bytes.NewReader(source.Bytes()), out))
+
+	original, err := gif.DecodeAll(bytes.NewReader(source.Bytes()))
+	assert.NoError(t, err)
+	optimized, err := gif.DecodeAll(bytes.NewReader(out.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, composeAll(original), composeAll(optimized))
+}
+
+func TestGIFOptimizerLimits(t *testing.T) {
+	source := new(bytes.Buffer)
+	assert.NoError(t, gif.EncodeAll(source, animation()))
+
+	opts := DefaultGIFOptions()
+	opts.MaxFrames = 2
+	err := NewGIFOptimizer(opts).Optimize(bytes.NewReader(source.Bytes()), io.Discard)
+	assert.True(t, errors.Is(err, ErrTooManyFrames))
+
+	opts = DefaultGIFOptions()
+	opts.MaxFramePixels = 32 * 32
+	err = NewGIFOptimizer(opts).Optimize(bytes.NewReader(source.Bytes()), io.Discard)
+	assert.True(t, errors.Is(err, ErrFrameTooLarge))
+
+	opts = DefaultGIFOptions()
+	opts.MaxTotalPixels = 64 * 64 * 3
+	err = NewGIFOptimizer(opts).Optimize(bytes.NewReader(source.Bytes()), io.Discard)
+	assert.True(t, errors.Is(err, ErrFrameTooLarge))
+}
+
+func TestScanGIF(t *testing.T) {
+	source := new(bytes.Buffer)
+	assert.NoError(t, gif.EncodeAll(source, animation()))
+
+	info, err := ScanGIF(bytes.NewReader(source.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, &GIFInfo{Width: 64, Height: 64, Frames: 4, MaxFramePixels: 64 * 64}, info)
+
+	_, err = ScanGIF(strings.NewReader("not a gif at all"))
+	assert.True(t, errors.Is(err, ErrMalformedGIF))
+
+	// A truncated file is malformed too
+	_, err = ScanGIF(bytes.NewReader(source.Bytes()[:source.Len()/2]))
+	assert.True(t, errors.Is(err, ErrMalformedGIF))
+}
+
+type stubWebPEncoder struct {
+	input []byte
+}
+
+func (s *stubWebPEncoder) Encode(src io.Reader, dst io.Writer) error {
+	data, err := io.ReadAll(src)
+	s.input = data
+	_, _ = dst.Write([]byte("RIFF....WEBP"))
+	return err
+}
+
+func TestGIFOptimizerConvertsToWebP(t *testing.T) {
+	source := new(bytes.Buffer)
+	assert.NoError(t, gif.EncodeAll(source, animation()))
+
+	encoder := &stubWebPEncoder{}
+	opts := DefaultGIFOptions()
+	opts.WebP = encoder
+	o := NewGIFOptimizer(opts)
+
+	out := new(bytes.Buffer)
+	assert.NoError(t, o.Optimize(bytes.NewReader(source.Bytes()), out))
+	assert.Equal(t, ".webp", o.OutputExt(".gif"))
+	assert.Equal(t, "RIFF....WEBP", out.String())
+
+	// The encoder gets the optimized GIF
+	optimized, err := gif.DecodeAll(bytes.NewReader(encoder.input))
+	assert.NoError(t, err)
+	assert.Len(t, optimized.Image, 3)
+}
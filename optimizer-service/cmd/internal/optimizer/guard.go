@@ -0,0 +1,124 @@
+package optimizer
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrBudgetExceeded is returned when a job goes over its budget
+	ErrBudgetExceeded = errors.New("job budget exceeded")
+	// ErrOverloaded is returned when too many timed out jobs are still running
+	ErrOverloaded = errors.New("optimizer overloaded")
+)
+
+// abandoned is the number of jobs that timed out and are still running
+// It is shared by every budget since they all use the memory of the process
+var abandoned atomic.Int64
+
+// Budget limits the resources a single optimization job may use
+// A zero value disables the corresponding check
+type Budget struct {
+	// Timeout is the time the optimizer may run for
+	Timeout time.Duration
+	// MaxBytes is the largest upload we read into memory
+	MaxBytes int64
+	// MaxMemory is the largest estimated size of the decoded image
+	MaxMemory int64
+	// MaxAbandoned is the number of timed out jobs that may still be running
+	// before new jobs are refused
+	MaxAbandoned int
+}
+
+// DefaultBudget returns the budget used when none is configured
+func DefaultBudget() Budget {
+	return Budget{
+		Timeout:      2 * time.Minute,
+		MaxBytes:     50 << 20,
+		MaxMemory:    512 << 20,
+		MaxAbandoned: 4,
+	}
+}
+
+// CheckSize returns an error if an upload of size bytes is over budget
+func (b Budget) CheckSize(size int64) error {
+	if b.MaxBytes > 0 && size > b.MaxBytes {
+		return fmt.Errorf("%w: %d bytes exceed %d", ErrBudgetExceeded, size, b.MaxBytes)
+	}
+	return nil
+}
+
+// CheckMemory returns an error if decoding the image is over budget
+func (b Budget) CheckMemory(info *ImageInfo) error {
+	if b.MaxMemory > 0 && info.DecodedBytes() > b.MaxMemory {
+		return fmt.Errorf("%w: decoding needs about %d bytes, the limit is %d", ErrBudgetExceeded, info.DecodedBytes(), b.MaxMemory)
+	}
+	return nil
+}
+
+// PanicError is returned when an optimizer panics
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("optimizer panicked: %v", e.Value)
+}
+
+// States of a job started by Run
+const (
+	jobRunning int32 = iota
+	jobFinished
+	jobAbandoned
+)
+
+// Run runs fn in its own goroutine and isolates the caller from it
+// A panic is returned as a *PanicError, and once the timeout passes
+// Run stops waiting and returns ErrBudgetExceeded
+// Go cannot stop fn, so it keeps running until it returns. Once
+// MaxAbandoned of those are still running, Run refuses new jobs with
+// ErrOverloaded instead of piling them up
+func (b Budget) Run(fn func() error) error {
+	if n := abandoned.Load(); b.MaxAbandoned > 0 && n >= int64(b.MaxAbandoned) {
+		return fmt.Errorf("%w: %d timed out jobs are still running", ErrOverloaded, n)
+	}
+
+	var state atomic.Int32
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if !state.CompareAndSwap(jobRunning, jobFinished) {
+				abandoned.Add(-1)
+			}
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				done <- &PanicError{Value: r, Stack: debug.Stack()}
+			}
+		}()
+		done <- fn()
+	}()
+
+	if b.Timeout <= 0 {
+		return <-done
+	}
+
+	timer := time.NewTimer(b.Timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		// The job may have finished while the timer fired
+		if !state.CompareAndSwap(jobRunning, jobAbandoned) {
+			return <-done
+		}
+		abandoned.Add(1)
+		return fmt.Errorf("%w: timed out after %s", ErrBudgetExceeded, b.Timeout)
+	}
+}
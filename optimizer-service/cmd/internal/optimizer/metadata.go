@@ -0,0 +1,616 @@
+package optimizer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"optimizer-service/cmd/internal/models"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// MetadataOptions decides how the metadata of an image is handled
+type MetadataOptions struct {
+	Policy models.MetadataPolicy
+	// AutoOrient rotates the pixels upright from the EXIF orientation
+	AutoOrient bool
+	// Quality is the JPEG quality used when a JPEG has to be re-encoded
+	Quality int
+}
+
+// DefaultMetadataOptions strips all metadata and rotates images upright
+func DefaultMetadataOptions() MetadataOptions {
+	return MetadataOptions{
+		Policy:     models.MetadataStrip,
+		AutoOrient: true,
+		Quality:    90,
+	}
+}
+
+// ProcessMetadata extracts the metadata of an image and applies the policy
+// Formats without metadata support are returned unchanged
+// It returns the new content, the extracted metadata and an error
+func ProcessMetadata(data []byte, format string, opts MetadataOptions) ([]byte, *models.ImageMetadata, error) {
+	var (
+		out  []byte
+		meta *models.ImageMetadata
+		err  error
+	)
+	switch format {
+	case FormatJPEG:
+		out, meta, err = processJPEG(data, opts)
+	case FormatPNG:
+		out, meta, err = processPNG(data, opts)
+	default:
+		return data, nil, nil
+	}
+	if meta != nil {
+		sanitizeMetadata(meta)
+	}
+	return out, meta, err
+}
+
+// sanitizeMetadata makes the extracted texts fit their columns
+// The image keeps them as they were, only the stored copy is changed
+func sanitizeMetadata(meta *models.ImageMetadata) {
+	for _, field := range []struct {
+		value *string
+		size  int
+	}{
+		{&meta.CameraMake, 255},
+		{&meta.CameraModel, 255},
+		{&meta.LensModel, 255},
+		{&meta.Artist, 255},
+		{&meta.Copyright, 255},
+		{&meta.ColorSpace, 32},
+		{&meta.ColorProfile, 255},
+	} {
+		*field.value = sanitizeText(*field.value, field.size)
+	}
+}
+
+// sanitizeText returns a text as valid UTF-8 without NULs, cut to size characters
+// EXIF ASCII and PNG text are often Latin-1, so invalid UTF-8 is read as Latin-1
+func sanitizeText(text string, size int) string {
+	runes := []rune(text)
+	if !utf8.ValidString(text) {
+		runes = make([]rune, len(text))
+		for i := 0; i < len(text); i++ {
+			runes[i] = rune(text[i])
+		}
+	}
+
+	cleaned := make([]rune, 0, len(runes))
+	for _, r := range runes {
+		if r == 0 {
+			continue
+		}
+		if len(cleaned) == size {
+			break
+		}
+		cleaned = append(cleaned, r)
+	}
+	return strings.TrimSpace(string(cleaned))
+}
+
+// JPEG markers we look at
+const (
+	markerSOS   = 0xDA
+	markerEOI   = 0xD9
+	markerAPP0  = 0xE0
+	markerAPP1  = 0xE1
+	markerAPP2  = 0xE2
+	markerAPP14 = 0xEE
+	markerAPP15 = 0xEF
+	markerCOM   = 0xFE
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	iccHeader  = []byte("ICC_PROFILE\x00")
+)
+
+// jpegSegment is a marker segment before the scan data
+type jpegSegment struct {
+	marker  byte
+	raw     []byte
+	payload []byte
+}
+
+// isMetadata reports whether the segment only carries metadata
+// JFIF (APP0) and Adobe (APP14) segments affect decoding and are not metadata
+func (s jpegSegment) isMetadata() bool {
+	return (s.marker >= markerAPP1 && s.marker <= markerAPP15 && s.marker != markerAPP14) || s.marker == markerCOM
+}
+
+func (s jpegSegment) isExif() bool {
+	return s.marker == markerAPP1 && bytes.HasPrefix(s.payload, exifHeader)
+}
+
+func (s jpegSegment) isICC() bool {
+	return s.marker == markerAPP2 && bytes.HasPrefix(s.payload, iccHeader) && len(s.payload) >= len(iccHeader)+2
+}
+
+// splitJPEG splits a JPEG into the segments before the scan and the rest
+func splitJPEG(data []byte) ([]jpegSegment, []byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, nil, fmt.Errorf("%w: missing SOI", ErrMalformedImage)
+	}
+
+	var segments []jpegSegment
+	pos := 2
+	for pos+1 < len(data) {
+		if data[pos] != 0xFF {
+			return nil, nil, fmt.Errorf("%w: expected a marker at %d", ErrMalformedImage, pos)
+		}
+		// Skip fill bytes
+		if data[pos+1] == 0xFF {
+			pos++
+			continue
+		}
+
+		marker := data[pos+1]
+		if marker == markerSOS || marker == markerEOI {
+			return segments, data[pos:], nil
+		}
+
+		// Standalone markers have no length
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			segments = append(segments, jpegSegment{marker: marker, raw: data[pos : pos+2]})
+			pos += 2
+			continue
+		}
+
+		if pos+4 > len(data) {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, nil, fmt.Errorf("%w: bad segment length", ErrMalformedImage)
+		}
+		segments = append(segments, jpegSegment{
+			marker:  marker,
+			raw:     data[pos : pos+2+length],
+			payload: data[pos+4 : pos+2+length],
+		})
+		pos += 2 + length
+	}
+
+	return nil, nil, fmt.Errorf("%w: missing scan data", ErrMalformedImage)
+}
+
+// newJPEGSegment builds a marker segment around the payload
+func newJPEGSegment(marker byte, payload []byte) jpegSegment {
+	raw := make([]byte, 4, 4+len(payload))
+	raw[0], raw[1] = 0xFF, marker
+	binary.BigEndian.PutUint16(raw[2:], uint16(len(payload)+2))
+	raw = append(raw, payload...)
+	return jpegSegment{marker: marker, raw: raw, payload: raw[4:]}
+}
+
+// processJPEG applies the metadata options to a JPEG
+func processJPEG(data []byte, opts MetadataOptions) ([]byte, *models.ImageMetadata, error) {
+	segments, scan, err := splitJPEG(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrMalformedImage, err)
+	}
+
+	meta := &models.ImageMetadata{Width: config.Width, Height: config.Height, Orientation: 1}
+
+	// Copy the EXIF block so we can patch it without touching the upload
+	var exifData *exif
+	var iccChunks []jpegSegment
+	for _, seg := range segments {
+		switch {
+		case seg.isExif() && exifData == nil:
+			exifData, _ = parseExif(append([]byte(nil), seg.payload[len(exifHeader):]...))
+		case seg.isICC():
+			iccChunks = append(iccChunks, seg)
+		}
+	}
+	fillExifMetadata(meta, exifData)
+
+	// ICC profiles larger than a segment are split into numbered chunks
+	sort.SliceStable(iccChunks, func(i, j int) bool {
+		return iccChunks[i].payload[len(iccHeader)] < iccChunks[j].payload[len(iccHeader)]
+	})
+	var profile []byte
+	for _, chunk := range iccChunks {
+		profile = append(profile, chunk.payload[len(iccHeader)+2:]...)
+	}
+	meta.ColorSpace, meta.ColorProfile = parseICC(profile)
+
+	rotate := opts.AutoOrient && meta.Orientation != 1
+	orientation := meta.Orientation
+	if rotate {
+		orientation = 1
+		if exifData != nil {
+			exifData.resetOrientation()
+		}
+		uprightSize(meta)
+	}
+
+	// Pick the metadata segments to keep
+	var kept []jpegSegment
+	exifKept := false
+	for _, seg := range segments {
+		if !seg.isMetadata() {
+			continue
+		}
+		switch {
+		case opts.Policy == models.MetadataPreserve && seg.isExif() && exifData != nil && !exifKept:
+			// The parsed copy carries the reset orientation
+			kept = append(kept, newJPEGSegment(markerAPP1, append(append([]byte(nil), exifHeader...), exifData.tiff...)))
+			exifKept = true
+		case opts.Policy == models.MetadataPreserve:
+			kept = append(kept, seg)
+		case opts.Policy == models.MetadataKeepCopyright && seg.isICC():
+			kept = append(kept, seg)
+		}
+	}
+
+	// Without the full EXIF block we still need the orientation to display
+	// the image the right way up, and the copyright when asked to keep it
+	if opts.Policy != models.MetadataPreserve || exifData == nil {
+		tags := map[uint16]string{}
+		if opts.Policy == models.MetadataKeepCopyright {
+			tags[tagArtist] = meta.Artist
+			tags[tagCopyright] = meta.Copyright
+		}
+		if tiff := buildExif(orientation, tags); tiff != nil {
+			kept = append([]jpegSegment{newJPEGSegment(markerAPP1, append(append([]byte(nil), exifHeader...), tiff...))}, kept...)
+		}
+	}
+
+	// The coding segments come from the original, or from a new
+	// encoding when the pixels had to be rotated
+	coding := segments
+	if rotate {
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrMalformedImage, err)
+		}
+		encoded := new(bytes.Buffer)
+		if err := jpeg.Encode(encoded, orient(img, meta.Orientation), &jpeg.Options{Quality: opts.Quality}); err != nil {
+			return nil, nil, err
+		}
+		coding, scan, err = splitJPEG(encoded.Bytes())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write([]byte{0xFF, 0xD8})
+	// JFIF must stay the first segment
+	for _, seg := range coding {
+		if seg.marker == markerAPP0 {
+			out.Write(seg.raw)
+		}
+	}
+	for _, seg := range kept {
+		out.Write(seg.raw)
+	}
+	for _, seg := range coding {
+		if seg.marker != markerAPP0 && !seg.isMetadata() {
+			out.Write(seg.raw)
+		}
+	}
+	out.Write(scan)
+
+	return out.Bytes(), meta, nil
+}
+
+// fillExifMetadata copies the EXIF details to the metadata
+func fillExifMetadata(meta *models.ImageMetadata, e *exif) {
+	if e == nil {
+		return
+	}
+	meta.Orientation = e.orientation()
+	meta.CameraMake = e.string(e.ifd0, tagMake)
+	meta.CameraModel = e.string(e.ifd0, tagModel)
+	meta.LensModel = e.string(e.sub, tagLensModel)
+	meta.Artist = e.string(e.ifd0, tagArtist)
+	meta.Copyright = e.string(e.ifd0, tagCopyright)
+	meta.TakenAt = e.takenAt()
+	_, meta.HasGPS = e.ifd0[tagGPSIFD]
+}
+
+// pngSignature starts every PNG file
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are the ancillary chunks that only carry metadata
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"iCCP": true,
+	"tIME": true,
+}
+
+// pngTextChunks are the chunks holding a keyword and a text
+var pngTextChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+}
+
+// pngColorChunks describe the color space and survive a re-encode
+var pngColorChunks = map[string]bool{
+	"sRGB": true,
+	"gAMA": true,
+	"cHRM": true,
+	"pHYs": true,
+}
+
+// pngChunk is a chunk of a PNG file
+type pngChunk struct {
+	typ  string
+	raw  []byte
+	data []byte
+}
+
+// keyword returns the keyword of a text chunk
+func (c pngChunk) keyword() string {
+	if i := bytes.IndexByte(c.data, 0); i >= 0 {
+		return string(c.data[:i])
+	}
+	return ""
+}
+
+// splitPNG splits a PNG into its chunks
+func splitPNG(data []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, fmt.Errorf("%w: bad signature", ErrMalformedImage)
+	}
+
+	var chunks []pngChunk
+	for pos := len(pngSignature); pos < len(data); {
+		if pos+8 > len(data) {
+			return nil, fmt.Errorf("%w: truncated chunk", ErrMalformedImage)
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, fmt.Errorf("%w: truncated chunk", ErrMalformedImage)
+		}
+		chunks = append(chunks, pngChunk{
+			typ:  string(data[pos+4 : pos+8]),
+			raw:  data[pos:end],
+			data: data[pos+8 : pos+8+length],
+		})
+		pos = end
+	}
+
+	return chunks, nil
+}
+
+// newPNGChunk builds a chunk with its length and CRC
+func newPNGChunk(typ string, data []byte) pngChunk {
+	raw := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(raw, uint32(len(data)))
+	copy(raw[4:], typ)
+	raw = append(raw, data...)
+	raw = binary.BigEndian.AppendUint32(raw, crc32.ChecksumIEEE(raw[4:]))
+	return pngChunk{typ: typ, raw: raw, data: raw[8 : 8+len(data)]}
+}
+
+// processPNG applies the metadata options to a PNG
+func processPNG(data []byte, opts MetadataOptions) ([]byte, *models.ImageMetadata, error) {
+	chunks, err := splitPNG(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrMalformedImage, err)
+	}
+
+	meta := &models.ImageMetadata{Width: config.Width, Height: config.Height, Orientation: 1}
+
+	var exifData *exif
+	for _, c := range chunks {
+		switch c.typ {
+		case "eXIf":
+			if exifData == nil {
+				exifData, _ = parseExif(append([]byte(nil), c.data...))
+			}
+		case "iCCP":
+			meta.ColorProfile = c.keyword()
+			if profile, err := inflateICCP(c.data); err == nil {
+				colorSpace, description := parseICC(profile)
+				meta.ColorSpace = colorSpace
+				if description != "" {
+					meta.ColorProfile = description
+				}
+			}
+		case "tEXt":
+			keyword := c.keyword()
+			if keyword == "" {
+				continue
+			}
+			value := string(c.data[len(keyword)+1:])
+			switch keyword {
+			case "Copyright":
+				meta.Copyright = value
+			case "Author":
+				meta.Artist = value
+			}
+		}
+	}
+	fillExifMetadata(meta, exifData)
+	if meta.ColorSpace == "" && meta.ColorProfile == "" {
+		for _, c := range chunks {
+			if c.typ == "sRGB" {
+				meta.ColorSpace, meta.ColorProfile = "RGB", "sRGB"
+			}
+		}
+	}
+
+	rotate := opts.AutoOrient && meta.Orientation != 1
+	orientation := meta.Orientation
+	if rotate {
+		orientation = 1
+		if exifData != nil {
+			exifData.resetOrientation()
+		}
+		uprightSize(meta)
+	}
+
+	keep := func(c pngChunk) (pngChunk, bool) {
+		switch {
+		case !pngMetadataChunks[c.typ]:
+			return c, true
+		case opts.Policy == models.MetadataPreserve && c.typ == "eXIf" && exifData != nil:
+			return newPNGChunk("eXIf", exifData.tiff), true
+		case opts.Policy == models.MetadataPreserve:
+			return c, true
+		case opts.Policy == models.MetadataKeepCopyright:
+			return c, c.typ == "iCCP" || (pngTextChunks[c.typ] && c.keyword() == "Copyright")
+		default:
+			return c, false
+		}
+	}
+
+	var extra []pngChunk
+	if opts.Policy != models.MetadataPreserve || exifData == nil {
+		if tiff := buildExif(orientation, nil); tiff != nil {
+			extra = append(extra, newPNGChunk("eXIf", tiff))
+		}
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+
+	if !rotate {
+		for _, c := range chunks {
+			if kept, ok := keep(c); ok {
+				out.Write(kept.raw)
+			}
+			if c.typ == "IHDR" {
+				for _, e := range extra {
+					out.Write(e.raw)
+				}
+			}
+		}
+		return out.Bytes(), meta, nil
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrMalformedImage, err)
+	}
+	encoded := new(bytes.Buffer)
+	if err := png.Encode(encoded, orient(img, meta.Orientation)); err != nil {
+		return nil, nil, err
+	}
+	rotated, err := splitPNG(encoded.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Carry the metadata and color chunks over, right after the new IHDR
+	for _, c := range rotated {
+		out.Write(c.raw)
+		if c.typ != "IHDR" {
+			continue
+		}
+		for _, original := range chunks {
+			if !pngMetadataChunks[original.typ] && !pngColorChunks[original.typ] {
+				continue
+			}
+			if kept, ok := keep(original); ok {
+				out.Write(kept.raw)
+			}
+		}
+		for _, e := range extra {
+			out.Write(e.raw)
+		}
+	}
+
+	return out.Bytes(), meta, nil
+}
+
+// inflateICCP returns the ICC profile of an iCCP chunk
+func inflateICCP(data []byte) ([]byte, error) {
+	// Keyword, null separator and compression method
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || i+2 > len(data) {
+		return nil, fmt.Errorf("%w: bad iCCP chunk", ErrMalformedImage)
+	}
+	r, err := zlib.NewReader(bytes.NewReader(data[i+2:]))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// Profiles are small, refuse anything that inflates suspiciously
+	return io.ReadAll(io.LimitReader(r, 4<<20))
+}
+
+// uprightSize swaps the width and height of the metadata for the orientations
+// that turn the image a quarter, so they describe the auto-oriented image
+func uprightSize(meta *models.ImageMetadata) {
+	if meta.Orientation >= 5 {
+		meta.Width, meta.Height = meta.Height, meta.Width
+	}
+}
+
+// orient rotates and flips the image according to the EXIF orientation
+// It returns an upright copy of the image
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+
+	// Orientations 5 to 8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+
+	return dst
+}
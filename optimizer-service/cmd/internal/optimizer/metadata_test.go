@@ -0,0 +1,305 @@
+package optimizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"optimizer-service/cmd/internal/models"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testTIFF builds a big-endian TIFF block with an orientation, a camera,
+// a copyright and a GPS pointer, like a phone would write
+func testTIFF(orientation int) []byte {
+	order := binary.BigEndian
+	ascii := []struct {
+		tag   uint16
+		value string
+	}{
+		{tagMake, "Phone Maker"},
+		{tagModel, "Phone 12"},
+		{tagCopyright, "(c) Jane Doe"},
+	}
+
+	entries := len(ascii) + 2
+	out := make([]byte, 8+2+entries*12+4)
+	copy(out, "MM")
+	order.PutUint16(out[2:], 42)
+	order.PutUint32(out[4:], 8)
+	order.PutUint16(out[8:], uint16(entries))
+
+	pos := 10
+	write := func(tag, typ uint16, count, value uint32) {
+		order.PutUint16(out[pos:], tag)
+		order.PutUint16(out[pos+2:], typ)
+		order.PutUint32(out[pos+4:], count)
+		order.PutUint32(out[pos+8:], value)
+		pos += 12
+	}
+
+	// Entries sorted by tag: Make, Model, Orientation, Copyright, GPS
+	for _, a := range ascii[:2] {
+		write(a.tag, typeASCII, uint32(len(a.value)+1), uint32(len(out)))
+		out = append(out, append([]byte(a.value), 0)...)
+	}
+	order.PutUint16(out[pos:], tagOrientation)
+	order.PutUint16(out[pos+2:], typeShort)
+	order.PutUint32(out[pos+4:], 1)
+	order.PutUint16(out[pos+8:], uint16(orientation))
+	pos += 12
+	write(tagCopyright, typeASCII, uint32(len(ascii[2].value)+1), uint32(len(out)))
+	out = append(out, append([]byte(ascii[2].value), 0)...)
+	write(tagGPSIFD, typeLong, 1, 0)
+
+	return out
+}
+
+// testICC builds a minimal ICC profile with a v2 description
+func testICC(description string) []byte {
+	desc := make([]byte, 12)
+	copy(desc, "desc")
+	binary.BigEndian.PutUint32(desc[8:], uint32(len(description)+1))
+	desc = append(desc, append([]byte(description), 0)...)
+
+	profile := make([]byte, 132+12)
+	copy(profile[16:], "RGB ")
+	binary.BigEndian.PutUint32(profile[128:], 1)
+	copy(profile[132:], "desc")
+	binary.BigEndian.PutUint32(profile[136:], uint32(len(profile)))
+	binary.BigEndian.PutUint32(profile[140:], uint32(len(desc)))
+	profile = append(profile, desc...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+// testJPEG encodes a 4x2 image, white with a black bottom-left pixel,
+// with an EXIF block, an ICC profile and a comment
+func testJPEG(t *testing.T, orientation int) []byte {
+	img := image.NewGray(image.Rect(0, 0, 4, 2))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.SetGray(0, 1, color.Gray{})
+
+	encoded := new(bytes.Buffer)
+	if err := jpeg.Encode(encoded, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := []byte{0xFF, 0xD8}
+	out = append(out, newJPEGSegment(markerAPP1, append(append([]byte(nil), exifHeader...), testTIFF(orientation)...)).raw...)
+	out = append(out, newJPEGSegment(markerAPP2, append(append([]byte(nil), iccHeader...), append([]byte{1, 1}, testICC("Display P3")...)...)).raw...)
+	out = append(out, newJPEGSegment(markerCOM, []byte("shot on a phone")).raw...)
+	return append(out, encoded.Bytes()[2:]...)
+}
+
+// jpegMarkers lists the metadata segments of a JPEG
+func jpegMarkers(t *testing.T, data []byte) []byte {
+	segments, _, err := splitJPEG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var markers []byte
+	for _, seg := range segments {
+		if seg.isMetadata() {
+			markers = append(markers, seg.marker)
+		}
+	}
+	return markers
+}
+
+func TestProcessJPEGExtractsMetadata(t *testing.T) {
+	opts := DefaultMetadataOptions()
+	opts.AutoOrient = false
+	_, meta, err := ProcessMetadata(testJPEG(t, 6), FormatJPEG, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, meta.Width)
+	assert.Equal(t, 2, meta.Height)
+	assert.Equal(t, 6, meta.Orientation)
+	assert.Equal(t, "Phone Maker", meta.CameraMake)
+	assert.Equal(t, "Phone 12", meta.CameraModel)
+	assert.Equal(t, "(c) Jane Doe", meta.Copyright)
+	assert.Equal(t, "RGB", meta.ColorSpace)
+	assert.Equal(t, "Display P3", meta.ColorProfile)
+	assert.True(t, meta.HasGPS)
+}
+
+func TestProcessJPEGStripAndAutoOrient(t *testing.T) {
+	out, _, err := ProcessMetadata(testJPEG(t, 6), FormatJPEG, DefaultMetadataOptions())
+	assert.NoError(t, err)
+
+	// Rotated upright, with every metadata segment gone
+	img, err := jpeg.Decode(bytes.NewReader(out))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 2, 4), img.Bounds())
+	assert.Empty(t, jpegMarkers(t, out))
+
+	// The black bottom-left pixel is now top-left
+	r, _, _, _ := img.At(0, 0).RGBA()
+	assert.Less(t, r, uint32(0x4000))
+}
+
+func TestProcessJPEGReportsUprightSize(t *testing.T) {
+	for orientation, size := range map[int][2]int{1: {4, 2}, 3: {4, 2}, 5: {2, 4}, 6: {2, 4}, 8: {2, 4}} {
+		out, meta, err := ProcessMetadata(testJPEG(t, orientation), FormatJPEG, DefaultMetadataOptions())
+		assert.NoError(t, err)
+		assert.Equal(t, orientation, meta.Orientation)
+		assert.Equal(t, size, [2]int{meta.Width, meta.Height}, "orientation %d", orientation)
+
+		// The size is the one of the image we store
+		config, err := jpeg.DecodeConfig(bytes.NewReader(out))
+		assert.NoError(t, err)
+		assert.Equal(t, size, [2]int{config.Width, config.Height}, "orientation %d", orientation)
+	}
+}
+
+func TestProcessJPEGKeepCopyrightWithoutOrienting(t *testing.T) {
+	opts := MetadataOptions{Policy: models.MetadataKeepCopyright, Quality: 90}
+	out, _, err := ProcessMetadata(testJPEG(t, 6), FormatJPEG, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{markerAPP1, markerAPP2}, jpegMarkers(t, out))
+
+	// The new EXIF block only has the orientation and the copyright
+	_, meta, err := ProcessMetadata(out, FormatJPEG, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, meta.Orientation)
+	assert.Equal(t, "(c) Jane Doe", meta.Copyright)
+	assert.Equal(t, "Display P3", meta.ColorProfile)
+	assert.Empty(t, meta.CameraMake)
+	assert.False(t, meta.HasGPS)
+}
+
+func TestProcessJPEGPreserveResetsOrientation(t *testing.T) {
+	opts := MetadataOptions{Policy: models.MetadataPreserve, AutoOrient: true, Quality: 90}
+	out, _, err := ProcessMetadata(testJPEG(t, 6), FormatJPEG, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{markerAPP1, markerAPP2, markerCOM}, jpegMarkers(t, out))
+
+	_, meta, err := ProcessMetadata(out, FormatJPEG, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, meta.Orientation)
+	assert.Equal(t, 2, meta.Width)
+	assert.Equal(t, "Phone Maker", meta.CameraMake)
+	assert.True(t, meta.HasGPS)
+}
+
+// testPNG encodes a PNG with a copyright and a comment
+func testPNG(t *testing.T) []byte {
+	encoded := new(bytes.Buffer)
+	if err := png.Encode(encoded, image.NewGray(image.Rect(0, 0, 3, 3))); err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := splitPNG(encoded.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := append([]byte(nil), pngSignature...)
+	for _, c := range chunks {
+		out = append(out, c.raw...)
+		if c.typ == "IHDR" {
+			out = append(out, newPNGChunk("tEXt", []byte("Copyright\x00(c) Jane Doe")).raw...)
+			out = append(out, newPNGChunk("tEXt", []byte("Comment\x00secret location")).raw...)
+		}
+	}
+	return out
+}
+
+func TestProcessPNGPolicies(t *testing.T) {
+	textChunks := func(data []byte) []string {
+		chunks, err := splitPNG(data)
+		assert.NoError(t, err)
+		var keywords []string
+		for _, c := range chunks {
+			if c.typ == "tEXt" {
+				keywords = append(keywords, c.keyword())
+			}
+		}
+		return keywords
+	}
+
+	tests := []struct {
+		policy   models.MetadataPolicy
+		expected []string
+	}{
+		{models.MetadataStrip, nil},
+		{models.MetadataKeepCopyright, []string{"Copyright"}},
+		{models.MetadataPreserve, []string{"Copyright", "Comment"}},
+	}
+
+	for _, tt := range tests {
+		out, meta, err := ProcessMetadata(testPNG(t), FormatPNG, MetadataOptions{Policy: tt.policy})
+		assert.NoError(t, err)
+		assert.Equal(t, "(c) Jane Doe", meta.Copyright)
+		assert.Equal(t, tt.expected, textChunks(out), tt.policy)
+
+		// The result is still a valid PNG
+		_, err = png.Decode(bytes.NewReader(out))
+		assert.NoError(t, err)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// A 3x2 image with a marked top-left pixel
+	img := image.NewGray(image.Rect(0, 0, 3, 2))
+	img.SetGray(0, 0, color.Gray{Y: 0xff})
+
+	tests := []struct {
+		orientation int
+		bounds      image.Rectangle
+		marked      image.Point
+	}{
+		{1, image.Rect(0, 0, 3, 2), image.Pt(0, 0)},
+		{2, image.Rect(0, 0, 3, 2), image.Pt(2, 0)},
+		{3, image.Rect(0, 0, 3, 2), image.Pt(2, 1)},
+		{4, image.Rect(0, 0, 3, 2), image.Pt(0, 1)},
+		{5, image.Rect(0, 0, 2, 3), image.Pt(0, 0)},
+		{6, image.Rect(0, 0, 2, 3), image.Pt(1, 0)},
+		{7, image.Rect(0, 0, 2, 3), image.Pt(1, 2)},
+		{8, image.Rect(0, 0, 2, 3), image.Pt(0, 2)},
+	}
+
+	for _, tt := range tests {
+		out := orient(img, tt.orientation)
+		assert.Equal(t, tt.bounds, out.Bounds(), tt.orientation)
+		r, _, _, _ := out.At(tt.marked.X, tt.marked.Y).RGBA()
+		assert.Equal(t, uint32(0xffff), r, tt.orientation)
+	}
+}
+
+func TestProcessPNGSanitizesText(t *testing.T) {
+	encoded := new(bytes.Buffer)
+	if err := png.Encode(encoded, image.NewGray(image.Rect(0, 0, 3, 3))); err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := splitPNG(encoded.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A Latin-1 copyright with a NUL, longer than its column
+	copyright := "\xa9 Jane\x00 Doe " + strings.Repeat("x", 300)
+	data := append([]byte(nil), pngSignature...)
+	for _, c := range chunks {
+		data = append(data, c.raw...)
+		if c.typ == "IHDR" {
+			data = append(data, newPNGChunk("tEXt", []byte("Copyright\x00"+copyright)).raw...)
+		}
+	}
+
+	out, meta, err := ProcessMetadata(data, FormatPNG, MetadataOptions{Policy: models.MetadataKeepCopyright})
+	assert.NoError(t, err)
+	assert.True(t, utf8.ValidString(meta.Copyright))
+	assert.True(t, strings.HasPrefix(meta.Copyright, "© Jane Doe xxx"), meta.Copyright)
+	assert.Equal(t, 255, utf8.RuneCountInString(meta.Copyright))
+
+	// The image keeps the copyright as it was
+	assert.True(t, bytes.Contains(out, []byte(copyright)))
+}
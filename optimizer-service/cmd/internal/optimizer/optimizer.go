@@ -0,0 +1,59 @@
+// Package optimizer
+package optimizer
+
+import (
+	"io"
+	"strings"
+)
+
+// Optimizer is an interface for a file optimizer
+// Each optimizer handles one or more file extensions
+type Optimizer interface {
+	Supports(ext string) bool
+	Optimize(src io.Reader, dst io.Writer) error
+}
+
+// Converter is implemented by optimizers that change the file format
+// OutputExt returns the extension of the optimized file
+type Converter interface {
+	OutputExt(ext string) string
+}
+
+// Pipeline holds the registered optimizers
+// It picks the optimizer for a file based on its extension
+type Pipeline struct {
+	Optimizers []Optimizer
+}
+
+// NewPipeline creates a new pipeline with the given optimizers
+// It returns a pointer to the pipeline
+func NewPipeline(optimizers ...Optimizer) *Pipeline {
+	return &Pipeline{Optimizers: optimizers}
+}
+
+// For returns the first optimizer that supports the extension
+// It falls back to a passthrough optimizer when none does
+func (p *Pipeline) For(ext string) Optimizer {
+	ext = strings.ToLower(ext)
+	for _, o := range p.Optimizers {
+		if o.Supports(ext) {
+			return o
+		}
+	}
+	return PassthroughOptimizer{}
+}
+
+// PassthroughOptimizer copies the file unchanged
+// It is used for types we do not know how to optimize yet
+type PassthroughOptimizer struct{}
+
+// Supports reports whether the optimizer handles the extension
+func (PassthroughOptimizer) Supports(ext string) bool {
+	return true
+}
+
+// Optimize copies src to dst
+func (PassthroughOptimizer) Optimize(src io.Reader, dst io.Writer) error {
+	_, err := io.Copy(dst, src)
+	return err
+}
@@ -0,0 +1,235 @@
+package optimizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"strings"
+
+	// Register the decoders used to read image headers
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// Image formats as detected from the file content
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+	FormatWebP = "webp"
+)
+
+var (
+	// ErrFormatMismatch is returned when the content does not match the declared type
+	ErrFormatMismatch = errors.New("format mismatch")
+	// ErrMalformedImage is returned when the image header cannot be read
+	ErrMalformedImage = errors.New("malformed image")
+	// ErrImageTooLarge is returned when an image exceeds the validation limits
+	ErrImageTooLarge = errors.New("image too large")
+)
+
+// imageFormats maps the image extensions to the format we expect in the content
+var imageFormats = map[string]string{
+	".jpg":  FormatJPEG,
+	".jpeg": FormatJPEG,
+	".png":  FormatPNG,
+	".gif":  FormatGIF,
+	".webp": FormatWebP,
+}
+
+// Limits are the validation limits for uploaded images
+// A zero value disables the corresponding check
+type Limits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int
+	MaxFrames int
+}
+
+// DefaultLimits returns the limits used when none are configured
+func DefaultLimits() Limits {
+	return Limits{
+		MaxWidth:  16384,
+		MaxHeight: 16384,
+		MaxPixels: 50_000_000,
+		MaxFrames: 1000,
+	}
+}
+
+// ImageInfo describes an image as read from its header
+// It is empty for files that are not images
+type ImageInfo struct {
+	Format string
+	Width  int
+	Height int
+	Frames int
+}
+
+// DecodedBytes estimates the memory needed to decode every frame as RGBA
+func (i *ImageInfo) DecodedBytes() int64 {
+	return int64(i.Width) * int64(i.Height) * 4 * int64(i.Frames)
+}
+
+// Validate checks the content of an upload before any optimizer touches it
+// It detects the real format, compares it with the declared extension
+// and enforces the limits using the image header only
+// It returns the image info and an error
+func Validate(data []byte, ext string, limits Limits) (*ImageInfo, error) {
+	format := DetectFormat(data)
+	expected, isImage := imageFormats[strings.ToLower(ext)]
+
+	if !isImage {
+		// An image hiding behind a text extension would skip every image check
+		if format != "" {
+			return nil, fmt.Errorf("%w: %s content uploaded as %s", ErrFormatMismatch, format, ext)
+		}
+		return &ImageInfo{}, nil
+	}
+
+	if format != expected {
+		detected := format
+		if detected == "" {
+			detected = "unknown"
+		}
+		return nil, fmt.Errorf("%w: %s content uploaded as %s", ErrFormatMismatch, detected, ext)
+	}
+
+	info, err := readImageHeader(format, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := limits.check(info); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// check enforces the limits on the image info
+func (l Limits) check(info *ImageInfo) error {
+	if l.MaxWidth > 0 && info.Width > l.MaxWidth {
+		return fmt.Errorf("%w: width %d exceeds %d", ErrImageTooLarge, info.Width, l.MaxWidth)
+	}
+	if l.MaxHeight > 0 && info.Height > l.MaxHeight {
+		return fmt.Errorf("%w: height %d exceeds %d", ErrImageTooLarge, info.Height, l.MaxHeight)
+	}
+	if l.MaxPixels > 0 && info.Width*info.Height > l.MaxPixels {
+		return fmt.Errorf("%w: %dx%d exceeds %d pixels", ErrImageTooLarge, info.Width, info.Height, l.MaxPixels)
+	}
+	if l.MaxFrames > 0 && info.Frames > l.MaxFrames {
+		return fmt.Errorf("%w: %d frames exceed %d", ErrTooManyFrames, info.Frames, l.MaxFrames)
+	}
+	return nil
+}
+
+// DetectFormat returns the image format from the magic bytes
+// It returns an empty string for anything else
+func DetectFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}):
+		return FormatJPEG
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return FormatPNG
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return FormatGIF
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return FormatWebP
+	default:
+		return ""
+	}
+}
+
+// readImageHeader reads the dimensions and frame count of an image
+func readImageHeader(format string, data []byte) (*ImageInfo, error) {
+	info := &ImageInfo{Format: format, Frames: 1}
+
+	switch format {
+	case FormatGIF:
+		// The block scan also catches truncated frames
+		gifInfo, err := ScanGIF(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedImage, err)
+		}
+		info.Width, info.Height, info.Frames = gifInfo.Width, gifInfo.Height, gifInfo.Frames
+		if gifInfo.MaxFramePixels > info.Width*info.Height {
+			return nil, fmt.Errorf("%w: frame larger than the canvas", ErrMalformedImage)
+		}
+	case FormatWebP:
+		width, height, frames, err := readWebPHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		info.Width, info.Height, info.Frames = width, height, frames
+	default:
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedImage, err)
+		}
+		info.Width, info.Height = config.Width, config.Height
+	}
+
+	if info.Width <= 0 || info.Height <= 0 {
+		return nil, fmt.Errorf("%w: empty image", ErrMalformedImage)
+	}
+
+	return info, nil
+}
+
+// readWebPHeader reads the canvas size and frame count of a WebP file
+func readWebPHeader(data []byte) (int, int, int, error) {
+	width, height, frames := 0, 0, 0
+
+	// Walk the RIFF chunks following the "WEBP" form type
+	for offset := 12; offset+8 <= len(data); {
+		fourCC := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		payload := data[offset+8:]
+		if size > len(payload) {
+			return 0, 0, 0, fmt.Errorf("%w: truncated %q chunk", ErrMalformedImage, fourCC)
+		}
+		payload = payload[:size]
+
+		switch fourCC {
+		case "VP8X":
+			if len(payload) < 10 {
+				return 0, 0, 0, fmt.Errorf("%w: short VP8X chunk", ErrMalformedImage)
+			}
+			width = int(uint32(payload[4])|uint32(payload[5])<<8|uint32(payload[6])<<16) + 1
+			height = int(uint32(payload[7])|uint32(payload[8])<<8|uint32(payload[9])<<16) + 1
+		case "VP8 ":
+			if len(payload) < 10 || !bytes.Equal(payload[3:6], []byte{0x9d, 0x01, 0x2a}) {
+				return 0, 0, 0, fmt.Errorf("%w: bad VP8 chunk", ErrMalformedImage)
+			}
+			if width == 0 {
+				width = int(binary.LittleEndian.Uint16(payload[6:8]) & 0x3fff)
+				height = int(binary.LittleEndian.Uint16(payload[8:10]) & 0x3fff)
+			}
+			frames++
+		case "VP8L":
+			if len(payload) < 5 || payload[0] != 0x2f {
+				return 0, 0, 0, fmt.Errorf("%w: bad VP8L chunk", ErrMalformedImage)
+			}
+			if width == 0 {
+				bits := binary.LittleEndian.Uint32(payload[1:5])
+				width = int(bits&0x3fff) + 1
+				height = int((bits>>14)&0x3fff) + 1
+			}
+			frames++
+		case "ANMF":
+			frames++
+		}
+
+		// Chunks are padded to an even size
+		offset += 8 + size + size%2
+	}
+
+	if frames == 0 {
+		return 0, 0, 0, fmt.Errorf("%w: no image data", ErrMalformedImage)
+	}
+
+	return width, height, frames, nil
+}
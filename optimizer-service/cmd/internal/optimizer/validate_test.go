@@ -0,0 +1,160 @@
+package optimizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/gif"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// webpVP8X builds the header of an animated WebP with the given frames
+func webpVP8X(width, height, frames int) []byte {
+	chunk := func(fourCC string, payload []byte) []byte {
+		out := append([]byte(fourCC), 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(out[4:], uint32(len(payload)))
+		return append(out, payload...)
+	}
+
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x02
+	w, h := width-1, height-1
+	vp8x[4], vp8x[5], vp8x[6] = byte(w), byte(w>>8), byte(w>>16)
+	vp8x[7], vp8x[8], vp8x[9] = byte(h), byte(h>>8), byte(h>>16)
+
+	body := append([]byte("WEBP"), chunk("VP8X", vp8x)...)
+	for i := 0; i < frames; i++ {
+		body = append(body, chunk("ANMF", make([]byte, 16))...)
+	}
+
+	out := append([]byte("RIFF"), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(body)))
+	return append(out, body...)
+}
+
+func TestValidateAcceptsImages(t *testing.T) {
+	info, err := Validate(encodePNG(t, 40, 30), ".png", DefaultLimits())
+	assert.NoError(t, err)
+	assert.Equal(t, &ImageInfo{Format: FormatPNG, Width: 40, Height: 30, Frames: 1}, info)
+
+	source := new(bytes.Buffer)
+	assert.NoError(t, gif.EncodeAll(source, animation()))
+	info, err = Validate(source.Bytes(), ".GIF", DefaultLimits())
+	assert.NoError(t, err)
+	assert.Equal(t, 4, info.Frames)
+
+	info, err = Validate(webpVP8X(300, 200, 5), ".webp", DefaultLimits())
+	assert.NoError(t, err)
+	assert.Equal(t, &ImageInfo{Format: FormatWebP, Width: 300, Height: 200, Frames: 5}, info)
+
+	info, err = Validate([]byte("body { color: red; }"), ".css", DefaultLimits())
+	assert.NoError(t, err)
+	assert.Equal(t, &ImageInfo{}, info)
+}
+
+func TestValidateFormatMismatch(t *testing.T) {
+	_, err := Validate(encodePNG(t, 4, 4), ".jpg", DefaultLimits())
+	assert.True(t, errors.Is(err, ErrFormatMismatch))
+
+	_, err = Validate([]byte("<html></html>"), ".png", DefaultLimits())
+	assert.True(t, errors.Is(err, ErrFormatMismatch))
+
+	// Images cannot hide behind a text extension
+	_, err = Validate(encodePNG(t, 4, 4), ".txt", DefaultLimits())
+	assert.True(t, errors.Is(err, ErrFormatMismatch))
+}
+
+func TestValidateLimits(t *testing.T) {
+	_, err := Validate(encodePNG(t, 20000, 1), ".png", DefaultLimits())
+	assert.True(t, errors.Is(err, ErrImageTooLarge))
+
+	_, err = Validate(encodePNG(t, 100, 100), ".png", Limits{MaxPixels: 5000})
+	assert.True(t, errors.Is(err, ErrImageTooLarge))
+
+	// A decompression bomb declares a huge canvas in a tiny file
+	_, err = Validate(webpVP8X(16000, 16000, 1), ".webp", DefaultLimits())
+	assert.True(t, errors.Is(err, ErrImageTooLarge))
+
+	_, err = Validate(webpVP8X(10, 10, 5000), ".webp", DefaultLimits())
+	assert.True(t, errors.Is(err, ErrTooManyFrames))
+}
+
+func TestValidateMalformed(t *testing.T) {
+	data := encodePNG(t, 10, 10)
+	_, err := Validate(data[:20], ".png", DefaultLimits())
+	assert.True(t, errors.Is(err, ErrMalformedImage))
+
+	_, err = Validate([]byte("RIFF\x00\x00\x00\x00WEBP"), ".webp", DefaultLimits())
+	assert.True(t, errors.Is(err, ErrMalformedImage))
+}
+
+func TestBudget(t *testing.T) {
+	budget := Budget{MaxBytes: 10, MaxMemory: 100}
+	assert.NoError(t, budget.CheckSize(10))
+	assert.True(t, errors.Is(budget.CheckSize(11), ErrBudgetExceeded))
+	assert.NoError(t, budget.CheckMemory(&ImageInfo{Width: 5, Height: 5, Frames: 1}))
+	assert.True(t, errors.Is(budget.CheckMemory(&ImageInfo{Width: 5, Height: 5, Frames: 2}), ErrBudgetExceeded))
+}
+
+func TestRunIsolatesPanics(t *testing.T) {
+	err := Budget{Timeout: time.Second}.Run(func() error {
+		var m map[string]int
+		m["boom"]++
+		return nil
+	})
+
+	var panicErr *PanicError
+	assert.True(t, errors.As(err, &panicErr))
+	assert.NotEmpty(t, panicErr.Stack)
+}
+
+func TestRunTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	err := Budget{Timeout: 10 * time.Millisecond}.Run(func() error {
+		<-release
+		return nil
+	})
+	assert.True(t, errors.Is(err, ErrBudgetExceeded))
+
+	assert.NoError(t, Budget{}.Run(func() error { return nil }))
+}
+
+func TestRunRefusesWorkWhileAbandonedJobsRun(t *testing.T) {
+	release := make(chan struct{})
+	budget := Budget{Timeout: 10 * time.Millisecond, MaxAbandoned: 2}
+	for i := 0; i < 2; i++ {
+		err := budget.Run(func() error {
+			<-release
+			return nil
+		})
+		assert.True(t, errors.Is(err, ErrBudgetExceeded))
+	}
+
+	// New jobs are refused until the abandoned ones return
+	ran := false
+	err := budget.Run(func() error {
+		ran = true
+		return nil
+	})
+	assert.True(t, errors.Is(err, ErrOverloaded))
+	assert.False(t, ran)
+
+	close(release)
+	assert.Eventually(t, func() bool { return abandoned.Load() == 0 }, time.Second, time.Millisecond)
+	assert.NoError(t, budget.Run(func() error { return nil }))
+}
@@ -0,0 +1,91 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// WebPEncoder converts an animated GIF into an animated WebP
+type WebPEncoder interface {
+	Encode(src io.Reader, dst io.Writer) error
+}
+
+// Gif2WebP converts animations with the gif2webp tool from libwebp
+type Gif2WebP struct {
+	Path    string
+	Quality int
+	Lossy   bool
+	Timeout time.Duration
+}
+
+// NewGif2WebP creates a new gif2webp encoder
+// It returns an error if gif2webp is not installed
+func NewGif2WebP(quality int, lossy bool) (*Gif2WebP, error) {
+	path, err := exec.LookPath("gif2webp")
+	if err != nil {
+		return nil, err
+	}
+	return &Gif2WebP{
+		Path:    path,
+		Quality: quality,
+		Lossy:   lossy,
+		Timeout: 2 * time.Minute,
+	}, nil
+}
+
+// Encode writes the WebP version of the GIF read from src to dst
+// It returns an error if gif2webp fails or times out
+func (g *Gif2WebP) Encode(src io.Reader, dst io.Writer) error {
+	dir, err := os.MkdirTemp("", "gif2webp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input.gif")
+	output := filepath.Join(dir, "output.webp")
+
+	in, err := os.Create(input)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(in, src); err != nil {
+		in.Close()
+		return err
+	}
+	if err := in.Close(); err != nil {
+		return err
+	}
+
+	// -mixed lets gif2webp pick lossy or lossless per frame
+	mode := "-mixed"
+	if g.Lossy {
+		mode = "-lossy"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, g.Path, mode, "-q", strconv.Itoa(g.Quality), "-m", "6", "-min_size", input, "-o", output)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("gif2webp failed: %w: %s", err, stderr.String())
+	}
+
+	out, err := os.Open(output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(dst, out)
+	return err
+}
@@ -0,0 +1,31 @@
+package outbox
+
+import (
+	"encoding/json"
+
+	"gorm.io/gorm"
+)
+
+// NotifyPublisher is a MessagePublisher using Postgres NOTIFY as the broker
+// The topic is the channel, consumers LISTEN on it
+// Postgres limits payloads to 8000 bytes, so messages are sent without the file
+type NotifyPublisher struct {
+	DB *gorm.DB
+}
+
+// NewNotifyPublisher creates a new Postgres NOTIFY publisher
+func NewNotifyPublisher(db *gorm.DB) *NotifyPublisher {
+	return &NotifyPublisher{DB: db}
+}
+
+// Publish notifies the topic channel of a message
+func (p *NotifyPublisher) Publish(topic string, message *Message) error {
+	light := *message
+	light.Data = nil
+
+	payload, err := json.Marshal(&light)
+	if err != nil {
+		return err
+	}
+	return p.DB.Exec("SELECT pg_notify(?, ?)", topic, string(payload)).Error
+}
@@ -0,0 +1,136 @@
+// Package outbox relays the file events written by the repositories to the sinks
+package outbox
+
+import (
+	"log"
+	"optimizer-service/cmd/internal/app/interfaces"
+	"optimizer-service/cmd/internal/models"
+	"time"
+)
+
+// eventBatchSize is the number of events claimed per pass
+const eventBatchSize = 100
+
+// Sink is something events are relayed to
+type Sink interface {
+	// Name identifies the sink in the consumption records, it must not change
+	Name() string
+	// Handle processes an event
+	// An event can be handled again if the relay stops before recording it,
+	// sinks use the event ID to recognise it
+	Handle(event *models.OutboxEvent) error
+}
+
+// Relay hands the events of the outbox to every sink once
+// It records what each sink did with each event, so a sink that failed is
+// retried without the others getting the event again
+type Relay struct {
+	Repo  interfaces.IOutboxRepository
+	Sinks []Sink
+	// Interval is how often the outbox is looked at
+	Interval time.Duration
+	// Lease is how long a claimed event is held by this relay
+	Lease time.Duration
+	// MaxAttempts is the number of times a sink is given an event before it is skipped
+	MaxAttempts int
+	// Backoff is the wait after the first failure, doubled after each one
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// NewRelay creates a new relay to the given sinks
+// It returns a pointer to the relay
+func NewRelay(repo interfaces.IOutboxRepository, sinks ...Sink) *Relay {
+	return &Relay{
+		Repo:        repo,
+		Sinks:       sinks,
+		Interval:    time.Second,
+		Lease:       time.Minute,
+		MaxAttempts: 10,
+		Backoff:     5 * time.Second,
+		MaxBackoff:  10 * time.Minute,
+	}
+}
+
+// Start relays events in the background
+func (r *Relay) Start() {
+	go func() {
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			r.RelayPending()
+		}
+	}()
+}
+
+// RelayPending relays the events that are due, oldest first
+func (r *Relay) RelayPending() {
+	events, err := r.Repo.ClaimEvents(time.Now(), r.Lease, eventBatchSize)
+	if err != nil {
+		log.Printf("Error claiming outbox events: %v", err)
+		return
+	}
+
+	for i := range events {
+		if err := r.relay(&events[i]); err != nil {
+			log.Printf("Error relaying outbox event %s: %v", events[i].ID, err)
+		}
+	}
+}
+
+// relay hands an event to the sinks that did not process it yet
+// The event is published once every sink processed it or gave up on it,
+// otherwise it is retried after a backoff
+func (r *Relay) relay(event *models.OutboxEvent) error {
+	consumptions, err := r.Repo.GetConsumptions(event.ID)
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, sink := range r.Sinks {
+		consumption, ok := consumptions[sink.Name()]
+		if !ok {
+			consumption = &models.OutboxConsumption{EventID: event.ID, Sink: sink.Name()}
+		}
+		if consumption.ProcessedAt != nil || consumption.Attempts >= r.MaxAttempts {
+			continue
+		}
+
+		consumption.Attempts++
+		if err := sink.Handle(event); err != nil {
+			reason := err.Error()
+			consumption.LastError = &reason
+			if consumption.Attempts >= r.MaxAttempts {
+				log.Printf("Sink %s gave up on outbox event %s after %d attempts: %v", sink.Name(), event.ID, consumption.Attempts, err)
+			} else {
+				pending = max(pending, consumption.Attempts)
+			}
+		} else {
+			now := time.Now()
+			consumption.ProcessedAt = &now
+			consumption.LastError = nil
+		}
+
+		if err := r.Repo.SaveConsumption(consumption); err != nil {
+			return err
+		}
+	}
+
+	if pending > 0 {
+		return r.Repo.Reschedule(event.ID, time.Now().Add(r.backoff(pending)))
+	}
+	return r.Repo.MarkPublished(event.ID, time.Now())
+}
+
+// backoff returns the wait after a number of failed attempts
+func (r *Relay) backoff(attempts int) time.Duration {
+	wait := r.Backoff
+	for i := 1; i < attempts; i++ {
+		wait *= 2
+		if r.MaxBackoff > 0 && wait >= r.MaxBackoff {
+			return r.MaxBackoff
+		}
+	}
+	return wait
+}
@@ -0,0 +1,235 @@
+package outbox
+
+import (
+	"errors"
+	"optimizer-service/cmd/internal/app/repositories"
+	"optimizer-service/cmd/internal/models"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// recordingSink records the events it handles
+// It fails the first failures calls
+type recordingSink struct {
+	name     string
+	failures int
+
+	mu      sync.Mutex
+	calls   int
+	handled []models.EventType
+}
+
+func (s *recordingSink) Name() string {
+	return s.name
+}
+
+func (s *recordingSink) Handle(event *models.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls++
+	if s.calls <= s.failures {
+		return errors.New("sink unavailable")
+	}
+	s.handled = append(s.handled, event.Type)
+	return nil
+}
+
+func (s *recordingSink) events() []models.EventType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]models.EventType(nil), s.handled...)
+}
+
+// setUpOutbox returns the file and outbox repositories over an in-memory database
+func setUpOutbox(t *testing.T) (*repositories.FileRepository, *repositories.OutboxRepository, *gorm.DB) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a new database
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+
+	if err := db.AutoMigrate(&models.File{}, &models.FileEncoding{}, &models.OutboxEvent{}, &models.OutboxConsumption{}); err != nil {
+		t.Fatal(err)
+	}
+	return repositories.NewFileRepository(db), repositories.NewOutboxRepository(db), db
+}
+
+// changeFile uploads, optimizes and deletes a file
+func changeFile(t *testing.T, files *repositories.FileRepository) {
+	file := &models.File{
+		ID:           uuid.New().String(),
+		UserID:       uuid.New().String(),
+		OriginalName: "file.png",
+		OriginalPath: "/file.png",
+		Type:         ".png",
+		Status:       models.StatusUploaded,
+	}
+	assert.NoError(t, files.CreateFile(file))
+
+	file.Status = models.StatusProcessing
+	assert.NoError(t, files.UpdateFile(file))
+	file.Status = models.StatusCompleleted
+	assert.NoError(t, files.UpdateFile(file))
+	assert.NoError(t, files.DeleteFile(file))
+}
+
+func TestFileChangesAreWrittenToTheOutbox(t *testing.T) {
+	files, _, db := setUpOutbox(t)
+	changeFile(t, files)
+
+	var events []models.OutboxEvent
+	assert.NoError(t, db.Order("created_at, id").Find(&events).Error)
+
+	var types []models.EventType
+	for _, e := range events {
+		types = append(types, e.Type)
+		assert.Contains(t, e.Payload, `"original_name":"file.png"`)
+	}
+	assert.ElementsMatch(t, []models.EventType{
+		models.EventFileUploaded,
+		models.EventFileProcessing,
+		models.EventFileOptimized,
+		models.EventFileDeleted,
+	}, types)
+}
+
+func TestFailedFileChangesWriteNoEvent(t *testing.T) {
+	files, _, db := setUpOutbox(t)
+
+	file := &models.File{ID: uuid.New().String(), UserID: uuid.New().String(), Status: models.StatusUploaded}
+	assert.NoError(t, files.CreateFile(file))
+	// The same ID cannot be created twice
+	assert.Error(t, files.CreateFile(file))
+
+	var count int64
+	assert.NoError(t, db.Model(&models.OutboxEvent{}).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestRelayHandsEveryEventToEverySinkOnce(t *testing.T) {
+	files, outbox, db := setUpOutbox(t)
+	changeFile(t, files)
+
+	webhooks := &recordingSink{name: "webhooks"}
+	// Fails the first two events
+	email := &recordingSink{name: "email", failures: 2}
+	relay := NewRelay(outbox, webhooks, email)
+	relay.Backoff = 0
+
+	relay.RelayPending()
+	assert.Len(t, webhooks.events(), 4)
+	assert.Len(t, email.events(), 2)
+
+	// Only the email sink gets the failed events again
+	relay.RelayPending()
+	assert.Len(t, webhooks.events(), 4)
+	assert.Len(t, email.events(), 4)
+
+	// Everything is published, nothing is relayed anymore
+	relay.RelayPending()
+	assert.Len(t, webhooks.events(), 4)
+	assert.Len(t, email.events(), 4)
+
+	var pending int64
+	assert.NoError(t, db.Model(&models.OutboxEvent{}).Where("published_at IS NULL").Count(&pending).Error)
+	assert.Equal(t, int64(0), pending)
+
+	var consumptions []models.OutboxConsumption
+	assert.NoError(t, db.Where("sink = ?", "email").Find(&consumptions).Error)
+	assert.Len(t, consumptions, 4)
+	for _, c := range consumptions {
+		assert.NotNil(t, c.ProcessedAt)
+	}
+}
+
+func TestFailedEventsWaitForTheBackoff(t *testing.T) {
+	files, outbox, _ := setUpOutbox(t)
+	changeFile(t, files)
+
+	sink := &recordingSink{name: "webhooks", failures: 1}
+	relay := NewRelay(outbox, sink)
+	relay.Backoff = time.Hour
+
+	relay.RelayPending()
+	assert.Equal(t, 4, sink.calls)
+
+	// The failed event is not due yet
+	relay.RelayPending()
+	assert.Equal(t, 4, sink.calls)
+}
+
+func TestSinksGiveUpAfterMaxAttempts(t *testing.T) {
+	files, outbox, db := setUpOutbox(t)
+	assert.NoError(t, files.CreateFile(&models.File{ID: uuid.New().String(), UserID: uuid.New().String(), Status: models.StatusUploaded}))
+
+	sink := &recordingSink{name: "webhooks", failures: 100}
+	relay := NewRelay(outbox, sink)
+	relay.Backoff = 0
+	relay.MaxAttempts = 3
+
+	for i := 0; i < 5; i++ {
+		relay.RelayPending()
+	}
+	assert.Equal(t, 3, sink.calls)
+
+	var event models.OutboxEvent
+	assert.NoError(t, db.First(&event).Error)
+	assert.NotNil(t, event.PublishedAt)
+}
+
+func TestConcurrentRelaysClaimEventsOnce(t *testing.T) {
+	files, outbox, _ := setUpOutbox(t)
+	for i := 0; i < 5; i++ {
+		changeFile(t, files)
+	}
+
+	sink := &recordingSink{name: "webhooks"}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			NewRelay(outbox, sink).RelayPending()
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, sink.events(), 20)
+}
+
+func TestBrokerSinkPublishesMessages(t *testing.T) {
+	publisher := &recordingPublisher{}
+	sink := NewBrokerSink(publisher, "file-events")
+	assert.Equal(t, "broker:file-events", sink.Name())
+
+	event := &models.OutboxEvent{ID: "event-id", FileID: "file-id", Type: models.EventFileOptimized, Payload: `{"id":"file-id"}`}
+	assert.NoError(t, sink.Handle(event))
+
+	if assert.Len(t, publisher.messages, 1) {
+		assert.Equal(t, "file-events", publisher.topics[0])
+		assert.Equal(t, "event-id", publisher.messages[0].ID)
+		assert.Equal(t, "file-id", publisher.messages[0].Key)
+		assert.JSONEq(t, `{"id":"file-id"}`, string(publisher.messages[0].Data))
+	}
+}
+
+// recordingPublisher is an in-memory message broker
+type recordingPublisher struct {
+	topics   []string
+	messages []*Message
+}
+
+func (p *recordingPublisher) Publish(topic string, message *Message) error {
+	p.topics = append(p.topics, topic)
+	p.messages = append(p.messages, message)
+	return nil
+}
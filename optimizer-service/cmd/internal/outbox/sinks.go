@@ -0,0 +1,71 @@
+package outbox
+
+import (
+	"encoding/json"
+	"optimizer-service/cmd/internal/models"
+	"time"
+)
+
+// HandlerSink relays events to a function in this process
+type HandlerSink struct {
+	name   string
+	handle func(event *models.OutboxEvent) error
+}
+
+// NewHandlerSink creates a sink calling handle with every event
+func NewHandlerSink(name string, handle func(event *models.OutboxEvent) error) *HandlerSink {
+	return &HandlerSink{name: name, handle: handle}
+}
+
+// Name identifies the sink
+func (s *HandlerSink) Name() string {
+	return s.name
+}
+
+// Handle calls the function with the event
+func (s *HandlerSink) Handle(event *models.OutboxEvent) error {
+	return s.handle(event)
+}
+
+// Message is an event as it is published to a message broker
+type Message struct {
+	// ID is the event ID, brokers and consumers deduplicate on it
+	ID string `json:"id"`
+	// Key groups the messages of a file, e.g. to keep them in order in a partition
+	Key       string           `json:"key"`
+	Type      models.EventType `json:"type"`
+	CreatedAt time.Time        `json:"created_at"`
+	Data      json.RawMessage  `json:"data,omitempty"`
+}
+
+// MessagePublisher publishes messages to a message broker
+type MessagePublisher interface {
+	Publish(topic string, message *Message) error
+}
+
+// BrokerSink relays events to a message broker
+type BrokerSink struct {
+	Publisher MessagePublisher
+	Topic     string
+}
+
+// NewBrokerSink creates a sink publishing events to a topic of a broker
+func NewBrokerSink(publisher MessagePublisher, topic string) *BrokerSink {
+	return &BrokerSink{Publisher: publisher, Topic: topic}
+}
+
+// Name identifies the sink
+func (s *BrokerSink) Name() string {
+	return "broker:" + s.Topic
+}
+
+// Handle publishes the event
+func (s *BrokerSink) Handle(event *models.OutboxEvent) error {
+	return s.Publisher.Publish(s.Topic, &Message{
+		ID:        event.ID,
+		Key:       event.FileID,
+		Type:      event.Type,
+		CreatedAt: event.CreatedAt,
+		Data:      json.RawMessage(event.Payload),
+	})
+}
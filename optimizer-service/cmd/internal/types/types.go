@@ -8,10 +8,13 @@ import (
 )
 
 type AppContainer struct {
-	DB          *gorm.DB
-	Utils       utils.IUtils
-	FileService interfaces.IFileService // interface
-	AuthService interfaces.IAuthService
+	DB                  *gorm.DB
+	Utils               utils.IUtils
+	FileService         interfaces.IFileService // interface
+	AuthService         interfaces.IAuthService
+	NotificationService interfaces.INotificationService
+	WebhookService      interfaces.IWebhookService
+	FileEvents          interfaces.IFileEventBroker
 }
 
 type LoginInput struct {
@@ -22,3 +25,14 @@ type LoginInput struct {
 type ResponsePayload struct {
 	Data interface{} `json:"data"`
 }
+
+// NotificationPreferenceInput is the body to update a notification preference
+type NotificationPreferenceInput struct {
+	EmailOptOut *bool `json:"email_opt_out"`
+}
+
+// WebhookInput is the body to create a webhook
+type WebhookInput struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
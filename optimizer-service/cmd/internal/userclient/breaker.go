@@ -0,0 +1,80 @@
+package userclient
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the user service while it is failing
+var ErrCircuitOpen = errors.New("user service circuit is open")
+
+// Defaults for the circuit breaker
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
+// Breaker stops calls to a failing service
+// It opens after Threshold consecutive failures and rejects calls for Cooldown,
+// then lets a single trial call through: its success closes the breaker,
+// its failure opens it for another Cooldown
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	open     bool
+	trial    bool
+	now      func() time.Time
+}
+
+// NewBreaker creates a closed circuit breaker
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Allow reports whether a call may be made
+// It returns ErrCircuitOpen while the breaker is open or its trial call is running
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return nil
+	}
+	if b.trial || b.now().Sub(b.openedAt) < b.Cooldown {
+		return ErrCircuitOpen
+	}
+	b.trial = true
+	return nil
+}
+
+// Success records a call that reached a healthy service and closes the breaker
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.open = false
+	b.trial = false
+}
+
+// Failure records a failed call and opens the breaker past the threshold
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.trial || b.failures >= b.Threshold {
+		b.open = true
+		b.trial = false
+		b.openedAt = b.now()
+	}
+}
@@ -0,0 +1,351 @@
+// Package userclient calls the user service
+package userclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"optimizer-service/cmd/internal/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenExpiryMargin is how long before its expiry a service token is renewed
+const tokenExpiryMargin = 30 * time.Second
+
+// Defaults for the client
+const (
+	DefaultTimeout = 5 * time.Second
+	DefaultRetries = 2
+	DefaultBackoff = 100 * time.Millisecond
+)
+
+// Errors returned for the answers of the user service
+var (
+	ErrInvalidCredentials = errors.New("Invalid credentials")
+	ErrLoginLocked        = errors.New("Too many failed login attempts, try again later")
+	ErrUserNotFound       = errors.New("User not found")
+	ErrInvalidClient      = errors.New("Invalid service credentials")
+)
+
+// StatusError is returned when the user service responds with an unexpected status
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("user service responded with status %d", e.StatusCode)
+}
+
+// Client is a typed client of the user service
+// Idempotent calls are retried with a jittered exponential backoff when the
+// user service cannot be reached or fails, and every call goes through a
+// circuit breaker so a failing user service is not waited on
+// The internal routes are called with a service token, obtained with the
+// client credentials of this service and renewed before it expires
+type Client struct {
+	BaseURL      string
+	ClientID     string
+	ClientSecret string
+	HTTP         *http.Client
+	// Retries is the number of retries of an idempotent call
+	Retries int
+	// Backoff is the delay before the first retry, doubled for each retry
+	Backoff time.Duration
+	Breaker *Breaker
+
+	sleep func(time.Duration)
+	now   func() time.Time
+
+	mu             sync.Mutex
+	token          string
+	tokenExpiresAt time.Time
+}
+
+// NewClient creates a client of the user service at baseURL
+// It authenticates to the internal routes with the credentials of this service
+func NewClient(baseURL, clientID, clientSecret string) *Client {
+	return &Client{
+		BaseURL:      strings.TrimSuffix(baseURL, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		HTTP:         &http.Client{Timeout: DefaultTimeout},
+		Retries:      DefaultRetries,
+		Backoff:      DefaultBackoff,
+		Breaker:      NewBreaker(DefaultBreakerThreshold, DefaultBreakerCooldown),
+		sleep:        time.Sleep,
+		now:          time.Now,
+	}
+}
+
+// ClientIPHeader is the address of the client a user is logged in for
+// The user service only believes it with the token of this service
+const ClientIPHeader = "X-Client-IP"
+
+// Login logs a user in with their email and password, for a client at clientIP
+// The failed logins are counted by the user service per client address,
+// rather than for all the users of this service
+// It is not retried, a login is not idempotent
+// It returns the tokens, ErrInvalidCredentials if the user service refused them,
+// or ErrLoginLocked after too many failed logins
+func (c *Client) Login(email, password, clientIP string) (*models.LoginResult, error) {
+	body, err := json.Marshal(map[string]string{"email": email, "password": password})
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := c.serviceToken(false)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.doWith(false, loginFailed, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, c.BaseURL+"/login", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		if clientIP != "" {
+			req.Header.Set(ClientIPHeader, clientIP)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound:
+		return nil, ErrInvalidCredentials
+	case http.StatusTooManyRequests:
+		return nil, ErrLoginLocked
+	default:
+		return nil, &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	var payload struct {
+		Data models.LoginResult `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, err
+	}
+	return &payload.Data, nil
+}
+
+// Introspect asks the user service whether a token is still active
+// It does not change anything, so it is retried
+// It returns the introspection and an error if the user service could not answer
+func (c *Client) Introspect(token string) (*models.TokenIntrospection, error) {
+	form := url.Values{"token": {token}}.Encode()
+
+	resp, err := c.doInternal(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, c.BaseURL+"/introspect", strings.NewReader(form))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	var introspection models.TokenIntrospection
+	if err := json.NewDecoder(resp.Body).Decode(&introspection); err != nil {
+		return nil, err
+	}
+	return &introspection, nil
+}
+
+// GetUser retrieves the contact details of a user
+// It returns the user and ErrUserNotFound if the user does not exist
+func (c *Client) GetUser(userID string) (*models.User, error) {
+	resp, err := c.doInternal(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, c.BaseURL+"/internal/users/"+url.PathEscape(userID), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrUserNotFound
+	default:
+		return nil, &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	var payload struct {
+		Data models.User `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, err
+	}
+	return &payload.Data, nil
+}
+
+// doInternal sends an idempotent request to an internal route with the service token
+// A token the user service no longer accepts, after a secret or key rotation,
+// is renewed once
+// It returns the response, which the caller closes, or an error
+func (c *Client) doInternal(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for renewed := false; ; renewed = true {
+		token, err := c.serviceToken(renewed)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.do(true, func() (*http.Request, error) {
+			req, err := newRequest()
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			return req, nil
+		})
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || renewed {
+			return resp, err
+		}
+		resp.Body.Close()
+	}
+}
+
+// serviceToken returns the token of this service, requesting a new one when
+// it is about to expire or renew is set
+// It returns the token and ErrInvalidClient if the user service refused the credentials
+func (c *Client) serviceToken(renew bool) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !renew && c.token != "" && c.now().Before(c.tokenExpiresAt) {
+		return c.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}.Encode()
+	resp, err := c.do(true, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, c.BaseURL+"/oauth/token", strings.NewReader(form))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(c.ClientID, c.ClientSecret)
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return "", ErrInvalidClient
+	default:
+		return "", &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("user service issued an empty service token")
+	}
+
+	c.token = token.AccessToken
+	c.tokenExpiresAt = c.now().Add(time.Duration(token.ExpiresIn)*time.Second - tokenExpiryMargin)
+	return c.token, nil
+}
+
+// do sends the request built by newRequest through the circuit breaker
+// Failures of idempotent calls are retried, a new request is built for each attempt
+// It returns the response, which the caller closes, or the last error
+func (c *Client) do(idempotent bool, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	return c.doWith(idempotent, failed, newRequest)
+}
+
+// doWith sends a request like do, failed tells which statuses mean the user service is failing
+// It returns the response, which the caller closes, or the last error
+func (c *Client) doWith(idempotent bool, failed func(int) bool, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	attempts := 1
+	if idempotent {
+		attempts += c.Retries
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			c.sleep(c.backoff(attempt))
+		}
+
+		// The request is built first, a trial call let through by the
+		// breaker must end in a Success or a Failure
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := c.Breaker.Allow(); err != nil {
+			return nil, err
+		}
+
+		resp, err := c.HTTP.Do(req)
+		if err != nil {
+			log.Printf("Failed to reach the user service: %v", err)
+			c.Breaker.Failure()
+			lastErr = err
+			continue
+		}
+		if !failed(resp.StatusCode) {
+			c.Breaker.Success()
+			return resp, nil
+		}
+
+		c.Breaker.Failure()
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		lastErr = &StatusError{StatusCode: resp.StatusCode}
+	}
+	return nil, lastErr
+}
+
+// backoff returns the jittered delay before a retry
+// It is between half and all of Backoff doubled for each previous retry
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.Backoff << (attempt - 1)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// failed reports whether a status means the user service is failing
+// Other statuses are answers of a healthy user service
+func failed(status int) bool {
+	return status >= http.StatusInternalServerError || status == http.StatusTooManyRequests
+}
+
+// loginFailed reports whether a status of a login means the user service is failing
+// Too many requests is a locked login, not a busy user service
+func loginFailed(status int) bool {
+	return status >= http.StatusInternalServerError
+}
@@ -0,0 +1,339 @@
+package userclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// userService is a user service answering with the statuses it is given
+// It issues service tokens to optimizer-service:service-secret and its
+// internal routes only accept the last one
+type userService struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	tokens   int
+	revoked  bool
+}
+
+// newUserService starts a user service that responds with the statuses in
+// order, then keeps responding with the last one
+func newUserService(t *testing.T, statuses ...int) *userService {
+	s := &userService{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		s.mu.Lock()
+		if r.URL.Path == "/oauth/token" {
+			defer s.mu.Unlock()
+			s.issueToken(w, r)
+			return
+		}
+		if r.URL.Path != "/login" && r.Header.Get("Authorization") != "Bearer "+s.lastToken() {
+			s.mu.Unlock()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.requests = append(s.requests, r)
+		status := s.statuses[0]
+		if len(s.statuses) > 1 {
+			s.statuses = s.statuses[1:]
+		}
+		s.mu.Unlock()
+
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			return
+		}
+		switch r.URL.Path {
+		case "/login":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"token": "access", "token_type": "Bearer", "expires_in": 900, "refresh_token": "rt_refresh"},
+			})
+		case "/introspect":
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "sub": "user-id"})
+		case "/internal/users/user-id":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"id": "user-id", "email": "admin@admin.com"},
+			})
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// issueToken answers a client credentials grant
+// The lock must be held
+func (s *userService) issueToken(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	if r.PostForm.Get("grant_type") != "client_credentials" || id != "optimizer-service" || secret != "service-secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.tokens++
+	s.revoked = false
+	json.NewEncoder(w).Encode(map[string]interface{}{"access_token": s.lastToken(), "token_type": "Bearer", "expires_in": 300})
+}
+
+// lastToken returns the token internal routes accept
+// The lock must be held
+func (s *userService) lastToken() string {
+	if s.tokens == 0 || s.revoked {
+		return ""
+	}
+	return fmt.Sprintf("service-token-%d", s.tokens)
+}
+
+// revokeTokens stops accepting the tokens issued so far
+func (s *userService) revokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked = true
+}
+
+func (s *userService) tokenCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens
+}
+
+func (s *userService) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+// newTestClient returns a client of the server that records its sleeps
+func newTestClient(url string) (*Client, *[]time.Duration) {
+	client := NewClient(url, "optimizer-service", "service-secret")
+	var sleeps []time.Duration
+	client.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	return client, &sleeps
+}
+
+func TestLogin(t *testing.T) {
+	server := newUserService(t, http.StatusOK)
+	client, _ := newTestClient(server.URL)
+
+	result, err := client.Login("admin@admin.com", "password", "192.0.2.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "access", result.Token)
+	assert.Equal(t, "Bearer", result.TokenType)
+	assert.Equal(t, int64(900), result.ExpiresIn)
+	assert.Equal(t, "rt_refresh", result.RefreshToken)
+
+	// The client address is only believed from an authenticated service
+	if assert.Len(t, server.requests, 1) {
+		assert.Equal(t, "Bearer "+server.lastToken(), server.requests[0].Header.Get("Authorization"))
+		assert.Equal(t, "192.0.2.1", server.requests[0].Header.Get(ClientIPHeader))
+	}
+}
+
+func TestLoginErrors(t *testing.T) {
+	server := newUserService(t, http.StatusUnauthorized)
+	client, _ := newTestClient(server.URL)
+
+	_, err := client.Login("admin@admin.com", "wrong", "192.0.2.1")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	// Locked logins are answers, they do not open the circuit
+	server = newUserService(t, http.StatusTooManyRequests)
+	client, _ = newTestClient(server.URL)
+	for i := 0; i < DefaultBreakerThreshold; i++ {
+		_, err = client.Login("admin@admin.com", "wrong", "192.0.2.1")
+		assert.ErrorIs(t, err, ErrLoginLocked)
+	}
+	assert.NoError(t, client.Breaker.Allow())
+
+	// A login is not retried
+	server = newUserService(t, http.StatusServiceUnavailable, http.StatusOK)
+	client, sleeps := newTestClient(server.URL)
+	_, err = client.Login("admin@admin.com", "password", "192.0.2.1")
+	var statusErr *StatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusServiceUnavailable, statusErr.StatusCode)
+	assert.Equal(t, 1, server.requestCount())
+	assert.Empty(t, *sleeps)
+}
+
+func TestGetUser(t *testing.T) {
+	server := newUserService(t, http.StatusOK, http.StatusNotFound)
+	client, _ := newTestClient(server.URL)
+
+	user, err := client.GetUser("user-id")
+	assert.NoError(t, err)
+	assert.Equal(t, "admin@admin.com", user.Email)
+	assert.Equal(t, "Bearer service-token-1", server.requests[0].Header.Get("Authorization"))
+
+	_, err = client.GetUser("user-id")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestIntrospectRetries(t *testing.T) {
+	server := newUserService(t, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK)
+	client, sleeps := newTestClient(server.URL)
+
+	introspection, err := client.Introspect("token")
+	assert.NoError(t, err)
+	assert.True(t, introspection.Active)
+	assert.Equal(t, "user-id", introspection.Sub)
+	assert.Equal(t, "token", server.requests[2].PostForm.Get("token"))
+
+	// The backoff doubles and is jittered
+	assert.Len(t, *sleeps, 2)
+	assert.GreaterOrEqual(t, (*sleeps)[0], DefaultBackoff/2)
+	assert.LessOrEqual(t, (*sleeps)[0], DefaultBackoff)
+	assert.GreaterOrEqual(t, (*sleeps)[1], DefaultBackoff)
+	assert.LessOrEqual(t, (*sleeps)[1], 2*DefaultBackoff)
+}
+
+func TestRetriesGiveUp(t *testing.T) {
+	server := newUserService(t, http.StatusInternalServerError)
+	client, _ := newTestClient(server.URL)
+
+	_, err := client.Introspect("token")
+	var statusErr *StatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusInternalServerError, statusErr.StatusCode)
+	assert.Equal(t, DefaultRetries+1, server.requestCount())
+
+	// Answers of a healthy user service are not retried
+	server = newUserService(t, http.StatusForbidden)
+	client, _ = newTestClient(server.URL)
+	_, err = client.Introspect("token")
+	assert.Error(t, err)
+	assert.Equal(t, 1, server.requestCount())
+}
+
+func TestTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+	client, _ := newTestClient(server.URL)
+	client.HTTP.Timeout = 20 * time.Millisecond
+	client.Retries = 0
+
+	start := time.Now()
+	_, err := client.GetUser("user-id")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	server := newUserService(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK)
+	client, _ := newTestClient(server.URL)
+	client.Retries = 0
+	client.Breaker = NewBreaker(2, time.Minute)
+	now := time.Now()
+	client.Breaker.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Introspect("token")
+		assert.Error(t, err)
+	}
+
+	// The open breaker fails fast without calling the user service
+	_, err := client.Introspect("token")
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 2, server.requestCount())
+
+	// After the cooldown a trial call goes through and closes it
+	now = now.Add(time.Minute)
+	_, err = client.Introspect("token")
+	assert.NoError(t, err)
+	_, err = client.Introspect("token")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, server.requestCount())
+}
+
+func TestCircuitBreakerRequestError(t *testing.T) {
+	server := newUserService(t, http.StatusServiceUnavailable, http.StatusOK)
+	client, _ := newTestClient(server.URL)
+	client.Retries = 0
+	client.Breaker = NewBreaker(1, time.Minute)
+	now := time.Now()
+	client.Breaker.now = func() time.Time { return now }
+
+	_, err := client.Introspect("token")
+	assert.Error(t, err)
+
+	// A request that cannot be built does not use up the trial call
+	now = now.Add(time.Minute)
+	_, err = client.do(true, func() (*http.Request, error) {
+		return nil, errors.New("invalid request")
+	})
+	assert.EqualError(t, err, "invalid request")
+
+	_, err = client.Introspect("token")
+	assert.NoError(t, err)
+}
+
+func TestBreakerTrial(t *testing.T) {
+	breaker := NewBreaker(1, time.Minute)
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	assert.NoError(t, breaker.Allow())
+	breaker.Failure()
+	assert.ErrorIs(t, breaker.Allow(), ErrCircuitOpen)
+
+	// Only one trial call runs at a time
+	now = now.Add(time.Minute)
+	assert.NoError(t, breaker.Allow())
+	assert.ErrorIs(t, breaker.Allow(), ErrCircuitOpen)
+
+	// A failed trial opens the breaker for another cooldown
+	breaker.Failure()
+	assert.ErrorIs(t, breaker.Allow(), ErrCircuitOpen)
+	now = now.Add(time.Minute)
+	assert.NoError(t, breaker.Allow())
+	breaker.Success()
+	assert.NoError(t, breaker.Allow())
+	assert.NoError(t, breaker.Allow())
+}
+
+func TestServiceToken(t *testing.T) {
+	server := newUserService(t, http.StatusOK)
+	client, _ := newTestClient(server.URL)
+	now := time.Now()
+	client.now = func() time.Time { return now }
+
+	// The token is reused until it is about to expire
+	for i := 0; i < 3; i++ {
+		_, err := client.GetUser("user-id")
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, server.tokenCount())
+
+	now = now.Add(300*time.Second - tokenExpiryMargin)
+	_, err := client.GetUser("user-id")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, server.tokenCount())
+
+	// A token the user service stopped accepting is renewed once
+	server.revokeTokens()
+	_, err = client.Introspect("token")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, server.tokenCount())
+	assert.Equal(t, 5, server.requestCount())
+}
+
+func TestServiceTokenInvalidClient(t *testing.T) {
+	server := newUserService(t, http.StatusOK)
+	client, _ := newTestClient(server.URL)
+	client.ClientSecret = "old-secret"
+
+	_, err := client.GetUser("user-id")
+	assert.ErrorIs(t, err, ErrInvalidClient)
+	assert.Equal(t, 0, server.requestCount())
+}
@@ -0,0 +1,266 @@
+// Package webhook posts file events to the webhooks users subscribe
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"optimizer-service/cmd/internal/app/interfaces"
+	"optimizer-service/cmd/internal/models"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Headers sent with every delivery
+const (
+	HeaderEvent     = "X-OptiMate-Event"
+	HeaderDelivery  = "X-OptiMate-Delivery"
+	HeaderTimestamp = "X-OptiMate-Timestamp"
+	HeaderSignature = "X-OptiMate-Signature"
+)
+
+// deliveryBatchSize is the number of due deliveries attempted per pass
+const deliveryBatchSize = 50
+
+// Payload is the body posted to webhooks
+type Payload struct {
+	ID        string           `json:"id"`
+	Event     models.EventType `json:"event"`
+	CreatedAt time.Time        `json:"created_at"`
+	Data      *models.File     `json:"data"`
+}
+
+// Sign returns the signature of a payload sent at timestamp
+// It is the hex encoded HMAC-SHA256 of "<timestamp>.<payload>"
+// Receivers compute it with their secret and compare it to the signature header
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher records file events as deliveries and posts them to webhooks
+// Failed deliveries are retried with an exponential backoff until they
+// run out of attempts, they are then left dead in the delivery log
+// It is the outbox sink for webhooks
+type Dispatcher struct {
+	Repo interfaces.IWebhookRepository
+	// Client posts the deliveries, it only connects to public addresses
+	Client *http.Client
+	// MaxAttempts is the number of attempts before a delivery is dead
+	MaxAttempts int
+	// Backoff is the wait after the first failed attempt, doubled after each one
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Interval is how often due deliveries are looked for
+	Interval time.Duration
+	// Lease is how long a claimed delivery is held by this dispatcher, it must
+	// be longer than the client timeout
+	Lease time.Duration
+	wake  chan struct{}
+}
+
+// NewDispatcher creates a new dispatcher
+// It returns a pointer to the dispatcher
+func NewDispatcher(repo interfaces.IWebhookRepository) *Dispatcher {
+	return &Dispatcher{
+		Repo:        repo,
+		Client:      NewClient(10*time.Second, false),
+		MaxAttempts: 8,
+		Backoff:     30 * time.Second,
+		MaxBackoff:  time.Hour,
+		Interval:    5 * time.Second,
+		Lease:       time.Minute,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Name identifies the dispatcher as an outbox sink
+func (d *Dispatcher) Name() string {
+	return "webhooks"
+}
+
+// Handle records a delivery of an outbox event for every webhook of the file
+// owner subscribed to it, the deliveries are then posted in the background
+// Delivery IDs derive from the event, so handling an event twice records nothing new
+// It returns an error if the deliveries could not be recorded
+func (d *Dispatcher) Handle(event *models.OutboxEvent) error {
+	if !models.IsWebhookEvent(event.Type) {
+		return nil
+	}
+
+	var file models.File
+	if err := json.Unmarshal([]byte(event.Payload), &file); err != nil {
+		return err
+	}
+
+	webhooks, err := d.Repo.GetWebhooks(event.UserID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, webhook := range webhooks {
+		if !webhook.Subscribes(event.Type) {
+			continue
+		}
+
+		id := uuid.NewSHA1(uuid.NameSpaceOID, []byte(event.ID+"/"+webhook.ID)).String()
+		payload, err := json.Marshal(&Payload{ID: id, Event: event.Type, CreatedAt: event.CreatedAt, Data: &file})
+		if err != nil {
+			return err
+		}
+
+		delivery := &models.WebhookDelivery{
+			ID:            id,
+			WebhookID:     webhook.ID,
+			Event:         event.Type,
+			Payload:       string(payload),
+			Status:        models.DeliveryPending,
+			NextAttemptAt: &now,
+		}
+		if err := d.Repo.CreateDelivery(delivery); err != nil {
+			return err
+		}
+	}
+
+	// Do not wait for the next pass
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Start attempts due deliveries in the background
+// It looks for them every Interval, or as soon as an event is published
+func (d *Dispatcher) Start() {
+	go func() {
+		ticker := time.NewTicker(d.Interval)
+		defer ticker.Stop()
+		for {
+			d.DeliverDue()
+			select {
+			case <-ticker.C:
+			case <-d.wake:
+			}
+		}
+	}()
+}
+
+// DeliverDue claims and attempts the deliveries whose next attempt is due
+func (d *Dispatcher) DeliverDue() {
+	deliveries, err := d.Repo.ClaimDueDeliveries(time.Now(), d.Lease, deliveryBatchSize)
+	if err != nil {
+		log.Printf("Error fetching due webhook deliveries: %v", err)
+		return
+	}
+
+	for i := range deliveries {
+		if err := d.Attempt(&deliveries[i]); err != nil {
+			log.Printf("Error attempting webhook delivery %s: %v", deliveries[i].ID, err)
+		}
+	}
+}
+
+// Attempt posts a delivery to its webhook and records the outcome
+// It returns an error if the outcome could not be recorded
+func (d *Dispatcher) Attempt(delivery *models.WebhookDelivery) error {
+	delivery.Attempts++
+
+	webhook, err := d.Repo.GetWebhook(delivery.WebhookID)
+	if err != nil {
+		// The webhook is gone, there is nothing left to deliver to
+		reason := "webhook not found"
+		delivery.LastError = &reason
+		delivery.Status = models.DeliveryDead
+		delivery.NextAttemptAt = nil
+		return d.Repo.UpdateDelivery(delivery)
+	}
+
+	code, err := d.post(webhook, delivery)
+	switch {
+	case err != nil:
+		d.fail(delivery, nil, err.Error())
+	case code < 200 || code > 299:
+		d.fail(delivery, &code, fmt.Sprintf("webhook responded with status %d", code))
+	default:
+		now := time.Now()
+		delivery.Status = models.DeliveryDelivered
+		delivery.ResponseCode = &code
+		delivery.LastError = nil
+		delivery.NextAttemptAt = nil
+		delivery.DeliveredAt = &now
+	}
+
+	return d.Repo.UpdateDelivery(delivery)
+}
+
+// post sends the signed payload of a delivery to a webhook
+// It returns the response status code and an error
+func (d *Dispatcher) post(webhook *models.Webhook, delivery *models.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "OptiMate-Webhooks/1.0")
+	req.Header.Set(HeaderEvent, string(delivery.Event))
+	req.Header.Set(HeaderDelivery, delivery.ID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(webhook.Secret, timestamp, body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Drain a little of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	return resp.StatusCode, nil
+}
+
+// fail records a failed attempt and schedules the next one
+// A delivery out of attempts is dead
+func (d *Dispatcher) fail(delivery *models.WebhookDelivery, code *int, reason string) {
+	delivery.ResponseCode = code
+	delivery.LastError = &reason
+
+	if delivery.Attempts >= d.MaxAttempts {
+		delivery.Status = models.DeliveryDead
+		delivery.NextAttemptAt = nil
+		return
+	}
+
+	next := time.Now().Add(d.backoff(delivery.Attempts))
+	delivery.Status = models.DeliveryPending
+	delivery.NextAttemptAt = &next
+}
+
+// backoff returns the wait after a number of failed attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.Backoff
+	for i := 1; i < attempts; i++ {
+		wait *= 2
+		if d.MaxBackoff > 0 && wait >= d.MaxBackoff {
+			return d.MaxBackoff
+		}
+	}
+	return wait
+}
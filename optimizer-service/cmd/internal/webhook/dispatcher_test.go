@@ -0,0 +1,284 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"optimizer-service/cmd/internal/app/repositories"
+	"optimizer-service/cmd/internal/models"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// receivedDelivery is a request received by the test receiver
+type receivedDelivery struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver is a webhook receiver answering with a fixed status
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	received []receivedDelivery
+}
+
+func newReceiver(t *testing.T, status int) *receiver {
+	r := &receiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.received = append(r.received, receivedDelivery{header: req.Header, body: body})
+		r.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) deliveries() []receivedDelivery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedDelivery(nil), r.received...)
+}
+
+// setUpDispatcher returns a dispatcher over an in-memory database
+// with a webhook of user-id for url subscribed to events
+func setUpDispatcher(t *testing.T, url, events string) (*Dispatcher, *repositories.WebhookRepository, *models.Webhook) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.Webhook{}, &models.WebhookDelivery{}); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := repositories.NewWebhookRepository(db)
+	webhook := &models.Webhook{
+		ID:     uuid.New().String(),
+		UserID: "user-id",
+		URL:    url,
+		Secret: "whsec_test",
+		Events: events,
+	}
+	if err := repo.CreateWebhook(webhook); err != nil {
+		t.Fatal(err)
+	}
+
+	// The receivers of the tests listen on loopback
+	d := NewDispatcher(repo)
+	d.Client = NewClient(10*time.Second, true)
+	return d, repo, webhook
+}
+
+func testFile() *models.File {
+	return &models.File{ID: "file-id", UserID: "user-id", Status: models.StatusCompleleted}
+}
+
+// outboxEvent returns the outbox event of a change to a file
+func outboxEvent(t *testing.T, eventType models.EventType, file *models.File) *models.OutboxEvent {
+	payload, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &models.OutboxEvent{
+		ID:        uuid.New().String(),
+		FileID:    file.ID,
+		UserID:    file.UserID,
+		Type:      eventType,
+		Payload:   string(payload),
+		CreatedAt: time.Now(),
+	}
+}
+
+func TestDeliversSignedPayload(t *testing.T) {
+	r := newReceiver(t, http.StatusNoContent)
+	d, repo, webhook := setUpDispatcher(t, r.URL, "file.optimized")
+
+	assert.NoError(t, d.Handle(outboxEvent(t, models.EventFileOptimized, testFile())))
+	d.DeliverDue()
+
+	received := r.deliveries()
+	if !assert.Len(t, received, 1) {
+		return
+	}
+	header := received[0].header
+	assert.Equal(t, "file.optimized", header.Get(HeaderEvent))
+
+	// The receiver can verify the payload with the secret
+	timestamp, err := strconv.ParseInt(header.Get(HeaderTimestamp), 10, 64)
+	assert.NoError(t, err)
+	assert.Equal(t, Sign("whsec_test", timestamp, received[0].body), header.Get(HeaderSignature))
+	assert.NotEqual(t, Sign("other", timestamp, received[0].body), header.Get(HeaderSignature))
+
+	var payload Payload
+	assert.NoError(t, json.Unmarshal(received[0].body, &payload))
+	assert.Equal(t, header.Get(HeaderDelivery), payload.ID)
+	assert.Equal(t, models.EventFileOptimized, payload.Event)
+	assert.Equal(t, "file-id", payload.Data.ID)
+
+	deliveries, err := repo.GetDeliveries(webhook.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, deliveries, 1) {
+		assert.Equal(t, models.DeliveryDelivered, deliveries[0].Status)
+		assert.Equal(t, 1, deliveries[0].Attempts)
+		assert.Equal(t, http.StatusNoContent, *deliveries[0].ResponseCode)
+		assert.NotNil(t, deliveries[0].DeliveredAt)
+	}
+
+	// Delivered deliveries are not due anymore
+	d.DeliverDue()
+	assert.Len(t, r.deliveries(), 1)
+}
+
+func TestOnlySubscribedEventsAreDelivered(t *testing.T) {
+	r := newReceiver(t, http.StatusOK)
+	d, repo, webhook := setUpDispatcher(t, r.URL, "file.deleted,file.failed")
+
+	assert.NoError(t, d.Handle(outboxEvent(t, models.EventFileOptimized, testFile())))
+	assert.NoError(t, d.Handle(outboxEvent(t, models.EventFileDeleted, testFile())))
+
+	// Other users' files are not delivered either
+	other := testFile()
+	other.UserID = "other-user-id"
+	assert.NoError(t, d.Handle(outboxEvent(t, models.EventFileDeleted, other)))
+
+	deliveries, err := repo.GetDeliveries(webhook.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, deliveries, 1) {
+		assert.Equal(t, models.EventFileDeleted, deliveries[0].Event)
+	}
+}
+
+func TestFailedDeliveriesBackOffUntilDead(t *testing.T) {
+	r := newReceiver(t, http.StatusInternalServerError)
+	d, repo, webhook := setUpDispatcher(t, r.URL, "")
+	d.MaxAttempts = 3
+	d.Backoff = time.Minute
+
+	assert.NoError(t, d.Handle(outboxEvent(t, models.EventFileOptimized, testFile())))
+	deliveries, err := repo.GetDeliveries(webhook.ID)
+	assert.NoError(t, err)
+	delivery := &deliveries[0]
+
+	for attempt, wait := range []time.Duration{time.Minute, 2 * time.Minute} {
+		assert.NoError(t, d.Attempt(delivery))
+		assert.Equal(t, models.DeliveryPending, delivery.Status, attempt)
+		assert.Equal(t, http.StatusInternalServerError, *delivery.ResponseCode)
+		assert.WithinDuration(t, time.Now().Add(wait), *delivery.NextAttemptAt, 5*time.Second)
+	}
+
+	// Not due yet
+	d.DeliverDue()
+	assert.Len(t, r.deliveries(), 2)
+
+	assert.NoError(t, d.Attempt(delivery))
+	assert.Equal(t, models.DeliveryDead, delivery.Status)
+	assert.Nil(t, delivery.NextAttemptAt)
+	assert.Equal(t, "webhook responded with status 500", *delivery.LastError)
+}
+
+func TestDueDeliveriesAreClaimedOnce(t *testing.T) {
+	r := newReceiver(t, http.StatusNoContent)
+	_, repo, webhook := setUpDispatcher(t, r.URL, "")
+	now := time.Now()
+	delivery := &models.WebhookDelivery{
+		ID:            uuid.New().String(),
+		WebhookID:     webhook.ID,
+		Event:         models.EventFileOptimized,
+		Payload:       "{}",
+		Status:        models.DeliveryPending,
+		NextAttemptAt: &now,
+	}
+	assert.NoError(t, repo.CreateDelivery(delivery))
+
+	// Another replica does not get the delivery while it is claimed
+	claimed, err := repo.ClaimDueDeliveries(now, time.Minute, 10)
+	assert.NoError(t, err)
+	assert.Len(t, claimed, 1)
+	claimed, err = repo.ClaimDueDeliveries(now, time.Minute, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, claimed)
+
+	// A claim that was never recorded runs out
+	claimed, err = repo.ClaimDueDeliveries(now.Add(time.Minute), time.Minute, 10)
+	assert.NoError(t, err)
+	assert.Len(t, claimed, 1)
+}
+
+func TestBackoffIsCapped(t *testing.T) {
+	d := NewDispatcher(nil)
+	d.Backoff = time.Minute
+	d.MaxBackoff = 10 * time.Minute
+
+	assert.Equal(t, time.Minute, d.backoff(1))
+	assert.Equal(t, 8*time.Minute, d.backoff(4))
+	assert.Equal(t, 10*time.Minute, d.backoff(5))
+	assert.Equal(t, 10*time.Minute, d.backoff(50))
+}
+
+func TestRedirectsAreNotFollowed(t *testing.T) {
+	target := newReceiver(t, http.StatusOK)
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	t.Cleanup(redirect.Close)
+
+	d, repo, webhook := setUpDispatcher(t, redirect.URL, "")
+	assert.NoError(t, d.Handle(outboxEvent(t, models.EventFileOptimized, testFile())))
+	d.DeliverDue()
+
+	assert.Empty(t, target.deliveries())
+	deliveries, _ := repo.GetDeliveries(webhook.ID)
+	assert.Equal(t, models.DeliveryPending, deliveries[0].Status)
+	assert.Equal(t, http.StatusFound, *deliveries[0].ResponseCode)
+}
+
+func TestPrivateAddressesAreNotPosted(t *testing.T) {
+	r := newReceiver(t, http.StatusNoContent)
+	d, repo, webhook := setUpDispatcher(t, r.URL, "")
+	d.Client = NewClient(time.Second, false)
+
+	assert.NoError(t, d.Handle(outboxEvent(t, models.EventFileOptimized, testFile())))
+	d.DeliverDue()
+
+	// The receiver is on loopback, the dial is refused before anything is sent
+	assert.Empty(t, r.deliveries())
+	deliveries, err := repo.GetDeliveries(webhook.ID)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, models.DeliveryPending, deliveries[0].Status)
+	assert.Contains(t, *deliveries[0].LastError, ErrForbiddenAddress.Error())
+}
+
+func TestPublicIP(t *testing.T) {
+	for _, ip := range []string{"127.0.0.1", "::1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "0.0.0.0", "::", "fe80::1", "fd00::1", "100.64.0.1", "::ffff:127.0.0.1"} {
+		assert.False(t, PublicIP(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"} {
+		assert.True(t, PublicIP(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestHandlingAnEventTwiceDeliversItOnce(t *testing.T) {
+	r := newReceiver(t, http.StatusOK)
+	d, repo, webhook := setUpDispatcher(t, r.URL, "")
+
+	event := outboxEvent(t, models.EventFileOptimized, testFile())
+	assert.NoError(t, d.Handle(event))
+	assert.NoError(t, d.Handle(event))
+
+	// Events webhooks cannot subscribe to are not delivered
+	assert.NoError(t, d.Handle(outboxEvent(t, models.EventFileProcessing, testFile())))
+
+	deliveries, err := repo.GetDeliveries(webhook.ID)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 1)
+}
@@ -3,6 +3,7 @@ package mocks
 
 import (
 	"optimizer-service/cmd/internal/models"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 )
@@ -20,12 +21,71 @@ func (m *MockFileRepository) CreateFile(file *models.File) error {
 	return args.Error(0)
 }
 
-func (m *MockAuthRepository) LoginWithREST(username string, password string) (interface{}, error) {
-	args := m.Called(username, password)
-	return args.Get(0), args.Error(1)
+// GetFile is a mocked method
+func (m *MockFileRepository) GetFile(id string) (*models.File, error) {
+	args := m.Called(id)
+	return args.Get(0).(*models.File), args.Error(1)
 }
 
-func (m *MockAuthRepository) ValidateToken(token string) (interface{},error) {
+// UpdateFile is a mocked method
+func (m *MockFileRepository) UpdateFile(file *models.File) error {
+	args := m.Called(file)
+	return args.Error(0)
+}
+
+// GetOptimizationSettings is a mocked method
+func (m *MockFileRepository) GetOptimizationSettings(fileType string) (*models.OptimizationSettings, error) {
+	args := m.Called(fileType)
+	settings, _ := args.Get(0).(*models.OptimizationSettings)
+	return settings, args.Error(1)
+}
+
+func (m *MockAuthRepository) LoginWithREST(username string, password string, clientIP string) (*models.LoginResult, error) {
+	args := m.Called(username, password, clientIP)
+	result, _ := args.Get(0).(*models.LoginResult)
+	return result, args.Error(1)
+}
+
+// Introspect is a mocked method
+func (m *MockAuthRepository) Introspect(token string) (*models.TokenIntrospection, error) {
 	args := m.Called(token)
-	return args.Get(0), args.Error(1)
+	introspection, _ := args.Get(0).(*models.TokenIntrospection)
+	return introspection, args.Error(1)
+}
+
+// CreateStreamTicket is a mocked method
+func (m *MockAuthRepository) CreateStreamTicket(ticket *models.StreamTicket) error {
+	args := m.Called(ticket)
+	return args.Error(0)
+}
+
+// RedeemStreamTicket is a mocked method
+func (m *MockAuthRepository) RedeemStreamTicket(id string, now time.Time) (*models.StreamTicket, error) {
+	args := m.Called(id, now)
+	ticket, _ := args.Get(0).(*models.StreamTicket)
+	return ticket, args.Error(1)
+}
+
+// DeleteExpiredStreamTickets is a mocked method
+func (m *MockAuthRepository) DeleteExpiredStreamTickets(now time.Time) error {
+	args := m.Called(now)
+	return args.Error(0)
+}
+
+// MockUserRepository is a mock type for the user repository
+type MockUserRepository struct {
+	mock.Mock
+}
+
+// GetUser is a mocked method
+func (m *MockUserRepository) GetUser(userID string) (*models.User, error) {
+	args := m.Called(userID)
+	user, _ := args.Get(0).(*models.User)
+	return user, args.Error(1)
+}
+
+// DeleteFile is a mocked method
+func (m *MockFileRepository) DeleteFile(file *models.File) error {
+	args := m.Called(file)
+	return args.Error(0)
 }
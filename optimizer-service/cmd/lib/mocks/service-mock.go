@@ -3,8 +3,10 @@ package mocks
 
 import (
 	"io"
+	"optimizer-service/cmd/internal/auth"
 	"optimizer-service/cmd/internal/models"
-	"github.com/golang-jwt/jwt"
+	"time"
+
 	"github.com/stretchr/testify/mock"
 )
 
@@ -23,13 +25,75 @@ func (m *MockFileService) UploadFile(userId string, fileData io.Reader, fileName
 	return args.Get(0).(*models.File), args.Error(1)
 }
 
+// GetFile is a mocked method
+// It returns a file and an error
+func (m *MockFileService) GetFile(id string) (*models.File, error) {
+	args := m.Called(id)
+	return args.Get(0).(*models.File), args.Error(1)
+}
+
+// OptimizeFile is a mocked method
+// It returns a file and an error
+func (m *MockFileService) OptimizeFile(id string) (*models.File, error) {
+	args := m.Called(id)
+	return args.Get(0).(*models.File), args.Error(1)
+}
+
+// OpenDownload is a mocked method
+// It returns the content, the content encoding and an error
+func (m *MockFileService) OpenDownload(file *models.File, acceptEncoding string) (io.ReadCloser, string, error) {
+	args := m.Called(file, acceptEncoding)
+	return args.Get(0).(io.ReadCloser), args.String(1), args.Error(2)
+}
+
+// DeleteFile is a mocked method
+// It returns an error
+func (m *MockFileService) DeleteFile(file *models.File) error {
+	args := m.Called(file)
+	return args.Error(0)
+}
+
 
-func (m *MockAuthService) Login(email string, password string) (interface{}, error) {
-	args := m.Called(email, password)
-	return args.String(0), args.Error(1)
+func (m *MockAuthService) Login(email string, password string, clientIP string) (*models.LoginResult, error) {
+	args := m.Called(email, password, clientIP)
+	result, _ := args.Get(0).(*models.LoginResult)
+	return result, args.Error(1)
 }
 
-func (m *MockAuthService) ValidateToken(token string) (*jwt.Token,error) {
+// ValidateToken is a mocked method
+func (m *MockAuthService) ValidateToken(token string) (*auth.Identity, error) {
 	args := m.Called(token)
-	return args.Get(0).(*jwt.Token), args.Error(1)
-}
\ No newline at end of file
+	identity, _ := args.Get(0).(*auth.Identity)
+	return identity, args.Error(1)
+}
+
+// IssueStreamTicket is a mocked method
+func (m *MockAuthService) IssueStreamTicket(userID, fileID string) (string, time.Duration, error) {
+	args := m.Called(userID, fileID)
+	return args.String(0), args.Get(1).(time.Duration), args.Error(2)
+}
+
+// RedeemStreamTicket is a mocked method
+func (m *MockAuthService) RedeemStreamTicket(ticket, fileID string) (*auth.Identity, error) {
+	args := m.Called(ticket, fileID)
+	identity, _ := args.Get(0).(*auth.Identity)
+	return identity, args.Error(1)
+}
+// MockNotificationService is a mock type for the notification service
+type MockNotificationService struct {
+	mock.Mock
+}
+
+// GetPreference is a mocked method
+func (m *MockNotificationService) GetPreference(userID string) (*models.NotificationPreference, error) {
+	args := m.Called(userID)
+	preference, _ := args.Get(0).(*models.NotificationPreference)
+	return preference, args.Error(1)
+}
+
+// UpdatePreference is a mocked method
+func (m *MockNotificationService) UpdatePreference(userID string, emailOptOut bool) (*models.NotificationPreference, error) {
+	args := m.Called(userID, emailOptOut)
+	preference, _ := args.Get(0).(*models.NotificationPreference)
+	return preference, args.Error(1)
+}
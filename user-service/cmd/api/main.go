@@ -1,11 +1,13 @@
 package main
 
 import (
+	"log"
 	"os"
 	"user-service/cmd/config"
 	"user-service/cmd/internal/app/handler"
 	"user-service/cmd/internal/app/repositories"
 	"user-service/cmd/internal/app/service"
+	"user-service/cmd/internal/audit"
 	"user-service/cmd/internal/interceptor"
 	"user-service/cmd/internal/types"
 	"user-service/cmd/internal/utils"
@@ -19,6 +21,18 @@ import (
 )
 
 func main() {
+	// Refuse to start without a key to sign tokens with
+	jwtConfig, err := config.LoadJWTConfig()
+	if err != nil {
+		log.Fatalf("Invalid JWT configuration: %v", err)
+	}
+
+	// Only the listed services can call the internal routes
+	clientService, err := config.LoadClientService(jwtConfig)
+	if err != nil {
+		log.Fatalf("Invalid service clients: %v", err)
+	}
+
 	// Initilize
 	app := config.NewConfig()
 	db := app.InitDB()
@@ -27,20 +41,46 @@ func main() {
 	userRepo := repositories.NewUserRepository(db)
 	jwtRepo := repositories.NewJWTTokenRepository(db)
 	userService := service.NewUserService(userRepo)
-	jwtService := service.NewJWTService(jwtRepo, "secret")
+	userService.Passwords = config.LoadPasswords()
+	userService.Policy, err = config.LoadPasswordPolicy()
+	if err != nil {
+		log.Fatalf("Invalid password policy: %v", err)
+	}
+	jwtService := service.NewJWTService(jwtRepo, jwtConfig)
+	jwtService.RefreshTTL = config.RefreshTokenTTL()
+	mail := config.LoadMailer()
+	passwordService := config.LoadPasswordService(userService, jwtService, mail)
+	verificationService, err := config.LoadVerificationService(userService, mail)
+	if err != nil {
+		log.Fatalf("Invalid email verification configuration: %v", err)
+	}
+	lockoutService := config.LoadLockoutService(db, audit.LogRecorder{})
+	mfaService := config.LoadMFAService(db, userService, jwtService, lockoutService)
 
 	// Create a new container
 	container := &types.AppContainer{
-		Utils:       utils.NewUtils(db),
-		DB:          db,
-		UserService: userService,
-		JWTService:  jwtService,
+		Utils:               utils.NewUtils(db),
+		DB:                  db,
+		UserService:         userService,
+		JWTService:          jwtService,
+		ClientService:       clientService,
+		PasswordService:     passwordService,
+		VerificationService: verificationService,
+		MFAService:          mfaService,
+		LockoutService:      lockoutService,
 	}
 
 	// Create new handler instance with the db instance
 	h := handler.NewHandler(container)
 
 	e := echo.New()
+	// Failed logins are counted per address, so it is only taken from
+	// X-Forwarded-For when the request comes through a trusted proxy
+	ipExtractor, err := config.IPExtractor()
+	if err != nil {
+		log.Fatalf("Invalid proxy configuration: %v", err)
+	}
+	e.IPExtractor = ipExtractor
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 
@@ -48,7 +88,7 @@ func main() {
 	// CORS
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins: []string{"*"},
-		AllowMethods: []string{echo.GET, echo.PUT, echo.POST, echo.DELETE},
+		AllowMethods: []string{echo.GET, echo.PUT, echo.PATCH, echo.POST, echo.DELETE},
 	}))
 
 	// add validator to middleware
@@ -57,15 +97,55 @@ func main() {
 	e.GET("/", h.Index)
 	e.POST("/register", h.Register)
 	e.POST("/login", h.Login)
-	e.POST("/validate", h.ValidateUserToken)
+	e.POST("/login/mfa", h.LoginMFA)
+	e.POST("/token/refresh", h.RefreshToken)
+	e.POST("/password/forgot", h.ForgotPassword)
+	e.POST("/password/reset", h.ResetPassword)
+	e.POST("/email/verify", h.VerifyEmail)
+	e.POST("/email/verify/resend", h.ResendVerification)
+	e.GET("/.well-known/jwks.json", h.GetJWKS)
 	// Docs Routes
 	e.GET("/docs/*", echoSwagger.WrapHandler)
 
+	// Personal access tokens cannot manage the account
+	jwtInterceptor := interceptor.JWTAuthentication(jwtService)
+	sessionInterceptor := interceptor.RequireSession()
+	e.POST("/logout", h.Logout, jwtInterceptor, sessionInterceptor)
+
 	authGroup := e.Group("profile")
 	// Middleware
-	authGroup.Use(interceptor.JWTAuthentication(jwtService))
+	authGroup.Use(jwtInterceptor, sessionInterceptor)
 
+	authGroup.GET("", h.GetProfile)
+	authGroup.PATCH("", h.UpdateProfile)
+	authGroup.POST("/password", h.ChangePassword)
+	authGroup.POST("/email", h.ChangeEmail)
 	authGroup.GET("/tokens", h.GetUserJWTTokens)
+	authGroup.POST("/tokens/revoke-all", h.RevokeAllUserTokens)
+	authGroup.POST("/tokens/:id/revoke", h.RevokeUserToken)
+	authGroup.POST("/access-tokens", h.CreatePersonalAccessToken)
+	authGroup.GET("/access-tokens", h.GetPersonalAccessTokens)
+	authGroup.DELETE("/access-tokens/:id", h.RevokePersonalAccessToken)
+	authGroup.GET("/sessions", h.GetSessions)
+	authGroup.POST("/sessions/revoke-others", h.RevokeOtherSessions)
+	authGroup.GET("/sessions/:id", h.GetSession)
+	authGroup.DELETE("/sessions/:id", h.RevokeSession)
+	authGroup.GET("/mfa", h.GetMFAStatus)
+	authGroup.POST("/mfa/totp", h.BeginTOTPEnrollment)
+	authGroup.POST("/mfa/totp/confirm", h.ConfirmTOTPEnrollment)
+	authGroup.POST("/mfa/totp/disable", h.DisableTOTP)
+	authGroup.POST("/mfa/recovery-codes", h.RegenerateRecoveryCodes)
+
+	// Routes for the other services, they authenticate with a service token
+	e.POST("/oauth/token", h.IssueServiceToken)
+	serviceInterceptor := interceptor.ServiceAuthentication(clientService)
+	e.POST("/introspect", h.Introspect, serviceInterceptor)
+	e.POST("/validate", h.ValidateUserToken, serviceInterceptor)
+
+	internalGroup := e.Group("internal")
+	internalGroup.Use(serviceInterceptor)
+
+	internalGroup.GET("/users/:id", h.GetUser)
 
 	userServicePort := os.Getenv("PORT")
 	e.Logger.Fatal(e.Start(":" + userServicePort))
@@ -6,7 +6,7 @@ import (
 	"log"
 	"os"
 	"time"
-	"user-service/cmd/internal/models"
+	"user-service/cmd/internal/migrations"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -36,9 +36,9 @@ func (app *Config) InitDB() *gorm.DB {
 			counts++
 		} else {
 			log.Printf("Connected to database")
-			err = db.AutoMigrate(&models.User{}, &models.PersonalToken{})
+			err = migrations.Run(db)
 			if err != nil {
-				fmt.Println("Error migrating the schema")
+				log.Printf("Error migrating the schema: %v", err)
 				return nil
 			}
 			return db
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+	"user-service/cmd/internal/app/service"
+	"user-service/cmd/internal/auth"
+)
+
+// LoadClientService reads the services allowed to call the internal routes
+// Clients are listed as client_id:secret in SERVICE_CLIENTS or in the file at
+// SERVICE_CLIENTS_FILE. To rotate a secret, list the client with both secrets,
+// switch the service to the new one, then remove the old one
+// Service tokens are signed with the JWT keys for SERVICE_TOKEN_AUDIENCE and
+// live for SERVICE_TOKEN_TTL_MINUTES
+// It returns the service and an error if the list is malformed
+func LoadClientService(jwtConfig *auth.Config) (*service.ClientService, error) {
+	data, err := envOrFile("SERVICE_CLIENTS", "SERVICE_CLIENTS_FILE")
+	if err != nil {
+		return nil, err
+	}
+
+	clients, err := auth.ParseServiceClients(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("SERVICE_CLIENTS: %w", err)
+	}
+	if clients.Len() == 0 {
+		log.Println("SERVICE_CLIENTS is not set, the internal routes reject every request")
+	}
+
+	ttl := service.DefaultServiceTokenTTL
+	if minutes, err := strconv.Atoi(envString("SERVICE_TOKEN_TTL_MINUTES", "")); err == nil && minutes > 0 {
+		ttl = time.Duration(minutes) * time.Minute
+	}
+
+	audience := envString("SERVICE_TOKEN_AUDIENCE", service.DefaultServiceAudience)
+	if audience == jwtConfig.Audience {
+		return nil, fmt.Errorf("SERVICE_TOKEN_AUDIENCE must differ from the audience of user tokens")
+	}
+
+	return service.NewClientService(clients, jwtConfig.ForAudience(audience, ttl)), nil
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"user-service/cmd/internal/app/service"
+	"user-service/cmd/internal/auth"
+)
+
+// Defaults for the optional token settings
+const (
+	defaultJWTIssuer   = "user-service"
+	defaultJWTAudience = "optimate"
+	defaultJWTTTL      = 15 * time.Minute
+)
+
+// LoadJWTConfig reads the token signing configuration
+// The signing key is a PEM encoded RSA or Ed25519 private key read from
+// JWT_SIGNING_KEY or from the file at JWT_SIGNING_KEY_FILE. It has no default
+// and the service must not start without it
+// To rotate keys, sign with the new key and list the previous ones in
+// JWT_VERIFICATION_KEY_FILES until the tokens they signed have expired
+// It returns the configuration and an error if it is missing or unsafe
+func LoadJWTConfig() (*auth.Config, error) {
+	data, err := envOrFile("JWT_SIGNING_KEY", "JWT_SIGNING_KEY_FILE")
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, auth.ErrNotConfigured
+	}
+
+	signingKey, err := auth.ParseKeyPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("JWT signing key: %w", err)
+	}
+	if !signingKey.CanSign() {
+		return nil, errors.New("JWT signing key must be a private key")
+	}
+
+	var verificationKeys []*auth.Key
+	for _, path := range strings.Split(os.Getenv("JWT_VERIFICATION_KEY_FILES"), ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading JWT verification key: %w", err)
+		}
+		key, err := auth.ParseKeyPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("JWT verification key %s: %w", path, err)
+		}
+		// Only the public part of old keys is needed
+		key.Private = nil
+		verificationKeys = append(verificationKeys, key)
+	}
+
+	ttl := defaultJWTTTL
+	if minutes, err := strconv.Atoi(os.Getenv("JWT_TTL_MINUTES")); err == nil && minutes > 0 {
+		ttl = time.Duration(minutes) * time.Minute
+	}
+
+	config := &auth.Config{
+		SigningKey:       signingKey,
+		VerificationKeys: verificationKeys,
+		Issuer:           envString("JWT_ISSUER", defaultJWTIssuer),
+		Audience:         envString("JWT_AUDIENCE", defaultJWTAudience),
+		TTL:              ttl,
+	}
+	if err := config.Check(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// envOrFile reads a value from an environment variable or from the file another one names
+// It returns nil when neither is set
+func envOrFile(key, fileKey string) ([]byte, error) {
+	value := os.Getenv(key)
+	path := os.Getenv(fileKey)
+
+	switch {
+	case value != "" && path != "":
+		return nil, fmt.Errorf("only one of %s and %s can be set", key, fileKey)
+	case value != "":
+		return []byte(value), nil
+	case path != "":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", fileKey, err)
+		}
+		return data, nil
+	default:
+		return nil, nil
+	}
+}
+
+// envString returns the value of an environment variable or the fallback when unset
+func envString(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// RefreshTokenTTL returns how long refresh tokens can be used
+// It reads JWT_REFRESH_TTL_HOURS and defaults to 30 days
+func RefreshTokenTTL() time.Duration {
+	if hours, err := strconv.Atoi(os.Getenv("JWT_REFRESH_TTL_HOURS")); err == nil && hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return service.DefaultRefreshTTL
+}
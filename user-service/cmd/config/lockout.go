@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"user-service/cmd/internal/app/repositories"
+	"user-service/cmd/internal/app/service"
+	"user-service/cmd/internal/audit"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// LoadLockoutService sets up the lockout of failed logins
+// An account is locked after LOGIN_MAX_FAILURES failed logins and an address
+// after LOGIN_MAX_FAILURES_PER_IP, for LOGIN_LOCKOUT_MINUTES
+func LoadLockoutService(db *gorm.DB, recorder audit.Recorder) *service.LockoutService {
+	lockoutService := service.NewLockoutService(repositories.NewLockoutRepository(db), recorder)
+	if failures, err := strconv.Atoi(os.Getenv("LOGIN_MAX_FAILURES")); err == nil && failures > 0 {
+		lockoutService.AccountFailures = failures
+	}
+	if failures, err := strconv.Atoi(os.Getenv("LOGIN_MAX_FAILURES_PER_IP")); err == nil && failures > 0 {
+		lockoutService.IPFailures = failures
+	}
+	if minutes, err := strconv.Atoi(os.Getenv("LOGIN_LOCKOUT_MINUTES")); err == nil && minutes > 0 {
+		lockoutService.LockoutDuration = time.Duration(minutes) * time.Minute
+		lockoutService.Window = lockoutService.LockoutDuration
+	}
+	return lockoutService
+}
+
+// IPExtractor returns how the address of a client is found, failed logins are counted by it
+// X-Forwarded-For is only believed from TRUSTED_PROXIES, a comma separated
+// list of address ranges like 10.0.0.0/8. Without it, the address requests
+// come from is used, any client could otherwise pick its address
+// It returns an error if a range cannot be parsed
+func IPExtractor() (echo.IPExtractor, error) {
+	value := os.Getenv("TRUSTED_PROXIES")
+	if value == "" {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, cidr := range strings.Split(value, ",") {
+		_, ipRange, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
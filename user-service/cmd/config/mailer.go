@@ -0,0 +1,85 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+	"user-service/cmd/internal/app/service"
+	"user-service/cmd/internal/mailer"
+)
+
+// defaultMailFrom is the sender of the emails when MAIL_FROM is not set
+const defaultMailFrom = "OptiMate <no-reply@optimate.local>"
+
+// Pages of the frontend the links sent by email open, when not configured
+const (
+	defaultPasswordResetURL = "http://localhost:3000/reset-password"
+	defaultVerifyEmailURL   = "http://localhost:3000/verify-email"
+)
+
+// Emails are delivered in the background, by mailWorkers from a queue of mailQueueSize
+const (
+	mailQueueSize = 1000
+	mailWorkers   = 4
+)
+
+// LoadMailer sets up the delivery of emails through the SMTP server at SMTP_HOST
+// Emails are queued and delivered in the background, so requests answer as
+// fast whether they send one or not. They are only logged when SMTP_HOST is not set
+func LoadMailer() mailer.Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		log.Println("SMTP_HOST is not set, emails are not delivered")
+		return mailer.LogMailer{}
+	}
+
+	port := 587
+	if value, err := strconv.Atoi(os.Getenv("SMTP_PORT")); err == nil && value > 0 {
+		port = value
+	}
+	smtpMailer := mailer.NewSMTPMailer(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	return mailer.NewQueueMailer(smtpMailer, mailQueueSize, mailWorkers)
+}
+
+// LoadPasswordService sets up password resets
+// Reset links open PASSWORD_RESET_URL and expire after PASSWORD_RESET_TTL_MINUTES,
+// they are sent from MAIL_FROM
+func LoadPasswordService(users *service.UserService, tokens *service.JWTService, mail mailer.Mailer) *service.PasswordService {
+	passwordService := service.NewPasswordService(
+		users,
+		tokens,
+		mail,
+		envString("MAIL_FROM", defaultMailFrom),
+		envString("PASSWORD_RESET_URL", defaultPasswordResetURL),
+	)
+	if minutes, err := strconv.Atoi(os.Getenv("PASSWORD_RESET_TTL_MINUTES")); err == nil && minutes > 0 {
+		passwordService.ResetTTL = time.Duration(minutes) * time.Minute
+	}
+	return passwordService
+}
+
+// LoadVerificationService sets up the verification of email addresses
+// Verification links open EMAIL_VERIFICATION_URL and expire after
+// EMAIL_VERIFICATION_TTL_HOURS, they are sent from MAIL_FROM
+// EMAIL_VERIFICATION_POLICY is what unverified users can do: off, restrict or block
+// It returns the service and an error if the policy is unknown
+func LoadVerificationService(users *service.UserService, mail mailer.Mailer) (*service.VerificationService, error) {
+	policy, err := service.ParseVerificationPolicy(os.Getenv("EMAIL_VERIFICATION_POLICY"))
+	if err != nil {
+		return nil, fmt.Errorf("EMAIL_VERIFICATION_POLICY: %w", err)
+	}
+
+	verificationService := service.NewVerificationService(
+		users,
+		mail,
+		envString("MAIL_FROM", defaultMailFrom),
+		envString("EMAIL_VERIFICATION_URL", defaultVerifyEmailURL),
+	)
+	verificationService.Policy = policy
+	if hours, err := strconv.Atoi(os.Getenv("EMAIL_VERIFICATION_TTL_HOURS")); err == nil && hours > 0 {
+		verificationService.TTL = time.Duration(hours) * time.Hour
+	}
+	return verificationService, nil
+}
@@ -0,0 +1,16 @@
+package config
+
+import (
+	"user-service/cmd/internal/app/repositories"
+	"user-service/cmd/internal/app/service"
+
+	"gorm.io/gorm"
+)
+
+// LoadMFAService sets up two-factor authentication
+// Authenticator apps show the accounts under MFA_ISSUER
+func LoadMFAService(db *gorm.DB, users *service.UserService, tokens *service.JWTService, lockout *service.LockoutService) *service.MFAService {
+	mfaService := service.NewMFAService(repositories.NewMFARepository(db), users, tokens, lockout)
+	mfaService.Issuer = envString("MFA_ISSUER", service.DefaultMFAIssuer)
+	return mfaService
+}
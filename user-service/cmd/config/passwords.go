@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"user-service/cmd/internal/app/service"
+	"user-service/cmd/internal/auth"
+	"user-service/cmd/internal/breached"
+)
+
+// LoadPasswords sets up the hashing of passwords with Argon2id
+// PASSWORD_ARGON2_MEMORY_KIB, PASSWORD_ARGON2_TIME and PASSWORD_ARGON2_THREADS
+// raise its costs, the hashes made before are replaced as the users log in
+func LoadPasswords() *auth.Passwords {
+	passwords := auth.NewPasswords()
+	hasher := passwords.Hasher.(*auth.Argon2id)
+	if memory, err := strconv.ParseUint(os.Getenv("PASSWORD_ARGON2_MEMORY_KIB"), 10, 32); err == nil && memory > 0 {
+		hasher.Memory = uint32(memory)
+	}
+	if time, err := strconv.ParseUint(os.Getenv("PASSWORD_ARGON2_TIME"), 10, 32); err == nil && time > 0 {
+		hasher.Time = uint32(time)
+	}
+	if threads, err := strconv.ParseUint(os.Getenv("PASSWORD_ARGON2_THREADS"), 10, 8); err == nil && threads > 0 {
+		hasher.Threads = uint8(threads)
+	}
+	return passwords
+}
+
+// LoadPasswordPolicy sets up what the passwords must be
+// PASSWORD_MIN_LENGTH, PASSWORD_MAX_LENGTH and PASSWORD_MIN_CHARACTER_CLASSES
+// set the rules, and PASSWORD_BREACHED_LIST is the file of the breached
+// passwords that cannot be used, a saved filter or one password or SHA-1
+// digest per line
+// It returns the policy and an error if it is invalid or the list cannot be loaded
+func LoadPasswordPolicy() (*service.PasswordPolicy, error) {
+	policy := service.NewPasswordPolicy()
+	if length, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil {
+		policy.MinLength = length
+	}
+	if length, err := strconv.Atoi(os.Getenv("PASSWORD_MAX_LENGTH")); err == nil {
+		policy.MaxLength = length
+	}
+	if classes, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_CHARACTER_CLASSES")); err == nil {
+		policy.MinClasses = classes
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+
+	path := os.Getenv("PASSWORD_BREACHED_LIST")
+	if path == "" {
+		log.Println("PASSWORD_BREACHED_LIST is not set, passwords are not checked against breached passwords")
+		return policy, nil
+	}
+	list, err := breached.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("PASSWORD_BREACHED_LIST: %w", err)
+	}
+	policy.Breached = list
+	return policy, nil
+}
@@ -2,16 +2,21 @@
 package handler
 
 import (
-	"fmt"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+	"user-service/cmd/internal/app/service"
+	"user-service/cmd/internal/auth"
 	"user-service/cmd/internal/models"
 	"user-service/cmd/internal/types"
 	"user-service/cmd/internal/utils"
 
-	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
 )
 
 // Handler struct to hold the db instance
@@ -21,8 +26,31 @@ type Handler struct {
 
 // UserJSONResponse struct to hold the response data
 type UserJSONResponse struct {
-	ID    string `json:"id"`
-	Email string `json:"email"`
+	ID            string `json:"id"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// ProfileJSONResponse is the profile of the user of a request
+type ProfileJSONResponse struct {
+	ID              string     `json:"id"`
+	Email           string     `json:"email"`
+	Firstname       *string    `json:"firstname"`
+	Lastname        *string    `json:"lastname"`
+	EmailVerified   bool       `json:"email_verified"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+}
+
+// profileOf returns the profile of a user
+func profileOf(user *models.User) *ProfileJSONResponse {
+	return &ProfileJSONResponse{
+		ID:              user.ID,
+		Email:           user.Email,
+		Firstname:       user.Firstname,
+		Lastname:        user.Lastname,
+		EmailVerified:   user.EmailVerified,
+		EmailVerifiedAt: user.EmailVerifiedAt,
+	}
 }
 
 // NewHandler function to initialize the handler with the given DB instance
@@ -32,6 +60,32 @@ func NewHandler(container *types.AppContainer) *Handler {
 	}
 }
 
+// ClientIPHeader is the address of the client a service, like the optimizer,
+// logs a user in for
+const ClientIPHeader = "X-Client-IP"
+
+// deviceOf returns the device a request was sent from
+// The address forwarded in ClientIPHeader is only believed from a service
+// with a service token, anyone else could choose whose failed logins theirs
+// are counted with
+func (h *Handler) deviceOf(c echo.Context) service.Device {
+	device := service.Device{
+		UserAgent: c.Request().UserAgent(),
+		IPAddress: c.RealIP(),
+	}
+
+	forwarded := net.ParseIP(c.Request().Header.Get(ClientIPHeader))
+	authorizationHeader := c.Request().Header.Get("Authorization")
+	tokenString := strings.TrimPrefix(authorizationHeader, "Bearer ")
+	if forwarded == nil || tokenString == authorizationHeader {
+		return device
+	}
+	if _, err := h.Container.ClientService.ValidateToken(tokenString); err == nil {
+		device.IPAddress = forwarded.String()
+	}
+	return device
+}
+
 // Index godoc
 // @Summary User service is running
 // @Description User service is running
@@ -50,12 +104,14 @@ func (h *Handler) Index(c echo.Context) error {
 // Register godoc
 // @Summary Register a new user
 // @Description Register a new user
+// @Description A link to verify the email address is sent to it, the user then logs in
+// @Description The response is the same whether the email is registered or not, its owner is emailed instead
 // @Accept json
 // @Produce json
-// @Success 201 {object} utils.JSONResponse "User created successfully"
+// @Success 202 {object} utils.JSONResponse "Check your email to finish signing up"
 // @Failure 400 {object} utils.JSONResponse "Invalid request payload"
-// @Failure 400 {object} utils.JSONResponse "Failed to create user"
-// @Failure 409 {object} utils.JSONResponse "Email already exists"
+// @Failure 400 {object} utils.JSONResponse "Password is too short, it must be at least 8 characters long"
+// @Failure 500 {object} utils.JSONResponse "Failed to create user"
 // @Router /register [post]
 // @Param email formData string true "Email"
 // @Param password formData string true "Password"
@@ -77,46 +133,39 @@ func (h *Handler) Register(c echo.Context) error {
 		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
 	}
 
-	existingUser, err := h.Container.UserService.Repo.GetUserByEmail(input.Email)
-
-	if err != nil {
-		log.Println(err)
-	}
-
-	if existingUser != nil {
-		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Email already exists")
+	// Taken emails get the same response, so that they cannot be found out
+	accepted := func() error {
+		return h.Container.Utils.WriteSuccessResponse(c, http.StatusAccepted, "Check your email to finish signing up", map[string]interface{}{
+			"email": input.Email,
+		})
 	}
 
+	// The password is refused the same whether the email is taken or not
 	user, err := h.Container.UserService.RegisterUser(&input)
-
-	if err != nil {
+	if errors.Is(err, service.ErrPasswordPolicy) {
 		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
 	}
-
-	// Generate new JWT token for user
-	t, err := h.Container.JWTService.GenerateJWTToken(user.ID)
-	if err != nil {
-		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to create token")
-	}
-
-	personalToken := &models.PersonalToken{
-		ID:        uuid.New().String(),
-		UserID:    user.ID,
-		Token:     t,
-		CreatedAt: time.Now().String(),
-		UpdatedAt: time.Now().String(),
+	if errors.Is(err, service.ErrEmailTaken) {
+		existingUser, err := h.Container.UserService.Repo.GetUserByEmail(input.Email)
+		if err == nil {
+			err = h.Container.VerificationService.NotifyExistingAccount(existingUser)
+		}
+		if err != nil {
+			log.Printf("Error notifying existing account: %v", err)
+		}
+		return accepted()
 	}
-
-	if err := h.Container.JWTService.StoreToken(personalToken); err != nil {
-		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to create token")
+	if err != nil {
+		log.Printf("Error creating user: %v", err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to create user")
 	}
 
-	UserJSONResponse := &UserJSONResponse{
-		ID:    user.ID,
-		Email: user.Email,
+	// The user can ask for another link if this one is lost
+	if err := h.Container.VerificationService.SendVerification(user); err != nil {
+		log.Printf("Error sending verification link: %v", err)
 	}
 
-	return h.Container.Utils.WriteSuccessResponse(c, http.StatusCreated, "User created successfully", UserJSONResponse)
+	return accepted()
 }
 
 // Login godoc
@@ -124,10 +173,13 @@ func (h *Handler) Register(c echo.Context) error {
 // @Description Login a user
 // @Accept json
 // @Produce json
+// @Description Users with two-factor authentication get an MFA token instead of the tokens,
+// @Description they send it to /login/mfa with a code of their authenticator app
 // @Success 200 {object} utils.JSONResponse "Login successful"
+// @Success 200 {object} utils.JSONResponse "Two-factor authentication required"
 // @Failure 400 {object} utils.JSONResponse "Invalid request payload"
-// @Failure 401 {object} utils.JSONResponse "Invalid password"
-// @Failure 404 {object} utils.JSONResponse "User not found"
+// @Failure 401 {object} utils.JSONResponse "Invalid password, or the email address is not verified when that is required"
+// @Failure 429 {object} utils.JSONResponse "Too many failed login attempts, try again later"
 // @Failure 500 {object} utils.JSONResponse "Failed to create token"
 // @Router /login [post]
 // @Param email formData string true "Email"
@@ -144,39 +196,263 @@ func (h *Handler) Login(c echo.Context) error {
 		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
 	}
 
+	// Locked accounts are refused before the password is checked, unknown emails alike
+	device := h.deviceOf(c)
+	if err := h.Container.LockoutService.Check(u.Email, device); err != nil {
+		return h.writeLoginError(c, err)
+	}
+
+	// Users the policy keeps out get the response of a wrong password, and
+	// count as one, so that it does not tell the password was right
 	user, err := h.Container.UserService.AuthenticateUser(u.Email, u.Password)
-	if err != nil {
+	if err == nil && !h.Container.VerificationService.CanLogIn(user) {
+		err = service.ErrInvalidCredentials
+	}
+	if errors.Is(err, service.ErrInvalidCredentials) {
+		if err := h.Container.LockoutService.Fail(u.Email, "", device); err != nil {
+			log.Printf("Error counting failed login: %v", err)
+		}
 		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "Invalid Credentials")
 	}
+	if err != nil {
+		return h.writeLoginError(c, err)
+	}
 
-	// Generate new JWT token for user
-	t, err := h.Container.JWTService.GenerateJWTToken(user.ID)
+	// Users with a second factor get their tokens from /login/mfa
+	mfaEnabled, err := h.Container.MFAService.Enabled(user.ID)
 	if err != nil {
-		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to create token")
+		return h.writeLoginError(c, err)
+	}
+	if mfaEnabled {
+		mfaToken, err := h.Container.MFAService.StartChallenge(user.ID)
+		if err != nil {
+			return h.writeLoginError(c, err)
+		}
+		return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Two-factor authentication required", map[string]interface{}{
+			"email":          user.Email,
+			"email_verified": user.EmailVerified,
+			"mfa_required":   true,
+			"mfa_token":      mfaToken,
+			"expires_in":     int64(h.Container.MFAService.ChallengeTTL.Seconds()),
+		})
 	}
 
-	personalToken := &models.PersonalToken{
-		ID:        uuid.New().String(),
-		UserID:    user.ID,
-		Token:     t,
-		CreatedAt: time.Now().String(),
-		UpdatedAt: time.Now().String(),
+	// The failures of users with a second factor are forgotten once they enter their code
+	if err := h.Container.LockoutService.Succeed(user.Email); err != nil {
+		log.Printf("Error clearing failed logins: %v", err)
 	}
 
-	if err := h.Container.JWTService.StoreToken(personalToken); err != nil {
+	// Issue a short-lived access token and the refresh token to renew it with
+	tokens, err := h.Container.JWTService.IssueTokenPair(user.ID, device)
+	if err != nil {
 		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to create token")
 	}
 
-	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Login successful", map[string]string{
-		"email": user.Email,
-		"token": t,
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Login successful", map[string]interface{}{
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"token":          tokens.AccessToken,
+		"token_type":     "Bearer",
+		"expires_in":     tokens.ExpiresIn,
+		"refresh_token":  tokens.RefreshToken,
+	})
+
+}
+
+// LoginMFA godoc
+// @Summary Complete a login with a second factor
+// @Description Exchanges the MFA token of a login and a code of the authenticator app for the tokens
+// @Description A recovery code can be sent instead of the code, it can only be used once
+// @Description The MFA token expires after 5 minutes or 5 wrong codes, the user then logs in again
+// @Accept json
+// @Produce json
+// @Param body body types.MFALoginInput true "MFA token and code"
+// @Success 200 {object} utils.JSONResponse "Login successful"
+// @Failure 400 {object} utils.JSONResponse "Invalid request payload"
+// @Failure 401 {object} utils.JSONResponse "Invalid two-factor authentication code"
+// @Failure 401 {object} utils.JSONResponse "Invalid or expired MFA token, log in again"
+// @Failure 429 {object} utils.JSONResponse "Too many failed login attempts, try again later"
+// @Failure 500 {object} utils.JSONResponse "Failed to create token"
+// @Router /login/mfa [post]
+// @Tags user
+func (h *Handler) LoginMFA(c echo.Context) error {
+	input := new(types.MFALoginInput)
+	if err := c.Bind(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Invalid request payload")
+	}
+	if err := c.Validate(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+
+	tokens, err := h.Container.MFAService.CompleteChallenge(input.MFAToken, input.Code, h.deviceOf(c))
+	if errors.Is(err, service.ErrInvalidMFAChallenge) || errors.Is(err, service.ErrInvalidMFACode) {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, err.Error())
+	}
+	if err != nil {
+		return h.writeLoginError(c, err)
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Login successful", map[string]interface{}{
+		"token":         tokens.AccessToken,
+		"token_type":    "Bearer",
+		"expires_in":    tokens.ExpiresIn,
+		"refresh_token": tokens.RefreshToken,
+	})
+}
+
+// writeLoginError writes the response to a login that failed for another
+// reason than wrong credentials
+// Locked logins tell the client when to try again
+func (h *Handler) writeLoginError(c echo.Context, err error) error {
+	var locked *service.LockedError
+	if errors.As(err, &locked) {
+		return h.writeLocked(c, locked)
+	}
+	log.Printf("Error logging in: %v", err)
+	return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to create token")
+}
+
+// writeLocked writes the response to a request refused after too many failed logins
+func (h *Handler) writeLocked(c echo.Context, locked *service.LockedError) error {
+	retryAfter := int(time.Until(locked.Until).Seconds()) + 1
+	c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	return h.Container.Utils.WriteErrorResponse(c, http.StatusTooManyRequests, locked.Error())
+}
+
+// ForgotPassword godoc
+// @Summary Request a password reset link
+// @Description Emails a link to reset the password, it can be used once within an hour
+// @Description The response is the same whether the email is registered or not
+// @Accept json
+// @Produce json
+// @Param body body types.ForgotPasswordInput true "Email"
+// @Success 202 {object} utils.JSONResponse "If the email is registered, a reset link has been sent"
+// @Failure 400 {object} utils.JSONResponse "Invalid request payload"
+// @Router /password/forgot [post]
+// @Tags user
+func (h *Handler) ForgotPassword(c echo.Context) error {
+	input := new(types.ForgotPasswordInput)
+	if err := c.Bind(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Invalid request payload")
+	}
+	if err := c.Validate(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+
+	// Failures are logged only, they would tell registered emails apart
+	if err := h.Container.PasswordService.ForgotPassword(input.Email); err != nil {
+		log.Printf("Error sending password reset link: %v", err)
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusAccepted, "If the email is registered, a reset link has been sent", nil)
+}
+
+// ResetPassword godoc
+// @Summary Reset a password
+// @Description Sets a new password with the token of a reset link
+// @Description Every session and token of the user is revoked
+// @Accept json
+// @Produce json
+// @Param body body types.ResetPasswordInput true "Token and new password"
+// @Success 200 {object} utils.JSONResponse "Password reset successfully"
+// @Failure 400 {object} utils.JSONResponse "Invalid or expired reset token"
+// @Failure 400 {object} utils.JSONResponse "Password has appeared in a data breach, choose another one"
+// @Failure 500 {object} utils.JSONResponse "Failed to reset password"
+// @Router /password/reset [post]
+// @Tags user
+func (h *Handler) ResetPassword(c echo.Context) error {
+	input := new(types.ResetPasswordInput)
+	if err := c.Bind(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Invalid request payload")
+	}
+	if err := c.Validate(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+
+	err := h.Container.PasswordService.ResetPassword(input.Token, input.Password)
+	switch {
+	case errors.Is(err, service.ErrInvalidResetToken), errors.Is(err, service.ErrPasswordPolicy):
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	case err != nil:
+		log.Printf("Error resetting password: %v", err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to reset password")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Password reset successfully", nil)
+}
+
+// VerifyEmail godoc
+// @Summary Verify an email address
+// @Description Verifies the email address of a user with the token of a verification link
+// @Accept json
+// @Produce json
+// @Param body body types.VerifyEmailInput true "Token"
+// @Success 200 {object} utils.JSONResponse "Email address verified successfully"
+// @Failure 400 {object} utils.JSONResponse "Invalid or expired verification token"
+// @Failure 409 {object} utils.JSONResponse "Email already exists"
+// @Failure 500 {object} utils.JSONResponse "Failed to verify email address"
+// @Router /email/verify [post]
+// @Tags user
+func (h *Handler) VerifyEmail(c echo.Context) error {
+	input := new(types.VerifyEmailInput)
+	if err := c.Bind(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Invalid request payload")
+	}
+	if err := c.Validate(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+
+	user, err := h.Container.VerificationService.VerifyEmail(input.Token)
+	switch {
+	case errors.Is(err, service.ErrInvalidVerificationToken):
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrEmailTaken):
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusConflict, err.Error())
+	case err != nil:
+		log.Printf("Error verifying email address: %v", err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to verify email address")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Email address verified successfully", &UserJSONResponse{
+		ID:            user.ID,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
 	})
+}
 
+// ResendVerification godoc
+// @Summary Resend the verification link
+// @Description Emails a new link to verify the email address, the previous links stop working
+// @Description The response is the same whether the email is registered, verified or not
+// @Accept json
+// @Produce json
+// @Param body body types.ResendVerificationInput true "Email"
+// @Success 202 {object} utils.JSONResponse "If the email is registered and not verified, a verification link has been sent"
+// @Failure 400 {object} utils.JSONResponse "Invalid request payload"
+// @Router /email/verify/resend [post]
+// @Tags user
+func (h *Handler) ResendVerification(c echo.Context) error {
+	input := new(types.ResendVerificationInput)
+	if err := c.Bind(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Invalid request payload")
+	}
+	if err := c.Validate(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+
+	// Failures are logged only, they would tell registered emails apart
+	if err := h.Container.VerificationService.ResendVerification(input.Email); err != nil {
+		log.Printf("Error sending verification link: %v", err)
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusAccepted, "If the email is registered and not verified, a verification link has been sent", nil)
 }
 
 // GetUserJWTTokens godoc
 // @Summary  get toksn
 // @Description gets all the authorization token belongin to a user
+// @Description Use /profile/sessions to list the logins of a user instead
+// @Deprecated
 // @Accept json
 // @Produce json
 // @Success 200 {object} utils.JSONResponse "User tokens retrieved successfully"
@@ -211,21 +487,942 @@ func (h *Handler) GetUserJWTTokens(c echo.Context) error {
 			"id":    user.ID,
 			"email": user.Email,
 		},
-		"tokens": tokens[len(tokens)-1],
+		"tokens": tokens,
 	}
 
 	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "User tokens retrieved successfully", response)
 }
 
+// RefreshToken godoc
+// @Summary Refresh an access token
+// @Description Exchanges a refresh token for a new access token and refresh token
+// @Description A refresh token can only be used once, using it again signs out the login it belongs to
+// @Accept json
+// @Produce json
+// @Param body body types.RefreshTokenInput true "Refresh token"
+// @Success 200 {object} utils.JSONResponse "Token refreshed successfully"
+// @Failure 400 {object} utils.JSONResponse "Refresh token is missing"
+// @Failure 401 {object} utils.JSONResponse "Invalid refresh token"
+// @Failure 500 {object} utils.JSONResponse "Failed to refresh token"
+// @Router /token/refresh [post]
+// @Tags user
+func (h *Handler) RefreshToken(c echo.Context) error {
+	input := new(types.RefreshTokenInput)
+	if err := c.Bind(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Invalid request payload")
+	}
+	if input.RefreshToken == "" {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Refresh token is missing")
+	}
+
+	tokens, err := h.Container.JWTService.Refresh(input.RefreshToken)
+	if errors.Is(err, service.ErrInvalidRefreshToken) || errors.Is(err, service.ErrRefreshTokenReused) {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "Invalid refresh token")
+	}
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to refresh token")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Token refreshed successfully", map[string]interface{}{
+		"token":         tokens.AccessToken,
+		"token_type":    "Bearer",
+		"expires_in":    tokens.ExpiresIn,
+		"refresh_token": tokens.RefreshToken,
+	})
+}
+
+// Logout godoc
+// @Summary Log out
+// @Description Ends the session of the request, revoking its access and refresh tokens
+// @Produce json
+// @Success 200 {object} utils.JSONResponse "Logged out successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to revoke token"
+// @Security Bearer
+// @Param Authorization header string true "Bearer token"
+// @Router /logout [post]
+// @Tags user
+func (h *Handler) Logout(c echo.Context) error {
+	userID, ok := c.Get("userID").(string)
+	tokenID, hasToken := c.Get("tokenID").(string)
+	if !ok || !hasToken {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	sessionID, err := h.Container.JWTService.CurrentSession(tokenID)
+	if err == nil {
+		err = h.Container.JWTService.RevokeSession(userID, sessionID)
+	}
+	// Tokens issued before sessions were recorded only have themselves to revoke
+	if errors.Is(err, service.ErrSessionNotFound) {
+		err = h.Container.JWTService.RevokeToken(userID, tokenID)
+	}
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to revoke token")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Logged out successfully", nil)
+}
+
+// RevokeUserToken godoc
+// @Summary Revoke a token
+// @Description Revokes one of the tokens of the user, signing out the session using it
+// @Produce json
+// @Success 200 {object} utils.JSONResponse "Token revoked successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 404 {object} utils.JSONResponse "Token not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to revoke token"
+// @Security Bearer
+// @Param Authorization header string true "Bearer token"
+// @Param id path string true "Token ID"
+// @Router /profile/tokens/{id}/revoke [post]
+// @Tags user
+func (h *Handler) RevokeUserToken(c echo.Context) error {
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	err := h.Container.JWTService.RevokeToken(userID, c.Param("id"))
+	if errors.Is(err, service.ErrTokenNotFound) {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusNotFound, "Token not found")
+	}
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to revoke token")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Token revoked successfully", nil)
+}
+
+// RevokeAllUserTokens godoc
+// @Summary Revoke all tokens
+// @Description Revokes all the tokens of the user, including the one of the request, signing out every session
+// @Description Personal access tokens are revoked too
+// @Produce json
+// @Success 200 {object} utils.JSONResponse "All tokens revoked successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to revoke tokens"
+// @Security Bearer
+// @Param Authorization header string true "Bearer token"
+// @Router /profile/tokens/revoke-all [post]
+// @Tags user
+func (h *Handler) RevokeAllUserTokens(c echo.Context) error {
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	if err := h.Container.JWTService.RevokeAllTokens(userID); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to revoke tokens")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "All tokens revoked successfully", nil)
+}
+
+// currentSession returns the user and the session of a request
+// It returns false if the request has no session
+func (h *Handler) currentSession(c echo.Context) (string, string, bool) {
+	userID, ok := c.Get("userID").(string)
+	tokenID, hasToken := c.Get("tokenID").(string)
+	if !ok || !hasToken {
+		return "", "", false
+	}
+	sessionID, err := h.Container.JWTService.CurrentSession(tokenID)
+	if err != nil {
+		return "", "", false
+	}
+	return userID, sessionID, true
+}
+
+// GetSessions godoc
+// @Summary List sessions
+// @Description Lists the active sessions of the user, most recently seen first
+// @Description The session of the request is marked as current
+// @Produce json
+// @Param page query int false "Page, starting at 1"
+// @Param per_page query int false "Sessions per page, at most 100"
+// @Success 200 {object} utils.JSONResponse "Sessions retrieved successfully"
+// @Failure 400 {object} utils.JSONResponse "Invalid page"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 403 {object} utils.JSONResponse "This route requires a login session"
+// @Failure 500 {object} utils.JSONResponse "Failed to fetch sessions"
+// @Security Bearer
+// @Router /profile/sessions [get]
+// @Tags user
+func (h *Handler) GetSessions(c echo.Context) error {
+	userID, sessionID, ok := h.currentSession(c)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	page, perPage := 1, 0
+	var err error
+	if value := c.QueryParam("page"); value != "" {
+		if page, err = strconv.Atoi(value); err != nil {
+			return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, service.ErrInvalidPage.Error())
+		}
+	}
+	if value := c.QueryParam("per_page"); value != "" {
+		if perPage, err = strconv.Atoi(value); err != nil || perPage == 0 {
+			return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, service.ErrInvalidPage.Error())
+		}
+	}
+
+	sessions, err := h.Container.JWTService.GetSessions(userID, sessionID, page, perPage)
+	if errors.Is(err, service.ErrInvalidPage) {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to fetch sessions")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Sessions retrieved successfully", sessions)
+}
+
+// GetSession godoc
+// @Summary Describe a session
+// @Description Gets an active session of the user, with the device and address it was started from
+// @Produce json
+// @Param id path string true "Session ID"
+// @Success 200 {object} utils.JSONResponse "Session retrieved successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 403 {object} utils.JSONResponse "This route requires a login session"
+// @Failure 404 {object} utils.JSONResponse "Session not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to fetch session"
+// @Security Bearer
+// @Router /profile/sessions/{id} [get]
+// @Tags user
+func (h *Handler) GetSession(c echo.Context) error {
+	userID, sessionID, ok := h.currentSession(c)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	session, err := h.Container.JWTService.GetSession(userID, c.Param("id"), sessionID)
+	if errors.Is(err, service.ErrSessionNotFound) {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusNotFound, "Session not found")
+	}
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to fetch session")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Session retrieved successfully", session)
+}
+
+// RevokeSession godoc
+// @Summary Revoke a session
+// @Description Signs the user out of one of their sessions, revoking its access and refresh tokens
+// @Produce json
+// @Param id path string true "Session ID"
+// @Success 200 {object} utils.JSONResponse "Session revoked successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 403 {object} utils.JSONResponse "This route requires a login session"
+// @Failure 404 {object} utils.JSONResponse "Session not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to revoke session"
+// @Security Bearer
+// @Router /profile/sessions/{id} [delete]
+// @Tags user
+func (h *Handler) RevokeSession(c echo.Context) error {
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	err := h.Container.JWTService.RevokeSession(userID, c.Param("id"))
+	if errors.Is(err, service.ErrSessionNotFound) {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusNotFound, "Session not found")
+	}
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to revoke session")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Session revoked successfully", nil)
+}
+
+// RevokeOtherSessions godoc
+// @Summary Revoke the other sessions
+// @Description Signs the user out of all their sessions but the one of the request
+// @Description Personal access tokens are not revoked
+// @Produce json
+// @Success 200 {object} utils.JSONResponse "Other sessions revoked successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 403 {object} utils.JSONResponse "This route requires a login session"
+// @Failure 500 {object} utils.JSONResponse "Failed to revoke sessions"
+// @Security Bearer
+// @Router /profile/sessions/revoke-others [post]
+// @Tags user
+func (h *Handler) RevokeOtherSessions(c echo.Context) error {
+	userID, sessionID, ok := h.currentSession(c)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	revoked, err := h.Container.JWTService.RevokeOtherSessions(userID, sessionID)
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to revoke sessions")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Other sessions revoked successfully", map[string]interface{}{
+		"revoked": revoked,
+	})
+}
+
+// GetProfile godoc
+// @Summary Get the profile
+// @Description Gets the names and the email address of the user
+// @Produce json
+// @Success 200 {object} utils.JSONResponse "Profile retrieved successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Security Bearer
+// @Router /profile [get]
+// @Tags user
+func (h *Handler) GetProfile(c echo.Context) error {
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+	user, err := h.Container.UserService.Repo.GetUserByID(h.Container.DB, userID)
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Profile retrieved successfully", profileOf(user))
+}
+
+// UpdateProfile godoc
+// @Summary Update the profile
+// @Description Changes the names of the user, the names left out are not changed
+// @Accept json
+// @Produce json
+// @Param body body types.UpdateProfileInput true "Names"
+// @Success 200 {object} utils.JSONResponse "Profile updated successfully"
+// @Failure 400 {object} utils.JSONResponse "Names cannot be empty"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to update profile"
+// @Security Bearer
+// @Router /profile [patch]
+// @Tags user
+func (h *Handler) UpdateProfile(c echo.Context) error {
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	input := new(types.UpdateProfileInput)
+	if err := c.Bind(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Invalid request payload")
+	}
+	if err := c.Validate(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+
+	user, err := h.Container.UserService.UpdateProfile(userID, input.Firstname, input.Lastname)
+	if errors.Is(err, service.ErrEmptyName) {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		log.Printf("Error updating profile: %v", err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to update profile")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Profile updated successfully", profileOf(user))
+}
+
+// ChangePassword godoc
+// @Summary Change the password
+// @Description Sets a new password, the user confirms the current one
+// @Description The other sessions of the user are revoked, the session of the request stays
+// @Accept json
+// @Produce json
+// @Param body body types.ChangePasswordInput true "Current and new password"
+// @Success 200 {object} utils.JSONResponse "Password changed successfully"
+// @Failure 400 {object} utils.JSONResponse "Password has appeared in a data breach, choose another one"
+// @Failure 401 {object} utils.JSONResponse "Current password is incorrect"
+// @Failure 403 {object} utils.JSONResponse "This route requires a login session"
+// @Failure 429 {object} utils.JSONResponse "Too many failed login attempts, try again later"
+// @Failure 500 {object} utils.JSONResponse "Failed to change password"
+// @Security Bearer
+// @Router /profile/password [post]
+// @Tags user
+func (h *Handler) ChangePassword(c echo.Context) error {
+	userID, sessionID, ok := h.currentSession(c)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+	user, err := h.Container.UserService.Repo.GetUserByID(h.Container.DB, userID)
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	input := new(types.ChangePasswordInput)
+	if err := c.Bind(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Invalid request payload")
+	}
+	if err := c.Validate(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+
+	// Wrong passwords count as failed logins, so a stolen session cannot guess them
+	device := h.deviceOf(c)
+	var locked *service.LockedError
+	err = h.Container.LockoutService.Check(user.Email, device)
+	if err == nil {
+		err = h.Container.UserService.ChangePassword(user, input.CurrentPassword, input.NewPassword)
+	}
+	switch {
+	case errors.As(err, &locked):
+		return h.writeLocked(c, locked)
+	case errors.Is(err, service.ErrWrongPassword):
+		if err := h.Container.LockoutService.Fail(user.Email, user.ID, device); err != nil {
+			log.Printf("Error counting failed login: %v", err)
+		}
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, service.ErrPasswordPolicy):
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	case err != nil:
+		log.Printf("Error changing password: %v", err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to change password")
+	}
+	if err := h.Container.LockoutService.Succeed(user.Email); err != nil {
+		log.Printf("Error clearing failed logins: %v", err)
+	}
+
+	// Whoever knew the old password is logged out everywhere else
+	if _, err := h.Container.JWTService.RevokeOtherSessions(userID, sessionID); err != nil {
+		log.Printf("Error revoking sessions after a password change: %v", err)
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Password changed successfully", nil)
+}
+
+// ChangeEmail godoc
+// @Summary Change the email address
+// @Description Emails a link to the new address, the address changes once the link is opened
+// @Description The user confirms their password, and the current address is told of the change
+// @Description The response is the same whether the new address is taken or not
+// @Accept json
+// @Produce json
+// @Param body body types.ChangeEmailInput true "New email and password"
+// @Success 202 {object} utils.JSONResponse "Check your new email address to confirm the change"
+// @Failure 400 {object} utils.JSONResponse "Email is unchanged"
+// @Failure 401 {object} utils.JSONResponse "Current password is incorrect"
+// @Failure 429 {object} utils.JSONResponse "Too many failed login attempts, try again later"
+// @Failure 500 {object} utils.JSONResponse "Failed to change email address"
+// @Security Bearer
+// @Router /profile/email [post]
+// @Tags user
+func (h *Handler) ChangeEmail(c echo.Context) error {
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+	user, err := h.Container.UserService.Repo.GetUserByID(h.Container.DB, userID)
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	input := new(types.ChangeEmailInput)
+	if err := c.Bind(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Invalid request payload")
+	}
+	if err := c.Validate(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+
+	// Wrong passwords count as failed logins, so a stolen session cannot guess them
+	device := h.deviceOf(c)
+	var locked *service.LockedError
+	if err := h.Container.LockoutService.Check(user.Email, device); errors.As(err, &locked) {
+		return h.writeLocked(c, locked)
+	} else if err != nil {
+		log.Printf("Error changing email address: %v", err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to change email address")
+	}
+	if !h.Container.UserService.VerifyPassword(user, input.Password) {
+		if err := h.Container.LockoutService.Fail(user.Email, user.ID, device); err != nil {
+			log.Printf("Error counting failed login: %v", err)
+		}
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, service.ErrWrongPassword.Error())
+	}
+	if err := h.Container.LockoutService.Succeed(user.Email); err != nil {
+		log.Printf("Error clearing failed logins: %v", err)
+	}
+	if input.Email == user.Email {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Email is unchanged")
+	}
+
+	// Taken addresses get the same response, with no link sent
+	_, err = h.Container.UserService.Repo.GetUserByEmail(input.Email)
+	switch {
+	case err == nil:
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		if err := h.Container.VerificationService.RequestEmailChange(user, input.Email); err != nil {
+			log.Printf("Error sending email change link: %v", err)
+			return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to change email address")
+		}
+	default:
+		log.Printf("Error changing email address: %v", err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to change email address")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusAccepted, "Check your new email address to confirm the change", nil)
+}
+
+// GetMFAStatus godoc
+// @Summary Describe two-factor authentication
+// @Description Tells whether the user logs in with an authenticator app, and how many recovery codes they have left
+// @Produce json
+// @Success 200 {object} utils.JSONResponse "Two-factor authentication status retrieved successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 403 {object} utils.JSONResponse "This route requires a login session"
+// @Failure 500 {object} utils.JSONResponse "Failed to fetch two-factor authentication status"
+// @Security Bearer
+// @Router /profile/mfa [get]
+// @Tags user
+func (h *Handler) GetMFAStatus(c echo.Context) error {
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	status, err := h.Container.MFAService.Status(userID)
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to fetch two-factor authentication status")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Two-factor authentication status retrieved successfully", status)
+}
+
+// BeginTOTPEnrollment godoc
+// @Summary Set up an authenticator app
+// @Description Generates the secret of an authenticator app, and the otpauth URI to show as a QR code
+// @Description Two-factor authentication is enabled once a code of the app is confirmed
+// @Produce json
+// @Success 201 {object} utils.JSONResponse "Authenticator app enrollment started"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 403 {object} utils.JSONResponse "This route requires a login session"
+// @Failure 409 {object} utils.JSONResponse "Two-factor authentication is already enabled"
+// @Failure 500 {object} utils.JSONResponse "Failed to start authenticator app enrollment"
+// @Security Bearer
+// @Router /profile/mfa/totp [post]
+// @Tags user
+func (h *Handler) BeginTOTPEnrollment(c echo.Context) error {
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+	user, err := h.Container.UserService.Repo.GetUserByID(h.Container.DB, userID)
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	enrollment, err := h.Container.MFAService.BeginTOTPEnrollment(user)
+	if errors.Is(err, service.ErrMFAAlreadyEnabled) {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		log.Printf("Error starting authenticator app enrollment: %v", err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to start authenticator app enrollment")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusCreated, "Authenticator app enrollment started", enrollment)
+}
+
+// ConfirmTOTPEnrollment godoc
+// @Summary Confirm an authenticator app
+// @Description Enables two-factor authentication with a code of the authenticator app being set up
+// @Description The recovery codes are only returned in this response, they cannot be retrieved later
+// @Accept json
+// @Produce json
+// @Param body body types.MFACodeInput true "Code"
+// @Success 200 {object} utils.JSONResponse "Two-factor authentication enabled successfully"
+// @Failure 400 {object} utils.JSONResponse "Invalid two-factor authentication code"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 403 {object} utils.JSONResponse "This route requires a login session"
+// @Failure 409 {object} utils.JSONResponse "Two-factor authentication is already enabled"
+// @Failure 500 {object} utils.JSONResponse "Failed to enable two-factor authentication"
+// @Security Bearer
+// @Router /profile/mfa/totp/confirm [post]
+// @Tags user
+func (h *Handler) ConfirmTOTPEnrollment(c echo.Context) error {
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	input := new(types.MFACodeInput)
+	if err := c.Bind(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Invalid request payload")
+	}
+	if err := c.Validate(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+
+	codes, err := h.Container.MFAService.ConfirmTOTPEnrollment(userID, input.Code)
+	switch {
+	case errors.Is(err, service.ErrInvalidMFACode), errors.Is(err, service.ErrMFAEnrollmentNeeded):
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrMFAAlreadyEnabled):
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusConflict, err.Error())
+	case err != nil:
+		log.Printf("Error enabling two-factor authentication: %v", err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to enable two-factor authentication")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Two-factor authentication enabled successfully", map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTOTP godoc
+// @Summary Disable two-factor authentication
+// @Description Removes the authenticator app and the recovery codes of the user
+// @Description The user authenticates again with their password and a code of the app or a recovery code
+// @Accept json
+// @Produce json
+// @Param body body types.MFAReauthInput true "Password and code"
+// @Success 200 {object} utils.JSONResponse "Two-factor authentication disabled successfully"
+// @Failure 400 {object} utils.JSONResponse "Two-factor authentication is not enabled"
+// @Failure 401 {object} utils.JSONResponse "Invalid password or code"
+// @Failure 403 {object} utils.JSONResponse "This route requires a login session"
+// @Failure 429 {object} utils.JSONResponse "Too many failed login attempts, try again later"
+// @Failure 500 {object} utils.JSONResponse "Failed to disable two-factor authentication"
+// @Security Bearer
+// @Router /profile/mfa/totp/disable [post]
+// @Tags user
+func (h *Handler) DisableTOTP(c echo.Context) error {
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+	user, err := h.Container.UserService.Repo.GetUserByID(h.Container.DB, userID)
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	input := new(types.MFAReauthInput)
+	if err := c.Bind(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Invalid request payload")
+	}
+	if err := c.Validate(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+
+	if err := h.Container.MFAService.DisableTOTP(user, input.Password, input.Code, h.deviceOf(c)); err != nil {
+		return h.writeMFAReauthError(c, err, "Failed to disable two-factor authentication")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Two-factor authentication disabled successfully", nil)
+}
+
+// RegenerateRecoveryCodes godoc
+// @Summary Replace the recovery codes
+// @Description Generates new recovery codes, the previous ones stop working
+// @Description The user authenticates again with their password and a code of the app or a recovery code
+// @Description The recovery codes are only returned in this response, they cannot be retrieved later
+// @Accept json
+// @Produce json
+// @Param body body types.MFAReauthInput true "Password and code"
+// @Success 200 {object} utils.JSONResponse "Recovery codes replaced successfully"
+// @Failure 400 {object} utils.JSONResponse "Two-factor authentication is not enabled"
+// @Failure 401 {object} utils.JSONResponse "Invalid password or code"
+// @Failure 403 {object} utils.JSONResponse "This route requires a login session"
+// @Failure 429 {object} utils.JSONResponse "Too many failed login attempts, try again later"
+// @Failure 500 {object} utils.JSONResponse "Failed to replace recovery codes"
+// @Security Bearer
+// @Router /profile/mfa/recovery-codes [post]
+// @Tags user
+func (h *Handler) RegenerateRecoveryCodes(c echo.Context) error {
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+	user, err := h.Container.UserService.Repo.GetUserByID(h.Container.DB, userID)
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	input := new(types.MFAReauthInput)
+	if err := c.Bind(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Invalid request payload")
+	}
+	if err := c.Validate(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+
+	codes, err := h.Container.MFAService.RegenerateRecoveryCodes(user, input.Password, input.Code, h.deviceOf(c))
+	if err != nil {
+		return h.writeMFAReauthError(c, err, "Failed to replace recovery codes")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Recovery codes replaced successfully", map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+// writeMFAReauthError writes the response to a failed change that authenticates again
+func (h *Handler) writeMFAReauthError(c echo.Context, err error, message string) error {
+	var locked *service.LockedError
+	switch {
+	case errors.As(err, &locked):
+		return h.writeLocked(c, locked)
+	case errors.Is(err, service.ErrMFANotEnabled):
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrReauthentication):
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, err.Error())
+	}
+	log.Printf("%s: %v", message, err)
+	return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, message)
+}
+
+// CreatePersonalAccessToken godoc
+// @Summary Create a personal access token
+// @Description Creates a long-lived token for scripts and CI, limited to the given scopes
+// @Description The token is only returned in this response, it cannot be retrieved later
+// @Accept json
+// @Produce json
+// @Param body body types.PersonalAccessTokenInput true "Name, scopes and lifetime"
+// @Success 201 {object} utils.JSONResponse "Personal access token created successfully"
+// @Failure 400 {object} utils.JSONResponse "Invalid scope"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 403 {object} utils.JSONResponse "Email address is not verified"
+// @Failure 500 {object} utils.JSONResponse "Failed to create personal access token"
+// @Security Bearer
+// @Router /profile/access-tokens [post]
+// @Tags user
+func (h *Handler) CreatePersonalAccessToken(c echo.Context) error {
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	// Unverified users cannot hand out access to their account
+	user, err := h.Container.UserService.Repo.GetUserByID(h.Container.DB, userID)
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+	if err := h.Container.VerificationService.CheckVerified(user); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusForbidden, err.Error())
+	}
+
+	input := new(types.PersonalAccessTokenInput)
+	if err := c.Bind(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Invalid request payload")
+	}
+	if err := c.Validate(input); err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+
+	ttl := time.Duration(input.ExpiresInDays) * 24 * time.Hour
+	token, value, err := h.Container.JWTService.CreatePersonalAccessToken(userID, input.Name, input.Scopes, ttl)
+	if errors.Is(err, auth.ErrInvalidScope) || errors.Is(err, service.ErrInvalidTokenTTL) {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		log.Printf("Error creating personal access token: %v", err)
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to create personal access token")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusCreated, "Personal access token created successfully", types.CreatedPersonalAccessToken{
+		PersonalAccessToken: *token,
+		Token:               value,
+	})
+}
+
+// GetPersonalAccessTokens godoc
+// @Summary List personal access tokens
+// @Description Lists the personal access tokens of the user, without their values
+// @Produce json
+// @Success 200 {object} utils.JSONResponse "Personal access tokens retrieved successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 403 {object} utils.JSONResponse "This route requires a login session"
+// @Failure 500 {object} utils.JSONResponse "Failed to fetch personal access tokens"
+// @Security Bearer
+// @Router /profile/access-tokens [get]
+// @Tags user
+func (h *Handler) GetPersonalAccessTokens(c echo.Context) error {
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	tokens, err := h.Container.JWTService.GetPersonalAccessTokens(userID)
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to fetch personal access tokens")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Personal access tokens retrieved successfully", tokens)
+}
+
+// RevokePersonalAccessToken godoc
+// @Summary Revoke a personal access token
+// @Description Revokes a personal access token of the user, scripts using it stop working
+// @Produce json
+// @Param id path string true "Personal access token ID"
+// @Success 200 {object} utils.JSONResponse "Personal access token revoked successfully"
+// @Failure 401 {object} utils.JSONResponse "User not found"
+// @Failure 403 {object} utils.JSONResponse "This route requires a login session"
+// @Failure 404 {object} utils.JSONResponse "Token not found"
+// @Failure 500 {object} utils.JSONResponse "Failed to revoke personal access token"
+// @Security Bearer
+// @Router /profile/access-tokens/{id} [delete]
+// @Tags user
+func (h *Handler) RevokePersonalAccessToken(c echo.Context) error {
+	userID, ok := c.Get("userID").(string)
+	if !ok {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "User not found")
+	}
+
+	err := h.Container.JWTService.RevokePersonalAccessToken(userID, c.Param("id"))
+	if errors.Is(err, service.ErrTokenNotFound) {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusNotFound, "Token not found")
+	}
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to revoke personal access token")
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "Personal access token revoked successfully", nil)
+}
+
+// GetUser godoc
+// @Summary Get a user
+// @Description Gets the contact details of a user, for other services
+// @Produce json
+// @Success 200 {object} utils.JSONResponse "User retrieved successfully"
+// @Failure 401 {object} utils.JSONResponse "Invalid service token"
+// @Failure 404 {object} utils.JSONResponse "User not found"
+// @Param id path string true "User ID"
+// @Security Bearer
+// @Router /internal/users/{id} [get]
+// @Tags internal
+func (h *Handler) GetUser(c echo.Context) error {
+	user, err := h.Container.UserService.Repo.GetUserByID(h.Container.DB, c.Param("id"))
+	if err != nil {
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusNotFound, "User not found")
+	}
+
+	response := map[string]interface{}{
+		"id":        user.ID,
+		"email":     user.Email,
+		"firstname": user.Firstname,
+	}
+
+	return h.Container.Utils.WriteSuccessResponse(c, http.StatusOK, "User retrieved successfully", response)
+}
+
+// GetJWKS godoc
+// @Summary Get the token signing keys
+// @Description Gets the public keys access tokens are verified with, as a JSON Web Key Set
+// @Description Keys of a rotation stay in the set until the tokens they signed have expired
+// @Produce json
+// @Success 200 {object} auth.JWKS "Key set"
+// @Router /.well-known/jwks.json [get]
+// @Tags auth
+func (h *Handler) GetJWKS(c echo.Context) error {
+	// Other services cache the keys and refetch them for unknown key IDs
+	c.Response().Header().Set("Cache-Control", "public, max-age=300")
+	return c.JSON(http.StatusOK, h.Container.JWTService.JWKS())
+}
+
+// IssueServiceToken godoc
+// @Summary Issue a service token
+// @Description Exchanges the credentials of a service for a short-lived token to call the internal routes with
+// @Description Implements the client credentials grant of RFC 6749, credentials are sent with HTTP Basic or in the form
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "client_credentials"
+// @Param client_id formData string false "Client ID"
+// @Param client_secret formData string false "Client secret"
+// @Success 200 {object} service.ServiceToken "Service token"
+// @Failure 400 {object} map[string]string "unsupported_grant_type"
+// @Failure 401 {object} map[string]string "invalid_client"
+// @Router /oauth/token [post]
+// @Tags internal
+func (h *Handler) IssueServiceToken(c echo.Context) error {
+	// Token responses must not be cached
+	c.Response().Header().Set("Cache-Control", "no-store")
+
+	if c.FormValue("grant_type") != "client_credentials" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+	}
+
+	clientID, secret, ok := c.Request().BasicAuth()
+	if !ok {
+		clientID, secret = c.FormValue("client_id"), c.FormValue("client_secret")
+	}
+
+	token, err := h.Container.ClientService.IssueToken(clientID, secret)
+	if errors.Is(err, service.ErrInvalidClient) {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="user-service"`)
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+	}
+	if err != nil {
+		log.Printf("Error issuing service token: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "server_error"})
+	}
+
+	return c.JSON(http.StatusOK, token)
+}
+
+// Introspect godoc
+// @Summary Introspect a token
+// @Description Returns the state of an access or refresh token, as defined by RFC 7662
+// @Description Tokens that are invalid, expired, revoked or unknown are reported as not active
+// @Description Active tokens also tell whether their user verified their email address,
+// @Description and whether the verification policy restricts the user until they do
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param token formData string true "Token"
+// @Param token_type_hint formData string false "access_token, refresh_token or personal_access_token, the kind of token looked up first"
+// @Success 200 {object} service.Introspection "Token state"
+// @Failure 400 {object} map[string]string "invalid_request"
+// @Failure 401 {object} utils.JSONResponse "Invalid service token"
+// @Security Bearer
+// @Router /introspect [post]
+// @Tags internal
+func (h *Handler) Introspect(c echo.Context) error {
+	// Introspection responses must not be cached by intermediaries
+	c.Response().Header().Set("Cache-Control", "no-store")
+
+	token := c.FormValue("token")
+	if token == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":             "invalid_request",
+			"error_description": "token is required",
+		})
+	}
+
+	result, err := h.Container.JWTService.Introspect(token, c.FormValue("token_type_hint"))
+	if err != nil {
+		log.Printf("Error introspecting token: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "server_error"})
+	}
+
+	// Other services restrict unverified users as the verification policy says
+	if result.Active {
+		user, err := h.Container.UserService.Repo.GetUserByID(h.Container.DB, result.Sub)
+		if err != nil {
+			return c.JSON(http.StatusOK, &service.Introspection{Active: false})
+		}
+		result.EmailVerified = user.EmailVerified
+		result.VerificationRequired = h.Container.VerificationService.CheckVerified(user) != nil
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
 // ValidateUserToken godoc
 // @Summary Validate a user token
 // @Description Validate a user token
+// @Description Other services should use /introspect instead
+// @Deprecated
 // @Accept json
 // @Produce json
 // @Success 200 {object} utils.JSONResponse "Token is valid"
 // @Failure 400 {object} utils.JSONResponse "Invalid request payload"
 // @Failure 404 {object} utils.JSONResponse "User not found"
-// @Failure 500 {object} utils.JSONResponse "Failed to validate token"
+// @Failure 401 {object} utils.JSONResponse "Invalid token"
+// @Failure 500 {object} utils.JSONResponse "Token claims are not accessible"
 // @Security Bearer
 // @Router /validate [post]
 // @Tags user
@@ -242,15 +1439,14 @@ func (h *Handler) ValidateUserToken(c echo.Context) error {
 		return h.Container.Utils.WriteErrorResponse(c, http.StatusBadRequest, "Token is missing")
 	}
 
-	fmt.Printf("Request body: %v\n", requestBody)
-
+	// Revoked tokens are not valid anymore
 	token, err := h.Container.JWTService.ValidateToken(requestBody.Token)
 	if err != nil || !token.Valid {
-		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Failed to validate token")
+		return h.Container.Utils.WriteErrorResponse(c, http.StatusUnauthorized, "Invalid token")
 	}
 
 	// Get the user id from the token
-	userID, err := h.Container.JWTService.GetUserIDFromToken(requestBody.Token)
+	userID, _, err := service.TokenIdentity(token)
 	if err != nil {
 		return h.Container.Utils.WriteErrorResponse(c, http.StatusInternalServerError, "Token claims are not accessible")
 	}
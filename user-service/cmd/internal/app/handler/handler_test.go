@@ -2,25 +2,64 @@
 package handler
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 	"user-service/cmd/internal/app/repositories"
 	"user-service/cmd/internal/app/service"
+	"user-service/cmd/internal/audit"
+	"user-service/cmd/internal/auth"
+	"user-service/cmd/internal/breached"
+	"user-service/cmd/internal/interceptor"
+	"user-service/cmd/internal/mailer"
 	"user-service/cmd/internal/models"
 	"user-service/cmd/internal/types"
 	"user-service/cmd/internal/utils"
 	"user-service/cmd/internal/validators"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
+// testJWTConfig signs and verifies the tokens of the tests
+var testJWTConfig = &auth.Config{
+	SigningKey: newTestKey(),
+	Issuer:     "user-service",
+	Audience:   "optimate",
+	TTL:        time.Hour,
+}
+
+// testClients are the services allowed to call the internal routes in the tests
+var testClients, _ = auth.ParseServiceClients("optimizer-service:service-secret")
+
+// newTestKey generates an Ed25519 signing key
+func newTestKey() *auth.Key {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(err)
+	}
+	key, err := auth.NewKey(private)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
 // Set up Echo and database for testing
 func setUpTest() (*echo.Echo, *types.AppContainer) {
 	e := echo.New()
@@ -29,7 +68,7 @@ func setUpTest() (*echo.Echo, *types.AppContainer) {
 	db, _ := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
 
 	// Migrate the schema for the test database
-	err := db.AutoMigrate(&models.User{}, &models.PersonalToken{})
+	err := db.AutoMigrate(&models.User{}, &models.PersonalToken{}, &models.RefreshToken{}, &models.PersonalAccessToken{}, &models.Session{}, &models.PasswordResetToken{}, &models.EmailVerificationToken{}, &models.TOTPCredential{}, &models.RecoveryCode{}, &models.MFAChallenge{}, &models.LoginThrottle{})
 	if err != nil {
 		fmt.Println("Error migrating the schema")
 		return nil, nil
@@ -42,8 +81,33 @@ func setUpTest() (*echo.Echo, *types.AppContainer) {
 		Utils:       utils.NewUtils(db),
 		DB:          db,
 		UserService: service.NewUserService(userRepo),
-		JWTService:  service.NewJWTService(tokenRepo, "secret"),
+		JWTService:  service.NewJWTService(tokenRepo, testJWTConfig),
+		ClientService: service.NewClientService(
+			testClients,
+			testJWTConfig.ForAudience(service.DefaultServiceAudience, time.Hour),
+		),
 	}
+	mail := mailer.NewMemoryMailer()
+	container.PasswordService = service.NewPasswordService(
+		container.UserService,
+		container.JWTService,
+		mail,
+		"OptiMate <no-reply@optimate.local>",
+		"https://optimate.test/reset-password",
+	)
+	container.VerificationService = service.NewVerificationService(
+		container.UserService,
+		mail,
+		"OptiMate <no-reply@optimate.local>",
+		"https://optimate.test/verify-email",
+	)
+	container.LockoutService = service.NewLockoutService(repositories.NewLockoutRepository(db), audit.NewMemoryRecorder())
+	container.MFAService = service.NewMFAService(
+		repositories.NewMFARepository(db),
+		container.UserService,
+		container.JWTService,
+		container.LockoutService,
+	)
 	return e, container
 }
 
@@ -158,8 +222,20 @@ func TestRegisterWithExistingEmail(t *testing.T) {
 	h := NewHandler(container)
 
 	if assert.NoError(t, h.Register(c)) {
-		assert.Equal(t, http.StatusBadRequest, rec.Code)
-		assert.Contains(t, rec.Body.String(), "Email already exists")
+		// Taken emails cannot be told apart, their owner is emailed instead
+		fresh := postJSON(t, e, h.Register, `{"email": "new@admin.com", "password": "password", "firstname": "John", "lastname": "Doe"}`)
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+		assert.Equal(t, fresh.Code, rec.Code)
+		assert.Equal(t, strings.Replace(fresh.Body.String(), "new@admin.com", "admin@admin.com", 1), rec.Body.String())
+		assert.NotContains(t, rec.Body.String(), "already")
+
+		msg, ok := container.VerificationService.Mailer.(*mailer.MemoryMailer).Last("admin@admin.com")
+		assert.True(t, ok)
+		assert.Equal(t, "You already have an account", msg.Subject)
+
+		var users int64
+		container.DB.Model(&models.User{}).Where("email = ?", "admin@admin.com").Count(&users)
+		assert.Equal(t, int64(1), users)
 	}
 }
 
@@ -224,3 +300,1958 @@ func TestLoginInvalidData(t *testing.T) {
 	}
 
 }
+
+func TestGetUserForService(t *testing.T) {
+	e, container := setUpTest()
+
+	user, err := container.UserService.RegisterUser(
+		&models.RegisterInput{
+			Email:     "admin@admin.com",
+			Password:  "password",
+			Firstname: "John",
+			LastName:  "Doe",
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to register user: %v", err)
+	}
+
+	h := NewHandler(container)
+	e.GET("/internal/users/:id", h.GetUser, interceptor.ServiceAuthentication(container.ClientService))
+
+	serviceToken := issueServiceToken(t, container)
+	userToken, err := container.JWTService.IssueToken(user.ID, service.Device{})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		token  string
+		id     string
+		status int
+	}{
+		{"service token", serviceToken, user.ID, http.StatusOK},
+		{"missing token", "", user.ID, http.StatusUnauthorized},
+		{"user token", userToken, user.ID, http.StatusUnauthorized},
+		{"invalid token", "not-a-token", user.ID, http.StatusUnauthorized},
+		{"unknown user", serviceToken, "unknown", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/internal/users/"+tt.id, nil)
+		if tt.token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		assert.Equal(t, tt.status, rec.Code, tt.name)
+		if tt.status == http.StatusOK {
+			assert.Contains(t, rec.Body.String(), "admin@admin.com")
+		}
+	}
+}
+
+// validateToken posts a token to /validate
+// It returns the response recorder
+func validateToken(t *testing.T, e *echo.Echo, h *Handler, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(`{"token": "`+token+`"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	assert.NoError(t, h.ValidateUserToken(e.NewContext(req, rec)))
+	return rec
+}
+
+func TestValidateUserToken(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+
+	user, err := container.UserService.RegisterUser(
+		&models.RegisterInput{
+			Email:     "admin@admin.com",
+			Password:  "password",
+			Firstname: "John",
+			LastName:  "Doe",
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to register user: %v", err)
+	}
+
+	token, err := container.JWTService.IssueToken(user.ID, service.Device{})
+	assert.NoError(t, err)
+
+	rec := validateToken(t, e, h, token)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), user.ID)
+
+	// Tokens signed with a shared secret are not accepted anymore
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": user.ID,
+		"iss":     "user-service",
+		"aud":     "optimate",
+		"iat":     time.Now().Unix(),
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("test-secret-that-is-long-enough-to-sign"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, legacy).Code)
+
+	// Tokens for another audience are not accepted
+	other := *testJWTConfig
+	other.Audience = "another-service"
+	otherToken, err := other.Sign(jwt.MapClaims{"user_id": user.ID})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, otherToken).Code)
+
+	// Nor are tokens signed with an unknown key
+	unknown := *testJWTConfig
+	unknown.SigningKey = newTestKey()
+	unknownToken, err := unknown.Sign(jwt.MapClaims{"user_id": user.ID})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, unknownToken).Code)
+
+	// Expired tokens are not accepted
+	expired := *testJWTConfig
+	expired.TTL = -time.Hour
+	expiredToken, err := expired.Sign(jwt.MapClaims{"user_id": user.ID})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, expiredToken).Code)
+}
+
+func TestTokensFailClosedWithoutSigningKey(t *testing.T) {
+	e, container := setUpTest()
+
+	user, err := container.UserService.RegisterUser(
+		&models.RegisterInput{
+			Email:     "admin@admin.com",
+			Password:  "password",
+			Firstname: "John",
+			LastName:  "Doe",
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to register user: %v", err)
+	}
+
+	token, err := container.JWTService.IssueToken(user.ID, service.Device{})
+	assert.NoError(t, err)
+
+	container.JWTService.Config = &auth.Config{
+		VerificationKeys: []*auth.Key{testJWTConfig.SigningKey},
+		Issuer:           "user-service",
+		Audience:         "optimate",
+	}
+	h := NewHandler(container)
+
+	// No token can be issued
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{
+		"email": "admin@admin.com",
+		"password": "password"
+	}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	if assert.NoError(t, h.Login(e.NewContext(req, rec))) {
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	}
+
+	// And none is accepted
+	assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, token).Code)
+}
+
+func TestKeyRotation(t *testing.T) {
+	e, container := setUpTest()
+
+	user, err := container.UserService.RegisterUser(
+		&models.RegisterInput{
+			Email:     "admin@admin.com",
+			Password:  "password",
+			Firstname: "John",
+			LastName:  "Doe",
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to register user: %v", err)
+	}
+
+	oldToken, err := container.JWTService.IssueToken(user.ID, service.Device{})
+	assert.NoError(t, err)
+
+	// Rotate to an RSA key, the old key still verifies the tokens it signed
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	newKey, err := auth.NewKey(rsaKey)
+	assert.NoError(t, err)
+
+	oldKey := *testJWTConfig.SigningKey
+	oldKey.Private = nil
+	rotated := *testJWTConfig
+	rotated.SigningKey = newKey
+	rotated.VerificationKeys = []*auth.Key{&oldKey}
+	container.JWTService.Config = &rotated
+	h := NewHandler(container)
+
+	newToken, err := container.JWTService.IssueToken(user.ID, service.Device{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, oldToken).Code)
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, newToken).Code)
+
+	token, _, err := new(jwt.Parser).ParseUnverified(newToken, jwt.MapClaims{})
+	assert.NoError(t, err)
+	assert.Equal(t, "RS256", token.Header["alg"])
+	assert.Equal(t, newKey.ID, token.Header["kid"])
+
+	// Both keys are published, without their private parts
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	rec := httptest.NewRecorder()
+	if assert.NoError(t, h.GetJWKS(e.NewContext(req, rec))) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var set auth.JWKS
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &set))
+		if assert.Len(t, set.Keys, 2) {
+			assert.Equal(t, auth.JWK{Kty: "RSA", Kid: newKey.ID, Use: "sig", Alg: "RS256", N: set.Keys[0].N, E: "AQAB"}, set.Keys[0])
+			assert.Equal(t, "OKP", set.Keys[1].Kty)
+			assert.Equal(t, "Ed25519", set.Keys[1].Crv)
+			assert.Equal(t, oldKey.ID, set.Keys[1].Kid)
+		}
+		assert.NotContains(t, rec.Body.String(), `"d"`)
+	}
+
+	// Once the old key is dropped, its tokens are not accepted
+	rotated.VerificationKeys = nil
+	assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, oldToken).Code)
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, newToken).Code)
+}
+
+// registerUser registers a user with an email
+func registerUser(t *testing.T, container *types.AppContainer, email string) *models.User {
+	user, err := container.UserService.RegisterUser(
+		&models.RegisterInput{
+			Email:     email,
+			Password:  "password",
+			Firstname: "John",
+			LastName:  "Doe",
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to register user: %v", err)
+	}
+	return user
+}
+
+// setUpRoutes registers the token routes of the service
+func setUpRoutes(e *echo.Echo, container *types.AppContainer) *Handler {
+	h := NewHandler(container)
+	jwtInterceptor := interceptor.JWTAuthentication(container.JWTService)
+	sessionInterceptor := interceptor.RequireSession()
+	e.POST("/logout", h.Logout, jwtInterceptor, sessionInterceptor)
+	profile := e.Group("/profile", jwtInterceptor, sessionInterceptor)
+	profile.GET("", h.GetProfile)
+	profile.PATCH("", h.UpdateProfile)
+	profile.POST("/password", h.ChangePassword)
+	profile.POST("/email", h.ChangeEmail)
+	profile.GET("/tokens", h.GetUserJWTTokens)
+	profile.POST("/tokens/revoke-all", h.RevokeAllUserTokens)
+	profile.POST("/tokens/:id/revoke", h.RevokeUserToken)
+	profile.POST("/access-tokens", h.CreatePersonalAccessToken)
+	profile.GET("/access-tokens", h.GetPersonalAccessTokens)
+	profile.DELETE("/access-tokens/:id", h.RevokePersonalAccessToken)
+	profile.GET("/sessions", h.GetSessions)
+	profile.POST("/sessions/revoke-others", h.RevokeOtherSessions)
+	profile.GET("/sessions/:id", h.GetSession)
+	profile.DELETE("/sessions/:id", h.RevokeSession)
+	profile.GET("/mfa", h.GetMFAStatus)
+	profile.POST("/mfa/totp", h.BeginTOTPEnrollment)
+	profile.POST("/mfa/totp/confirm", h.ConfirmTOTPEnrollment)
+	profile.POST("/mfa/totp/disable", h.DisableTOTP)
+	profile.POST("/mfa/recovery-codes", h.RegenerateRecoveryCodes)
+	return h
+}
+
+// authorized sends an authenticated request
+// It returns the response recorder
+func authorized(e *echo.Echo, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// tokenID returns the jti of a token
+func tokenID(t *testing.T, tokenString string) string {
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jti, _ := token.Claims.(jwt.MapClaims)["jti"].(string)
+	return jti
+}
+
+func TestLogout(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+
+	laptop, err := container.JWTService.IssueToken(user.ID, service.Device{})
+	assert.NoError(t, err)
+	phone, err := container.JWTService.IssueToken(user.ID, service.Device{})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, tokenID(t, laptop))
+
+	assert.Equal(t, http.StatusOK, authorized(e, http.MethodPost, "/logout", laptop).Code)
+
+	// The token is rejected by the middleware and by /validate
+	assert.Equal(t, http.StatusUnauthorized, authorized(e, http.MethodGet, "/profile/tokens", laptop).Code)
+	assert.Equal(t, http.StatusUnauthorized, authorized(e, http.MethodPost, "/logout", laptop).Code)
+	assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, laptop).Code)
+
+	// The other session is still signed in
+	assert.Equal(t, http.StatusOK, authorized(e, http.MethodGet, "/profile/tokens", phone).Code)
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, phone).Code)
+}
+
+func TestRevokeUserToken(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	other := registerUser(t, container, "other@admin.com")
+
+	current, err := container.JWTService.IssueToken(user.ID, service.Device{})
+	assert.NoError(t, err)
+	stolen, err := container.JWTService.IssueToken(user.ID, service.Device{})
+	assert.NoError(t, err)
+	othersToken, err := container.JWTService.IssueToken(other.ID, service.Device{})
+	assert.NoError(t, err)
+
+	rec := authorized(e, http.MethodPost, "/profile/tokens/"+tokenID(t, stolen)+"/revoke", current)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, stolen).Code)
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, current).Code)
+
+	// Tokens of other users cannot be revoked
+	rec = authorized(e, http.MethodPost, "/profile/tokens/"+tokenID(t, othersToken)+"/revoke", current)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, othersToken).Code)
+
+	rec = authorized(e, http.MethodPost, "/profile/tokens/unknown/revoke", current)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestRevokeAllUserTokens(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	other := registerUser(t, container, "other@admin.com")
+
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		token, err := container.JWTService.IssueToken(user.ID, service.Device{})
+		assert.NoError(t, err)
+		tokens = append(tokens, token)
+	}
+	othersToken, err := container.JWTService.IssueToken(other.ID, service.Device{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, authorized(e, http.MethodPost, "/profile/tokens/revoke-all", tokens[0]).Code)
+
+	for _, token := range tokens {
+		assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, token).Code)
+	}
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, othersToken).Code)
+}
+
+func TestTokensWeDidNotIssueAreRejected(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+
+	// Correctly signed, but without a jti or with one we have no record of
+	withoutID, err := testJWTConfig.Sign(jwt.MapClaims{"user_id": user.ID})
+	assert.NoError(t, err)
+	unknownID, err := testJWTConfig.Sign(jwt.MapClaims{"user_id": user.ID, "jti": "unknown"})
+	assert.NoError(t, err)
+
+	for _, token := range []string{withoutID, unknownID} {
+		assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, token).Code)
+		assert.Equal(t, http.StatusUnauthorized, authorized(e, http.MethodGet, "/profile/tokens", token).Code)
+	}
+}
+
+// refresh posts a refresh token to /token/refresh
+// It returns the status and the new access and refresh tokens
+func refresh(t *testing.T, e *echo.Echo, h *Handler, refreshToken string) (int, string, string) {
+	req := httptest.NewRequest(http.MethodPost, "/token/refresh", strings.NewReader(`{"refresh_token": "`+refreshToken+`"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h.RefreshToken(e.NewContext(req, rec)))
+
+	var response struct {
+		Data struct {
+			Token        string `json:"token"`
+			RefreshToken string `json:"refresh_token"`
+			ExpiresIn    int64  `json:"expires_in"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	return rec.Code, response.Data.Token, response.Data.RefreshToken
+}
+
+func TestLoginIssuesRefreshToken(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	registerUser(t, container, "admin@admin.com")
+
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{
+		"email": "admin@admin.com",
+		"password": "password"
+	}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	if assert.NoError(t, h.Login(e.NewContext(req, rec))) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"refresh_token":"rt_`)
+		assert.Contains(t, rec.Body.String(), `"expires_in":3600`)
+	}
+
+	// Only the hash of the refresh token is stored
+	var stored models.RefreshToken
+	assert.NoError(t, container.DB.First(&stored).Error)
+	assert.NotContains(t, rec.Body.String(), stored.TokenHash)
+	assert.Len(t, stored.TokenHash, 64)
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	user := registerUser(t, container, "admin@admin.com")
+
+	tokens, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+
+	status, accessToken, refreshToken := refresh(t, e, h, tokens.RefreshToken)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEqual(t, tokens.RefreshToken, refreshToken)
+
+	// The new access token replaces the old one
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, accessToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, tokens.AccessToken).Code)
+
+	// And the new refresh token can be used in turn
+	status, accessToken, refreshToken = refresh(t, e, h, refreshToken)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, accessToken).Code)
+
+	// Other logins are not affected by a reuse
+	other, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+
+	// Using a refresh token again revokes its whole family
+	status, _, _ = refresh(t, e, h, tokens.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, accessToken).Code)
+	status, _, _ = refresh(t, e, h, refreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, other.AccessToken).Code)
+	status, _, _ = refresh(t, e, h, other.RefreshToken)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestFailedRefreshKeepsRefreshToken(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	user := registerUser(t, container, "admin@admin.com")
+
+	tokens, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+
+	// Signing the new access token fails once the refresh token is used
+	config := container.JWTService.Config
+	container.JWTService.Config = &auth.Config{}
+	_, err = container.JWTService.Refresh(tokens.RefreshToken)
+	assert.Error(t, err)
+	container.JWTService.Config = config
+
+	// Nothing of the refresh was kept, the tokens can still be used
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, tokens.AccessToken).Code)
+	status, accessToken, _ := refresh(t, e, h, tokens.RefreshToken)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, accessToken).Code)
+}
+
+func TestRefreshTokenRejected(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+
+	status, _, _ := refresh(t, e, h, "rt_unknown")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, _, _ = refresh(t, e, h, "")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// Expired refresh tokens
+	container.JWTService.RefreshTTL = -time.Minute
+	expired, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+	status, _, _ = refresh(t, e, h, expired.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	container.JWTService.RefreshTTL = time.Hour
+
+	// Logging out revokes the refresh token too
+	tokens, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, authorized(e, http.MethodPost, "/logout", tokens.AccessToken).Code)
+	status, _, _ = refresh(t, e, h, tokens.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// And so does revoking all the tokens
+	tokens, err = container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, authorized(e, http.MethodPost, "/profile/tokens/revoke-all", tokens.AccessToken).Code)
+	status, _, _ = refresh(t, e, h, tokens.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+// issueServiceToken issues a token of the optimizer service
+func issueServiceToken(t *testing.T, container *types.AppContainer) string {
+	token, err := container.ClientService.IssueToken("optimizer-service", "service-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.AccessToken
+}
+
+// introspect posts a token to /introspect as another service
+// It returns the response recorder
+func introspect(e *echo.Echo, form, serviceToken string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/introspect", strings.NewReader(form))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	if serviceToken != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+serviceToken)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIntrospect(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	e.POST("/introspect", h.Introspect, interceptor.ServiceAuthentication(container.ClientService))
+	user := registerUser(t, container, "admin@admin.com")
+	serviceToken := issueServiceToken(t, container)
+
+	tokens, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+
+	// Only our services can introspect tokens
+	assert.Equal(t, http.StatusUnauthorized, introspect(e, "token="+tokens.AccessToken, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, introspect(e, "token="+tokens.AccessToken, tokens.AccessToken).Code)
+	assert.Equal(t, http.StatusBadRequest, introspect(e, "", serviceToken).Code)
+
+	rec := introspect(e, "token="+tokens.AccessToken, serviceToken)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+	var result map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Equal(t, true, result["active"])
+	assert.Equal(t, user.ID, result["sub"])
+	assert.Equal(t, "optimate", result["client_id"])
+	assert.Equal(t, "access_token", result["token_type"])
+	assert.Equal(t, tokenID(t, tokens.AccessToken), result["jti"])
+	assert.InDelta(t, time.Now().Add(time.Hour).Unix(), result["exp"], 5)
+
+	// Refresh tokens can be introspected too
+	rec = introspect(e, "token="+tokens.RefreshToken+"&token_type_hint=refresh_token", serviceToken)
+	assert.Contains(t, rec.Body.String(), `"active":true`)
+	assert.Contains(t, rec.Body.String(), `"token_type":"refresh_token"`)
+
+	// The hint is only advisory, a wrong one does not make a token inactive
+	rec = introspect(e, "token="+tokens.AccessToken+"&token_type_hint=refresh_token", serviceToken)
+	assert.Contains(t, rec.Body.String(), `"token_type":"access_token"`)
+	rec = introspect(e, "token="+tokens.RefreshToken+"&token_type_hint=access_token", serviceToken)
+	assert.Contains(t, rec.Body.String(), `"token_type":"refresh_token"`)
+
+	// Inactive tokens only say so
+	assert.Equal(t, http.StatusOK, authorized(e, http.MethodPost, "/logout", tokens.AccessToken).Code)
+	for _, token := range []string{tokens.AccessToken, tokens.RefreshToken, "not-a-token", "rt_unknown"} {
+		rec = introspect(e, "token="+token+"&token_type_hint=refresh_token", serviceToken)
+		assert.JSONEq(t, `{"active":false}`, rec.Body.String())
+		rec = introspect(e, "token="+token, serviceToken)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"active":false}`, rec.Body.String())
+	}
+}
+
+// requestServiceToken posts a client credentials grant to /oauth/token
+// It returns the response recorder
+func requestServiceToken(e *echo.Echo, form string, basic ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	if len(basic) == 2 {
+		req.SetBasicAuth(basic[0], basic[1])
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIssueServiceToken(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	e.POST("/oauth/token", h.IssueServiceToken)
+	e.GET("/internal/users/:id", h.GetUser, interceptor.ServiceAuthentication(container.ClientService))
+
+	// Credentials are accepted with HTTP Basic and in the form
+	for _, rec := range []*httptest.ResponseRecorder{
+		requestServiceToken(e, "grant_type=client_credentials", "optimizer-service", "service-secret"),
+		requestServiceToken(e, "grant_type=client_credentials&client_id=optimizer-service&client_secret=service-secret"),
+	} {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+		var token service.ServiceToken
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &token))
+		assert.Equal(t, "Bearer", token.TokenType)
+		assert.Equal(t, int64(3600), token.ExpiresIn)
+
+		// The token opens the internal routes, not the user routes
+		assert.Equal(t, http.StatusNotFound, authorized(e, http.MethodGet, "/internal/users/unknown", token.AccessToken).Code)
+		_, err := container.JWTService.ValidateToken(token.AccessToken)
+		assert.Error(t, err)
+	}
+
+	rec := requestServiceToken(e, "grant_type=client_credentials", "optimizer-service", "wrong-secret")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.JSONEq(t, `{"error":"invalid_client"}`, rec.Body.String())
+	assert.Equal(t, http.StatusUnauthorized, requestServiceToken(e, "grant_type=client_credentials", "unknown", "service-secret").Code)
+
+	rec = requestServiceToken(e, "grant_type=password", "optimizer-service", "service-secret")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.JSONEq(t, `{"error":"unsupported_grant_type"}`, rec.Body.String())
+}
+
+func TestServiceClientRotation(t *testing.T) {
+	_, container := setUpTest()
+	oldToken := issueServiceToken(t, container)
+
+	// During a rotation both secrets are accepted
+	clients, err := auth.ParseServiceClients("optimizer-service:service-secret,optimizer-service:new-secret")
+	assert.NoError(t, err)
+	container.ClientService.Clients = clients
+	for _, secret := range []string{"service-secret", "new-secret"} {
+		_, err := container.ClientService.IssueToken("optimizer-service", secret)
+		assert.NoError(t, err, secret)
+	}
+
+	// Then the old one is removed
+	clients, err = auth.ParseServiceClients("optimizer-service:sha256:" + hashToken("new-secret"))
+	assert.NoError(t, err)
+	container.ClientService.Clients = clients
+	_, err = container.ClientService.IssueToken("optimizer-service", "service-secret")
+	assert.ErrorIs(t, err, service.ErrInvalidClient)
+	_, err = container.ClientService.IssueToken("optimizer-service", "new-secret")
+	assert.NoError(t, err)
+
+	// Tokens of removed clients stop working
+	_, err = container.ClientService.ValidateToken(oldToken)
+	assert.NoError(t, err)
+	container.ClientService.Clients, _ = auth.ParseServiceClients("")
+	_, err = container.ClientService.ValidateToken(oldToken)
+	assert.ErrorIs(t, err, service.ErrInvalidServiceToken)
+}
+
+// sessionPage is the body of a page of sessions
+type sessionPage struct {
+	Data struct {
+		Sessions []models.Session `json:"sessions"`
+		Page     int              `json:"page"`
+		PerPage  int              `json:"per_page"`
+		Total    int64            `json:"total"`
+	} `json:"data"`
+}
+
+// getSessions lists the sessions of a user
+func getSessions(t *testing.T, e *echo.Echo, query, token string) (int, sessionPage) {
+	rec := authorized(e, http.MethodGet, "/profile/sessions"+query, token)
+	var page sessionPage
+	if rec.Code == http.StatusOK {
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	}
+	return rec.Code, page
+}
+
+func TestSessions(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	other := registerUser(t, container, "other@admin.com")
+
+	laptop, err := container.JWTService.IssueTokenPair(user.ID, service.Device{UserAgent: "Firefox", IPAddress: "10.0.0.1"})
+	assert.NoError(t, err)
+	phone, err := container.JWTService.IssueTokenPair(user.ID, service.Device{UserAgent: "Safari", IPAddress: "10.0.0.2"})
+	assert.NoError(t, err)
+	othersLogin, err := container.JWTService.IssueTokenPair(other.ID, service.Device{})
+	assert.NoError(t, err)
+
+	status, page := getSessions(t, e, "", laptop.AccessToken)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int64(2), page.Data.Total)
+	assert.Equal(t, service.DefaultSessionPageSize, page.Data.PerPage)
+	var current, phoneSession models.Session
+	for _, session := range page.Data.Sessions {
+		assert.Equal(t, user.ID, session.UserID)
+		if session.Current {
+			current = session
+		} else {
+			phoneSession = session
+		}
+	}
+	assert.Equal(t, "Firefox", current.UserAgent)
+	assert.Equal(t, "10.0.0.1", current.IPAddress)
+	assert.Equal(t, "Safari", phoneSession.UserAgent)
+	assert.False(t, current.CreatedAt.IsZero())
+	assert.False(t, current.LastSeenAt.IsZero())
+
+	// Pages
+	status, page = getSessions(t, e, "?page=2&per_page=1", laptop.AccessToken)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, page.Data.Sessions, 1)
+	assert.Equal(t, int64(2), page.Data.Total)
+	status, page = getSessions(t, e, "?page=3&per_page=1", laptop.AccessToken)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, page.Data.Sessions)
+	for _, query := range []string{"?page=0", "?page=x", "?per_page=0", "?per_page=101"} {
+		status, _ = getSessions(t, e, query, laptop.AccessToken)
+		assert.Equal(t, http.StatusBadRequest, status, query)
+	}
+
+	// Describe a session
+	rec := authorized(e, http.MethodGet, "/profile/sessions/"+phoneSession.ID, laptop.AccessToken)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"user_agent":"Safari"`)
+	assert.Contains(t, rec.Body.String(), `"current":false`)
+
+	// Sessions of other users cannot be seen nor revoked
+	_, othersPage := getSessions(t, e, "", othersLogin.AccessToken)
+	othersSession := othersPage.Data.Sessions[0].ID
+	assert.Equal(t, http.StatusNotFound, authorized(e, http.MethodGet, "/profile/sessions/"+othersSession, laptop.AccessToken).Code)
+	assert.Equal(t, http.StatusNotFound, authorized(e, http.MethodDelete, "/profile/sessions/"+othersSession, laptop.AccessToken).Code)
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, othersLogin.AccessToken).Code)
+
+	// Revoking a session signs it out, its refresh token included
+	assert.Equal(t, http.StatusOK, authorized(e, http.MethodDelete, "/profile/sessions/"+phoneSession.ID, laptop.AccessToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, phone.AccessToken).Code)
+	status, _, _ = refresh(t, e, h, phone.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, http.StatusNotFound, authorized(e, http.MethodDelete, "/profile/sessions/"+phoneSession.ID, laptop.AccessToken).Code)
+	status, page = getSessions(t, e, "", laptop.AccessToken)
+	assert.Equal(t, int64(1), page.Data.Total)
+
+	// A refresh keeps the session
+	status, accessToken, _ := refresh(t, e, h, laptop.RefreshToken)
+	assert.Equal(t, http.StatusOK, status)
+	_, page = getSessions(t, e, "", accessToken)
+	if assert.Len(t, page.Data.Sessions, 1) {
+		assert.Equal(t, current.ID, page.Data.Sessions[0].ID)
+		assert.True(t, page.Data.Sessions[0].Current)
+	}
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	other := registerUser(t, container, "other@admin.com")
+
+	current, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+	var others []*service.TokenPair
+	for i := 0; i < 2; i++ {
+		tokens, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+		assert.NoError(t, err)
+		others = append(others, tokens)
+	}
+	_, pat, err := container.JWTService.CreatePersonalAccessToken(user.ID, "ci", []string{"files:read"}, 0)
+	assert.NoError(t, err)
+	othersLogin, err := container.JWTService.IssueTokenPair(other.ID, service.Device{})
+	assert.NoError(t, err)
+
+	rec := authorized(e, http.MethodPost, "/profile/sessions/revoke-others", current.AccessToken)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"revoked":2`)
+
+	for _, tokens := range others {
+		assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, tokens.AccessToken).Code)
+		status, _, _ := refresh(t, e, h, tokens.RefreshToken)
+		assert.Equal(t, http.StatusUnauthorized, status)
+	}
+
+	// The current session, personal access tokens and other users are kept
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, current.AccessToken).Code)
+	_, err = container.JWTService.AuthenticatePersonalAccessToken(pat)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, othersLogin.AccessToken).Code)
+	status, _, _ := refresh(t, e, h, current.RefreshToken)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+// postJSON sends a JSON body to a handler
+// It returns the response recorder
+func postJSON(t *testing.T, e *echo.Echo, handler echo.HandlerFunc, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, handler(e.NewContext(req, rec)))
+	return rec
+}
+
+// resetToken returns the token of the last reset link sent to an address
+func resetToken(t *testing.T, container *types.AppContainer, email string) string {
+	msg, ok := container.PasswordService.Mailer.(*mailer.MemoryMailer).Last(email)
+	if !assert.True(t, ok, "no email sent to %s", email) {
+		return ""
+	}
+	match := regexp.MustCompile(`https://optimate\.test/reset-password\?token=(\S+)`).FindStringSubmatch(msg.Text)
+	if !assert.Len(t, match, 2, msg.Text) {
+		return ""
+	}
+	return match[1]
+}
+
+func TestPasswordReset(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	session, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+	_, pat, err := container.JWTService.CreatePersonalAccessToken(user.ID, "ci", []string{"files:read"}, 0)
+	assert.NoError(t, err)
+
+	rec := postJSON(t, e, h.ForgotPassword, `{"email": "admin@admin.com"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	token := resetToken(t, container, "admin@admin.com")
+	msg, _ := container.PasswordService.Mailer.(*mailer.MemoryMailer).Last("admin@admin.com")
+	assert.Equal(t, "Reset your password", msg.Subject)
+
+	// Only the hash of the token is stored
+	var stored models.PasswordResetToken
+	assert.NoError(t, container.DB.First(&stored).Error)
+	assert.Equal(t, service.HashToken(token), stored.TokenHash)
+
+	// The password policy applies
+	rec = postJSON(t, e, h.ResetPassword, `{"token": "`+token+`", "password": "short"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), service.ErrPasswordTooShort.Error())
+
+	rec = postJSON(t, e, h.ResetPassword, `{"token": "`+token+`", "password": "new password"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// The new password works, the old one does not
+	_, err = container.UserService.AuthenticateUser("admin@admin.com", "new password")
+	assert.NoError(t, err)
+	_, err = container.UserService.AuthenticateUser("admin@admin.com", "password")
+	assert.Error(t, err)
+
+	// Every session and token was revoked
+	assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, session.AccessToken).Code)
+	status, _, _ := refresh(t, e, h, session.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	_, err = container.JWTService.AuthenticatePersonalAccessToken(pat)
+	assert.Error(t, err)
+
+	// The token can only be used once
+	rec = postJSON(t, e, h.ResetPassword, `{"token": "`+token+`", "password": "another password"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), service.ErrInvalidResetToken.Error())
+}
+
+func TestPasswordResetRejected(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	registerUser(t, container, "admin@admin.com")
+	sent := container.PasswordService.Mailer.(*mailer.MemoryMailer)
+
+	// Unknown emails get the same answer, and no email
+	rec := postJSON(t, e, h.ForgotPassword, `{"email": "nobody@admin.com"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Empty(t, sent.Messages())
+
+	rec = postJSON(t, e, h.ForgotPassword, `{"email": "not an email"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = postJSON(t, e, h.ResetPassword, `{"token": "prt_unknown", "password": "new password"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// A new link invalidates the previous ones
+	postJSON(t, e, h.ForgotPassword, `{"email": "admin@admin.com"}`)
+	first := resetToken(t, container, "admin@admin.com")
+	postJSON(t, e, h.ForgotPassword, `{"email": "admin@admin.com"}`)
+	second := resetToken(t, container, "admin@admin.com")
+	assert.NotEqual(t, first, second)
+	rec = postJSON(t, e, h.ResetPassword, `{"token": "`+first+`", "password": "new password"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Expired links
+	container.PasswordService.ResetTTL = -time.Minute
+	postJSON(t, e, h.ForgotPassword, `{"email": "admin@admin.com"}`)
+	expired := resetToken(t, container, "admin@admin.com")
+	rec = postJSON(t, e, h.ResetPassword, `{"token": "`+expired+`", "password": "new password"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	_, err := container.UserService.AuthenticateUser("admin@admin.com", "password")
+	assert.NoError(t, err)
+}
+
+// verificationToken returns the token of the last verification link sent to an address
+func verificationToken(t *testing.T, container *types.AppContainer, email string) string {
+	msg, ok := container.VerificationService.Mailer.(*mailer.MemoryMailer).Last(email)
+	if !assert.True(t, ok, "no email sent to %s", email) {
+		return ""
+	}
+	match := regexp.MustCompile(`https://optimate\.test/verify-email\?token=(\S+)`).FindStringSubmatch(msg.Text)
+	if !assert.Len(t, match, 2, msg.Text) {
+		return ""
+	}
+	return match[1]
+}
+
+func TestEmailVerification(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+
+	rec := postJSON(t, e, h.Register, `{"email": "admin@admin.com", "password": "password", "firstname": "John", "lastname": "Doe"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	// Registering does not sign in, the link is emailed instead
+	var tokens int64
+	container.DB.Model(&models.PersonalToken{}).Count(&tokens)
+	assert.Zero(t, tokens)
+	token := verificationToken(t, container, "admin@admin.com")
+
+	rec = postJSON(t, e, h.VerifyEmail, `{"token": "evt_unknown"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = postJSON(t, e, h.VerifyEmail, `{"token": "`+token+`"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"email_verified":true`)
+
+	user, err := container.UserService.Repo.GetUserByEmail("admin@admin.com")
+	assert.NoError(t, err)
+	assert.True(t, user.EmailVerified)
+	assert.NotNil(t, user.EmailVerifiedAt)
+
+	// The link can only be used once, and verified users are not sent another
+	rec = postJSON(t, e, h.VerifyEmail, `{"token": "`+token+`"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	sent := len(container.VerificationService.Mailer.(*mailer.MemoryMailer).Messages())
+	rec = postJSON(t, e, h.ResendVerification, `{"email": "admin@admin.com"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Len(t, container.VerificationService.Mailer.(*mailer.MemoryMailer).Messages(), sent)
+}
+
+func TestResendVerification(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	user := registerUser(t, container, "admin@admin.com")
+	sent := container.VerificationService.Mailer.(*mailer.MemoryMailer)
+
+	rec := postJSON(t, e, h.ResendVerification, `{"email": "nobody@admin.com"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Empty(t, sent.Messages())
+
+	rec = postJSON(t, e, h.ResendVerification, `{"email": "admin@admin.com"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	first := verificationToken(t, container, "admin@admin.com")
+
+	// Links are not sent again right away
+	rec = postJSON(t, e, h.ResendVerification, `{"email": "admin@admin.com"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Len(t, sent.Messages(), 1)
+
+	// A new link invalidates the previous one
+	container.VerificationService.ResendInterval = 0
+	postJSON(t, e, h.ResendVerification, `{"email": "admin@admin.com"}`)
+	second := verificationToken(t, container, "admin@admin.com")
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, http.StatusBadRequest, postJSON(t, e, h.VerifyEmail, `{"token": "`+first+`"}`).Code)
+
+	// A link only verifies the address it was sent to
+	assert.NoError(t, container.DB.Model(user).Update("email", "new@admin.com").Error)
+	assert.Equal(t, http.StatusBadRequest, postJSON(t, e, h.VerifyEmail, `{"token": "`+second+`"}`).Code)
+	user, _ = container.UserService.Repo.GetUserByEmail("new@admin.com")
+	assert.False(t, user.EmailVerified)
+}
+
+func TestVerificationPolicy(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	registerUser(t, container, "admin@admin.com")
+	login := `{"email": "admin@admin.com", "password": "password"}`
+
+	// Unverified users can log in, but not create personal access tokens
+	rec := postJSON(t, e, h.Login, login)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var response struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+
+	createToken := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/profile/access-tokens", strings.NewReader(`{"name": "ci", "scopes": ["files:read"]}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+response.Data.Token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusForbidden, createToken())
+
+	container.VerificationService.Policy = service.VerificationOff
+	assert.Equal(t, http.StatusCreated, createToken())
+
+	// Or not even log in, with the response of a wrong password so that it
+	// does not tell the password was right
+	container.VerificationService.Policy = service.VerificationBlock
+	rec = postJSON(t, e, h.Login, login)
+	wrong := postJSON(t, e, h.Login, `{"email": "admin@admin.com", "password": "wrong password"}`)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, wrong.Body.String(), rec.Body.String())
+	unlockLogins(container)
+
+	assert.NoError(t, container.DB.Model(&models.User{}).Where("email = ?", "admin@admin.com").Update("email_verified", true).Error)
+	assert.Equal(t, http.StatusOK, postJSON(t, e, h.Login, login).Code)
+
+	_, err := service.ParseVerificationPolicy("sometimes")
+	assert.ErrorIs(t, err, service.ErrInvalidVerificationPolicy)
+}
+
+func TestIntrospectEmailVerified(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	e.POST("/introspect", h.Introspect, interceptor.ServiceAuthentication(container.ClientService))
+	user := registerUser(t, container, "admin@admin.com")
+	serviceToken := issueServiceToken(t, container)
+
+	tokens, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+
+	rec := introspect(e, "token="+tokens.AccessToken, serviceToken)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"active":true`)
+	assert.NotContains(t, rec.Body.String(), `"email_verified"`)
+	assert.Contains(t, rec.Body.String(), `"verification_required":true`)
+
+	// Whether unverified users are restricted is up to the policy of this service
+	container.VerificationService.Policy = service.VerificationOff
+	rec = introspect(e, "token="+tokens.AccessToken, serviceToken)
+	assert.NotContains(t, rec.Body.String(), `"verification_required"`)
+	container.VerificationService.Policy = service.VerificationRestrict
+
+	assert.NoError(t, container.DB.Model(user).Update("email_verified", true).Error)
+	rec = introspect(e, "token="+tokens.AccessToken, serviceToken)
+	assert.Contains(t, rec.Body.String(), `"email_verified":true`)
+	assert.NotContains(t, rec.Body.String(), `"verification_required"`)
+}
+
+// authorizedJSON sends an authenticated request with a JSON body
+// It returns the response recorder
+func authorizedJSON(e *echo.Echo, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// totpCode returns the code an authenticator app shows a number of steps from now
+func totpCode(t *testing.T, secret string, steps int64) string {
+	code, err := auth.TOTPCode(secret, auth.TOTPStep(time.Now())+steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// enrollTOTP sets up an authenticator app for a user
+// It returns the secret of the app and the recovery codes
+func enrollTOTP(t *testing.T, e *echo.Echo, token string) (string, []string) {
+	rec := authorized(e, http.MethodPost, "/profile/mfa/totp", token)
+	if !assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String()) {
+		t.FailNow()
+	}
+	var enrollment struct {
+		Data service.TOTPEnrollment `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &enrollment))
+
+	rec = authorizedJSON(e, http.MethodPost, "/profile/mfa/totp/confirm", token, `{"code": "`+totpCode(t, enrollment.Data.Secret, 0)+`"}`)
+	if !assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String()) {
+		t.FailNow()
+	}
+	var confirmed struct {
+		Data struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &confirmed))
+	return enrollment.Data.Secret, confirmed.Data.RecoveryCodes
+}
+
+// login logs a user in with their password
+// It returns the status and the data of the response
+func login(t *testing.T, e *echo.Echo, h *Handler, email, password string) (int, map[string]interface{}) {
+	rec := postJSON(t, e, h.Login, `{"email": "`+email+`", "password": "`+password+`"}`)
+	var response struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	return rec.Code, response.Data
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	e, container := setUpTest()
+	setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	session, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+
+	rec := authorized(e, http.MethodPost, "/profile/mfa/totp", session.AccessToken)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var enrollment struct {
+		Data service.TOTPEnrollment `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &enrollment))
+	assert.Equal(t, auth.TOTPURI("OptiMate", "admin@admin.com", enrollment.Data.Secret), enrollment.Data.URI)
+	assert.True(t, strings.HasPrefix(enrollment.Data.URI, "otpauth://totp/"))
+
+	// A wrong code does not enable the app
+	rec = authorizedJSON(e, http.MethodPost, "/profile/mfa/totp/confirm", session.AccessToken, `{"code": "000000"}`)
+	if totpCode(t, enrollment.Data.Secret, 0) != "000000" {
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+	rec = authorized(e, http.MethodGet, "/profile/mfa", session.AccessToken)
+	assert.Contains(t, rec.Body.String(), `"totp_enabled":false`)
+
+	rec = authorizedJSON(e, http.MethodPost, "/profile/mfa/totp/confirm", session.AccessToken, `{"code": "`+totpCode(t, enrollment.Data.Secret, 0)+`"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var confirmed struct {
+		Data struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &confirmed))
+	assert.Len(t, confirmed.Data.RecoveryCodes, service.RecoveryCodeCount)
+
+	// Only the hashes of the recovery codes are stored, and the secret is never shown again
+	var stored []models.RecoveryCode
+	assert.NoError(t, container.DB.Find(&stored).Error)
+	assert.Len(t, stored, service.RecoveryCodeCount)
+	for _, code := range stored {
+		assert.NotContains(t, confirmed.Data.RecoveryCodes, code.CodeHash)
+	}
+	rec = authorized(e, http.MethodGet, "/profile/mfa", session.AccessToken)
+	assert.Contains(t, rec.Body.String(), `"totp_enabled":true`)
+	assert.Contains(t, rec.Body.String(), `"recovery_codes_remaining":10`)
+	assert.NotContains(t, rec.Body.String(), enrollment.Data.Secret)
+
+	// An enabled app cannot be replaced without disabling it
+	rec = authorized(e, http.MethodPost, "/profile/mfa/totp", session.AccessToken)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestLoginWithTOTP(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	session, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+	secret, _ := enrollTOTP(t, e, session.AccessToken)
+
+	// The password only gets an MFA token
+	status, data := login(t, e, h, "admin@admin.com", "password")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, true, data["mfa_required"])
+	assert.NotContains(t, data, "token")
+	assert.NotContains(t, data, "refresh_token")
+	mfaToken, _ := data["mfa_token"].(string)
+	assert.True(t, strings.HasPrefix(mfaToken, "mfa_"))
+
+	// The code used to confirm the app cannot be used again
+	rec := postJSON(t, e, h.LoginMFA, `{"mfa_token": "`+mfaToken+`", "code": "`+totpCode(t, secret, 0)+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), service.ErrInvalidMFACode.Error())
+
+	rec = postJSON(t, e, h.LoginMFA, `{"mfa_token": "`+mfaToken+`", "code": "`+totpCode(t, secret, 1)+`"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var response struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	token, _ := response.Data["token"].(string)
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, token).Code)
+	assert.NotEmpty(t, response.Data["refresh_token"])
+
+	// The MFA token can only be used once
+	rec = postJSON(t, e, h.LoginMFA, `{"mfa_token": "`+mfaToken+`", "code": "`+totpCode(t, secret, 1)+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), service.ErrInvalidMFAChallenge.Error())
+}
+
+func TestLoginWithRecoveryCode(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	session, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+	_, codes := enrollTOTP(t, e, session.AccessToken)
+
+	// Recovery codes can be typed in upper case and without the dashes
+	_, data := login(t, e, h, "admin@admin.com", "password")
+	typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	rec := postJSON(t, e, h.LoginMFA, `{"mfa_token": "`+data["mfa_token"].(string)+`", "code": "`+typed+`"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = authorized(e, http.MethodGet, "/profile/mfa", session.AccessToken)
+	assert.Contains(t, rec.Body.String(), `"recovery_codes_remaining":9`)
+
+	// A recovery code can only be used once
+	_, data = login(t, e, h, "admin@admin.com", "password")
+	rec = postJSON(t, e, h.LoginMFA, `{"mfa_token": "`+data["mfa_token"].(string)+`", "code": "`+codes[0]+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestLoginMFAAttempts(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	session, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+	secret, _ := enrollTOTP(t, e, session.AccessToken)
+	// The wrong codes do not slow down the logins here
+	container.LockoutService.FreeFailures = service.DefaultMFAMaxAttempts
+
+	rec := postJSON(t, e, h.LoginMFA, `{"mfa_token": "mfa_unknown", "code": "123456"}`)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), service.ErrInvalidMFAChallenge.Error())
+
+	// The challenge is given up on after too many wrong codes
+	_, data := login(t, e, h, "admin@admin.com", "password")
+	mfaToken := data["mfa_token"].(string)
+	for i := 0; i < service.DefaultMFAMaxAttempts; i++ {
+		rec = postJSON(t, e, h.LoginMFA, `{"mfa_token": "`+mfaToken+`", "code": "abcdef"}`)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Contains(t, rec.Body.String(), service.ErrInvalidMFACode.Error())
+	}
+	rec = postJSON(t, e, h.LoginMFA, `{"mfa_token": "`+mfaToken+`", "code": "`+totpCode(t, secret, 1)+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), service.ErrInvalidMFAChallenge.Error())
+
+	// And it expires
+	container.MFAService.ChallengeTTL = -time.Second
+	_, data = login(t, e, h, "admin@admin.com", "password")
+	rec = postJSON(t, e, h.LoginMFA, `{"mfa_token": "`+data["mfa_token"].(string)+`", "code": "`+totpCode(t, secret, 1)+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), service.ErrInvalidMFAChallenge.Error())
+}
+
+func TestDisableTOTP(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	session, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+	_, codes := enrollTOTP(t, e, session.AccessToken)
+
+	// The session alone is not enough
+	rec := authorizedJSON(e, http.MethodPost, "/profile/mfa/totp/disable", session.AccessToken, `{"password": "password"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = authorizedJSON(e, http.MethodPost, "/profile/mfa/totp/disable", session.AccessToken, `{"password": "wrong", "code": "`+codes[0]+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = authorizedJSON(e, http.MethodPost, "/profile/mfa/totp/disable", session.AccessToken, `{"password": "password", "code": "aaaa-aaaa-aaaa-aaaa"}`)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// A wrong password does not use up the code
+	rec = authorizedJSON(e, http.MethodPost, "/profile/mfa/recovery-codes", session.AccessToken, `{"password": "password", "code": "`+codes[0]+`"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), codes[1])
+	var regenerated struct {
+		Data struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &regenerated))
+
+	// The previous codes stopped working
+	rec = authorizedJSON(e, http.MethodPost, "/profile/mfa/totp/disable", session.AccessToken, `{"password": "password", "code": "`+codes[1]+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = authorizedJSON(e, http.MethodPost, "/profile/mfa/totp/disable", session.AccessToken, `{"password": "password", "code": "`+regenerated.Data.RecoveryCodes[0]+`"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// The password is enough again
+	status, data := login(t, e, h, "admin@admin.com", "password")
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotContains(t, data, "mfa_required")
+	assert.NotEmpty(t, data["token"])
+	var remaining int64
+	container.DB.Model(&models.RecoveryCode{}).Count(&remaining)
+	assert.Zero(t, remaining)
+
+	rec = authorizedJSON(e, http.MethodPost, "/profile/mfa/totp/disable", session.AccessToken, `{"password": "password", "code": "123456"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), service.ErrMFANotEnabled.Error())
+}
+
+// loginFrom logs a user in from an address
+// It returns the response recorder
+func loginFrom(t *testing.T, e *echo.Echo, h *Handler, ip, email, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"email": "`+email+`", "password": "`+password+`"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.RemoteAddr = ip + ":1234"
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h.Login(e.NewContext(req, rec)))
+	return rec
+}
+
+// unlockLogins lets the locked logins try again, as if the lockout had passed
+func unlockLogins(container *types.AppContainer) {
+	container.DB.Model(&models.LoginThrottle{}).Where("1 = 1").Update("locked_until", nil)
+}
+
+func TestLoginLockout(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	registerUser(t, container, "admin@admin.com")
+	lockout := container.LockoutService
+	lockout.FreeFailures = 2
+	lockout.AccountFailures = 4
+	recorder := lockout.Audit.(*audit.MemoryRecorder)
+
+	// The first failures are free
+	for i := 0; i < lockout.FreeFailures; i++ {
+		rec := loginFrom(t, e, h, "192.0.2.1", "admin@admin.com", "wrong password")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+
+	// Then every failure delays the next login, even with the right password
+	rec := loginFrom(t, e, h, "192.0.2.1", "admin@admin.com", "wrong password")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = loginFrom(t, e, h, "192.0.2.2", "Admin@Admin.com", "password")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.Empty(t, recorder.Events(audit.AccountLocked))
+
+	// Until the account is locked
+	unlockLogins(container)
+	rec = loginFrom(t, e, h, "192.0.2.1", "admin@admin.com", "wrong password")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = loginFrom(t, e, h, "192.0.2.3", "admin@admin.com", "password")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Contains(t, rec.Body.String(), service.ErrLoginLocked.Error())
+	retryAfter, _ := strconv.Atoi(rec.Header().Get("Retry-After"))
+	assert.InDelta(t, service.DefaultLockoutDuration.Seconds(), retryAfter, 2)
+
+	locked := recorder.Events(audit.AccountLocked)
+	if assert.Len(t, locked, 1) {
+		assert.Equal(t, "admin@admin.com", locked[0].Email)
+		assert.Equal(t, "192.0.2.1", locked[0].IPAddress)
+		assert.Equal(t, lockout.AccountFailures, locked[0].Failures)
+		assert.NotNil(t, locked[0].Until)
+	}
+	assert.Len(t, recorder.Events(audit.LoginFailed), lockout.AccountFailures)
+
+	// Once it is over, a login clears the failures of the account
+	unlockLogins(container)
+	rec = loginFrom(t, e, h, "192.0.2.1", "admin@admin.com", "password")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var throttles int64
+	container.DB.Model(&models.LoginThrottle{}).Where("key = ?", "account:admin@admin.com").Count(&throttles)
+	assert.Zero(t, throttles)
+}
+
+func TestLoginLockoutUniform(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	registerUser(t, container, "admin@admin.com")
+	container.LockoutService.FreeFailures = 0
+
+	// Unknown emails and wrong passwords get the same response, and are locked the same
+	unknown := loginFrom(t, e, h, "192.0.2.1", "nobody@admin.com", "wrong password")
+	wrong := loginFrom(t, e, h, "192.0.2.2", "admin@admin.com", "wrong password")
+	assert.Equal(t, http.StatusUnauthorized, unknown.Code)
+	assert.Equal(t, wrong.Body.String(), unknown.Body.String())
+
+	unknown = loginFrom(t, e, h, "192.0.2.3", "nobody@admin.com", "wrong password")
+	wrong = loginFrom(t, e, h, "192.0.2.4", "admin@admin.com", "wrong password")
+	assert.Equal(t, http.StatusTooManyRequests, unknown.Code)
+	assert.Equal(t, wrong.Code, unknown.Code)
+	assert.Equal(t, wrong.Body.String(), unknown.Body.String())
+}
+
+func TestLoginLockoutPerIP(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	registerUser(t, container, "admin@admin.com")
+	lockout := container.LockoutService
+	lockout.IPFailures = 3
+	recorder := lockout.Audit.(*audit.MemoryRecorder)
+
+	// Guessing at many accounts from one address locks the address
+	for i := 0; i < lockout.IPFailures; i++ {
+		rec := loginFrom(t, e, h, "192.0.2.1", fmt.Sprintf("user%d@admin.com", i), "wrong password")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	rec := loginFrom(t, e, h, "192.0.2.1", "admin@admin.com", "password")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	locked := recorder.Events(audit.IPLocked)
+	if assert.Len(t, locked, 1) {
+		assert.Equal(t, "192.0.2.1", locked[0].IPAddress)
+	}
+	assert.Empty(t, recorder.Events(audit.AccountLocked))
+
+	// Other addresses can still log in
+	rec = loginFrom(t, e, h, "192.0.2.2", "admin@admin.com", "password")
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+// loginFor logs a user in for a client, like the optimizer does
+// The address of the client is forwarded with the service token, if any
+// It returns the response recorder
+func loginFor(t *testing.T, e *echo.Echo, h *Handler, serviceToken, clientIP, email, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"email": "`+email+`", "password": "`+password+`"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(ClientIPHeader, clientIP)
+	if serviceToken != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+serviceToken)
+	}
+	req.RemoteAddr = "192.0.2.10:1234"
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h.Login(e.NewContext(req, rec)))
+	return rec
+}
+
+func TestLoginLockoutForwardedIP(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	registerUser(t, container, "admin@admin.com")
+	serviceToken := issueServiceToken(t, container)
+	lockout := container.LockoutService
+	lockout.IPFailures = 3
+	lockout.FreeFailures = 0
+
+	// The failures of a client guessing at many accounts through a service
+	// lock that client
+	for i := 0; i < lockout.IPFailures; i++ {
+		rec := loginFor(t, e, h, serviceToken, "203.0.113.1", fmt.Sprintf("user%d@admin.com", i), "wrong password")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	rec := loginFor(t, e, h, serviceToken, "203.0.113.1", "admin@admin.com", "password")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+	// Not the other clients of the service, nor does it slow them down
+	rec = loginFor(t, e, h, serviceToken, "203.0.113.2", "admin@admin.com", "password")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// Without a service token the forwarded address is not believed
+	for i := 0; i < lockout.IPFailures; i++ {
+		rec := loginFor(t, e, h, "", fmt.Sprintf("203.0.113.%d", 10+i), fmt.Sprintf("other%d@admin.com", i), "wrong password")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	rec = loginFor(t, e, h, "", "203.0.113.20", "admin@admin.com", "password")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+}
+
+func TestLoginFailureWindowDoesNotSlide(t *testing.T) {
+	_, container := setUpTest()
+	repo := container.LockoutService.Repo
+	window := 15 * time.Minute
+	start := time.Now()
+
+	// Failures keep counting within the window, however far apart
+	for i := 0; i < 3; i++ {
+		throttle, err := repo.CountLoginFailure("ip:192.0.2.1", start.Add(time.Duration(i)*10*time.Minute), window)
+		assert.NoError(t, err)
+		if i < 2 {
+			assert.Equal(t, i+1, throttle.Failures)
+		} else {
+			// Then they start over, though the last one was 10 minutes ago
+			assert.Equal(t, 1, throttle.Failures)
+		}
+	}
+}
+
+func TestLoginMFALockout(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	session, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+	secret, _ := enrollTOTP(t, e, session.AccessToken)
+	container.LockoutService.FreeFailures = 0
+	container.LockoutService.AccountFailures = 2
+
+	// Wrong codes count as failed logins of the account, over new challenges too
+	for i := 0; i < 2; i++ {
+		unlockLogins(container)
+		_, data := login(t, e, h, "admin@admin.com", "password")
+		rec := postJSON(t, e, h.LoginMFA, `{"mfa_token": "`+data["mfa_token"].(string)+`", "code": "abcdef"}`)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	status, _ := login(t, e, h, "admin@admin.com", "password")
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	locked := container.LockoutService.Audit.(*audit.MemoryRecorder).Events(audit.AccountLocked)
+	if assert.Len(t, locked, 1) {
+		assert.Equal(t, user.ID, locked[0].UserID)
+	}
+
+	// Entering the right code clears them
+	container.LockoutService.AccountFailures = 10
+	unlockLogins(container)
+	_, data := login(t, e, h, "admin@admin.com", "password")
+	rec := postJSON(t, e, h.LoginMFA, `{"mfa_token": "`+data["mfa_token"].(string)+`", "code": "`+totpCode(t, secret, 1)+`"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var throttles int64
+	container.DB.Model(&models.LoginThrottle{}).Where("key = ?", "account:admin@admin.com").Count(&throttles)
+	assert.Zero(t, throttles)
+}
+
+func TestLoginRehashesPassword(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	user := registerUser(t, container, "admin@admin.com")
+	assert.True(t, strings.HasPrefix(user.Password, "$argon2id$"), user.Password)
+
+	// Users registered with bcrypt keep their password
+	legacy, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	assert.NoError(t, container.UserService.Repo.UpdatePassword(user.ID, string(legacy)))
+
+	// A wrong password does not replace the hash
+	status, _ := login(t, e, h, "admin@admin.com", "wrong password")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	stored, err := container.UserService.Repo.GetUserByEmail("admin@admin.com")
+	assert.NoError(t, err)
+	assert.Equal(t, string(legacy), stored.Password)
+
+	// The right one does
+	status, _ = login(t, e, h, "admin@admin.com", "password")
+	assert.Equal(t, http.StatusOK, status)
+	stored, err = container.UserService.Repo.GetUserByEmail("admin@admin.com")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored.Password, "$argon2id$"), stored.Password)
+
+	// And so do raised costs
+	container.UserService.Passwords.Hasher = auth.NewArgon2id(auth.DefaultArgon2Memory, auth.DefaultArgon2Time+1, auth.DefaultArgon2Threads)
+	status, _ = login(t, e, h, "admin@admin.com", "password")
+	assert.Equal(t, http.StatusOK, status)
+	rehashed, err := container.UserService.Repo.GetUserByEmail("admin@admin.com")
+	assert.NoError(t, err)
+	assert.Contains(t, rehashed.Password, fmt.Sprintf("t=%d,", auth.DefaultArgon2Time+1))
+
+	status, _ = login(t, e, h, "admin@admin.com", "password")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+// breachedList returns a list of breached passwords
+func breachedList(t *testing.T, passwords ...string) *breached.List {
+	list, err := breached.Read(strings.NewReader(strings.Join(passwords, "\n")), len(passwords), breached.DefaultFalsePositiveRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestRegisterPasswordPolicy(t *testing.T) {
+	e, container := setUpTest()
+	h := NewHandler(container)
+	registerUser(t, container, "admin@admin.com")
+	policy := container.UserService.Policy
+	policy.MinClasses = 2
+	policy.Breached = breachedList(t, "Summer2024", "P@ssw0rd!")
+
+	tests := map[string]error{
+		"short":                     service.ErrPasswordTooShort,
+		strings.Repeat("Long1", 15): service.ErrPasswordTooLong,
+		"onlylowercase":             service.ErrPasswordTooSimple,
+		"Johnny-B-Goode":            service.ErrPasswordContainsPersonalInfo,
+		"my new@admin.com pass":     service.ErrPasswordContainsPersonalInfo,
+		"Summer2024":                service.ErrPasswordBreached,
+		"P@ssw0rd!":                 service.ErrPasswordBreached,
+	}
+	for password, rule := range tests {
+		rec := postJSON(t, e, h.Register, `{"email": "new@admin.com", "password": "`+password+`", "firstname": "John", "lastname": "Doe"}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, password)
+		assert.Contains(t, rec.Body.String(), rule.Error(), password)
+	}
+	var users int64
+	container.DB.Model(&models.User{}).Where("email = ?", "new@admin.com").Count(&users)
+	assert.Zero(t, users)
+
+	// Taken emails get the same answer, so the policy does not give them away
+	taken := postJSON(t, e, h.Register, `{"email": "admin@admin.com", "password": "Summer2024", "firstname": "Jane", "lastname": "Roe"}`)
+	fresh := postJSON(t, e, h.Register, `{"email": "other@admin.com", "password": "Summer2024", "firstname": "Jane", "lastname": "Roe"}`)
+	assert.Equal(t, http.StatusBadRequest, taken.Code)
+	assert.Equal(t, fresh.Body.String(), taken.Body.String())
+
+	rec := postJSON(t, e, h.Register, `{"email": "new@admin.com", "password": "correct horse battery 9", "firstname": "John", "lastname": "Doe"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+}
+
+func TestResetPasswordPolicy(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	registerUser(t, container, "admin@admin.com")
+	container.UserService.Policy.Breached = breachedList(t, "Summer2024")
+
+	rec := postJSON(t, e, h.ForgotPassword, `{"email": "admin@admin.com"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	token := resetToken(t, container, "admin@admin.com")
+
+	rec = postJSON(t, e, h.ResetPassword, `{"token": "`+token+`", "password": "Summer2024"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), service.ErrPasswordBreached.Error())
+	rec = postJSON(t, e, h.ResetPassword, `{"token": "`+token+`", "password": "admin@admin.com!"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), service.ErrPasswordContainsPersonalInfo.Error())
+
+	// A refused password does not use up the token
+	rec = postJSON(t, e, h.ResetPassword, `{"token": "`+token+`", "password": "new password"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+// getProfile gets the profile of the user of a token
+func getProfile(t *testing.T, e *echo.Echo, token string) ProfileJSONResponse {
+	rec := authorized(e, http.MethodGet, "/profile", token)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var response struct {
+		Data ProfileJSONResponse `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	return response.Data
+}
+
+func TestProfile(t *testing.T) {
+	e, container := setUpTest()
+	setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	session, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+
+	profile := getProfile(t, e, session.AccessToken)
+	assert.Equal(t, user.ID, profile.ID)
+	assert.Equal(t, "admin@admin.com", profile.Email)
+	assert.Equal(t, "John", *profile.Firstname)
+	assert.Equal(t, "Doe", *profile.Lastname)
+	assert.False(t, profile.EmailVerified)
+
+	// Names that are left out are kept
+	rec := authorizedJSON(e, http.MethodPatch, "/profile", session.AccessToken, `{"lastname": " Smith "}`)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.NotContains(t, rec.Body.String(), "password")
+	profile = getProfile(t, e, session.AccessToken)
+	assert.Equal(t, "John", *profile.Firstname)
+	assert.Equal(t, "Smith", *profile.Lastname)
+
+	for _, body := range []string{
+		`{"firstname": ""}`,
+		`{"lastname": "   "}`,
+		`{"firstname": "` + strings.Repeat("a", 256) + `"}`,
+	} {
+		rec = authorizedJSON(e, http.MethodPatch, "/profile", session.AccessToken, body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+	profile = getProfile(t, e, session.AccessToken)
+	assert.Equal(t, "John", *profile.Firstname)
+	assert.Equal(t, "Smith", *profile.Lastname)
+
+	rec = authorized(e, http.MethodGet, "/profile", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestChangePassword(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	container.UserService.Policy.Breached = breachedList(t, "Summer2024")
+	current, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+	other, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+
+	rec := authorizedJSON(e, http.MethodPost, "/profile/password", current.AccessToken,
+		`{"current_password": "wrong password", "new_password": "new password"}`)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), service.ErrWrongPassword.Error())
+	rec = authorizedJSON(e, http.MethodPost, "/profile/password", current.AccessToken,
+		`{"current_password": "password", "new_password": "Summer2024"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), service.ErrPasswordBreached.Error())
+	rec = authorizedJSON(e, http.MethodPost, "/profile/password", current.AccessToken, `{"current_password": "password"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Refused changes keep every session
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, other.AccessToken).Code)
+
+	rec = authorizedJSON(e, http.MethodPost, "/profile/password", current.AccessToken,
+		`{"current_password": "password", "new_password": "new password"}`)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// The other sessions are revoked, the current one stays
+	assert.Equal(t, http.StatusUnauthorized, validateToken(t, e, h, other.AccessToken).Code)
+	assert.Equal(t, http.StatusOK, validateToken(t, e, h, current.AccessToken).Code)
+
+	status, _ := login(t, e, h, "admin@admin.com", "password")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = login(t, e, h, "admin@admin.com", "new password")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestChangeEmail(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	session, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+
+	rec := authorizedJSON(e, http.MethodPost, "/profile/email", session.AccessToken, `{"email": "new@admin.com", "password": "wrong password"}`)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = authorizedJSON(e, http.MethodPost, "/profile/email", session.AccessToken, `{"email": "not an email", "password": "password"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = authorizedJSON(e, http.MethodPost, "/profile/email", session.AccessToken, `{"email": "admin@admin.com", "password": "password"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = authorizedJSON(e, http.MethodPost, "/profile/email", session.AccessToken, `{"email": "new@admin.com", "password": "password"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+
+	// The address changes once the link is opened, and the current one is told
+	assert.Equal(t, "admin@admin.com", getProfile(t, e, session.AccessToken).Email)
+	notice, ok := container.VerificationService.Mailer.(*mailer.MemoryMailer).Last("admin@admin.com")
+	assert.True(t, ok)
+	assert.Contains(t, notice.Text, "new@admin.com")
+	token := verificationToken(t, container, "new@admin.com")
+
+	rec = postJSON(t, e, h.VerifyEmail, `{"token": "`+token+`"}`)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	profile := getProfile(t, e, session.AccessToken)
+	assert.Equal(t, "new@admin.com", profile.Email)
+	assert.True(t, profile.EmailVerified)
+
+	rec = postJSON(t, e, h.VerifyEmail, `{"token": "`+token+`"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	status, _ := login(t, e, h, "admin@admin.com", "password")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = login(t, e, h, "new@admin.com", "password")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestChangesCountWrongPasswords(t *testing.T) {
+	e, container := setUpTest()
+	setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	session, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+	_, codes := enrollTOTP(t, e, session.AccessToken)
+	container.LockoutService.FreeFailures = 0
+	recorder := container.LockoutService.Audit.(*audit.MemoryRecorder)
+
+	// Recovery codes are used up, so the right body uses the first one left
+	withCode := func(password string) func() string {
+		return func() string { return `{"password": "` + password + `", "code": "` + codes[0] + `"}` }
+	}
+	changes := []struct {
+		path, wrong string
+		right       func() string
+	}{
+		{"/profile/password", `{"current_password": "wrong password", "new_password": "new password"}`,
+			func() string { return `{"current_password": "password", "new_password": "password"}` }},
+		{"/profile/email", `{"email": "new@admin.com", "password": "wrong password"}`,
+			func() string { return `{"email": "new@admin.com", "password": "password"}` }},
+		{"/profile/mfa/recovery-codes", `{"password": "wrong password", "code": "` + codes[1] + `"}`, withCode("password")},
+		{"/profile/mfa/recovery-codes", `{"password": "password", "code": "aaaa-aaaa-aaaa-aaaa"}`, withCode("password")},
+		{"/profile/mfa/totp/disable", `{"password": "wrong password", "code": "aaaa-aaaa-aaaa-aaaa"}`, withCode("password")},
+	}
+	for _, change := range changes {
+		// A wrong password delays the next try like a failed login, even a right one
+		rec := authorizedJSON(e, http.MethodPost, change.path, session.AccessToken, change.wrong)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, change.path)
+		rec = authorizedJSON(e, http.MethodPost, change.path, session.AccessToken, change.right())
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code, change.path)
+		assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+
+		// Once it is over, the right password clears the failures
+		unlockLogins(container)
+		rec = authorizedJSON(e, http.MethodPost, change.path, session.AccessToken, change.right())
+		assert.Less(t, rec.Code, http.StatusBadRequest, change.path, rec.Body.String())
+		var throttles int64
+		container.DB.Model(&models.LoginThrottle{}).Where("key = ?", "account:admin@admin.com").Count(&throttles)
+		assert.Zero(t, throttles, change.path)
+
+		var regenerated struct {
+			Data struct {
+				RecoveryCodes []string `json:"recovery_codes"`
+			} `json:"data"`
+		}
+		if change.path == "/profile/mfa/recovery-codes" && assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &regenerated)) {
+			codes = regenerated.Data.RecoveryCodes
+		}
+	}
+
+	failed := recorder.Events(audit.LoginFailed)
+	if assert.Len(t, failed, len(changes)) {
+		assert.Equal(t, user.ID, failed[0].UserID)
+	}
+}
+
+func TestChangeEmailTaken(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	registerUser(t, container, "taken@admin.com")
+	session, err := container.JWTService.IssueTokenPair(user.ID, service.Device{})
+	assert.NoError(t, err)
+	mail := container.VerificationService.Mailer.(*mailer.MemoryMailer)
+
+	// A taken address gets the same response, with no link sent
+	sent := len(mail.Messages())
+	rec := authorizedJSON(e, http.MethodPost, "/profile/email", session.AccessToken, `{"email": "taken@admin.com", "password": "password"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Len(t, mail.Messages(), sent)
+
+	// An address taken after the link was sent is not given away
+	rec = authorizedJSON(e, http.MethodPost, "/profile/email", session.AccessToken, `{"email": "new@admin.com", "password": "password"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	token := verificationToken(t, container, "new@admin.com")
+	registerUser(t, container, "new@admin.com")
+
+	rec = postJSON(t, e, h.VerifyEmail, `{"token": "`+token+`"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, "admin@admin.com", getProfile(t, e, session.AccessToken).Email)
+}
+
+// hashToken returns the hex SHA-256 of a secret
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// createAccessToken posts a personal access token to create with a session token
+// It returns the response recorder
+func createAccessToken(e *echo.Echo, sessionToken, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/profile/access-tokens", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+sessionToken)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPersonalAccessTokens(t *testing.T) {
+	e, container := setUpTest()
+	h := setUpRoutes(e, container)
+	e.POST("/introspect", h.Introspect, interceptor.ServiceAuthentication(container.ClientService))
+	user := registerUser(t, container, "admin@admin.com")
+	serviceToken := issueServiceToken(t, container)
+	session, err := container.JWTService.IssueToken(user.ID, service.Device{})
+	assert.NoError(t, err)
+
+	// Only verified users can create personal access tokens
+	body := `{"name": "CI", "scopes": ["files:write", "files:read", "files:read"], "expires_in_days": 30}`
+	assert.Equal(t, http.StatusForbidden, createAccessToken(e, session, body).Code)
+	_, err = container.UserService.Repo.MarkEmailVerified(user.ID, user.Email, time.Now())
+	assert.NoError(t, err)
+
+	rec := createAccessToken(e, session, body)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var created struct {
+		Data struct {
+			ID        string    `json:"id"`
+			Token     string    `json:"token"`
+			Prefix    string    `json:"prefix"`
+			Scope     string    `json:"scope"`
+			ExpiresAt time.Time `json:"expires_at"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	assert.NotContains(t, rec.Body.String(), "token_hash")
+	token := created.Data.Token
+	assert.True(t, strings.HasPrefix(token, service.PersonalAccessTokenPrefix))
+	assert.True(t, strings.HasPrefix(token, created.Data.Prefix))
+	assert.Equal(t, "files:read files:write", created.Data.Scope)
+	assert.WithinDuration(t, time.Now().Add(30*24*time.Hour), created.Data.ExpiresAt, time.Minute)
+
+	// Only the hash is stored, and the token is not shown again
+	var stored models.PersonalAccessToken
+	assert.NoError(t, container.DB.First(&stored, "id = ?", created.Data.ID).Error)
+	assert.NotEqual(t, token, stored.TokenHash)
+	assert.NotContains(t, stored.TokenHash, created.Data.Prefix)
+	rec = authorized(e, http.MethodGet, "/profile/access-tokens", session)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), created.Data.ID)
+	assert.NotContains(t, rec.Body.String(), token)
+
+	// Other services see the scopes of the token
+	rec = introspect(e, "token="+token, serviceToken)
+	var result map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Equal(t, true, result["active"])
+	assert.Equal(t, user.ID, result["sub"])
+	assert.Equal(t, "files:read files:write", result["scope"])
+	assert.Equal(t, service.PersonalAccessTokenType, result["token_type"])
+	assert.NoError(t, container.DB.First(&stored, "id = ?", created.Data.ID).Error)
+	assert.NotNil(t, stored.LastUsedAt)
+
+	// A personal access token cannot manage the account
+	assert.Equal(t, http.StatusForbidden, authorized(e, http.MethodGet, "/profile/tokens", token).Code)
+	assert.Equal(t, http.StatusForbidden, createAccessToken(e, token, `{"name": "Escalated", "scopes": ["presets:admin"]}`).Code)
+	assert.Equal(t, http.StatusForbidden, authorized(e, http.MethodPost, "/logout", token).Code)
+
+	// Revoked tokens stop working
+	assert.Equal(t, http.StatusNotFound, authorized(e, http.MethodDelete, "/profile/access-tokens/unknown", session).Code)
+	assert.Equal(t, http.StatusOK, authorized(e, http.MethodDelete, "/profile/access-tokens/"+created.Data.ID, session).Code)
+	assert.JSONEq(t, `{"active":false}`, introspect(e, "token="+token, serviceToken).Body.String())
+	assert.Equal(t, http.StatusUnauthorized, authorized(e, http.MethodGet, "/profile/tokens", token).Code)
+}
+
+func TestPersonalAccessTokenValidation(t *testing.T) {
+	e, container := setUpTest()
+	setUpRoutes(e, container)
+	user := registerUser(t, container, "admin@admin.com")
+	session, err := container.JWTService.IssueToken(user.ID, service.Device{})
+	assert.NoError(t, err)
+	_, err = container.UserService.Repo.MarkEmailVerified(user.ID, user.Email, time.Now())
+	assert.NoError(t, err)
+
+	for _, body := range []string{
+		`{"name": "CI", "scopes": []}`,
+		`{"name": "CI", "scopes": ["admin"]}`,
+		`{"name": "", "scopes": ["files:read"]}`,
+		`{"name": "CI", "scopes": ["files:read"], "expires_in_days": 400}`,
+		`{"name": "CI", "scopes": ["files:read"], "expires_in_days": -1}`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, createAccessToken(e, session, body).Code, body)
+	}
+
+	// Expired tokens are rejected
+	token, value, err := container.JWTService.CreatePersonalAccessToken(user.ID, "CI", []string{auth.ScopeFilesRead}, time.Hour)
+	assert.NoError(t, err)
+	_, err = container.JWTService.AuthenticatePersonalAccessToken(value)
+	assert.NoError(t, err)
+	assert.NoError(t, container.DB.Model(token).Update("expires_at", time.Now().Add(-time.Second)).Error)
+	_, err = container.JWTService.AuthenticatePersonalAccessToken(value)
+	assert.ErrorIs(t, err, service.ErrInvalidAccessToken)
+
+	// Revoking all the tokens of the user revokes them too
+	_, value, err = container.JWTService.CreatePersonalAccessToken(user.ID, "CI", []string{auth.ScopeFilesRead}, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, container.JWTService.RevokeAllTokens(user.ID))
+	_, err = container.JWTService.AuthenticatePersonalAccessToken(value)
+	assert.ErrorIs(t, err, service.ErrInvalidAccessToken)
+}
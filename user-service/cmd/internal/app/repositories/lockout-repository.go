@@ -0,0 +1,71 @@
+// Package repositories
+package repositories
+
+import (
+	"time"
+	"user-service/cmd/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LockoutRepository is a repository for the failed logins
+type LockoutRepository struct {
+	DB *gorm.DB
+}
+
+// NewLockoutRepository creates a new instance of LockoutRepository
+func NewLockoutRepository(db *gorm.DB) *LockoutRepository {
+	return &LockoutRepository{DB: db}
+}
+
+// GetLoginThrottles retrieves the failed logins of keys
+// Keys without failed logins are left out
+// It returns the throttles and an error
+func (repo *LockoutRepository) GetLoginThrottles(keys ...string) ([]models.LoginThrottle, error) {
+	var throttles []models.LoginThrottle
+	if err := repo.DB.Where("key IN ?", keys).Find(&throttles).Error; err != nil {
+		return nil, err
+	}
+	return throttles, nil
+}
+
+// CountLoginFailure counts a failed login of a key
+// The count starts over once its window is over, the window does not move
+// with every failure, so failing slowly does not keep a count forever
+// It returns the throttle with the new count and an error
+func (repo *LockoutRepository) CountLoginFailure(key string, now time.Time, window time.Duration) (*models.LoginThrottle, error) {
+	throttle := &models.LoginThrottle{Key: key, Failures: 1, WindowStart: &now, UpdatedAt: now}
+	over := "login_throttles.window_start IS NULL OR login_throttles.window_start < ?"
+	err := repo.DB.Transaction(func(tx *gorm.DB) error {
+		// Concurrent failures are all counted
+		err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "key"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"failures":     gorm.Expr("CASE WHEN "+over+" THEN 1 ELSE login_throttles.failures + 1 END", now.Add(-window)),
+				"window_start": gorm.Expr("CASE WHEN "+over+" THEN ? ELSE login_throttles.window_start END", now.Add(-window), now),
+				"updated_at":   now,
+			}),
+		}).Create(throttle).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("key = ?", key).First(throttle).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return throttle, nil
+}
+
+// LockLogin stops a key from logging in until a time
+// It returns an error if the operation fails
+func (repo *LockoutRepository) LockLogin(key string, until time.Time) error {
+	return repo.DB.Model(&models.LoginThrottle{}).Where("key = ?", key).Update("locked_until", until).Error
+}
+
+// ClearLoginFailures forgets the failed logins of a key
+// It returns an error if the operation fails
+func (repo *LockoutRepository) ClearLoginFailures(key string) error {
+	return repo.DB.Where("key = ?", key).Delete(&models.LoginThrottle{}).Error
+}
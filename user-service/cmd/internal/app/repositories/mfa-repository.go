@@ -0,0 +1,140 @@
+package repositories
+
+import (
+	"time"
+	"user-service/cmd/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// MFARepository is a repository for the second factors of the users
+// It contains the database connection
+type MFARepository struct {
+	DB *gorm.DB
+}
+
+// NewMFARepository creates a new instance of MFARepository
+// It returns a pointer to the instance
+func NewMFARepository(db *gorm.DB) *MFARepository {
+	return &MFARepository{DB: db}
+}
+
+// GetTOTPCredential retrieves the authenticator app of a user
+// It returns the credential and an error
+func (repo *MFARepository) GetTOTPCredential(userID string) (*models.TOTPCredential, error) {
+	credential := &models.TOTPCredential{}
+	if err := repo.DB.Where("user_id = ?", userID).First(credential).Error; err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+// SaveTOTPCredential stores the authenticator app of a user, replacing a pending one
+// It returns an error if the operation fails
+func (repo *MFARepository) SaveTOTPCredential(credential *models.TOTPCredential) error {
+	return repo.DB.Save(credential).Error
+}
+
+// EnableTOTPCredential enables the authenticator app of a user and replaces their recovery codes
+// It returns an error if the operation fails
+func (repo *MFARepository) EnableTOTPCredential(userID string, step int64, now time.Time, codes []models.RecoveryCode) error {
+	return repo.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.TOTPCredential{}).Where("user_id = ?", userID).Updates(map[string]interface{}{
+			"enabled":        true,
+			"last_used_step": step,
+			"confirmed_at":   now,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return replaceRecoveryCodes(tx, userID, codes)
+	})
+}
+
+// UseTOTPStep records the time step of a code used by a user
+// Only one of concurrent uses of a step succeeds
+// It returns whether the step was after the last one used and an error
+func (repo *MFARepository) UseTOTPStep(userID string, step int64) (bool, error) {
+	result := repo.DB.Model(&models.TOTPCredential{}).
+		Where("user_id = ? AND last_used_step < ?", userID, step).
+		Update("last_used_step", step)
+	return result.RowsAffected == 1, result.Error
+}
+
+// DeleteMFA deletes the authenticator app and the recovery codes of a user
+// It returns an error if the operation fails
+func (repo *MFARepository) DeleteMFA(userID string) error {
+	return repo.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.TOTPCredential{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+	})
+}
+
+// ReplaceRecoveryCodes replaces the recovery codes of a user
+// It returns an error if the operation fails
+func (repo *MFARepository) ReplaceRecoveryCodes(userID string, codes []models.RecoveryCode) error {
+	return repo.DB.Transaction(func(tx *gorm.DB) error {
+		return replaceRecoveryCodes(tx, userID, codes)
+	})
+}
+
+// replaceRecoveryCodes replaces the recovery codes of a user within a transaction
+func replaceRecoveryCodes(tx *gorm.DB, userID string, codes []models.RecoveryCode) error {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return err
+	}
+	return tx.Create(&codes).Error
+}
+
+// CountRecoveryCodes counts the unused recovery codes of a user
+// It returns the count and an error
+func (repo *MFARepository) CountRecoveryCodes(userID string) (int64, error) {
+	var count int64
+	err := repo.DB.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+// UseRecoveryCode marks a recovery code of a user as used
+// Only one of concurrent uses succeeds
+// It returns whether the user had the code unused and an error
+func (repo *MFARepository) UseRecoveryCode(userID, hash string, now time.Time) (bool, error) {
+	result := repo.DB.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hash).
+		Update("used_at", now)
+	return result.RowsAffected == 1, result.Error
+}
+
+// StoreMFAChallenge stores an MFA challenge in the database
+// It returns an error if the operation fails
+func (repo *MFARepository) StoreMFAChallenge(challenge *models.MFAChallenge) error {
+	return repo.DB.Create(challenge).Error
+}
+
+// GetMFAChallengeByHash retrieves an MFA challenge by the hash of its token
+// It returns the challenge and an error
+func (repo *MFARepository) GetMFAChallengeByHash(hash string) (*models.MFAChallenge, error) {
+	challenge := &models.MFAChallenge{}
+	if err := repo.DB.Where("token_hash = ?", hash).First(challenge).Error; err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// CountMFAChallengeAttempt records a wrong code for an MFA challenge
+// It returns an error if the operation fails
+func (repo *MFARepository) CountMFAChallengeAttempt(id string) error {
+	return repo.DB.Model(&models.MFAChallenge{}).Where("id = ?", id).
+		Update("attempts", gorm.Expr("attempts + 1")).Error
+}
+
+// UseMFAChallenge marks an MFA challenge as completed
+// Only one of concurrent uses succeeds
+// It returns whether the challenge was unused and an error
+func (repo *MFARepository) UseMFAChallenge(id string, now time.Time) (bool, error) {
+	result := repo.DB.Model(&models.MFAChallenge{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Update("used_at", now)
+	return result.RowsAffected == 1, result.Error
+}
@@ -1,6 +1,7 @@
 package repositories
 
 import (
+	"time"
 	"user-service/cmd/internal/models"
 
 	"gorm.io/gorm"
@@ -18,28 +19,248 @@ func NewJWTTokenRepository(db *gorm.DB) *JWTRepository {
 	return &JWTRepository{DB: db}
 }
 
+// Transaction runs fn with a repository whose changes are committed together
+// Nothing is changed if fn returns an error
+// It returns the error of fn, or of the commit
+func (repo *JWTRepository) Transaction(fn func(tx *JWTRepository) error) error {
+	return repo.DB.Transaction(func(tx *gorm.DB) error {
+		return fn(&JWTRepository{DB: tx})
+	})
+}
+
 // StoreToken stores a token in the database
 // It returns an error if the operation fails
 func (repo *JWTRepository) StoreToken(token *models.PersonalToken) error {
 	return repo.DB.Create(token).Error
 }
 
-// RevokeToken revokes a token by setting the revoked field to true
+// RevokeToken revokes a token of a user by setting the revoked field to true
+// The refresh tokens issued with it are revoked too
+// It returns whether the user has such a token and an error
+func (repo *JWTRepository) RevokeToken(userID, tokenID string) (bool, error) {
+	found := false
+	err := repo.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.PersonalToken{}).
+			Where("id = ? AND user_id = ?", tokenID, userID).
+			Update("revoked", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		found = result.RowsAffected > 0
+
+		return tx.Model(&models.RefreshToken{}).
+			Where("access_token_id = ? AND user_id = ?", tokenID, userID).
+			Update("revoked", true).Error
+	})
+	return found, err
+}
+
+// RevokeUserTokens revokes all the sessions and the access, refresh and personal access tokens of a user
+// It returns an error if the operation fails
+func (repo *JWTRepository) RevokeUserTokens(userID string) error {
+	return repo.DB.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&models.Session{}, &models.PersonalToken{}, &models.RefreshToken{}, &models.PersonalAccessToken{}} {
+			err := tx.Model(model).
+				Where("user_id = ? AND revoked = ?", userID, false).
+				Update("revoked", true).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetToken retrieves an access token by its ID
+// It returns the token and an error
+func (repo *JWTRepository) GetToken(tokenID string) (*models.PersonalToken, error) {
+	token := &models.PersonalToken{}
+	if err := repo.DB.Where("id = ?", tokenID).First(token).Error; err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// TouchToken records when an access token was last used
 // It returns an error if the operation fails
-func (repo *JWTRepository) RevokeToken(tokenString string) error {
-	result := repo.DB.Model(&models.PersonalToken{}).Where("token = ?", tokenString).Update("revoked", true)
-	return result.Error
+func (repo *JWTRepository) TouchToken(tokenID string, now time.Time) error {
+	return repo.DB.Model(&models.PersonalToken{}).Where("id = ?", tokenID).Update("last_used_at", now).Error
 }
 
-// CheckTokenRevocation checks if a token has been revoked
-// It returns a boolean and an error
-func (repo *JWTRepository) CheckTokenRevocation(token string) (bool, error) {
-	var t models.PersonalToken
-	if err := repo.DB.Where("token = ? AND revoked =?", token, true).First(&t).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return false, nil
+// StoreRefreshToken stores a refresh token in the database
+// It returns an error if the operation fails
+func (repo *JWTRepository) StoreRefreshToken(token *models.RefreshToken) error {
+	return repo.DB.Create(token).Error
+}
+
+// GetRefreshTokenByHash retrieves a refresh token by the hash of its value
+// It returns the token and an error
+func (repo *JWTRepository) GetRefreshTokenByHash(hash string) (*models.RefreshToken, error) {
+	token := &models.RefreshToken{}
+	if err := repo.DB.Where("token_hash = ?", hash).First(token).Error; err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// UseRefreshToken marks a refresh token as used
+// Only one of concurrent uses succeeds
+// It returns whether the token was unused and an error
+func (repo *JWTRepository) UseRefreshToken(id string, now time.Time) (bool, error) {
+	result := repo.DB.Model(&models.RefreshToken{}).
+		Where("id = ? AND used_at IS NULL AND revoked = ?", id, false).
+		Update("used_at", now)
+	return result.RowsAffected == 1, result.Error
+}
+
+// RevokeFamily revokes the access and refresh tokens of a token family, and its session
+// It returns an error if the operation fails
+func (repo *JWTRepository) RevokeFamily(familyID string) error {
+	return repo.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Session{}).Where("id = ?", familyID).Update("revoked", true).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.PersonalToken{}).Where("family_id = ?", familyID).Update("revoked", true).Error; err != nil {
+			return err
 		}
-		return false, err
+		return tx.Model(&models.RefreshToken{}).Where("family_id = ?", familyID).Update("revoked", true).Error
+	})
+}
+
+// StorePersonalAccessToken stores a personal access token in the database
+// It returns an error if the operation fails
+func (repo *JWTRepository) StorePersonalAccessToken(token *models.PersonalAccessToken) error {
+	return repo.DB.Create(token).Error
+}
+
+// GetPersonalAccessTokenByHash retrieves a personal access token by the hash of its value
+// It returns the token and an error
+func (repo *JWTRepository) GetPersonalAccessTokenByHash(hash string) (*models.PersonalAccessToken, error) {
+	token := &models.PersonalAccessToken{}
+	if err := repo.DB.Where("token_hash = ?", hash).First(token).Error; err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// GetUserPersonalAccessTokens retrieves the personal access tokens of a user, newest first
+// It returns the tokens and an error
+func (repo *JWTRepository) GetUserPersonalAccessTokens(userID string) ([]models.PersonalAccessToken, error) {
+	var tokens []models.PersonalAccessToken
+	err := repo.DB.Where("user_id = ?", userID).Order("created_at DESC").Find(&tokens).Error
+	return tokens, err
+}
+
+// RevokePersonalAccessToken revokes a personal access token of a user
+// It returns whether the user has such a token and an error
+func (repo *JWTRepository) RevokePersonalAccessToken(userID, tokenID string) (bool, error) {
+	result := repo.DB.Model(&models.PersonalAccessToken{}).
+		Where("id = ? AND user_id = ?", tokenID, userID).
+		Update("revoked", true)
+	return result.RowsAffected > 0, result.Error
+}
+
+// TouchPersonalAccessToken records when a personal access token was last used
+// It returns an error if the operation fails
+func (repo *JWTRepository) TouchPersonalAccessToken(id string, now time.Time) error {
+	return repo.DB.Model(&models.PersonalAccessToken{}).Where("id = ?", id).Update("last_used_at", now).Error
+}
+
+// StoreSession stores a session in the database
+// It returns an error if the operation fails
+func (repo *JWTRepository) StoreSession(session *models.Session) error {
+	return repo.DB.Create(session).Error
+}
+
+// GetUserSessions retrieves a page of the active sessions of a user, most recently seen first
+// It returns the sessions, the number of active sessions and an error
+func (repo *JWTRepository) GetUserSessions(userID string, now time.Time, offset, limit int) ([]models.Session, int64, error) {
+	query := repo.DB.Model(&models.Session{}).
+		Where("user_id = ? AND revoked = ? AND expires_at > ?", userID, false, now)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
 	}
-	return true, nil
+
+	var sessions []models.Session
+	err := query.Order("last_seen_at DESC").Offset(offset).Limit(limit).Find(&sessions).Error
+	return sessions, total, err
+}
+
+// GetUserSession retrieves an active session of a user
+// It returns the session and an error
+func (repo *JWTRepository) GetUserSession(userID, sessionID string, now time.Time) (*models.Session, error) {
+	session := &models.Session{}
+	err := repo.DB.
+		Where("id = ? AND user_id = ? AND revoked = ? AND expires_at > ?", sessionID, userID, false, now).
+		First(session).Error
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// TouchSession records when a session was last seen
+// A non-zero expiresAt extends the session too
+// It returns an error if the operation fails
+func (repo *JWTRepository) TouchSession(sessionID string, now, expiresAt time.Time) error {
+	updates := map[string]interface{}{"last_seen_at": now}
+	if !expiresAt.IsZero() {
+		updates["expires_at"] = expiresAt
+	}
+	return repo.DB.Model(&models.Session{}).Where("id = ?", sessionID).Updates(updates).Error
+}
+
+// RevokeSession revokes a session of a user with its access and refresh tokens
+// It returns whether the user has such a session and an error
+func (repo *JWTRepository) RevokeSession(userID, sessionID string) (bool, error) {
+	found := false
+	err := repo.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Session{}).
+			Where("id = ? AND user_id = ? AND revoked = ?", sessionID, userID, false).
+			Update("revoked", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		found = result.RowsAffected > 0
+
+		for _, model := range []interface{}{&models.PersonalToken{}, &models.RefreshToken{}} {
+			err := tx.Model(model).
+				Where("family_id = ? AND user_id = ?", sessionID, userID).
+				Update("revoked", true).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// RevokeOtherSessions revokes all the sessions of a user but one, with their access and refresh tokens
+// Personal access tokens are not revoked
+// It returns the number of sessions revoked and an error
+func (repo *JWTRepository) RevokeOtherSessions(userID, sessionID string) (int64, error) {
+	var revoked int64
+	err := repo.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Session{}).
+			Where("user_id = ? AND id <> ? AND revoked = ?", userID, sessionID, false).
+			Update("revoked", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		revoked = result.RowsAffected
+
+		for _, model := range []interface{}{&models.PersonalToken{}, &models.RefreshToken{}} {
+			err := tx.Model(model).
+				Where("user_id = ? AND family_id <> ? AND revoked = ?", userID, sessionID, false).
+				Update("revoked", true).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return revoked, err
 }
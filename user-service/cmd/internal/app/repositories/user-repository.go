@@ -2,6 +2,7 @@
 package repositories
 
 import (
+	"time"
 	"user-service/cmd/internal/models"
 
 	"gorm.io/gorm"
@@ -57,3 +58,123 @@ func (repo *UserRepository) GetTokensByUserID(id string) ([]models.PersonalToken
 	}
 	return tokens, nil
 }
+
+// UpdatePassword replaces the password hash of a user
+// It returns an error if the operation fails
+func (repo *UserRepository) UpdatePassword(userID, hash string) error {
+	return repo.DB.Model(&models.User{}).Where("id = ?", userID).Update("password", hash).Error
+}
+
+// ReplacePasswordHash replaces the password hash of a user, if it is still the old one
+// It returns whether it was replaced and an error
+func (repo *UserRepository) ReplacePasswordHash(userID, oldHash, newHash string) (bool, error) {
+	result := repo.DB.Model(&models.User{}).
+		Where("id = ? AND password = ?", userID, oldHash).
+		Update("password", newHash)
+	return result.RowsAffected == 1, result.Error
+}
+
+// StorePasswordResetToken stores a password reset token in the database
+// The unused tokens the user was sent before are invalidated
+// It returns an error if the operation fails
+func (repo *UserRepository) StorePasswordResetToken(token *models.PasswordResetToken) error {
+	return repo.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", token.UserID).
+			Update("used_at", token.CreatedAt).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(token).Error
+	})
+}
+
+// GetPasswordResetTokenByHash retrieves a password reset token by the hash of its value
+// It returns the token and an error
+func (repo *UserRepository) GetPasswordResetTokenByHash(hash string) (*models.PasswordResetToken, error) {
+	token := &models.PasswordResetToken{}
+	if err := repo.DB.Where("token_hash = ?", hash).First(token).Error; err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// UsePasswordResetToken marks a password reset token as used
+// Only one of concurrent uses succeeds
+// It returns whether the token was unused and an error
+func (repo *UserRepository) UsePasswordResetToken(id string, now time.Time) (bool, error) {
+	result := repo.DB.Model(&models.PasswordResetToken{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Update("used_at", now)
+	return result.RowsAffected == 1, result.Error
+}
+
+// StoreEmailVerificationToken stores an email verification token in the database
+// The unused tokens the user was sent before are invalidated
+// It returns an error if the operation fails
+func (repo *UserRepository) StoreEmailVerificationToken(token *models.EmailVerificationToken) error {
+	return repo.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.EmailVerificationToken{}).
+			Where("user_id = ? AND used_at IS NULL", token.UserID).
+			Update("used_at", token.CreatedAt).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(token).Error
+	})
+}
+
+// GetLastEmailVerificationToken retrieves the last email verification token sent to a user
+// It returns the token and an error
+func (repo *UserRepository) GetLastEmailVerificationToken(userID string) (*models.EmailVerificationToken, error) {
+	token := &models.EmailVerificationToken{}
+	if err := repo.DB.Where("user_id = ?", userID).Order("created_at DESC").First(token).Error; err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// GetEmailVerificationTokenByHash retrieves an email verification token by the hash of its value
+// It returns the token and an error
+func (repo *UserRepository) GetEmailVerificationTokenByHash(hash string) (*models.EmailVerificationToken, error) {
+	token := &models.EmailVerificationToken{}
+	if err := repo.DB.Where("token_hash = ?", hash).First(token).Error; err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// UseEmailVerificationToken marks an email verification token as used
+// Only one of concurrent uses succeeds
+// It returns whether the token was unused and an error
+func (repo *UserRepository) UseEmailVerificationToken(id string, now time.Time) (bool, error) {
+	result := repo.DB.Model(&models.EmailVerificationToken{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Update("used_at", now)
+	return result.RowsAffected == 1, result.Error
+}
+
+// MarkEmailVerified marks the email of a user as verified, if it is still the given address
+// It returns whether the user still has the address and an error
+func (repo *UserRepository) MarkEmailVerified(userID, email string, now time.Time) (bool, error) {
+	result := repo.DB.Model(&models.User{}).
+		Where("id = ? AND email = ?", userID, email).
+		Updates(map[string]interface{}{"email_verified": true, "email_verified_at": now})
+	return result.RowsAffected == 1, result.Error
+}
+
+// UpdateProfile updates the names of a user
+// Only the given fields are changed
+// It returns an error if the operation fails
+func (repo *UserRepository) UpdateProfile(userID string, fields map[string]interface{}) error {
+	return repo.DB.Model(&models.User{}).Where("id = ?", userID).Updates(fields).Error
+}
+
+// ChangeEmail replaces the email of a user with a verified one, if it is still the old address
+// It returns whether the user still had the old address and an error
+func (repo *UserRepository) ChangeEmail(userID, oldEmail, newEmail string, now time.Time) (bool, error) {
+	result := repo.DB.Model(&models.User{}).
+		Where("id = ? AND email = ?", userID, oldEmail).
+		Updates(map[string]interface{}{"email": newEmail, "email_verified": true, "email_verified_at": now})
+	return result.RowsAffected == 1, result.Error
+}
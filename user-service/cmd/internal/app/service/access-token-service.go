@@ -0,0 +1,143 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+	"user-service/cmd/internal/auth"
+	"user-service/cmd/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Lifetimes of personal access tokens
+const (
+	DefaultPersonalAccessTokenTTL = 90 * 24 * time.Hour
+	MaxPersonalAccessTokenTTL     = 365 * 24 * time.Hour
+)
+
+// PersonalAccessTokenPrefix tells personal access tokens apart from the other tokens
+const PersonalAccessTokenPrefix = "pat_"
+
+// personalAccessTokenDisplayLength is the length of the prefix stored to recognize a token
+const personalAccessTokenDisplayLength = len(PersonalAccessTokenPrefix) + 8
+
+// lastUsedPrecision is how often the last use of a token is recorded
+const lastUsedPrecision = time.Minute
+
+var (
+	ErrInvalidAccessToken = errors.New("Invalid personal access token")
+	ErrInvalidTokenTTL    = errors.New("Token lifetime must be between 1 and 365 days")
+)
+
+// CreatePersonalAccessToken creates a personal access token for a user
+// A zero ttl gives the token the default lifetime
+// It returns the stored token, the token itself, which is not stored and
+// cannot be shown again, and an error
+func (s *JWTService) CreatePersonalAccessToken(userID, name string, scopes []string, ttl time.Duration) (*models.PersonalAccessToken, string, error) {
+	scopes, err := auth.NormalizeScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	if ttl == 0 {
+		ttl = DefaultPersonalAccessTokenTTL
+	}
+	if ttl < 0 || ttl > MaxPersonalAccessTokenTTL {
+		return nil, "", ErrInvalidTokenTTL
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	value := PersonalAccessTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	token := &models.PersonalAccessToken{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Name:      name,
+		TokenHash: HashToken(value),
+		Prefix:    value[:personalAccessTokenDisplayLength],
+		Scope:     strings.Join(scopes, " "),
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+	if err := s.Repo.StorePersonalAccessToken(token); err != nil {
+		return nil, "", err
+	}
+	return token, value, nil
+}
+
+// GetPersonalAccessTokens returns the personal access tokens of a user
+func (s *JWTService) GetPersonalAccessTokens(userID string) ([]models.PersonalAccessToken, error) {
+	return s.Repo.GetUserPersonalAccessTokens(userID)
+}
+
+// RevokePersonalAccessToken revokes a personal access token of a user
+// It returns ErrTokenNotFound if the user has no such token
+func (s *JWTService) RevokePersonalAccessToken(userID, tokenID string) error {
+	found, err := s.Repo.RevokePersonalAccessToken(userID, tokenID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// AuthenticatePersonalAccessToken looks up a personal access token and records its use
+// It returns the token and ErrInvalidAccessToken if it is unknown, revoked or expired
+func (s *JWTService) AuthenticatePersonalAccessToken(value string) (*models.PersonalAccessToken, error) {
+	if !strings.HasPrefix(value, PersonalAccessTokenPrefix) {
+		return nil, ErrInvalidAccessToken
+	}
+
+	token, err := s.Repo.GetPersonalAccessTokenByHash(HashToken(value))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidAccessToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if token.Revoked || !now.Before(token.ExpiresAt) {
+		return nil, ErrInvalidAccessToken
+	}
+
+	// Scripts use their tokens often, the last use is only recorded once a minute
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= lastUsedPrecision {
+		if err := s.Repo.TouchPersonalAccessToken(token.ID, now); err != nil {
+			return nil, err
+		}
+		token.LastUsedAt = &now
+	}
+	return token, nil
+}
+
+// introspectPersonalAccessToken returns the state of a personal access token
+func (s *JWTService) introspectPersonalAccessToken(value string) (*Introspection, error) {
+	token, err := s.AuthenticatePersonalAccessToken(value)
+	if errors.Is(err, ErrInvalidAccessToken) {
+		return &Introspection{Active: false}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Introspection{
+		Active:    true,
+		Scope:     token.Scope,
+		Sub:       token.UserID,
+		TokenType: PersonalAccessTokenType,
+		Exp:       token.ExpiresAt.Unix(),
+		Iat:       token.CreatedAt.Unix(),
+		Iss:       s.Config.Issuer,
+		Jti:       token.ID,
+	}, nil
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"errors"
+	"time"
+	"user-service/cmd/internal/auth"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Defaults for the service tokens
+const (
+	DefaultServiceAudience = "user-service-internal"
+	DefaultServiceTokenTTL = 5 * time.Minute
+)
+
+var (
+	ErrInvalidClient       = errors.New("Invalid client credentials")
+	ErrInvalidServiceToken = errors.New("Invalid service token")
+)
+
+// ClientService issues and verifies the tokens other services call the internal routes with
+// Services exchange their client credentials for a short-lived token, signed
+// with the keys of the user tokens but for an audience of its own
+type ClientService struct {
+	Clients *auth.ServiceClients
+	Config  *auth.Config
+}
+
+// NewClientService creates a new instance of ClientService
+// Tokens are signed and verified with the given configuration
+func NewClientService(clients *auth.ServiceClients, config *auth.Config) *ClientService {
+	return &ClientService{
+		Clients: clients,
+		Config:  config,
+	}
+}
+
+// ServiceToken is an access token of a service
+type ServiceToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	// ExpiresIn is the lifetime of the token in seconds
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// IssueToken exchanges the credentials of a client for a service token
+// It returns the token and ErrInvalidClient if the credentials are wrong
+func (s *ClientService) IssueToken(clientID, secret string) (*ServiceToken, error) {
+	if !s.Clients.Authenticate(clientID, secret) {
+		return nil, ErrInvalidClient
+	}
+
+	token, err := s.Config.Sign(jwt.MapClaims{
+		"sub":       clientID,
+		"client_id": clientID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ServiceToken{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(s.Config.TTL / time.Second),
+	}, nil
+}
+
+// ValidateToken validates a service token
+// Tokens of clients that were removed are rejected
+// It returns the client ID and an error if the token is not valid
+func (s *ClientService) ValidateToken(tokenString string) (string, error) {
+	token, err := s.Config.Parse(tokenString)
+	if err != nil {
+		return "", err
+	}
+
+	claims, _ := token.Claims.(jwt.MapClaims)
+	clientID, _ := claims["client_id"].(string)
+	if !s.Clients.Known(clientID) {
+		return "", ErrInvalidServiceToken
+	}
+	return clientID, nil
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"user-service/cmd/internal/app/repositories"
+	"user-service/cmd/internal/audit"
+)
+
+// Defaults for the lockout of failed logins
+const (
+	// DefaultFreeLoginFailures is how many logins can fail before they are slowed down
+	DefaultFreeLoginFailures = 3
+	// DefaultAccountLoginFailures is how many logins to an account can fail before it is locked
+	DefaultAccountLoginFailures = 10
+	// DefaultIPLoginFailures is how many logins from an address can fail before it is locked
+	DefaultIPLoginFailures = 50
+	DefaultLoginDelay      = time.Second
+	DefaultMaxLoginDelay   = time.Minute
+	DefaultLockoutDuration = 15 * time.Minute
+	// DefaultLoginFailureWindow is how long failed logins are remembered for
+	DefaultLoginFailureWindow = 15 * time.Minute
+)
+
+// ErrLoginLocked is the error of logins that are locked, whether the account exists or not
+var ErrLoginLocked = errors.New("Too many failed login attempts, try again later")
+
+// LockedError is a login that is locked until a time
+// It matches ErrLoginLocked
+type LockedError struct {
+	Until time.Time
+}
+
+// Error returns the message of ErrLoginLocked
+func (e *LockedError) Error() string {
+	return ErrLoginLocked.Error()
+}
+
+// Unwrap returns ErrLoginLocked
+func (e *LockedError) Unwrap() error {
+	return ErrLoginLocked
+}
+
+// LockoutService is a service that slows down and locks failed logins, per
+// account and per address
+// Accounts are tracked by the email logged in with, so that unknown emails
+// are locked the same as accounts and cannot be told apart
+type LockoutService struct {
+	Repo  *repositories.LockoutRepository
+	Audit audit.Recorder
+	// FreeFailures is how many logins can fail before each failure delays the next login
+	FreeFailures int
+	// AccountFailures is how many logins to an account can fail before it is locked
+	AccountFailures int
+	// IPFailures is how many logins from an address can fail before it is locked
+	IPFailures int
+	// Delay is the delay after the first slowed down failure, it doubles with every failure
+	Delay time.Duration
+	// MaxDelay caps the delay
+	MaxDelay time.Duration
+	// LockoutDuration is how long an account or address is locked
+	LockoutDuration time.Duration
+	// Window is how long failed logins are remembered for
+	Window time.Duration
+}
+
+// NewLockoutService creates a new instance of LockoutService
+// It returns a pointer to the instance
+func NewLockoutService(repo *repositories.LockoutRepository, recorder audit.Recorder) *LockoutService {
+	return &LockoutService{
+		Repo:            repo,
+		Audit:           recorder,
+		FreeFailures:    DefaultFreeLoginFailures,
+		AccountFailures: DefaultAccountLoginFailures,
+		IPFailures:      DefaultIPLoginFailures,
+		Delay:           DefaultLoginDelay,
+		MaxDelay:        DefaultMaxLoginDelay,
+		LockoutDuration: DefaultLockoutDuration,
+		Window:          DefaultLoginFailureWindow,
+	}
+}
+
+// accountKey returns the key of the failed logins to an account
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// ipKey returns the key of the failed logins from an address
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check checks that a login to an account from a device is not locked
+// It returns a *LockedError if it is
+func (s *LockoutService) Check(email string, device Device) error {
+	throttles, err := s.Repo.GetLoginThrottles(accountKey(email), ipKey(device.IPAddress))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var until time.Time
+	for _, throttle := range throttles {
+		if throttle.LockedUntil != nil && throttle.LockedUntil.After(until) {
+			until = *throttle.LockedUntil
+		}
+	}
+	if until.After(now) {
+		return &LockedError{Until: until}
+	}
+	return nil
+}
+
+// Fail counts a failed login to an account from a device
+// Every failure to an account after FreeFailures delays its next login twice
+// as long as the one before, and the account or the address is locked for
+// LockoutDuration once it has too many. Addresses are not slowed down, many
+// users can share one
+// It returns an error if the failure could not be counted
+func (s *LockoutService) Fail(email, userID string, device Device) error {
+	now := time.Now()
+	s.Audit.Record(audit.Event{
+		Type:      audit.LoginFailed,
+		UserID:    userID,
+		Email:     email,
+		IPAddress: device.IPAddress,
+		UserAgent: device.UserAgent,
+		Time:      now,
+	})
+
+	err := s.fail(accountKey(email), s.AccountFailures, true, now, audit.Event{
+		Type:      audit.AccountLocked,
+		UserID:    userID,
+		Email:     email,
+		IPAddress: device.IPAddress,
+		UserAgent: device.UserAgent,
+	})
+	if err != nil {
+		return err
+	}
+	return s.fail(ipKey(device.IPAddress), s.IPFailures, false, now, audit.Event{
+		Type:      audit.IPLocked,
+		IPAddress: device.IPAddress,
+		UserAgent: device.UserAgent,
+	})
+}
+
+// fail counts a failed login of a key, and locks its next one past the limit
+// or, if slowed is set, delays it
+// The event is recorded when the key is locked
+func (s *LockoutService) fail(key string, limit int, slowed bool, now time.Time, locked audit.Event) error {
+	throttle, err := s.Repo.CountLoginFailure(key, now, s.Window)
+	if err != nil {
+		return err
+	}
+
+	if throttle.Failures >= limit {
+		until := now.Add(s.LockoutDuration)
+		if err := s.Repo.LockLogin(key, until); err != nil {
+			return err
+		}
+		// Only the failure that locks it is recorded, not the ones while it is locked
+		if throttle.Failures == limit {
+			locked.Failures = throttle.Failures
+			locked.Until = &until
+			locked.Time = now
+			s.Audit.Record(locked)
+		}
+		return nil
+	}
+
+	if delay := s.delay(throttle.Failures); slowed && delay > 0 {
+		return s.Repo.LockLogin(key, now.Add(delay))
+	}
+	return nil
+}
+
+// delay returns how long the login after a number of failures is delayed
+func (s *LockoutService) delay(failures int) time.Duration {
+	slowed := failures - s.FreeFailures
+	if slowed <= 0 {
+		return 0
+	}
+	delay := s.Delay
+	for i := 1; i < slowed && delay < s.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.MaxDelay {
+		return s.MaxDelay
+	}
+	return delay
+}
+
+// Succeed forgets the failed logins to an account
+// The failures of the address are kept, a login to one account does not
+// make up for the guesses at others
+// It returns an error if the failures could not be forgotten
+func (s *LockoutService) Succeed(email string) error {
+	return s.Repo.ClearLoginFailures(accountKey(email))
+}
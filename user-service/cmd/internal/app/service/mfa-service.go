@@ -0,0 +1,393 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+	"user-service/cmd/internal/app/repositories"
+	"user-service/cmd/internal/auth"
+	"user-service/cmd/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Defaults for the second factor
+const (
+	DefaultMFAIssuer       = "OptiMate"
+	DefaultMFAChallengeTTL = 5 * time.Minute
+	// DefaultMFAMaxAttempts is how many wrong codes a challenge takes before it is given up on
+	DefaultMFAMaxAttempts = 5
+)
+
+// RecoveryCodeCount is how many recovery codes a user is given
+const RecoveryCodeCount = 10
+
+// mfaTokenPrefix tells MFA challenge tokens apart from the other tokens
+const mfaTokenPrefix = "mfa_"
+
+// recoveryCodeEncoding is the alphabet of the recovery codes, it has no 0/O or 1/l to confuse
+var recoveryCodeEncoding = base32.NewEncoding("abcdefghijkmnpqrstuvwxyz23456789").WithPadding(base32.NoPadding)
+
+var (
+	ErrMFAAlreadyEnabled   = errors.New("Two-factor authentication is already enabled")
+	ErrMFANotEnabled       = errors.New("Two-factor authentication is not enabled")
+	ErrMFAEnrollmentNeeded = errors.New("Start the enrollment of an authenticator app first")
+	ErrInvalidMFACode      = errors.New("Invalid two-factor authentication code")
+	ErrInvalidMFAChallenge = errors.New("Invalid or expired MFA token, log in again")
+	ErrReauthentication    = errors.New("Invalid password or code")
+)
+
+// TOTPEnrollment is a pending authenticator app
+// The app is set up by scanning the URI as a QR code, or typing in the secret
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// MFAStatus is the state of the second factor of a user
+type MFAStatus struct {
+	TOTPEnabled            bool  `json:"totp_enabled"`
+	RecoveryCodesRemaining int64 `json:"recovery_codes_remaining"`
+}
+
+// MFAService is a service that handles the second factor of the users
+type MFAService struct {
+	Repo   *repositories.MFARepository
+	Users  *UserService
+	Tokens *JWTService
+	// Lockout counts wrong codes as failed logins
+	Lockout *LockoutService
+	// Issuer is the name authenticator apps show for the account
+	Issuer string
+	// ChallengeTTL is how long a user has to enter their code after their password
+	ChallengeTTL time.Duration
+	// MaxAttempts is how many wrong codes a challenge takes
+	MaxAttempts int
+}
+
+// NewMFAService creates a new instance of MFAService
+// It returns a pointer to the instance
+func NewMFAService(repo *repositories.MFARepository, users *UserService, tokens *JWTService, lockout *LockoutService) *MFAService {
+	return &MFAService{
+		Repo:         repo,
+		Users:        users,
+		Tokens:       tokens,
+		Lockout:      lockout,
+		Issuer:       DefaultMFAIssuer,
+		ChallengeTTL: DefaultMFAChallengeTTL,
+		MaxAttempts:  DefaultMFAMaxAttempts,
+	}
+}
+
+// Enabled reports whether a user logs in with a second factor
+// It returns an error if the state could not be looked up
+func (s *MFAService) Enabled(userID string) (bool, error) {
+	credential, err := s.Repo.GetTOTPCredential(userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return credential.Enabled, nil
+}
+
+// Status returns the state of the second factor of a user
+// It returns an error if the state could not be looked up
+func (s *MFAService) Status(userID string) (*MFAStatus, error) {
+	enabled, err := s.Enabled(userID)
+	if err != nil {
+		return nil, err
+	}
+	remaining, err := s.Repo.CountRecoveryCodes(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &MFAStatus{TOTPEnabled: enabled, RecoveryCodesRemaining: remaining}, nil
+}
+
+// BeginTOTPEnrollment generates the secret of a new authenticator app for a user
+// It replaces an enrollment that was not confirmed
+// It returns the enrollment, or ErrMFAAlreadyEnabled
+func (s *MFAService) BeginTOTPEnrollment(user *models.User) (*TOTPEnrollment, error) {
+	enabled, err := s.Enabled(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	err = s.Repo.SaveTOTPCredential(&models.TOTPCredential{
+		UserID:    user.ID,
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TOTPEnrollment{
+		Secret: secret,
+		URI:    auth.TOTPURI(s.Issuer, user.Email, secret),
+	}, nil
+}
+
+// ConfirmTOTPEnrollment enables the authenticator app of a user with a code it shows
+// It returns the recovery codes of the user, which are not stored and cannot
+// be shown again, or ErrInvalidMFACode
+func (s *MFAService) ConfirmTOTPEnrollment(userID, code string) ([]string, error) {
+	credential, err := s.Repo.GetTOTPCredential(userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMFAEnrollmentNeeded
+	}
+	if err != nil {
+		return nil, err
+	}
+	if credential.Enabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	now := time.Now()
+	step, ok := auth.VerifyTOTP(credential.Secret, code, now, credential.LastUsedStep)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, records, err := newRecoveryCodes(userID, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Repo.EnableTOTPCredential(userID, step, now, records); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of a user
+// The user authenticates again with their password and a code, from a device
+// It returns the new codes, or ErrReauthentication
+func (s *MFAService) RegenerateRecoveryCodes(user *models.User, password, code string, device Device) ([]string, error) {
+	if err := s.reauthenticate(user, password, code, device); err != nil {
+		return nil, err
+	}
+
+	codes, records, err := newRecoveryCodes(user.ID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Repo.ReplaceRecoveryCodes(user.ID, records); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP removes the authenticator app and the recovery codes of a user
+// The user authenticates again with their password and a code, so that a
+// stolen session cannot remove the second factor
+// It returns ErrReauthentication if they do not
+func (s *MFAService) DisableTOTP(user *models.User, password, code string, device Device) error {
+	if err := s.reauthenticate(user, password, code, device); err != nil {
+		return err
+	}
+	return s.Repo.DeleteMFA(user.ID)
+}
+
+// reauthenticate checks the password and a code of a user with a second factor
+// Wrong ones count as failed logins, so a stolen session cannot guess them
+// It returns ErrMFANotEnabled, a *LockedError, or ErrReauthentication if either is wrong
+func (s *MFAService) reauthenticate(user *models.User, password, code string, device Device) error {
+	enabled, err := s.Enabled(user.ID)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return ErrMFANotEnabled
+	}
+	if err := s.Lockout.Check(user.Email, device); err != nil {
+		return err
+	}
+
+	// The code is only used up once the password is right
+	if !s.Users.VerifyPassword(user, password) {
+		return s.failReauthentication(user, device)
+	}
+	err = s.verifyCode(user.ID, code)
+	if errors.Is(err, ErrInvalidMFACode) {
+		return s.failReauthentication(user, device)
+	}
+	if err != nil {
+		return err
+	}
+	return s.Lockout.Succeed(user.Email)
+}
+
+// failReauthentication counts a wrong password or code of a user
+// It returns ErrReauthentication, or an error if the failure could not be counted
+func (s *MFAService) failReauthentication(user *models.User, device Device) error {
+	if err := s.Lockout.Fail(user.Email, user.ID, device); err != nil {
+		return err
+	}
+	return ErrReauthentication
+}
+
+// StartChallenge starts the second step of the login of a user
+// It returns the token the code is sent with, and an error
+func (s *MFAService) StartChallenge(userID string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := mfaTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	err := s.Repo.StoreMFAChallenge(&models.MFAChallenge{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		TokenHash: HashToken(token),
+		ExpiresAt: now.Add(s.ChallengeTTL),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// CompleteChallenge completes a login with the code of the authenticator app or a recovery code
+// A challenge is given up on after MaxAttempts wrong codes, and wrong codes
+// count as failed logins of the account and the device
+// It returns the tokens of the login, ErrInvalidMFAChallenge if the login
+// must start over, ErrInvalidMFACode, or a *LockedError
+func (s *MFAService) CompleteChallenge(token, code string, device Device) (*TokenPair, error) {
+	challenge, err := s.Repo.GetMFAChallengeByHash(HashToken(token))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if challenge.UsedAt != nil || challenge.Attempts >= s.MaxAttempts || !now.Before(challenge.ExpiresAt) {
+		return nil, ErrInvalidMFAChallenge
+	}
+
+	user, err := s.Users.Repo.GetUserByID(s.Users.Repo.DB, challenge.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Lockout.Check(user.Email, device); err != nil {
+		return nil, err
+	}
+
+	if err := s.verifyCode(challenge.UserID, code); err != nil {
+		if errors.Is(err, ErrInvalidMFACode) {
+			if err := s.Repo.CountMFAChallengeAttempt(challenge.ID); err != nil {
+				return nil, err
+			}
+			if err := s.Lockout.Fail(user.Email, user.ID, device); err != nil {
+				return nil, err
+			}
+		}
+		return nil, err
+	}
+
+	unused, err := s.Repo.UseMFAChallenge(challenge.ID, now)
+	if err != nil {
+		return nil, err
+	}
+	if !unused {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err := s.Lockout.Succeed(user.Email); err != nil {
+		return nil, err
+	}
+	return s.Tokens.IssueTokenPair(challenge.UserID, device)
+}
+
+// verifyCode checks a code of the authenticator app or a recovery code of a user
+// Either can only be used once
+// It returns ErrInvalidMFACode if the code is wrong
+func (s *MFAService) verifyCode(userID, code string) error {
+	code = strings.TrimSpace(code)
+	if len(code) > auth.TOTPDigits {
+		return s.useRecoveryCode(userID, code)
+	}
+
+	credential, err := s.Repo.GetTOTPCredential(userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrInvalidMFACode
+	}
+	if err != nil {
+		return err
+	}
+	if !credential.Enabled {
+		return ErrInvalidMFACode
+	}
+
+	step, ok := auth.VerifyTOTP(credential.Secret, code, time.Now(), credential.LastUsedStep)
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	// Only one of concurrent uses of the code wins
+	used, err := s.Repo.UseTOTPStep(userID, step)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// useRecoveryCode uses up a recovery code of a user
+// It returns ErrInvalidMFACode if the user has no such unused code
+func (s *MFAService) useRecoveryCode(userID, code string) error {
+	used, err := s.Repo.UseRecoveryCode(userID, hashRecoveryCode(code), time.Now())
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// newRecoveryCodes generates the recovery codes of a user
+// It returns the codes, the records storing their hashes and an error
+func newRecoveryCodes(userID string, now time.Time) ([]string, []models.RecoveryCode, error) {
+	codes := make([]string, RecoveryCodeCount)
+	records := make([]models.RecoveryCode, RecoveryCodeCount)
+	for i := range codes {
+		// 80 bits, shown as four groups of four characters
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := recoveryCodeEncoding.EncodeToString(b)
+		codes[i] = raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+		records[i] = models.RecoveryCode{
+			ID:        uuid.New().String(),
+			UserID:    userID,
+			CodeHash:  hashRecoveryCode(codes[i]),
+			CreatedAt: now,
+		}
+	}
+	return codes, records, nil
+}
+
+// hashRecoveryCode hashes a recovery code the way it was typed
+// Case and separators do not matter
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return HashToken(code)
+}
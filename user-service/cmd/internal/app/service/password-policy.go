@@ -0,0 +1,154 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"user-service/cmd/internal/models"
+)
+
+// Defaults of the password policy
+const (
+	DefaultPasswordMinLength = 8
+	// DefaultPasswordMaxLength is in bytes, bcrypt ignores what comes after 72
+	// so passwords stay usable with the older hashes
+	DefaultPasswordMaxLength = 72
+	// DefaultPasswordMinClasses does not require mixing characters, length and
+	// the breached passwords matter more
+	DefaultPasswordMinClasses = 1
+)
+
+// minPersonalInfoLength is the length from which names and emails are looked for in passwords
+const minPersonalInfoLength = 3
+
+var (
+	// ErrPasswordPolicy is matched by every rule of the policy
+	ErrPasswordPolicy               = errors.New("Password does not meet the password policy")
+	ErrPasswordTooShort             = errors.New("Password is too short")
+	ErrPasswordTooLong              = errors.New("Password is too long")
+	ErrPasswordTooSimple            = errors.New("Password is too simple")
+	ErrPasswordContainsPersonalInfo = errors.New("Password contains your email address or name")
+	ErrPasswordBreached             = errors.New("Password has appeared in a data breach")
+	ErrInvalidPasswordPolicy        = errors.New("Invalid password policy")
+)
+
+// PasswordPolicyError is a rule of the policy a password breaks
+// It matches the rule and ErrPasswordPolicy
+type PasswordPolicyError struct {
+	Rule    error
+	Message string
+}
+
+// Error returns the message of the rule
+func (e *PasswordPolicyError) Error() string {
+	return e.Message
+}
+
+// Is reports whether the error is ErrPasswordPolicy or the rule
+func (e *PasswordPolicyError) Is(target error) bool {
+	return target == ErrPasswordPolicy || target == e.Rule
+}
+
+// BreachedPasswords tells the passwords that appeared in data breaches
+type BreachedPasswords interface {
+	Contains(password string) bool
+}
+
+// PasswordPolicy is what the passwords of the users must be
+type PasswordPolicy struct {
+	// MinLength is in characters
+	MinLength int
+	// MaxLength is in bytes
+	MaxLength int
+	// MinClasses is how many of lowercase letters, uppercase letters, digits
+	// and symbols a password mixes
+	MinClasses int
+	// Breached are the passwords that cannot be used, none when nil
+	Breached BreachedPasswords
+}
+
+// NewPasswordPolicy creates the default policy, without breached passwords
+// It returns a pointer to the policy
+func NewPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength:  DefaultPasswordMinLength,
+		MaxLength:  DefaultPasswordMaxLength,
+		MinClasses: DefaultPasswordMinClasses,
+	}
+}
+
+// Validate checks the settings of the policy
+// It returns ErrInvalidPasswordPolicy if they cannot be met
+func (p *PasswordPolicy) Validate() error {
+	if p.MinLength < 1 || p.MaxLength < p.MinLength {
+		return fmt.Errorf("%w: the lengths must be 1 <= min <= max", ErrInvalidPasswordPolicy)
+	}
+	if p.MinClasses < 1 || p.MinClasses > 4 {
+		return fmt.Errorf("%w: the character classes must be between 1 and 4", ErrInvalidPasswordPolicy)
+	}
+	return nil
+}
+
+// Check checks that a user can use a password
+// The user is who the password is for, their email and name cannot be in it
+// It returns a *PasswordPolicyError with the first rule the password breaks
+func (p *PasswordPolicy) Check(password string, user *models.User) error {
+	if len([]rune(password)) < p.MinLength {
+		return &PasswordPolicyError{ErrPasswordTooShort, fmt.Sprintf("%s, it must be at least %d characters long", ErrPasswordTooShort, p.MinLength)}
+	}
+	if len(password) > p.MaxLength {
+		return &PasswordPolicyError{ErrPasswordTooLong, fmt.Sprintf("%s, it must be at most %d bytes long", ErrPasswordTooLong, p.MaxLength)}
+	}
+	if characterClasses(password) < p.MinClasses {
+		return &PasswordPolicyError{ErrPasswordTooSimple, fmt.Sprintf("%s, it must mix at least %d of lowercase letters, uppercase letters, digits and symbols", ErrPasswordTooSimple, p.MinClasses)}
+	}
+	if user != nil && containsPersonalInfo(password, user) {
+		return &PasswordPolicyError{ErrPasswordContainsPersonalInfo, ErrPasswordContainsPersonalInfo.Error()}
+	}
+	if p.Breached != nil && p.Breached.Contains(password) {
+		return &PasswordPolicyError{ErrPasswordBreached, fmt.Sprintf("%s, choose another one", ErrPasswordBreached)}
+	}
+	return nil
+}
+
+// characterClasses counts the classes of characters a password mixes
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// containsPersonalInfo reports whether a password contains the email address,
+// the part of it before the @, or a name of a user, whatever the case
+func containsPersonalInfo(password string, user *models.User) bool {
+	password = strings.ToLower(password)
+	email := strings.ToLower(user.Email)
+	local, _, _ := strings.Cut(email, "@")
+	infos := []string{email, local}
+	if user.Firstname != nil {
+		infos = append(infos, strings.ToLower(*user.Firstname))
+	}
+	if user.Lastname != nil {
+		infos = append(infos, strings.ToLower(*user.Lastname))
+	}
+
+	for _, info := range infos {
+		info = strings.TrimSpace(info)
+		if len([]rune(info)) >= minPersonalInfoLength && strings.Contains(password, info) {
+			return true
+		}
+	}
+	return false
+}
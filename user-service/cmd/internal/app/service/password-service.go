@@ -0,0 +1,139 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+	"user-service/cmd/internal/mailer"
+	"user-service/cmd/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DefaultPasswordResetTTL is how long a password reset link can be used
+const DefaultPasswordResetTTL = time.Hour
+
+// passwordResetTokenPrefix tells password reset tokens apart from the other tokens
+const passwordResetTokenPrefix = "prt_"
+
+var ErrInvalidResetToken = errors.New("Invalid or expired reset token")
+
+// PasswordService is a service that resets forgotten passwords
+type PasswordService struct {
+	Users  *UserService
+	Tokens *JWTService
+	Mailer mailer.Mailer
+	// From is the sender of the reset emails
+	From string
+	// ResetURL is the page of the frontend the reset link opens, it receives the token as a query parameter
+	ResetURL string
+	// ResetTTL is how long a reset link can be used
+	ResetTTL time.Duration
+}
+
+// NewPasswordService creates a new instance of PasswordService
+// It returns a pointer to the instance
+func NewPasswordService(users *UserService, tokens *JWTService, mail mailer.Mailer, from, resetURL string) *PasswordService {
+	return &PasswordService{
+		Users:    users,
+		Tokens:   tokens,
+		Mailer:   mail,
+		From:     from,
+		ResetURL: resetURL,
+		ResetTTL: DefaultPasswordResetTTL,
+	}
+}
+
+// ForgotPassword emails a password reset link to a user
+// Nothing is sent to unknown addresses, and callers must not tell the
+// difference, so that the addresses of users cannot be found out
+// It returns an error if the link could not be sent
+func (s *PasswordService) ForgotPassword(email string) error {
+	user, err := s.Users.Repo.GetUserByEmail(email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := passwordResetTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	err = s.Users.Repo.StorePasswordResetToken(&models.PasswordResetToken{
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		TokenHash: HashToken(token),
+		ExpiresAt: now.Add(s.ResetTTL),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return err
+	}
+
+	link := s.ResetURL + "?token=" + url.QueryEscape(token)
+	return s.Mailer.Send(&mailer.Message{
+		From:    s.From,
+		To:      user.Email,
+		Subject: "Reset your password",
+		Text: fmt.Sprintf("Someone asked to reset the password of your account.\n\n"+
+			"To choose a new password, open this link within %d minutes:\n\n%s\n\n"+
+			"If it was not you, ignore this email, your password stays the same.\n",
+			int(s.ResetTTL.Minutes()), link),
+	})
+}
+
+// ResetPassword sets a new password with a reset token
+// The token is used up, and every session and token of the user is revoked
+// It returns ErrInvalidResetToken if the token cannot be used, or a
+// *PasswordPolicyError if the policy refuses the password
+func (s *PasswordService) ResetPassword(tokenString, password string) error {
+	token, err := s.Users.Repo.GetPasswordResetTokenByHash(HashToken(tokenString))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if token.UsedAt != nil || !now.Before(token.ExpiresAt) {
+		return ErrInvalidResetToken
+	}
+
+	// A password the policy refuses does not use up the token
+	user, err := s.Users.Repo.GetUserByID(s.Users.Repo.DB, token.UserID)
+	if err != nil {
+		return err
+	}
+	if err := s.Users.Policy.Check(password, user); err != nil {
+		return err
+	}
+
+	// Only one of concurrent resets wins
+	unused, err := s.Users.Repo.UsePasswordResetToken(token.ID, now)
+	if err != nil {
+		return err
+	}
+	if !unused {
+		return ErrInvalidResetToken
+	}
+
+	hash, err := s.Users.Passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+	if err := s.Users.Repo.UpdatePassword(token.UserID, hash); err != nil {
+		return err
+	}
+
+	// Whoever knew the old password is signed out
+	return s.Tokens.RevokeAllTokens(token.UserID)
+}
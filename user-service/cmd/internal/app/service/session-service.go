@@ -0,0 +1,129 @@
+package service
+
+import (
+	"errors"
+	"time"
+	"user-service/cmd/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// Page sizes of the session list
+const (
+	DefaultSessionPageSize = 20
+	MaxSessionPageSize     = 100
+)
+
+// maxUserAgentLength is the length user agents are cut to before they are stored
+const maxUserAgentLength = 512
+
+var (
+	ErrSessionNotFound = errors.New("Session not found")
+	ErrInvalidPage     = errors.New("Invalid page")
+)
+
+// Device is the client a user logs in with
+type Device struct {
+	UserAgent string
+	IPAddress string
+}
+
+// SessionPage is a page of the sessions of a user
+type SessionPage struct {
+	Sessions []models.Session `json:"sessions"`
+	Page     int              `json:"page"`
+	PerPage  int              `json:"per_page"`
+	Total    int64            `json:"total"`
+}
+
+// startSession stores the session of a new token family
+// It returns an error if the operation fails
+func (s *JWTService) startSession(userID, familyID string, device Device, now, expiresAt time.Time) error {
+	userAgent := device.UserAgent
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	return s.Repo.StoreSession(&models.Session{
+		ID:         familyID,
+		UserID:     userID,
+		UserAgent:  userAgent,
+		IPAddress:  device.IPAddress,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  expiresAt,
+	})
+}
+
+// CurrentSession returns the ID of the session an access token belongs to
+// It returns ErrSessionNotFound if the token is unknown
+func (s *JWTService) CurrentSession(tokenID string) (string, error) {
+	token, err := s.Repo.GetToken(tokenID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrSessionNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return token.FamilyID, nil
+}
+
+// GetSessions retrieves a page of the active sessions of a user, most recently seen first
+// Pages start at 1, a zero perPage gives the default page size
+// The current session is marked
+// It returns the page and ErrInvalidPage if the page is out of range
+func (s *JWTService) GetSessions(userID, currentSessionID string, page, perPage int) (*SessionPage, error) {
+	if perPage == 0 {
+		perPage = DefaultSessionPageSize
+	}
+	if page < 1 || perPage < 1 || perPage > MaxSessionPageSize {
+		return nil, ErrInvalidPage
+	}
+
+	sessions, total, err := s.Repo.GetUserSessions(userID, time.Now(), (page-1)*perPage, perPage)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSessionID
+	}
+
+	return &SessionPage{
+		Sessions: sessions,
+		Page:     page,
+		PerPage:  perPage,
+		Total:    total,
+	}, nil
+}
+
+// GetSession retrieves an active session of a user
+// It returns ErrSessionNotFound if the user has no such session
+func (s *JWTService) GetSession(userID, sessionID, currentSessionID string) (*models.Session, error) {
+	session, err := s.Repo.GetUserSession(userID, sessionID, time.Now())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	session.Current = session.ID == currentSessionID
+	return session, nil
+}
+
+// RevokeSession signs a user out of one of their sessions
+// It returns ErrSessionNotFound if the user has no such session
+func (s *JWTService) RevokeSession(userID, sessionID string) error {
+	found, err := s.Repo.RevokeSession(userID, sessionID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeOtherSessions signs a user out of all their sessions but the current one
+// It returns the number of sessions revoked and an error
+func (s *JWTService) RevokeOtherSessions(userID, currentSessionID string) (int64, error) {
+	return s.Repo.RevokeOtherSessions(userID, currentSessionID)
+}
@@ -1,37 +1,73 @@
 package service
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"log"
+	"strings"
 	"time"
 	"user-service/cmd/internal/app/repositories"
+	"user-service/cmd/internal/auth"
 	"user-service/cmd/internal/models"
 
 	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
 )
 
+// DefaultRefreshTTL is how long refresh tokens can be used
+const DefaultRefreshTTL = 30 * 24 * time.Hour
+
+// refreshTokenPrefix tells refresh tokens apart from access tokens
+const refreshTokenPrefix = "rt_"
+
+// tokenPrefixLength is the length of the prefix stored to recognize an access token
+const tokenPrefixLength = 8
+
 // JWTService is a service that handles JWT token generation, validation, and revocation
 type JWTService struct {
-	Repo      *repositories.JWTRepository
-	SecretKey string
+	Repo       *repositories.JWTRepository
+	Config     *auth.Config
+	RefreshTTL time.Duration
 }
 
 // NewJWTService creates a new instance of JWTService
-func NewJWTService(repo *repositories.JWTRepository, secretKey string) *JWTService {
+// Tokens are signed and verified with the given configuration
+func NewJWTService(repo *repositories.JWTRepository, config *auth.Config) *JWTService {
 	return &JWTService{
-		Repo:      repo,
-		SecretKey: secretKey,
+		Repo:       repo,
+		Config:     config,
+		RefreshTTL: DefaultRefreshTTL,
 	}
 }
 
+// TokenPair is a short-lived access token and the refresh token it is renewed with
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	// ExpiresIn is the lifetime of the access token in seconds
+	ExpiresIn int64
+}
+
+var (
+	ErrTokenRevoked        = errors.New("Token has been revoked")
+	ErrTokenNotFound       = errors.New("Token not found")
+	ErrInvalidRefreshToken = errors.New("Invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("Refresh token has already been used")
+)
+
 // GenerateJWTToken generates a new JWT token
+// The token ID is its jti claim, revocations are tracked by it
 // It returns a token string and an error if the operation fails
-func (s *JWTService) GenerateJWTToken(userID string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+func (s *JWTService) GenerateJWTToken(userID, tokenID string) (string, error) {
+	tokenString, err := s.Config.Sign(jwt.MapClaims{
 		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * 72).Unix(),
+		"jti":     tokenID,
 	})
-	tokenString, err := token.SignedString([]byte(s.SecretKey))
 	if err != nil {
 		return "", err
 	}
@@ -39,22 +75,387 @@ func (s *JWTService) GenerateJWTToken(userID string) (string, error) {
 	return tokenString, nil
 }
 
+// IssueToken generates a JWT token for a user and stores it
+// It starts a session on the device that lasts as long as the token
+// It returns the token string and an error if the operation fails
+func (s *JWTService) IssueToken(userID string, device Device) (string, error) {
+	familyID := uuid.New().String()
+	now := time.Now()
+	if err := s.startSession(userID, familyID, device, now, now.Add(s.Config.TTL)); err != nil {
+		return "", err
+	}
+
+	tokenString, _, err := s.issueToken(userID, familyID)
+	return tokenString, err
+}
+
+// issueToken generates a JWT token of a token family and stores it
+// It returns the token string, the token ID and an error
+func (s *JWTService) issueToken(userID, familyID string) (string, string, error) {
+	tokenID := uuid.New().String()
+	tokenString, err := s.GenerateJWTToken(userID, tokenID)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	personalToken := &models.PersonalToken{
+		ID:        tokenID,
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: HashToken(tokenString),
+		Prefix:    TokenPrefix(tokenString),
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(s.Config.TTL),
+	}
+	if err := s.StoreToken(personalToken); err != nil {
+		return "", "", err
+	}
+
+	return tokenString, tokenID, nil
+}
+
+// IssueTokenPair issues an access token and a refresh token for a user
+// They start a new token family, the session on the device
+// It returns the tokens and an error if the operation fails
+func (s *JWTService) IssueTokenPair(userID string, device Device) (*TokenPair, error) {
+	familyID := uuid.New().String()
+	now := time.Now()
+	if err := s.startSession(userID, familyID, device, now, now.Add(s.RefreshTTL)); err != nil {
+		return nil, err
+	}
+
+	return s.issueTokenPair(userID, familyID)
+}
+
+// issueTokenPair issues an access token and a refresh token of a token family
+func (s *JWTService) issueTokenPair(userID, familyID string) (*TokenPair, error) {
+	accessToken, accessTokenID, err := s.issueToken(userID, familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	err = s.Repo.StoreRefreshToken(&models.RefreshToken{
+		ID:            uuid.New().String(),
+		UserID:        userID,
+		FamilyID:      familyID,
+		TokenHash:     HashToken(refreshToken),
+		AccessTokenID: accessTokenID,
+		ExpiresAt:     now.Add(s.RefreshTTL),
+		CreatedAt:     now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(s.Config.TTL.Seconds()),
+	}, nil
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh token
+// The refresh token can only be used once. Using it again means it leaked,
+// the whole token family is then revoked
+// It returns the new tokens and an error
+func (s *JWTService) Refresh(refreshToken string) (*TokenPair, error) {
+	token, err := s.Repo.GetRefreshTokenByHash(HashToken(refreshToken))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if token.UsedAt != nil || token.Revoked {
+		return nil, s.revokeFamily(token)
+	}
+	now := time.Now()
+	if now.After(token.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	// The refresh token is used, and replaced, all at once or not at all,
+	// so a failure does not leave the session without a usable token
+	var pair *TokenPair
+	err = s.Repo.Transaction(func(repo *repositories.JWTRepository) error {
+		tx := &JWTService{Repo: repo, Config: s.Config, RefreshTTL: s.RefreshTTL}
+
+		// Only one of concurrent refreshes wins, the others are reuses
+		unused, err := repo.UseRefreshToken(token.ID, now)
+		if err != nil {
+			return err
+		}
+		if !unused {
+			return ErrRefreshTokenReused
+		}
+
+		// The access token is replaced by the new one
+		if _, err := repo.RevokeToken(token.UserID, token.AccessTokenID); err != nil {
+			return err
+		}
+		// And the session lasts as long as the new refresh token
+		if err := repo.TouchSession(token.FamilyID, now, now.Add(s.RefreshTTL)); err != nil {
+			return err
+		}
+
+		pair, err = tx.issueTokenPair(token.UserID, token.FamilyID)
+		return err
+	})
+	if errors.Is(err, ErrRefreshTokenReused) {
+		return nil, s.revokeFamily(token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+// revokeFamily revokes the family of a refresh token that was used again
+// It returns ErrRefreshTokenReused, or the error revoking the family
+func (s *JWTService) revokeFamily(token *models.RefreshToken) error {
+	log.Printf("Refresh token %s of user %s was reused, revoking its family %s", token.ID, token.UserID, token.FamilyID)
+	if err := s.Repo.RevokeFamily(token.FamilyID); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+// newRefreshToken generates an opaque refresh token
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return refreshTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the SHA-256 hash of a token, as it is stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenPrefix returns the part of an access token stored to recognize it
+// The header of every token is alike, so it is the start of the signature
+func TokenPrefix(token string) string {
+	signature := token[strings.LastIndex(token, ".")+1:]
+	if len(signature) > tokenPrefixLength {
+		signature = signature[:tokenPrefixLength]
+	}
+	return signature
+}
+
 // ValidateToken validates a JWT token
+// Its exp, iat, iss and aud claims are required, and every token is
+// rejected when the signing key is not configured
+// Tokens that were revoked, or that we did not issue, are rejected too
 // It returns a token and an error if the operation fails
 func (s *JWTService) ValidateToken(tokenString string) (*jwt.Token, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Ensure the token method conform to "SigningMethodHMAC"
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, echo.NewHTTPError(401, "Invalid token")
-		}
-		return []byte("secret"), nil
-	})
+	token, err := s.Config.Parse(tokenString)
 	if err != nil {
 		return nil, err
 	}
+
+	_, tokenID, err := TokenIdentity(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkToken(tokenID); err != nil {
+		return nil, err
+	}
+
 	return token, nil
 }
 
+// checkToken checks the record of an access token and records its use
+// Tokens we have no record of count as revoked
+// It returns ErrTokenRevoked if the token cannot be used
+func (s *JWTService) checkToken(tokenID string) error {
+	token, err := s.Repo.GetToken(tokenID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrTokenRevoked
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if token.Revoked || !now.Before(token.ExpiresAt.Add(auth.Leeway)) {
+		return ErrTokenRevoked
+	}
+
+	// The last use is only recorded once a minute, it is when the session was last seen
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= lastUsedPrecision {
+		if err := s.Repo.TouchToken(tokenID, now); err != nil {
+			return err
+		}
+		if err := s.Repo.TouchSession(token.FamilyID, now, time.Time{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TokenIdentity returns the user ID and the token ID (jti) of a validated token
+// It returns an error if the token does not carry them
+func TokenIdentity(token *jwt.Token) (string, string, error) {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", "", echo.NewHTTPError(401, "Token claims are not accessible")
+	}
+
+	userID, _ := claims["user_id"].(string)
+	tokenID, _ := claims["jti"].(string)
+	if userID == "" || tokenID == "" {
+		return "", "", auth.ErrInvalidClaims
+	}
+
+	return userID, tokenID, nil
+}
+
+// PersonalAccessTokenType is the token type introspection reports for personal access tokens
+// Unlike the access tokens of a login, they can only do what their scope allows
+const PersonalAccessTokenType = "personal_access_token"
+
+// Introspection is the state of a token, as defined by RFC 7662
+// Only Active is set for tokens that are not active
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+	Aud       string `json:"aud,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+	// EmailVerified is whether the user verified their email address, it is not part of RFC 7662
+	EmailVerified bool `json:"email_verified,omitempty"`
+	// VerificationRequired is whether the verification policy restricts the user
+	// until they verify their email address, it is not part of RFC 7662.
+	// Other services follow it rather than a policy of their own
+	VerificationRequired bool `json:"verification_required,omitempty"`
+}
+
+// Introspect returns the state of an access, refresh or personal access token
+// The hint says which kind of token it probably is, as in RFC 7662. It is
+// only advisory: that kind is looked up first, then the others
+// Tokens that are invalid, expired, revoked or unknown are not active
+// It returns an error only if the state could not be looked up
+func (s *JWTService) Introspect(tokenString, hint string) (*Introspection, error) {
+	lookups := map[string]func(string) (*Introspection, error){
+		"access_token":          s.introspectAccessToken,
+		"refresh_token":         s.introspectRefreshToken,
+		PersonalAccessTokenType: s.introspectPersonalAccessToken,
+	}
+
+	// Without a hint, the kind of token is told by its prefix
+	guess := "access_token"
+	if strings.HasPrefix(tokenString, refreshTokenPrefix) {
+		guess = "refresh_token"
+	} else if strings.HasPrefix(tokenString, PersonalAccessTokenPrefix) {
+		guess = PersonalAccessTokenType
+	}
+
+	order := []string{guess, "access_token", "refresh_token", PersonalAccessTokenType}
+	if _, ok := lookups[hint]; ok {
+		order = append([]string{hint}, order...)
+	}
+
+	for _, kind := range order {
+		lookup, ok := lookups[kind]
+		if !ok {
+			continue
+		}
+		// Each kind is looked up once
+		delete(lookups, kind)
+
+		result, err := lookup(tokenString)
+		if err != nil || result.Active {
+			return result, err
+		}
+	}
+	return &Introspection{Active: false}, nil
+}
+
+// introspectAccessToken returns the state of the access token of a login
+func (s *JWTService) introspectAccessToken(tokenString string) (*Introspection, error) {
+	inactive := &Introspection{Active: false}
+	token, err := s.Config.Parse(tokenString)
+	if err != nil {
+		return inactive, nil
+	}
+	userID, tokenID, err := TokenIdentity(token)
+	if err != nil {
+		return inactive, nil
+	}
+	err = s.checkToken(tokenID)
+	if errors.Is(err, ErrTokenRevoked) {
+		return inactive, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	result := &Introspection{
+		Active:    true,
+		ClientID:  s.Config.Audience,
+		Sub:       userID,
+		TokenType: "access_token",
+		Iss:       s.Config.Issuer,
+		Aud:       s.Config.Audience,
+		Jti:       tokenID,
+	}
+	result.Scope, _ = claims["scope"].(string)
+	if exp, ok := claims["exp"].(float64); ok {
+		result.Exp = int64(exp)
+	}
+	if iat, ok := claims["iat"].(float64); ok {
+		result.Iat = int64(iat)
+	}
+	return result, nil
+}
+
+// introspectRefreshToken returns the state of a refresh token
+func (s *JWTService) introspectRefreshToken(refreshToken string) (*Introspection, error) {
+	token, err := s.Repo.GetRefreshTokenByHash(HashToken(refreshToken))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &Introspection{Active: false}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Revoked || token.UsedAt != nil || time.Now().After(token.ExpiresAt) {
+		return &Introspection{Active: false}, nil
+	}
+
+	return &Introspection{
+		Active:    true,
+		ClientID:  s.Config.Audience,
+		Sub:       token.UserID,
+		TokenType: "refresh_token",
+		Exp:       token.ExpiresAt.Unix(),
+		Iat:       token.CreatedAt.Unix(),
+		Iss:       s.Config.Issuer,
+	}, nil
+}
+
+// JWKS returns the public keys tokens are verified with
+func (s *JWTService) JWKS() auth.JWKS {
+	return s.Config.JWKS()
+}
+
 // GetUserTokens retrieves all tokens for a user
 // It returns a list of tokens and an error
 func (s *UserService) GetUserTokens(id string) ([]models.PersonalToken, error) {
@@ -67,39 +468,23 @@ func (s *JWTService) StoreToken(token *models.PersonalToken) error {
 	return s.Repo.StoreToken(token)
 }
 
-// RevokeToken revokes a token by setting the revoked field to true
-// It returns an error if the operation fails
-func (s *JWTService) RevokeToken(tokenString string) error {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return nil, nil // don't need the key for just checking expiration
-	})
-
-	// Error handling, ignoring signature validation since we provide nil key
+// RevokeToken revokes a token of a user
+// It returns ErrTokenNotFound if the user has no such token
+func (s *JWTService) RevokeToken(userID, tokenID string) error {
+	found, err := s.Repo.RevokeToken(userID, tokenID)
 	if err != nil {
-		if ve, ok := err.(*jwt.ValidationError); ok {
-			if ve.Errors&jwt.ValidationErrorExpired != 0 {
-				// Token is expired
-				return errors.New("token is already expired")
-			}
-		}
 		return err
 	}
-
-	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		// Check if the token is already expired
-		if exp, ok := claims["exp"].(float64); ok && time.Unix(int64(exp), 0).Before(time.Now()) {
-			return errors.New("token is already expired")
-		}
+	if !found {
+		return ErrTokenNotFound
 	}
-
-	// Proceed to revoke the token if it's not expired
-	return s.Repo.RevokeToken(tokenString)
+	return nil
 }
 
-// CheckTokenRevocation checks if a token has been revoked
-// It returns a boolean and an error
-func (s *JWTService) CheckTokenRevocation(token string) (bool, error) {
-	return s.Repo.CheckTokenRevocation(token)
+// RevokeAllTokens revokes all the tokens of a user, signing them out everywhere
+// It returns an error if the operation fails
+func (s *JWTService) RevokeAllTokens(userID string) error {
+	return s.Repo.RevokeUserTokens(userID)
 }
 
 // GetUserIDFromToken retrieves the user ID from a JWT token
@@ -110,14 +495,9 @@ func (s *JWTService) GetUserIDFromToken(tokenString string) (string, error) {
 		return "", err
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return "", echo.NewHTTPError(401, "Token claims are not accessible")
-	}
-
-	userID, ok := claims["user_id"].(string)
-	if !ok {
-		return "", echo.NewHTTPError(401, "User ID not found in token claims")
+	userID, _, err := TokenIdentity(token)
+	if err != nil {
+		return "", err
 	}
 
 	return userID, nil
@@ -3,54 +3,177 @@ package service
 
 import (
 	"errors"
+	"log"
+	"strings"
+	"sync"
 	"user-service/cmd/internal/app/repositories"
+	"user-service/cmd/internal/auth"
 	"user-service/cmd/internal/models"
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidCredentials is the error of a wrong email or password, they are not told apart
+	ErrInvalidCredentials = errors.New("Invalid credentials")
+	ErrEmailTaken         = errors.New("Email already exists")
+	ErrWrongPassword      = errors.New("Current password is incorrect")
+	ErrEmptyName          = errors.New("Names cannot be empty")
 )
 
 // UserService is a service that handles user operations
 type UserService struct {
 	Repo *repositories.UserRepository
+	// Passwords hashes the passwords, hashes made before with other
+	// parameters are replaced when the users log in
+	Passwords *auth.Passwords
+	// Policy is what the passwords must be
+	Policy *PasswordPolicy
+
+	// dummyHash is compared with the passwords logged in to unknown emails,
+	// so that they take as long to refuse as wrong passwords
+	dummyHash     string
+	dummyHashOnce sync.Once
 }
 
 // NewUserService creates a new instance of UserService
 // It returns a pointer to the instance
 func NewUserService(repo *repositories.UserRepository) *UserService {
-	return &UserService{Repo: repo}
+	return &UserService{Repo: repo, Passwords: auth.NewPasswords(), Policy: NewPasswordPolicy()}
 }
 
 // RegisterUser registers a new user
-// It returns a user and an error if the operation fails
+// The password is checked before the email, so that callers can refuse it
+// whether the email is taken or not
+// It returns a user, a *PasswordPolicyError if the policy refuses the
+// password, or ErrEmailTaken
 func (s *UserService) RegisterUser(input *models.RegisterInput) (*models.User, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
-	if err != nil {
-		return nil, err
-	}
-
 	user := &models.User{
 		ID:        uuid.New().String(),
 		Email:     input.Email,
-		Password:  string(hashedPassword),
 		Firstname: &input.Firstname,
-		Lastname:  &input.Firstname,
+		Lastname:  &input.LastName,
+	}
+	if err := s.Policy.Check(input.Password, user); err != nil {
+		return nil, err
+	}
+
+	_, err := s.Repo.GetUserByEmail(input.Email)
+	if err == nil {
+		return nil, ErrEmailTaken
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
 	}
 
+	user.Password, err = s.Passwords.Hash(input.Password)
+	if err != nil {
+		return nil, err
+	}
 	return s.Repo.CreateUser(user)
 }
 
 // AuthenticateUser authenticates a user
-// It returns a user and an error if the operation fails
+// Unknown emails take as long as wrong passwords. The hash of the password is
+// replaced if it was made with an older hasher or other parameters
+// It returns a user, and ErrInvalidCredentials if the email or the password is wrong
 func (s *UserService) AuthenticateUser(email, password string) (*models.User, error) {
 	user, err := s.Repo.GetUserByEmail(email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		s.dummyHashOnce.Do(func() {
+			s.dummyHash, _ = s.Passwords.Hash("dummy password")
+		})
+		s.Passwords.Verify(s.dummyHash, password)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
 
+	ok, rehash, err := s.Passwords.Verify(user.Password, password)
 	if err != nil {
 		return nil, err
 	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
 
-	if !user.ComparePassword(password) {
-		return nil, errors.New("invalid credentials")
+	// The login goes on with the old hash if it cannot be replaced
+	if rehash {
+		if err := s.rehashPassword(user, password); err != nil {
+			log.Printf("Error rehashing password: %v", err)
+		}
 	}
 	return user, nil
 }
+
+// VerifyPassword reports whether a password is the one of a user
+// Hashes that cannot be read do not match
+func (s *UserService) VerifyPassword(user *models.User, password string) bool {
+	ok, _, err := s.Passwords.Verify(user.Password, password)
+	if err != nil {
+		log.Printf("Error verifying password: %v", err)
+	}
+	return ok
+}
+
+// UpdateProfile changes the names of a user
+// Names that are nil are left as they are
+// It returns the updated user, or ErrEmptyName
+func (s *UserService) UpdateProfile(userID string, firstname, lastname *string) (*models.User, error) {
+	fields := map[string]interface{}{}
+	for column, name := range map[string]*string{"firstname": firstname, "lastname": lastname} {
+		if name == nil {
+			continue
+		}
+		trimmed := strings.TrimSpace(*name)
+		if trimmed == "" {
+			return nil, ErrEmptyName
+		}
+		fields[column] = trimmed
+	}
+
+	if len(fields) > 0 {
+		if err := s.Repo.UpdateProfile(userID, fields); err != nil {
+			return nil, err
+		}
+	}
+	return s.Repo.GetUserByID(s.Repo.DB, userID)
+}
+
+// ChangePassword replaces the password of a user who knows the current one
+// It returns ErrWrongPassword, or a *PasswordPolicyError if the policy
+// refuses the new password
+func (s *UserService) ChangePassword(user *models.User, current, password string) error {
+	if !s.VerifyPassword(user, current) {
+		return ErrWrongPassword
+	}
+	if err := s.Policy.Check(password, user); err != nil {
+		return err
+	}
+
+	hash, err := s.Passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+	return s.Repo.UpdatePassword(user.ID, hash)
+}
+
+// rehashPassword replaces the hash of the password of a user with one of the current hasher
+// A hash that changed in the meantime, like for a password reset, is kept
+// It returns an error if the operation fails
+func (s *UserService) rehashPassword(user *models.User, password string) error {
+	hash, err := s.Passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+	replaced, err := s.Repo.ReplacePasswordHash(user.ID, user.Password, hash)
+	if err != nil {
+		return err
+	}
+	if replaced {
+		user.Password = hash
+	}
+	return nil
+}
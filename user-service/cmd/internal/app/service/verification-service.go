@@ -0,0 +1,282 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+	"user-service/cmd/internal/mailer"
+	"user-service/cmd/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Defaults for email verification
+const (
+	DefaultVerificationTTL            = 24 * time.Hour
+	DefaultVerificationResendInterval = time.Minute
+)
+
+// verificationTokenPrefix tells email verification tokens apart from the other tokens
+const verificationTokenPrefix = "evt_"
+
+// VerificationPolicy is what users can do before they verify their email address
+type VerificationPolicy string
+
+// The verification policies
+const (
+	// VerificationOff does not restrict unverified users
+	VerificationOff VerificationPolicy = "off"
+	// VerificationRestrict lets unverified users log in, but not create personal
+	// access tokens, and other services restrict them too
+	VerificationRestrict VerificationPolicy = "restrict"
+	// VerificationBlock does not let unverified users log in
+	VerificationBlock VerificationPolicy = "block"
+)
+
+var (
+	ErrInvalidVerificationToken  = errors.New("Invalid or expired verification token")
+	ErrInvalidVerificationPolicy = errors.New("Verification policy must be off, restrict or block")
+	ErrEmailNotVerified          = errors.New("Email address is not verified")
+)
+
+// ParseVerificationPolicy parses a verification policy, empty is restrict
+// It returns ErrInvalidVerificationPolicy for unknown policies
+func ParseVerificationPolicy(value string) (VerificationPolicy, error) {
+	switch policy := VerificationPolicy(value); policy {
+	case "":
+		return VerificationRestrict, nil
+	case VerificationOff, VerificationRestrict, VerificationBlock:
+		return policy, nil
+	default:
+		return "", ErrInvalidVerificationPolicy
+	}
+}
+
+// VerificationService is a service that verifies the email addresses of users
+type VerificationService struct {
+	Users  *UserService
+	Mailer mailer.Mailer
+	// From is the sender of the verification emails
+	From string
+	// VerifyURL is the page of the frontend the verification link opens, it receives the token as a query parameter
+	VerifyURL string
+	// Policy is what unverified users can do
+	Policy VerificationPolicy
+	// TTL is how long a verification link can be used
+	TTL time.Duration
+	// ResendInterval is how long a user waits before another link is sent
+	ResendInterval time.Duration
+}
+
+// NewVerificationService creates a new instance of VerificationService
+// It returns a pointer to the instance
+func NewVerificationService(users *UserService, mail mailer.Mailer, from, verifyURL string) *VerificationService {
+	return &VerificationService{
+		Users:          users,
+		Mailer:         mail,
+		From:           from,
+		VerifyURL:      verifyURL,
+		Policy:         VerificationRestrict,
+		TTL:            DefaultVerificationTTL,
+		ResendInterval: DefaultVerificationResendInterval,
+	}
+}
+
+// SendVerification emails a link to verify the address of a user
+// The links sent before stop working
+// It returns an error if the link could not be sent
+func (s *VerificationService) SendVerification(user *models.User) error {
+	link, err := s.newLink(user.ID, user.Email, "")
+	if err != nil {
+		return err
+	}
+
+	return s.Mailer.Send(&mailer.Message{
+		From:    s.From,
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Text: fmt.Sprintf("Welcome to OptiMate!\n\n"+
+			"To verify your email address, open this link within %d hours:\n\n%s\n\n"+
+			"If you did not create an account, ignore this email.\n",
+			int(s.TTL.Hours()), link),
+	})
+}
+
+// RequestEmailChange emails a link to the new address of a user, the address
+// changes once the link is opened
+// The links sent before stop working, and the current address is told of the change
+// It returns an error if the link could not be sent
+func (s *VerificationService) RequestEmailChange(user *models.User, email string) error {
+	link, err := s.newLink(user.ID, email, user.Email)
+	if err != nil {
+		return err
+	}
+
+	err = s.Mailer.Send(&mailer.Message{
+		From:    s.From,
+		To:      email,
+		Subject: "Confirm your new email address",
+		Text: fmt.Sprintf("To use this address for your OptiMate account, open this link within %d hours:\n\n%s\n\n"+
+			"If you did not ask for this, ignore this email.\n",
+			int(s.TTL.Hours()), link),
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.Mailer.Send(&mailer.Message{
+		From:    s.From,
+		To:      user.Email,
+		Subject: "Your email address is changing",
+		Text: fmt.Sprintf("Someone asked to change the email address of your OptiMate account to %s.\n\n"+
+			"The address changes once the link sent there is opened.\n"+
+			"If it was not you, change your password now.\n", email),
+	})
+}
+
+// newLink stores a verification token of an address of a user, and the
+// address it replaces if it is a new one
+// The tokens stored before stop working
+// It returns the link that verifies the address
+func (s *VerificationService) newLink(userID, email, previous string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := verificationTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	err := s.Users.Repo.StoreEmailVerificationToken(&models.EmailVerificationToken{
+		ID:            uuid.New().String(),
+		UserID:        userID,
+		Email:         email,
+		PreviousEmail: previous,
+		TokenHash:     HashToken(token),
+		ExpiresAt:     now.Add(s.TTL),
+		CreatedAt:     now,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return s.VerifyURL + "?token=" + url.QueryEscape(token), nil
+}
+
+// NotifyExistingAccount emails a user that someone tried to register with their address
+// Registering does not tell whether an address is taken, the owner learns it
+// from this email instead
+// It returns an error if the email could not be sent
+func (s *VerificationService) NotifyExistingAccount(user *models.User) error {
+	return s.Mailer.Send(&mailer.Message{
+		From:    s.From,
+		To:      user.Email,
+		Subject: "You already have an account",
+		Text: "Someone tried to create an OptiMate account with this email address, " +
+			"but you already have one.\n\n" +
+			"If it was you, log in instead, or reset your password if you forgot it.\n" +
+			"If it was not you, ignore this email.\n",
+	})
+}
+
+// ResendVerification emails a new verification link to a user
+// Nothing is sent to unknown or verified addresses, nor more than once per
+// ResendInterval, and callers must not tell the difference, so that the
+// addresses of users cannot be found out
+// It returns an error if the link could not be sent
+func (s *VerificationService) ResendVerification(email string) error {
+	user, err := s.Users.Repo.GetUserByEmail(email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.EmailVerified {
+		return nil
+	}
+
+	last, err := s.Users.Repo.GetLastEmailVerificationToken(user.ID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	if err == nil && time.Since(last.CreatedAt) < s.ResendInterval {
+		return nil
+	}
+
+	return s.SendVerification(user)
+}
+
+// VerifyEmail verifies the address of a user with the token of a verification link
+// The token is used up, and a token of a new address changes the address of the user
+// It returns ErrInvalidVerificationToken if the token cannot be used, or
+// verifies an address the user no longer has, and ErrEmailTaken if another
+// user has the new address
+func (s *VerificationService) VerifyEmail(tokenString string) (*models.User, error) {
+	token, err := s.Users.Repo.GetEmailVerificationTokenByHash(HashToken(tokenString))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if token.UsedAt != nil || !now.Before(token.ExpiresAt) {
+		return nil, ErrInvalidVerificationToken
+	}
+
+	// Only one of concurrent verifications wins
+	unused, err := s.Users.Repo.UseEmailVerificationToken(token.ID, now)
+	if err != nil {
+		return nil, err
+	}
+	if !unused {
+		return nil, ErrInvalidVerificationToken
+	}
+
+	var verified bool
+	if token.PreviousEmail == "" {
+		verified, err = s.Users.Repo.MarkEmailVerified(token.UserID, token.Email, now)
+	} else {
+		verified, err = s.changeEmail(token, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !verified {
+		return nil, ErrInvalidVerificationToken
+	}
+
+	return s.Users.Repo.GetUserByID(s.Users.Repo.DB, token.UserID)
+}
+
+// changeEmail replaces the address of a user with the verified address of a token
+// It returns whether the user still had the previous address and ErrEmailTaken
+// if another user has the new address
+func (s *VerificationService) changeEmail(token *models.EmailVerificationToken, now time.Time) (bool, error) {
+	_, err := s.Users.Repo.GetUserByEmail(token.Email)
+	if err == nil {
+		return false, ErrEmailTaken
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, err
+	}
+	return s.Users.Repo.ChangeEmail(token.UserID, token.PreviousEmail, token.Email, now)
+}
+
+// CanLogIn reports whether the policy lets a user log in
+func (s *VerificationService) CanLogIn(user *models.User) bool {
+	return user.EmailVerified || s.Policy != VerificationBlock
+}
+
+// CheckVerified checks the policy lets a user do what unverified users are restricted from
+// It returns ErrEmailNotVerified if it does not
+func (s *VerificationService) CheckVerified(user *models.User) error {
+	if user.EmailVerified || s.Policy == VerificationOff {
+		return nil
+	}
+	return ErrEmailNotVerified
+}
@@ -0,0 +1,81 @@
+// Package audit records the security events of the user service
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// The types of the events
+const (
+	// LoginFailed is a login with a wrong password or code
+	LoginFailed = "login.failed"
+	// AccountLocked is an account that cannot log in for a while after too many failed logins
+	AccountLocked = "login.account_locked"
+	// IPLocked is an address that cannot log in for a while after too many failed logins
+	IPLocked = "login.ip_locked"
+)
+
+// Event is something that happened to the security of an account
+type Event struct {
+	Type      string     `json:"type"`
+	UserID    string     `json:"user_id,omitempty"`
+	Email     string     `json:"email,omitempty"`
+	IPAddress string     `json:"ip_address,omitempty"`
+	UserAgent string     `json:"user_agent,omitempty"`
+	Failures  int        `json:"failures,omitempty"`
+	Until     *time.Time `json:"until,omitempty"`
+	Time      time.Time  `json:"time"`
+}
+
+// Recorder records events
+// Recording never fails the action the event is about
+type Recorder interface {
+	Record(event Event)
+}
+
+// LogRecorder writes the events to the log, one JSON object per line
+type LogRecorder struct{}
+
+// Record logs an event
+func (LogRecorder) Record(event Event) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error recording audit event %s: %v", event.Type, err)
+		return
+	}
+	log.Printf("audit: %s", line)
+}
+
+// MemoryRecorder keeps the events, for tests
+type MemoryRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// NewMemoryRecorder creates a new memory recorder
+func NewMemoryRecorder() *MemoryRecorder {
+	return &MemoryRecorder{}
+}
+
+// Record keeps an event
+func (r *MemoryRecorder) Record(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+// Events returns the events of a type recorded so far
+func (r *MemoryRecorder) Events(eventType string) []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []Event
+	for _, event := range r.events {
+		if event.Type == eventType {
+			events = append(events, event)
+		}
+	}
+	return events
+}
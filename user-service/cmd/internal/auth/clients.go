@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// hashedSecretPrefix marks a client secret given as its hex SHA-256
+const hashedSecretPrefix = "sha256:"
+
+// ErrInvalidClients is returned for a malformed list of service clients
+var ErrInvalidClients = errors.New("Invalid service clients")
+
+// ServiceClients are the services allowed to request service tokens
+// A client can have several secrets, so a new secret can be added before
+// the service is switched to it and the old one removed after
+type ServiceClients struct {
+	secrets map[string][][sha256.Size]byte
+}
+
+// ParseServiceClients parses a comma separated list of client_id:secret
+// A client is listed once per secret, and a secret can be given as
+// sha256:<hex> to keep the plain secret out of the configuration
+// It returns the clients and an error if an entry is malformed
+func ParseServiceClients(list string) (*ServiceClients, error) {
+	clients := &ServiceClients{secrets: map[string][][sha256.Size]byte{}}
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, secret, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("%w: entries must be client_id:secret", ErrInvalidClients)
+		}
+
+		var hash [sha256.Size]byte
+		if hexHash, ok := strings.CutPrefix(secret, hashedSecretPrefix); ok {
+			decoded, err := hex.DecodeString(hexHash)
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("%w: the secret hash of %s is not a hex SHA-256", ErrInvalidClients, id)
+			}
+			copy(hash[:], decoded)
+		} else {
+			hash = sha256.Sum256([]byte(secret))
+		}
+		clients.secrets[id] = append(clients.secrets[id], hash)
+	}
+	return clients, nil
+}
+
+// Len returns the number of clients
+func (s *ServiceClients) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.secrets)
+}
+
+// Known reports whether a client is allowed
+func (s *ServiceClients) Known(id string) bool {
+	return s != nil && len(s.secrets[id]) > 0
+}
+
+// Authenticate checks the secret of a client
+// Every secret of the client is compared, in constant time
+// It returns true if the secret is one of them
+func (s *ServiceClients) Authenticate(id, secret string) bool {
+	if s == nil || secret == "" {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(secret))
+	match := 0
+	for _, known := range s.secrets[id] {
+		match |= subtle.ConstantTimeCompare(hash[:], known[:])
+	}
+	return match == 1
+}
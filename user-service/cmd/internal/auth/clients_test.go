@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseServiceClients(t *testing.T) {
+	// The hash of "hashed-secret"
+	clients, err := ParseServiceClients(" optimizer-service:secret , optimizer-service:sha256:4e598f5daafc2fda61641ddbb5956deb23fde6616366dc9dd5a7c9f47da4d787,other:other-secret")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, clients.Len())
+
+	assert.True(t, clients.Authenticate("optimizer-service", "secret"))
+	assert.True(t, clients.Authenticate("optimizer-service", "hashed-secret"))
+	assert.True(t, clients.Authenticate("other", "other-secret"))
+	assert.False(t, clients.Authenticate("optimizer-service", "other-secret"))
+	assert.False(t, clients.Authenticate("optimizer-service", ""))
+	assert.False(t, clients.Authenticate("unknown", "secret"))
+	assert.True(t, clients.Known("other"))
+	assert.False(t, clients.Known("unknown"))
+}
+
+func TestParseServiceClientsRejectsMalformedEntries(t *testing.T) {
+	for _, list := range []string{"optimizer-service", "optimizer-service:", ":secret", "optimizer-service:sha256:not-hex", "optimizer-service:sha256:abcd"} {
+		_, err := ParseServiceClients(list)
+		assert.ErrorIs(t, err, ErrInvalidClients, list)
+	}
+
+	// Without clients every secret is rejected
+	clients, err := ParseServiceClients("")
+	assert.NoError(t, err)
+	assert.False(t, clients.Authenticate("", ""))
+	var missing *ServiceClients
+	assert.False(t, missing.Authenticate("optimizer-service", "secret"))
+}
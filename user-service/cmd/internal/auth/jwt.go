@@ -0,0 +1,148 @@
+// Package auth
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Leeway is the clock skew tolerated between the services
+const Leeway = time.Minute
+
+var (
+	ErrNotConfigured = errors.New("JWT signing key is not configured")
+	ErrInvalidClaims = errors.New("Invalid token claims")
+	ErrUnknownKey    = errors.New("Token is signed with an unknown key")
+)
+
+// Config is the configuration used to sign and verify access tokens
+// Tokens are signed with the signing key. During a rotation, the previous
+// keys stay in VerificationKeys until the tokens they signed have expired
+type Config struct {
+	SigningKey       *Key
+	VerificationKeys []*Key
+	Issuer           string
+	Audience         string
+	TTL              time.Duration
+}
+
+// Check checks the configuration is complete
+// It returns an error if tokens cannot be safely signed or verified with it
+func (c *Config) Check() error {
+	if c == nil || !c.SigningKey.CanSign() {
+		return ErrNotConfigured
+	}
+	if c.Issuer == "" || c.Audience == "" {
+		return errors.New("JWT issuer and audience are required")
+	}
+	return nil
+}
+
+// ForAudience returns a configuration signing tokens for another audience
+// It shares the keys and issuer, tokens of one audience are rejected by the other
+func (c *Config) ForAudience(audience string, ttl time.Duration) *Config {
+	if c == nil {
+		return nil
+	}
+	config := *c
+	config.Audience = audience
+	config.TTL = ttl
+	return &config
+}
+
+// Keys returns the keys tokens are verified with, the signing key first
+func (c *Config) Keys() []*Key {
+	keys := []*Key{c.SigningKey}
+	for _, key := range c.VerificationKeys {
+		if key != nil && key.ID != c.SigningKey.ID {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// JWKS returns the public keys tokens are verified with
+func (c *Config) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	if c.Check() != nil {
+		return set
+	}
+	for _, key := range c.Keys() {
+		set.Keys = append(set.Keys, key.JWK())
+	}
+	return set
+}
+
+// Sign signs an access token with the given claims
+// It sets the iss, aud, iat and exp claims, and the kid of the signing key
+// It returns the token string and an error
+func (c *Config) Sign(claims jwt.MapClaims) (string, error) {
+	if err := c.Check(); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims["iss"] = c.Issuer
+	claims["aud"] = c.Audience
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(c.TTL).Unix()
+
+	token := jwt.NewWithClaims(c.SigningKey.Method, claims)
+	token.Header["kid"] = c.SigningKey.ID
+	return token.SignedString(c.SigningKey.Private)
+}
+
+// Parse verifies the signature and the claims of an access token
+// The token must name one of the keys in its kid, and the exp, iat, iss
+// and aud claims are all required
+// It returns the token and an error if it is not valid
+func (c *Config) Parse(tokenString string) (*jwt.Token, error) {
+	if err := c.Check(); err != nil {
+		return nil, err
+	}
+
+	// The claims are checked below, with the leeway
+	parser := &jwt.Parser{
+		ValidMethods:         []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()},
+		SkipClaimsValidation: true,
+	}
+	token, err := parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		key := c.key(token)
+		if key == nil {
+			return nil, ErrUnknownKey
+		}
+		return key.Public, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !c.validClaims(claims, time.Now()) {
+		return nil, ErrInvalidClaims
+	}
+	return token, nil
+}
+
+// key returns the key a token names in its kid
+// The key must be used with the algorithm of the token
+func (c *Config) key(token *jwt.Token) *Key {
+	kid, _ := token.Header["kid"].(string)
+	for _, key := range c.Keys() {
+		if key.ID == kid && key.Method.Alg() == token.Method.Alg() {
+			return key
+		}
+	}
+	return nil
+}
+
+// validClaims checks the registered claims of a token at a time
+func (c *Config) validClaims(claims jwt.MapClaims, now time.Time) bool {
+	return claims.VerifyExpiresAt(now.Add(-Leeway).Unix(), true) &&
+		claims.VerifyNotBefore(now.Add(Leeway).Unix(), false) &&
+		claims.VerifyIssuedAt(now.Add(Leeway).Unix(), true) &&
+		claims.VerifyIssuer(c.Issuer, true) &&
+		claims.VerifyAudience(c.Audience, true)
+}
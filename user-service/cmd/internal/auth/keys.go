@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// MinRSAKeyBits is the minimum size of RSA signing keys
+const MinRSAKeyBits = 2048
+
+var (
+	ErrUnsupportedKey = errors.New("JWT keys must be RSA or Ed25519 keys")
+	ErrWeakKey        = errors.New("JWT RSA keys must be at least 2048 bits")
+	ErrInvalidKeyPEM  = errors.New("JWT key is not a PEM encoded key")
+)
+
+// Key is a key access tokens are signed or verified with
+// Keys of a previous rotation only have a public part
+type Key struct {
+	// ID is the kid of the tokens signed with the key
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.PrivateKey
+	Public  crypto.PublicKey
+}
+
+// JWK is a public key in the JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS is the set of keys published to the other services
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewKey creates a key from a private key
+// Its ID is the RFC 7638 thumbprint of the public key
+// It returns an error if the key is not a supported signing key
+func NewKey(private crypto.PrivateKey) (*Key, error) {
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		key, err := NewPublicKey(&k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		key.Private = k
+		return key, nil
+	case ed25519.PrivateKey:
+		key, err := NewPublicKey(k.Public())
+		if err != nil {
+			return nil, err
+		}
+		key.Private = k
+		return key, nil
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// NewPublicKey creates a key that only verifies tokens
+// It returns an error if the key is not a supported key
+func NewPublicKey(public crypto.PublicKey) (*Key, error) {
+	key := &Key{Public: public}
+	switch k := public.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < MinRSAKeyBits {
+			return nil, ErrWeakKey
+		}
+		key.Method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, ErrUnsupportedKey
+	}
+
+	key.ID = key.thumbprint()
+	return key, nil
+}
+
+// ParseKeyPEM parses a PEM encoded private or public key
+// Private keys can be PKCS #8 or PKCS #1 and public keys PKIX or PKCS #1
+// It returns the key and an error
+func ParseKeyPEM(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrInvalidKeyPEM
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewKey(private)
+	case "RSA PRIVATE KEY":
+		private, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewKey(private)
+	case "PUBLIC KEY":
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewPublicKey(public)
+	case "RSA PUBLIC KEY":
+		public, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewPublicKey(public)
+	default:
+		return nil, ErrInvalidKeyPEM
+	}
+}
+
+// CanSign reports whether tokens can be signed with the key
+func (k *Key) CanSign() bool {
+	return k != nil && k.Private != nil
+}
+
+// JWK returns the public part of the key as a JWK
+func (k *Key) JWK() JWK {
+	jwk := JWK{Kid: k.ID, Use: "sig", Alg: k.Method.Alg()}
+	switch public := k.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encode(public.N.Bytes())
+		jwk.E = encode(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encode(public)
+	}
+	return jwk
+}
+
+// thumbprint returns the RFC 7638 thumbprint of the public key
+// The members are the required ones, in lexicographic order
+func (k *Key) thumbprint() string {
+	var members interface{}
+	switch public := k.Public.(type) {
+	case *rsa.PublicKey:
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{encode(big.NewInt(int64(public.E)).Bytes()), "RSA", encode(public.N.Bytes())}
+	case ed25519.PublicKey:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{"Ed25519", "OKP", encode(public)}
+	}
+
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return encode(sum[:])
+}
+
+// encode encodes bytes as unpadded base64url
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThumbprint(t *testing.T) {
+	// The example of RFC 8037, appendix A.3
+	x, _ := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+
+	key, err := NewPublicKey(ed25519.PublicKey(x))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", key.ID)
+		assert.Equal(t, "EdDSA", key.Method.Alg())
+		assert.False(t, key.CanSign())
+	}
+}
+
+func TestParseKeyPEM(t *testing.T) {
+	_, edPrivate, _ := ed25519.GenerateKey(nil)
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(edPrivate)
+	pkix, _ := x509.MarshalPKIXPublicKey(edPrivate.Public())
+
+	tests := []struct {
+		name    string
+		block   *pem.Block
+		alg     string
+		canSign bool
+	}{
+		{"ed25519 private key", &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}, "EdDSA", true},
+		{"ed25519 public key", &pem.Block{Type: "PUBLIC KEY", Bytes: pkix}, "EdDSA", false},
+		{"rsa private key", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaPrivate)}, "RS256", true},
+		{"rsa public key", &pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&rsaPrivate.PublicKey)}, "RS256", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParseKeyPEM(pem.EncodeToMemory(tt.block))
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.alg, key.Method.Alg())
+				assert.Equal(t, tt.canSign, key.CanSign())
+			}
+		})
+	}
+
+	// The private and public parts of a key have the same ID
+	private, _ := ParseKeyPEM(pem.EncodeToMemory(tests[0].block))
+	public, _ := ParseKeyPEM(pem.EncodeToMemory(tests[1].block))
+	assert.Equal(t, private.ID, public.ID)
+}
+
+func TestParseKeyPEMRejectsUnsafeKeys(t *testing.T) {
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	_, err = ParseKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(weak)}))
+	assert.ErrorIs(t, err, ErrWeakKey)
+
+	_, err = ParseKeyPEM([]byte("a shared secret"))
+	assert.ErrorIs(t, err, ErrInvalidKeyPEM)
+
+	_, err = ParseKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}}))
+	assert.ErrorIs(t, err, ErrInvalidKeyPEM)
+}
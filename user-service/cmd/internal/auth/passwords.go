@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Argon2id parameters of new password hashes, as the OWASP cheat sheet recommends
+const (
+	DefaultArgon2Memory  = 19 * 1024
+	DefaultArgon2Time    = 2
+	DefaultArgon2Threads = 1
+	argon2SaltSize       = 16
+	argon2KeySize        = 32
+)
+
+var (
+	ErrUnknownPasswordHash = errors.New("Unknown password hash format")
+	ErrInvalidPasswordHash = errors.New("Invalid password hash")
+)
+
+// PasswordHasher hashes passwords in one format
+type PasswordHasher interface {
+	// Hash hashes a password with a random salt
+	Hash(password string) (string, error)
+	// Identifies reports whether a hash is in the format of the hasher
+	Identifies(hash string) bool
+	// Verify reports whether a password matches a hash of the format
+	Verify(hash, password string) (bool, error)
+	// NeedsRehash reports whether a hash of the format was made with other parameters
+	NeedsRehash(hash string) bool
+}
+
+// Passwords hashes new passwords with one hasher, and verifies the hashes of
+// the older ones, so that their parameters can change without resetting
+// the passwords of the users
+type Passwords struct {
+	// Hasher hashes new passwords
+	Hasher PasswordHasher
+	// Legacy verifies the hashes made before
+	Legacy []PasswordHasher
+}
+
+// NewPasswords hashes passwords with Argon2id and the default parameters, and
+// verifies the bcrypt hashes made before
+// It returns a pointer to the passwords
+func NewPasswords() *Passwords {
+	return &Passwords{
+		Hasher: NewArgon2id(DefaultArgon2Memory, DefaultArgon2Time, DefaultArgon2Threads),
+		Legacy: []PasswordHasher{NewBcrypt(bcrypt.DefaultCost)},
+	}
+}
+
+// Hash hashes a password with the hasher of new passwords
+// It returns the hash and an error
+func (p *Passwords) Hash(password string) (string, error) {
+	return p.Hasher.Hash(password)
+}
+
+// Verify checks a password against a hash of any of the hashers
+// A hash that is not of the hasher of new passwords, or that was made with
+// other parameters, should be replaced once the password matches
+// It returns whether the password matches, whether the hash should be
+// replaced, and ErrUnknownPasswordHash if no hasher knows the format
+func (p *Passwords) Verify(hash, password string) (bool, bool, error) {
+	for _, hasher := range append([]PasswordHasher{p.Hasher}, p.Legacy...) {
+		if !hasher.Identifies(hash) {
+			continue
+		}
+		ok, err := hasher.Verify(hash, password)
+		if err != nil || !ok {
+			return false, false, err
+		}
+		return true, !p.Hasher.Identifies(hash) || p.Hasher.NeedsRehash(hash), nil
+	}
+	return false, false, ErrUnknownPasswordHash
+}
+
+// Argon2id hashes passwords with Argon2id
+// The hashes are in the PHC string format, with their parameters:
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>
+type Argon2id struct {
+	// Memory is in KiB
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// argon2Params are the parameters read from a hash
+type argon2Params struct {
+	Argon2id
+	salt []byte
+	key  []byte
+}
+
+// NewArgon2id creates an Argon2id hasher
+// It returns a pointer to the hasher
+func NewArgon2id(memory, time uint32, threads uint8) *Argon2id {
+	return &Argon2id{Memory: memory, Time: time, Threads: threads}
+}
+
+// Hash hashes a password
+// It returns the hash and an error if there is no randomness
+func (a *Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, argon2KeySize)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Identifies reports whether a hash is an Argon2id hash
+func (a *Argon2id) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+// Verify reports whether a password matches a hash, with the parameters of the hash
+// It returns ErrInvalidPasswordHash if the hash cannot be read
+func (a *Argon2id) Verify(hash, password string) (bool, error) {
+	params, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey([]byte(password), params.salt, params.Time, params.Memory, params.Threads, uint32(len(params.key)))
+	return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+}
+
+// NeedsRehash reports whether a hash was made with other parameters, or cannot be read
+func (a *Argon2id) NeedsRehash(hash string) bool {
+	params, err := parseArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return params.Argon2id != *a || len(params.key) != argon2KeySize
+}
+
+// parseArgon2id reads the parameters of an Argon2id hash
+// It returns the parameters and ErrInvalidPasswordHash
+func parseArgon2id(hash string) (*argon2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, ErrInvalidPasswordHash
+	}
+	params := &argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, ErrInvalidPasswordHash
+	}
+	if params.Time == 0 || params.Threads == 0 {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	var err error
+	if params.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrInvalidPasswordHash
+	}
+	if params.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(params.key) == 0 {
+		return nil, ErrInvalidPasswordHash
+	}
+	return params, nil
+}
+
+// Bcrypt hashes passwords with bcrypt
+type Bcrypt struct {
+	Cost int
+}
+
+// NewBcrypt creates a bcrypt hasher
+// It returns a pointer to the hasher
+func NewBcrypt(cost int) *Bcrypt {
+	return &Bcrypt{Cost: cost}
+}
+
+// Hash hashes a password
+// It returns the hash and an error if the password is longer than 72 bytes
+func (b *Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Identifies reports whether a hash is a bcrypt hash
+func (b *Bcrypt) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// Verify reports whether a password matches a hash
+// It returns ErrInvalidPasswordHash if the hash cannot be read
+func (b *Bcrypt) Verify(hash, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, ErrInvalidPasswordHash
+	}
+	return true, nil
+}
+
+// NeedsRehash reports whether a hash was made with a lower cost, or cannot be read
+func (b *Bcrypt) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < b.Cost
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestArgon2id(t *testing.T) {
+	hasher := NewArgon2id(1024, 1, 1)
+
+	hash, err := hasher.Hash("password")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"), hash)
+	assert.True(t, hasher.Identifies(hash))
+	assert.False(t, hasher.NeedsRehash(hash))
+
+	// Every hash has its own salt
+	other, err := hasher.Hash("password")
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, other)
+
+	ok, err := hasher.Verify(hash, "password")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = hasher.Verify(hash, "wrong password")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Hashes are verified with their own parameters, and rehashed with others
+	stronger := NewArgon2id(2048, 2, 1)
+	ok, err = stronger.Verify(hash, "password")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, stronger.NeedsRehash(hash))
+
+	for _, invalid := range []string{
+		"$argon2id$v=19$m=1024,t=1,p=1$salt",
+		"$argon2id$v=18$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$not base64!",
+	} {
+		_, err := hasher.Verify(invalid, "password")
+		assert.ErrorIs(t, err, ErrInvalidPasswordHash, invalid)
+		assert.True(t, hasher.NeedsRehash(invalid), invalid)
+	}
+}
+
+func TestPasswordsRehash(t *testing.T) {
+	passwords := &Passwords{
+		Hasher: NewArgon2id(1024, 1, 1),
+		Legacy: []PasswordHasher{NewBcrypt(bcrypt.MinCost)},
+	}
+
+	// bcrypt hashes are verified, and replaced once the password matches
+	legacy, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	ok, rehash, err := passwords.Verify(string(legacy), "password")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, rehash)
+	ok, rehash, err = passwords.Verify(string(legacy), "wrong password")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.False(t, rehash)
+
+	hash, err := passwords.Hash("password")
+	assert.NoError(t, err)
+	ok, rehash, err = passwords.Verify(hash, "password")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, rehash)
+
+	// Raising the costs replaces the hashes made before
+	passwords.Hasher = NewArgon2id(2048, 1, 1)
+	ok, rehash, err = passwords.Verify(hash, "password")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, rehash)
+
+	_, _, err = passwords.Verify("plain text", "plain text")
+	assert.ErrorIs(t, err, ErrUnknownPasswordHash)
+}
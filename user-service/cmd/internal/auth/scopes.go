@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// The scopes personal access tokens can be given
+// Tokens of a login session are not scoped
+const (
+	ScopeFilesRead    = "files:read"
+	ScopeFilesWrite   = "files:write"
+	ScopePresetsAdmin = "presets:admin"
+)
+
+// ErrInvalidScope is returned for scopes that do not exist
+var ErrInvalidScope = errors.New("Invalid scope")
+
+// scopes are the known scopes
+var scopes = map[string]bool{
+	ScopeFilesRead:    true,
+	ScopeFilesWrite:   true,
+	ScopePresetsAdmin: true,
+}
+
+// NormalizeScopes checks a list of scopes and returns it sorted, without duplicates
+// It returns ErrInvalidScope if the list is empty or has an unknown scope
+func NormalizeScopes(list []string) ([]string, error) {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, scope := range list {
+		scope = strings.TrimSpace(scope)
+		if !scopes[scope] {
+			return nil, ErrInvalidScope
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			normalized = append(normalized, scope)
+		}
+	}
+	if len(normalized) == 0 {
+		return nil, ErrInvalidScope
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
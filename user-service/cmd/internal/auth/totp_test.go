@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA-1 test vectors of RFC 6238, cut to 6 digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	tests := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range tests {
+		code, err := TOTPCode(secret, TOTPStep(time.Unix(unix, 0)))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, code, unix)
+	}
+
+	_, err := TOTPCode("not base32!", 1)
+	assert.Error(t, err)
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	assert.NoError(t, err)
+	assert.Len(t, secret, 32)
+
+	now := time.Now()
+	step := TOTPStep(now)
+	code, _ := TOTPCode(secret, step)
+
+	matched, ok := VerifyTOTP(secret, code, now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, step, matched)
+
+	// Codes of the next and previous periods are accepted for clock drift
+	previous, _ := TOTPCode(secret, step-1)
+	_, ok = VerifyTOTP(secret, previous, now, 0)
+	assert.True(t, ok)
+	old, _ := TOTPCode(secret, step-2)
+	_, ok = VerifyTOTP(secret, old, now, 0)
+	assert.False(t, ok)
+
+	// A code cannot be used twice
+	_, ok = VerifyTOTP(secret, code, now, step)
+	assert.False(t, ok)
+
+	_, ok = VerifyTOTP(secret, "12345", now, 0)
+	assert.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("OptiMate", "admin@admin.com", "JBSWY3DPEHPK3PXP")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/OptiMate:admin@admin.com?"), uri)
+	assert.Contains(t, uri, "secret=JBSWY3DPEHPK3PXP")
+	assert.Contains(t, uri, "issuer=OptiMate")
+	assert.Contains(t, uri, "digits=6")
+	assert.Contains(t, uri, "period=30")
+}
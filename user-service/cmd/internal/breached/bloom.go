@@ -0,0 +1,148 @@
+package breached
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// filterMagic starts the files of saved filters
+const filterMagic = "BREACHED-BLOOM-1\n"
+
+// maxFilterBits caps the size of a loaded filter, 4 GiB of bits
+const maxFilterBits = 1 << 35
+
+// ErrInvalidFilter is the error of a saved filter that cannot be read
+var ErrInvalidFilter = errors.New("Invalid breached password filter")
+
+// ErrInvalidFalsePositiveRate is the error of a false positive rate not between 0 and 1
+var ErrInvalidFalsePositiveRate = errors.New("False positive rate must be between 0 and 1")
+
+// Filter is a Bloom filter of SHA-1 digests
+// It can tell that a digest was never added, and that one probably was, with
+// a rate of false positives chosen when it is created
+type Filter struct {
+	bits   []uint64
+	size   uint64
+	hashes uint32
+}
+
+// NewFilter creates a filter for a number of digests with a false positive rate
+// The filter is no larger than a loaded one may be, so a list too long for
+// the rate gets more false positives instead. A rate not between 0 and 1 is
+// replaced with DefaultFalsePositiveRate
+// It returns a pointer to the filter
+func NewFilter(count int, falsePositiveRate float64) *Filter {
+	size, hashes := filterShape(count, falsePositiveRate)
+	return &Filter{
+		bits:   make([]uint64, (size+63)/64),
+		size:   size,
+		hashes: hashes,
+	}
+}
+
+// filterShape returns the size and number of hashes of a filter for a number
+// of digests with a false positive rate, the size capped at maxFilterBits
+func filterShape(count int, falsePositiveRate float64) (uint64, uint32) {
+	if count < 1 {
+		count = 1
+	}
+	if !validRate(falsePositiveRate) {
+		falsePositiveRate = DefaultFalsePositiveRate
+	}
+	// The optimal size and number of hashes of a Bloom filter
+	bits := math.Ceil(-float64(count) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	size := uint64(math.Min(bits, maxFilterBits))
+	if size < 64 {
+		size = 64
+	}
+	hashes := uint32(math.Min(64, math.Max(1, math.Round(float64(size)/float64(count)*math.Ln2))))
+	return size, hashes
+}
+
+// validRate reports whether a false positive rate is between 0 and 1
+func validRate(falsePositiveRate float64) bool {
+	return falsePositiveRate > 0 && falsePositiveRate < 1
+}
+
+// locations returns the bits of a digest
+// The digest is already uniform, so two halves of it are combined into the
+// hashes rather than hashing it again
+func (f *Filter) locations(digest []byte) func(i uint32) uint64 {
+	h1 := binary.BigEndian.Uint64(digest[0:8])
+	h2 := binary.BigEndian.Uint64(digest[8:16]) | 1
+	return func(i uint32) uint64 {
+		return (h1 + uint64(i)*h2) % f.size
+	}
+}
+
+// Add adds a SHA-1 digest to the filter
+func (f *Filter) Add(digest []byte) {
+	location := f.locations(digest)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := location(i)
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Test reports whether a SHA-1 digest was probably added to the filter
+func (f *Filter) Test(digest []byte) bool {
+	location := f.locations(digest)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := location(i)
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTo saves the filter, so that it does not have to be built from the list again
+// It returns the number of bytes written and an error
+func (f *Filter) WriteTo(w io.Writer) (int64, error) {
+	header := make([]byte, len(filterMagic)+12)
+	copy(header, filterMagic)
+	binary.BigEndian.PutUint64(header[len(filterMagic):], f.size)
+	binary.BigEndian.PutUint32(header[len(filterMagic)+8:], f.hashes)
+	n, err := w.Write(header)
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+
+	buf := make([]byte, 8)
+	for _, word := range f.bits {
+		binary.BigEndian.PutUint64(buf, word)
+		n, err := w.Write(buf)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ReadFilter reads a filter saved with WriteTo
+// It returns the filter, and ErrInvalidFilter if it cannot be read
+func ReadFilter(r io.Reader) (*Filter, error) {
+	header := make([]byte, len(filterMagic)+12)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(filterMagic)]) != filterMagic {
+		return nil, ErrInvalidFilter
+	}
+	size := binary.BigEndian.Uint64(header[len(filterMagic):])
+	hashes := binary.BigEndian.Uint32(header[len(filterMagic)+8:])
+	if size == 0 || size > maxFilterBits || hashes == 0 || hashes > 64 {
+		return nil, ErrInvalidFilter
+	}
+
+	f := &Filter{bits: make([]uint64, (size+63)/64), size: size, hashes: hashes}
+	buf := make([]byte, 8)
+	for i := range f.bits {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, ErrInvalidFilter
+		}
+		f.bits[i] = binary.BigEndian.Uint64(buf)
+	}
+	return f, nil
+}
@@ -0,0 +1,124 @@
+// Package breached checks passwords against a list of breached passwords kept
+// on the server, so that they are never sent to another service
+package breached
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+)
+
+// DefaultFalsePositiveRate is the rate of passwords wrongly reported as breached
+const DefaultFalsePositiveRate = 0.001
+
+// List is a list of breached passwords, held as a Bloom filter of their SHA-1 digests
+// A few passwords that were never breached are reported as breached too
+type List struct {
+	filter *Filter
+}
+
+// NewList creates a list from a filter
+// It returns a pointer to the list
+func NewList(filter *Filter) *List {
+	return &List{filter: filter}
+}
+
+// Contains reports whether a password was probably breached
+func (l *List) Contains(password string) bool {
+	digest := sha1.Sum([]byte(password))
+	return l.filter.Test(digest[:])
+}
+
+// Filter returns the filter of the list, to save it
+func (l *List) Filter() *Filter {
+	return l.filter
+}
+
+// Load loads a list of breached passwords from a file
+// The file is either a filter saved with Filter.WriteTo, or has one breached
+// password per line: the hex SHA-1 digest of the password, optionally
+// followed by a colon and a count like in the Pwned Passwords downloads, or
+// the password itself
+// It returns the list and an error if the file cannot be read
+func Load(path string) (*List, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	magic, err := reader.Peek(len(filterMagic))
+	if err == nil && string(magic) == filterMagic {
+		filter, err := ReadFilter(reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewList(filter), nil
+	}
+
+	// The lines are counted first to size the filter
+	count, err := countLines(reader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return Read(file, count, DefaultFalsePositiveRate)
+}
+
+// Read reads a list of breached passwords, one per line as Load reads them
+// The filter is sized for count passwords, up to the size of a saved filter
+// It returns the list, ErrInvalidFalsePositiveRate if the rate is not between
+// 0 and 1, and an error if the lines cannot be read
+func Read(r io.Reader, count int, falsePositiveRate float64) (*List, error) {
+	if !validRate(falsePositiveRate) {
+		return nil, ErrInvalidFalsePositiveRate
+	}
+	filter := NewFilter(count, falsePositiveRate)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		filter.Add(digestOf(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewList(filter), nil
+}
+
+// digestOf returns the SHA-1 digest of a line of a list
+func digestOf(line string) []byte {
+	hash := line
+	if i := strings.IndexByte(line, ':'); i == sha1.Size*2 {
+		hash = line[:i]
+	}
+	if len(hash) == sha1.Size*2 {
+		if digest, err := hex.DecodeString(hash); err == nil {
+			return digest
+		}
+	}
+	digest := sha1.Sum([]byte(line))
+	return digest[:]
+}
+
+// countLines counts the lines that are not empty
+// It returns the count and an error
+func countLines(r io.Reader) (int, error) {
+	count := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
@@ -0,0 +1,107 @@
+package breached
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pwnedLine returns a line of the Pwned Passwords downloads for a password
+func pwnedLine(password string, count int) string {
+	digest := sha1.Sum([]byte(password))
+	return fmt.Sprintf("%s:%d", strings.ToUpper(hex.EncodeToString(digest[:])), count)
+}
+
+func TestFilter(t *testing.T) {
+	filter := NewFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		digest := sha1.Sum([]byte(fmt.Sprintf("added %d", i)))
+		filter.Add(digest[:])
+	}
+
+	// No false negatives, and about as many false positives as asked for
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		digest := sha1.Sum([]byte(fmt.Sprintf("added %d", i)))
+		assert.True(t, filter.Test(digest[:]))
+		digest = sha1.Sum([]byte(fmt.Sprintf("not added %d", i)))
+		if filter.Test(digest[:]) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 30)
+
+	// A saved filter reads back the same
+	buf := new(bytes.Buffer)
+	_, err := filter.WriteTo(buf)
+	assert.NoError(t, err)
+	read, err := ReadFilter(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, filter, read)
+
+	_, err = ReadFilter(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+	_, err = ReadFilter(strings.NewReader("password\n"))
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+
+	// A list too long for the rate is capped like a saved filter
+	size, hashes := filterShape(1<<40, DefaultFalsePositiveRate)
+	assert.Equal(t, uint64(maxFilterBits), size)
+	assert.Equal(t, uint32(1), hashes)
+
+	// Rates that are not between 0 and 1 fall back to the default
+	defaultSize, defaultHashes := filterShape(1000, DefaultFalsePositiveRate)
+	for _, rate := range []float64{0, -1, 1, 2, math.NaN()} {
+		size, hashes := filterShape(1000, rate)
+		assert.Equal(t, defaultSize, size, rate)
+		assert.Equal(t, defaultHashes, hashes, rate)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "breached.txt")
+	lines := []string{
+		pwnedLine("P@ssw0rd", 52000),
+		strings.ToLower(pwnedLine("letmein", 12)[:40]),
+		"",
+		"correct horse battery staple",
+	}
+	assert.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600))
+
+	list, err := Load(path)
+	assert.NoError(t, err)
+	assert.True(t, list.Contains("P@ssw0rd"))
+	assert.True(t, list.Contains("letmein"))
+	assert.True(t, list.Contains("correct horse battery staple"))
+	assert.False(t, list.Contains("a password nobody has"))
+
+	// The list can be loaded from a saved filter instead
+	saved := filepath.Join(dir, "breached.bloom")
+	file, err := os.Create(saved)
+	assert.NoError(t, err)
+	_, err = list.Filter().WriteTo(file)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	list, err = Load(saved)
+	assert.NoError(t, err)
+	assert.True(t, list.Contains("P@ssw0rd"))
+	assert.False(t, list.Contains("a password nobody has"))
+
+	_, err = Load(filepath.Join(dir, "missing.txt"))
+	assert.Error(t, err)
+
+	_, err = Read(strings.NewReader("password\n"), 1, 0)
+	assert.ErrorIs(t, err, ErrInvalidFalsePositiveRate)
+	_, err = Read(strings.NewReader("password\n"), 1, 1)
+	assert.ErrorIs(t, err, ErrInvalidFalsePositiveRate)
+}
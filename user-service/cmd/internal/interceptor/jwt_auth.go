@@ -11,6 +11,7 @@ import (
 
 // JWTAuthentication is a middleware that checks if the request has a valid JWT token
 // and if the token is not revoked
+// Personal access tokens are accepted too, with the scopes they were given
 func JWTAuthentication(jwtService *service.JWTService) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
@@ -25,33 +26,49 @@ func JWTAuthentication(jwtService *service.JWTService) echo.MiddlewareFunc {
 				return echo.NewHTTPError(http.StatusUnauthorized, "Bearer token not found")
 			}
 
-			// Validate the token
+			// Personal access tokens only grant their scopes
+			if strings.HasPrefix(tokenString, service.PersonalAccessTokenPrefix) {
+				token, err := jwtService.AuthenticatePersonalAccessToken(tokenString)
+				if err != nil {
+					return echo.NewHTTPError(http.StatusUnauthorized, "Invalid token")
+				}
+
+				c.Set("userID", token.UserID)
+				c.Set("tokenID", token.ID)
+				c.Set("scopes", strings.Fields(token.Scope))
+				return next(c)
+			}
+
+			// Validate the token, revoked tokens are rejected too
 			token, err := jwtService.ValidateToken(tokenString)
 			if err != nil || !token.Valid {
-				return echo.NewHTTPError(http.StatusInternalServerError, "Failed to validate token")
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid token")
 			}
 
-			// Check the claims for userID
-			userID, err := jwtService.GetUserIDFromToken(tokenString)
+			// Check the claims for the user and token IDs
+			userID, tokenID, err := service.TokenIdentity(token)
 			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "Token claims are not accessible")
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid token")
 			}
 
-			// Check if token has been revoved
-			// _, err = jwtService.CheckTokenRevocation(tokenString)
-			// if err != nil {
-			// 	log.Printf("Failed to check token revocation %v\n", err)
-			// }
-
-			// // Attempt revoke token
-			// err = jwtService.RevokeToken(tokenString)
-			// if err != nil {
-			// 	return echo.NewHTTPError(http.StatusInternalServerError, "Failed to revoke token")
-			// }
-
 			c.Set("userID", userID)
+			c.Set("tokenID", tokenID)
+			c.Set("session", true)
 
 			return next(c)
 		}
 	}
 }
+
+// RequireSession is a middleware that only lets through the tokens of a login session
+// It runs after JWTAuthentication, personal access tokens are refused
+func RequireSession() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if session, _ := c.Get("session").(bool); !session {
+				return echo.NewHTTPError(http.StatusForbidden, "This route requires a login session")
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// Package interceptor
+package interceptor
+
+import (
+	"net/http"
+	"strings"
+	"user-service/cmd/internal/app/service"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ServiceAuthentication is a middleware that checks if the request comes from
+// one of our services by validating the service token it was issued at /oauth/token
+// User tokens are rejected, they are issued for another audience
+func ServiceAuthentication(clientService *service.ClientService) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			authorizationHeader := c.Request().Header.Get("Authorization")
+			tokenString := strings.TrimPrefix(authorizationHeader, "Bearer ")
+			if authorizationHeader == "" || tokenString == authorizationHeader {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Service token is required")
+			}
+
+			clientID, err := clientService.ValidateToken(tokenString)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid service token")
+			}
+
+			c.Set("clientID", clientID)
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Package mailer sends the emails of the user service
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"sync"
+	"time"
+)
+
+// Mailer delivers email messages
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// Message is a plain text email
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+}
+
+// Bytes renders the message as a MIME message
+// It returns the message and an error
+func (m *Message) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: %s\r\n", m.From)
+	fmt.Fprintf(buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(buf)
+	if _, err := qp.Write([]byte(m.Text)); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MemoryMailer keeps the messages instead of delivering them, for tests
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// NewMemoryMailer creates a new memory mailer
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+// Send keeps a message
+func (m *MemoryMailer) Send(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, *msg)
+	return nil
+}
+
+// Messages returns the messages sent so far
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// Last returns the last message sent to an address
+// It returns false if none was
+func (m *MemoryMailer) Last(to string) (Message, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].To == to {
+			return m.messages[i], true
+		}
+	}
+	return Message{}, false
+}
+
+// LogMailer only logs that a message was sent, for when no server is configured
+// The body is not logged, it holds secrets like reset links
+type LogMailer struct{}
+
+// Send logs a message
+func (LogMailer) Send(msg *Message) error {
+	log.Printf("Email %q to %s not delivered, no mail server is configured", msg.Subject, msg.To)
+	return nil
+}
@@ -0,0 +1,48 @@
+package mailer
+
+import (
+	"errors"
+	"log"
+)
+
+// ErrQueueFull is returned when more messages wait to be delivered than the queue holds
+var ErrQueueFull = errors.New("mail queue is full")
+
+// QueueMailer delivers messages with another mailer in the background
+// Send returns at once, so a request takes as long whether it sends an email
+// or not, and cannot be used to find out which addresses have an account.
+// Delivery errors are only logged
+type QueueMailer struct {
+	Mailer Mailer
+
+	queue chan Message
+}
+
+// NewQueueMailer creates a queue of size messages delivered by workers
+func NewQueueMailer(m Mailer, size, workers int) *QueueMailer {
+	q := &QueueMailer{Mailer: m, queue: make(chan Message, size)}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Send queues a message
+// It returns ErrQueueFull if it cannot be queued
+func (q *QueueMailer) Send(msg *Message) error {
+	select {
+	case q.queue <- *msg:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// work delivers the queued messages
+func (q *QueueMailer) work() {
+	for msg := range q.queue {
+		if err := q.Mailer.Send(&msg); err != nil {
+			log.Printf("Error delivering email %q to %s: %v", msg.Subject, msg.To, err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package mailer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingMailer delivers messages once released
+type blockingMailer struct {
+	release   chan struct{}
+	delivered chan Message
+}
+
+func (m *blockingMailer) Send(msg *Message) error {
+	<-m.release
+	m.delivered <- *msg
+	return nil
+}
+
+func TestQueueMailer(t *testing.T) {
+	m := &blockingMailer{release: make(chan struct{}), delivered: make(chan Message, 3)}
+	q := NewQueueMailer(m, 1, 1)
+
+	// Sending does not wait for the delivery
+	done := make(chan error)
+	go func() { done <- q.Send(&Message{To: "jane@example.com"}) }()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Send waited for the delivery")
+	}
+
+	// The worker holds the first message, the queue the second
+	assert.Eventually(t, func() bool { return len(q.queue) == 0 }, time.Second, time.Millisecond)
+	assert.NoError(t, q.Send(&Message{To: "john@example.com"}))
+	assert.ErrorIs(t, q.Send(&Message{To: "joe@example.com"}), ErrQueueFull)
+
+	close(m.release)
+	assert.Equal(t, "jane@example.com", (<-m.delivered).To)
+	assert.Equal(t, "john@example.com", (<-m.delivered).To)
+}
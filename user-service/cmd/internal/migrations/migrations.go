@@ -0,0 +1,21 @@
+// Package migrations migrates the database of the user service
+package migrations
+
+import (
+	"user-service/cmd/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// Run migrates the data that the schema migration cannot, then the schema
+// Every step checks whether it is needed, so it can run on every start
+// It returns an error if a step fails
+func Run(db *gorm.DB) error {
+	if err := HashPersonalTokens(db); err != nil {
+		return err
+	}
+	if err := VerifyExistingUsers(db); err != nil {
+		return err
+	}
+	return db.AutoMigrate(&models.User{}, &models.PersonalToken{}, &models.RefreshToken{}, &models.PersonalAccessToken{}, &models.Session{}, &models.PasswordResetToken{}, &models.EmailVerificationToken{}, &models.TOTPCredential{}, &models.RecoveryCode{}, &models.MFAChallenge{}, &models.LoginThrottle{})
+}
@@ -0,0 +1,103 @@
+package migrations
+
+import (
+	"testing"
+	"time"
+	"user-service/cmd/internal/app/service"
+	"user-service/cmd/internal/models"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// legacyToken is a personal token as the user service stored it before the tokens were hashed
+type legacyToken struct {
+	ID        string `gorm:"type=UUID;primary_key"`
+	UserID    string `gorm:"not null"`
+	FamilyID  string `gorm:"index"`
+	Token     string `gorm:"unique;not null"`
+	CreatedAt string `gorm:"not null"`
+	UpdatedAt string `gorm:"not null"`
+	Revoked   bool   `gorm:"default:false"`
+}
+
+func (legacyToken) TableName() string { return "personal_tokens" }
+
+func TestHashPersonalTokens(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&legacyToken{}))
+
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user", "exp": exp.Unix()}).
+		SignedString([]byte("secret"))
+	require.NoError(t, err)
+	created := time.Date(2024, 5, 1, 12, 30, 0, 123, time.UTC)
+
+	require.NoError(t, db.Create(&legacyToken{
+		ID: "valid", UserID: "user", FamilyID: "family", Token: token,
+		CreatedAt: created.String() + " m=+0.001", UpdatedAt: created.String(),
+	}).Error)
+	require.NoError(t, db.Create(&legacyToken{
+		ID: "broken", UserID: "user", FamilyID: "family", Token: "not-a-token",
+		CreatedAt: "yesterday", UpdatedAt: "yesterday",
+	}).Error)
+
+	require.NoError(t, Run(db))
+	assert.False(t, db.Migrator().HasColumn(&models.PersonalToken{}, "token"))
+
+	var migrated models.PersonalToken
+	require.NoError(t, db.First(&migrated, "id = ?", "valid").Error)
+	assert.Equal(t, service.HashToken(token), migrated.TokenHash)
+	assert.Equal(t, service.TokenPrefix(token), migrated.Prefix)
+	assert.True(t, migrated.ExpiresAt.Equal(exp))
+	assert.True(t, migrated.CreatedAt.Equal(created))
+	assert.False(t, migrated.Revoked)
+	assert.Nil(t, migrated.LastUsedAt)
+
+	var broken models.PersonalToken
+	require.NoError(t, db.First(&broken, "id = ?", "broken").Error)
+	assert.True(t, broken.Revoked)
+	assert.Equal(t, service.HashToken("not-a-token"), broken.TokenHash)
+
+	// A second run finds nothing left to migrate
+	require.NoError(t, Run(db))
+	var count int64
+	db.Model(&models.PersonalToken{}).Count(&count)
+	assert.Equal(t, int64(2), count)
+}
+
+// legacyUser is a user as the user service stored it before email addresses were verified
+type legacyUser struct {
+	ID       string `gorm:"type=UUID;primary_key"`
+	Email    string `gorm:"unique;not null"`
+	Password string `gorm:"type:varchar(255);not null"`
+}
+
+func (legacyUser) TableName() string { return "users" }
+
+func TestVerifyExistingUsers(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&legacyUser{}))
+	require.NoError(t, db.Create(&legacyUser{ID: "existing", Email: "existing@admin.com", Password: "hash"}).Error)
+
+	require.NoError(t, Run(db))
+
+	var existing models.User
+	require.NoError(t, db.First(&existing, "id = ?", "existing").Error)
+	assert.True(t, existing.EmailVerified)
+	assert.NotNil(t, existing.EmailVerifiedAt)
+
+	// Users registered afterwards verify their address
+	require.NoError(t, db.Create(&models.User{ID: "new", Email: "new@admin.com", Password: "hash"}).Error)
+	require.NoError(t, Run(db))
+	var registered models.User
+	require.NoError(t, db.First(&registered, "id = ?", "new").Error)
+	assert.False(t, registered.EmailVerified)
+	require.NoError(t, db.First(&existing, "id = ?", "existing").Error)
+	assert.True(t, existing.EmailVerified)
+}
@@ -0,0 +1,144 @@
+package migrations
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"user-service/cmd/internal/app/service"
+
+	"github.com/golang-jwt/jwt"
+	"gorm.io/gorm"
+)
+
+// legacyTimeLayout is the format of time.Time.String the timestamps were stored in
+const legacyTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// tokenConstraint is the unique constraint on the raw tokens
+const tokenConstraint = "uni_personal_tokens_token"
+
+// legacyPersonalToken is a personal token as it was stored before its value was hashed
+type legacyPersonalToken struct {
+	ID        string
+	Token     string
+	CreatedAt string
+	UpdatedAt string
+}
+
+// personalTokenColumns are the columns added to the personal tokens
+// They are nullable until every row has them
+type personalTokenColumns struct {
+	TokenHash     *string
+	Prefix        *string
+	ExpiresAt     *time.Time
+	LastUsedAt    *time.Time
+	CreatedAtTime *time.Time
+	UpdatedAtTime *time.Time
+}
+
+func (legacyPersonalToken) TableName() string  { return "personal_tokens" }
+func (personalTokenColumns) TableName() string { return "personal_tokens" }
+
+// HashPersonalTokens replaces the raw tokens stored in personal_tokens by their
+// SHA-256 hash and a display prefix, and converts the text timestamps to times
+// The expiry of a token is read from its exp claim. Tokens whose expiry
+// cannot be read are revoked
+// It does nothing once the token column is gone
+// It returns an error if the migration fails, nothing is changed then
+func HashPersonalTokens(db *gorm.DB) error {
+	if !db.Migrator().HasTable("personal_tokens") || !db.Migrator().HasColumn(&legacyPersonalToken{}, "token") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		migrator := tx.Migrator()
+		for _, column := range []string{"TokenHash", "Prefix", "ExpiresAt", "LastUsedAt", "CreatedAtTime", "UpdatedAtTime"} {
+			if migrator.HasColumn(&personalTokenColumns{}, column) {
+				continue
+			}
+			if err := migrator.AddColumn(&personalTokenColumns{}, column); err != nil {
+				return fmt.Errorf("adding %s to personal_tokens: %w", column, err)
+			}
+		}
+
+		var tokens []legacyPersonalToken
+		if err := tx.Find(&tokens).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, token := range tokens {
+			expiresAt, ok := tokenExpiry(token.Token)
+			if !ok {
+				expiresAt = now
+			}
+			createdAt := parseLegacyTime(token.CreatedAt, now)
+			updatedAt := parseLegacyTime(token.UpdatedAt, createdAt)
+
+			updates := map[string]interface{}{
+				"token_hash":      service.HashToken(token.Token),
+				"prefix":          service.TokenPrefix(token.Token),
+				"expires_at":      expiresAt,
+				"created_at_time": createdAt,
+				"updated_at_time": updatedAt,
+			}
+			if !ok {
+				updates["revoked"] = true
+			}
+			if err := tx.Model(&legacyPersonalToken{}).Where("id = ?", token.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		// The raw tokens go with their column, sqlite needs their unique constraint dropped first
+		if migrator.HasConstraint(&legacyPersonalToken{}, tokenConstraint) {
+			if err := migrator.DropConstraint(&legacyPersonalToken{}, tokenConstraint); err != nil {
+				return err
+			}
+		}
+		for _, column := range []string{"token", "created_at", "updated_at"} {
+			if err := migrator.DropColumn(&legacyPersonalToken{}, column); err != nil {
+				return fmt.Errorf("dropping %s from personal_tokens: %w", column, err)
+			}
+		}
+		if err := migrator.RenameColumn(&personalTokenColumns{}, "created_at_time", "created_at"); err != nil {
+			return err
+		}
+		if err := migrator.RenameColumn(&personalTokenColumns{}, "updated_at_time", "updated_at"); err != nil {
+			return err
+		}
+
+		log.Printf("Hashed %d personal tokens", len(tokens))
+		return nil
+	})
+}
+
+// tokenExpiry reads the exp claim of a token without verifying it
+// The tokens were issued by us, the claim only bounds how long they are kept
+// It returns the expiry and whether the token has one
+func tokenExpiry(tokenString string) (time.Time, bool) {
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		return time.Time{}, false
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(exp), 0), true
+}
+
+// parseLegacyTime parses a timestamp stored with time.Time.String
+// It returns the fallback if the timestamp cannot be parsed
+func parseLegacyTime(value string, fallback time.Time) time.Time {
+	// Drop the monotonic clock reading, as in "m=+0.001"
+	if i := strings.Index(value, " m="); i >= 0 {
+		value = value[:i]
+	}
+	t, err := time.Parse(legacyTimeLayout, value)
+	if err != nil {
+		return fallback
+	}
+	return t
+}
@@ -0,0 +1,46 @@
+package migrations
+
+import (
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// userVerification is the email verification state added to the users
+type userVerification struct {
+	EmailVerified   bool `gorm:"not null;default:false"`
+	EmailVerifiedAt *time.Time
+}
+
+func (userVerification) TableName() string { return "users" }
+
+// VerifyExistingUsers adds the email verification state to the users and
+// marks the users registered before it as verified, they are not asked to
+// verify an address they have been using
+// It does nothing once the users have the state
+// It returns an error if the migration fails, nothing is changed then
+func VerifyExistingUsers(db *gorm.DB) error {
+	if !db.Migrator().HasTable("users") || db.Migrator().HasColumn(&userVerification{}, "EmailVerified") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, column := range []string{"EmailVerified", "EmailVerifiedAt"} {
+			if err := tx.Migrator().AddColumn(&userVerification{}, column); err != nil {
+				return err
+			}
+		}
+
+		result := tx.Table("users").Where("1 = 1").Updates(map[string]interface{}{
+			"email_verified":    true,
+			"email_verified_at": time.Now(),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		log.Printf("Marked %d existing users as verified", result.RowsAffected)
+		return nil
+	})
+}
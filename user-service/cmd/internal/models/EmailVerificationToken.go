@@ -0,0 +1,21 @@
+// Package models
+package models
+
+import "time"
+
+// EmailVerificationToken is a model for the tokens sent to verify an email address
+// Only the SHA-256 hash of the token is stored. The token verifies the address
+// it was sent to, so it is useless once the user changes their email
+// A token of a new address changes the address of the user, as long as they
+// still have the previous one
+type EmailVerificationToken struct {
+	ID        string     `json:"id" gorm:"type=UUID;primary_key"`
+	UserID    string     `json:"user_id" gorm:"not null;index"`
+	Email     string     `json:"email" gorm:"not null"`
+	TokenHash string     `json:"-" gorm:"unique;not null"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	// PreviousEmail is the address a new address replaces, empty if the token verifies the current one
+	PreviousEmail string `json:"previous_email" gorm:"not null;default:''"`
+}
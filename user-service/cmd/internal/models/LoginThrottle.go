@@ -0,0 +1,16 @@
+// Package models
+package models
+
+import "time"
+
+// LoginThrottle is a model for the failed logins of an account or an address
+// The key is the kind of what is throttled and its value, like "account:<email>"
+// Failures are counted until a login succeeds, or the window they are
+// counted in, from WindowStart, is over
+type LoginThrottle struct {
+	Key         string     `json:"key" gorm:"primaryKey"`
+	Failures    int        `json:"failures" gorm:"not null;default:0"`
+	LockedUntil *time.Time `json:"locked_until"`
+	WindowStart *time.Time `json:"window_start"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
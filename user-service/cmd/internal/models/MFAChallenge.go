@@ -0,0 +1,17 @@
+// Package models
+package models
+
+import "time"
+
+// MFAChallenge is a model for the logins waiting for the second factor of a user
+// Only the SHA-256 hash of its token is stored. It is used once, and given
+// up on after too many wrong codes
+type MFAChallenge struct {
+	ID        string     `json:"id" gorm:"type=UUID;primary_key"`
+	UserID    string     `json:"user_id" gorm:"not null;index"`
+	TokenHash string     `json:"-" gorm:"unique;not null"`
+	Attempts  int        `json:"attempts"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
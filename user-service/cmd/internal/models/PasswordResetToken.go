@@ -0,0 +1,16 @@
+// Package models
+package models
+
+import "time"
+
+// PasswordResetToken is a model for the tokens sent to reset a forgotten password
+// Only the SHA-256 hash of the token is stored. A token can be used once,
+// and requesting a new one invalidates the previous ones
+type PasswordResetToken struct {
+	ID        string     `json:"id" gorm:"type=UUID;primary_key"`
+	UserID    string     `json:"user_id" gorm:"not null;index"`
+	TokenHash string     `json:"-" gorm:"unique;not null"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
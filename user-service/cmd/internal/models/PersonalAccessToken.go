@@ -0,0 +1,21 @@
+// Package models
+package models
+
+import "time"
+
+// PersonalAccessToken is a long-lived token users create for scripts and CI
+// It can only do what its scopes allow. The token is shown once when it is
+// created, only its SHA-256 hash and a prefix to recognize it are stored
+type PersonalAccessToken struct {
+	ID        string `json:"id" gorm:"type=UUID;primary_key"`
+	UserID    string `json:"user_id" gorm:"not null;index"`
+	Name      string `json:"name" gorm:"not null"`
+	TokenHash string `json:"-" gorm:"unique;not null"`
+	Prefix    string `json:"prefix" gorm:"not null"`
+	// Scope is the space separated list of scopes of the token
+	Scope      string     `json:"scope" gorm:"not null"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Revoked    bool       `json:"revoked"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
@@ -1,12 +1,20 @@
 // Package models
 package models
 
-// PersonalToken is a model for the personal token
+import "time"
+
+// PersonalToken is a model for the access tokens issued on login and refresh
+// Only the SHA-256 hash of the token is stored, so the table cannot be used
+// to sign in. The prefix is kept to recognize a token in a list
 type PersonalToken struct {
-	ID        string `json:"id" gorm:"type=UUID;primary_key"`
-	UserID    string `json:"user_id" gorm:"not null"`
-	Token     string `json:"token" gorm:"unique;not null"`
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
-	Revoked   bool   `json:"revoked"`
+	ID         string     `json:"id" gorm:"type=UUID;primary_key"`
+	UserID     string     `json:"user_id" gorm:"not null"`
+	FamilyID   string     `json:"family_id" gorm:"index"`
+	TokenHash  string     `json:"-" gorm:"unique;not null"`
+	Prefix     string     `json:"prefix"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Revoked    bool       `json:"revoked"`
 }
@@ -0,0 +1,14 @@
+// Package models
+package models
+
+import "time"
+
+// RecoveryCode is a model for the one-time codes a user signs in with when their authenticator app is lost
+// Only the SHA-256 hash of the code is stored
+type RecoveryCode struct {
+	ID        string     `json:"id" gorm:"type=UUID;primary_key"`
+	UserID    string     `json:"user_id" gorm:"not null;index"`
+	CodeHash  string     `json:"-" gorm:"unique;not null"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
@@ -0,0 +1,20 @@
+// Package models
+package models
+
+import "time"
+
+// RefreshToken is a model for the refresh tokens access tokens are renewed with
+// Only the SHA-256 hash of the token is stored. Every refresh rotates the
+// token, the tokens of one login share a family that is revoked together
+type RefreshToken struct {
+	ID        string `json:"id" gorm:"type=UUID;primary_key"`
+	UserID    string `json:"user_id" gorm:"not null;index"`
+	FamilyID  string `json:"family_id" gorm:"not null;index"`
+	TokenHash string `json:"-" gorm:"unique;not null"`
+	// AccessTokenID is the personal token issued with the refresh token
+	AccessTokenID string     `json:"access_token_id"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	UsedAt        *time.Time `json:"used_at"`
+	Revoked       bool       `json:"revoked"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
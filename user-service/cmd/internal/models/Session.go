@@ -0,0 +1,20 @@
+// Package models
+package models
+
+import "time"
+
+// Session is a login of a user on a device
+// Its ID is the token family of the login, refreshing the tokens keeps the
+// session alive until it is revoked or its refresh token expires
+type Session struct {
+	ID         string    `json:"id" gorm:"type=UUID;primary_key"`
+	UserID     string    `json:"user_id" gorm:"not null;index"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Revoked    bool      `json:"-"`
+	// Current is whether the session is the one of the request
+	Current bool `json:"current" gorm:"-"`
+}
@@ -0,0 +1,16 @@
+// Package models
+package models
+
+import "time"
+
+// TOTPCredential is a model for the authenticator app of a user
+// It is pending until the user confirms it with a code. LastUsedStep is the
+// time step of the last code used, so a code cannot be used twice
+type TOTPCredential struct {
+	UserID       string     `json:"user_id" gorm:"type=UUID;primary_key"`
+	Secret       string     `json:"-" gorm:"not null"`
+	Enabled      bool       `json:"enabled"`
+	LastUsedStep int64      `json:"-"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ConfirmedAt  *time.Time `json:"confirmed_at"`
+}
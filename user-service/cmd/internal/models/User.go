@@ -2,7 +2,7 @@
 package models
 
 import (
-	"golang.org/x/crypto/bcrypt"
+	"time"
 )
 
 // Models struct to hold the models
@@ -16,8 +16,11 @@ type User struct {
 	Email     string          `json:"email" gorm:"unique;not null" valid:"required~Email is required,email~Email must be a valid email address"`
 	Firstname *string         `json:"firstname" gorm:"type:varchar(255)" valid:""`
 	Lastname  *string         `json:"lastname" gorm:"type:varchar(255)" valid:""`
-	Password  string          `json:"password" gorm:"type:varchar(255);not null" valid:"required~Password is required,minstringlength(8)~Password must be at least 8 characters long"`
+	Password  string          `json:"password" gorm:"type:varchar(255);not null" valid:"required~Password is required"`
 	Tokens    []PersonalToken `json:"tokens" gorm:"foreignKey:UserID"`
+	// EmailVerified is whether the user proved the email address is theirs
+	EmailVerified   bool       `json:"email_verified" gorm:"not null;default:false"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
 }
 
 // RegisterInput struct to hold the input for the register endpoint
@@ -25,18 +28,10 @@ type RegisterInput struct {
 	Firstname string `json:"firstname" valid:"required~Firstname is required" `
 	LastName  string `json:"lastname" valid:"required~Lastname is required"`
 	Email     string `json:"email" valid:"email~Email is not a valid enail,required~Email is required"`
-	Password  string `json:"password" valid:"required~Password is required,minstringlength(8)~Password must be at least 8 characters long"`
+	Password  string `json:"password" valid:"required~Password is required"`
 }
 
 // TableName function to return the table name
 func (u *User) TableName() string {
 	return "users"
 }
-
-// ComparePassword function to compare the password
-// It returns true if the password is correct, false otherwise
-func (u *User) ComparePassword(password string) bool {
-	// u.Password should be the hashed password retrieved from the database
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
-	return err == nil
-}
@@ -3,6 +3,7 @@ package types
 
 import (
 	"user-service/cmd/internal/app/service"
+	"user-service/cmd/internal/models"
 	"user-service/cmd/internal/utils"
 
 	"gorm.io/gorm"
@@ -10,12 +11,98 @@ import (
 
 // AppContainer is a container for the application
 type AppContainer struct {
-	Utils       *utils.Utils
-	DB          *gorm.DB
-	UserService *service.UserService
-	JWTService  *service.JWTService
+	Utils               *utils.Utils
+	DB                  *gorm.DB
+	UserService         *service.UserService
+	JWTService          *service.JWTService
+	ClientService       *service.ClientService
+	PasswordService     *service.PasswordService
+	VerificationService *service.VerificationService
+	MFAService          *service.MFAService
+	LockoutService      *service.LockoutService
 }
 
 type TokenString struct {
 	Token string `json:"token"`
 }
+
+// RefreshTokenInput is the body of a token refresh
+type RefreshTokenInput struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// PersonalAccessTokenInput is the body to create a personal access token
+type PersonalAccessTokenInput struct {
+	Name   string   `json:"name" valid:"required~Name is required,stringlength(1|100)~Name must be at most 100 characters long"`
+	Scopes []string `json:"scopes"`
+	// ExpiresInDays is the lifetime of the token, it defaults to 90 days
+	ExpiresInDays int `json:"expires_in_days"`
+}
+
+// CreatedPersonalAccessToken is a new personal access token with its value
+// The value is only ever returned here
+type CreatedPersonalAccessToken struct {
+	models.PersonalAccessToken
+	Token string `json:"token"`
+}
+
+// ForgotPasswordInput is the body to request a password reset link
+type ForgotPasswordInput struct {
+	Email string `json:"email" valid:"required~Email is required,email~Email must be a valid email address"`
+}
+
+// ResetPasswordInput is the body to reset a password with the token of a reset link
+type ResetPasswordInput struct {
+	Token    string `json:"token" valid:"required~Token is required"`
+	Password string `json:"password" valid:"required~Password is required"`
+}
+
+// VerifyEmailInput is the body to verify an email address with the token of a verification link
+type VerifyEmailInput struct {
+	Token string `json:"token" valid:"required~Token is required"`
+}
+
+// ResendVerificationInput is the body to request a new verification link
+type ResendVerificationInput struct {
+	Email string `json:"email" valid:"required~Email is required,email~Email must be a valid email address"`
+}
+
+// MFALoginInput is the body to complete a login with a second factor
+// The code is one shown by the authenticator app, or a recovery code
+type MFALoginInput struct {
+	MFAToken string `json:"mfa_token" valid:"required~MFA token is required"`
+	Code     string `json:"code" valid:"required~Code is required"`
+}
+
+// MFACodeInput is the body to confirm an authenticator app with a code it shows
+type MFACodeInput struct {
+	Code string `json:"code" valid:"required~Code is required"`
+}
+
+// MFAReauthInput is the body of the changes to two-factor authentication that
+// require the user to authenticate again
+// The code is one shown by the authenticator app, or a recovery code
+type MFAReauthInput struct {
+	Password string `json:"password" valid:"required~Password is required"`
+	Code     string `json:"code" valid:"required~Code is required"`
+}
+
+// UpdateProfileInput is the body to change the names of a user
+// Names that are left out are not changed
+type UpdateProfileInput struct {
+	Firstname *string `json:"firstname" valid:"stringlength(1|255)~Firstname must be at most 255 characters long"`
+	Lastname  *string `json:"lastname" valid:"stringlength(1|255)~Lastname must be at most 255 characters long"`
+}
+
+// ChangePasswordInput is the body to change the password of a user who knows the current one
+type ChangePasswordInput struct {
+	CurrentPassword string `json:"current_password" valid:"required~Current password is required"`
+	NewPassword     string `json:"new_password" valid:"required~New password is required"`
+}
+
+// ChangeEmailInput is the body to change the email address of a user
+// The password is required so that a stolen session cannot take over the account
+type ChangeEmailInput struct {
+	Email    string `json:"email" valid:"required~Email is required,email~Email must be a valid email address"`
+	Password string `json:"password" valid:"required~Password is required"`
+}